@@ -1,26 +1,162 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/Fepozopo/httpfromtcp/internal/accesslog"
+	"github.com/Fepozopo/httpfromtcp/internal/auth"
+	"github.com/Fepozopo/httpfromtcp/internal/cookie"
+	"github.com/Fepozopo/httpfromtcp/internal/cors"
 	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/ipfilter"
+	"github.com/Fepozopo/httpfromtcp/internal/proxy"
+	"github.com/Fepozopo/httpfromtcp/internal/ratelimit"
 	"github.com/Fepozopo/httpfromtcp/internal/request"
 	"github.com/Fepozopo/httpfromtcp/internal/response"
 	"github.com/Fepozopo/httpfromtcp/internal/server"
+	"github.com/Fepozopo/httpfromtcp/internal/sse"
+	"github.com/Fepozopo/httpfromtcp/internal/timeout"
+	"github.com/Fepozopo/httpfromtcp/internal/tracecontext"
+	"github.com/Fepozopo/httpfromtcp/internal/tracing"
+	"github.com/Fepozopo/httpfromtcp/internal/websocket"
 )
 
 const port = 42069
 
 func main() {
-	server, err := server.Serve(port, handler)
+	proxyMode := flag.Bool("proxy", false, "also act as a forward proxy for absolute-form and CONNECT requests")
+	proxyPorts := flag.String("proxy-ports", "443", "comma-separated ports CONNECT may tunnel to")
+	proxyForwardPorts := flag.String("proxy-forward-ports", "80,443", "comma-separated ports absolute-form requests may be forwarded to")
+	proxyAllowPrivate := flag.Bool("proxy-allow-private", false, "let the proxy connect to loopback, private and link-local addresses")
+	proxyAuth := flag.String("proxy-auth", "", "require Proxy-Authorization Basic credentials in the form user:password")
+	pipelining := flag.Int("pipelining", 1, "number of pipelined requests per connection to handle at the same time")
+	maxConns := flag.Int("max-conns", 0, "maximum number of connections served at the same time, or 0 for no limit")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "maximum number of connections per client IP, or 0 for no limit")
+	maxBodySize := flag.Int64("max-body-size", server.DefaultMaxBodySize, "largest request body accepted in bytes, or 0 for no limit")
+	shutdownTimeout := flag.Duration("shutdown-timeout", server.DefaultShutdownTimeout, "how long shutdown waits for busy connections before closing them, or 0 to wait for ever")
+	rejectOverLimit := flag.Bool("reject-over-limit", false, "answer connections over -max-conns with 503 instead of leaving them waiting")
+	htpasswd := flag.String("htpasswd", "", "require Basic credentials from this htpasswd file")
+	jwtSecretFile := flag.String("jwt-secret-file", "", "accept Bearer JWTs signed with HS256 and the secret in this file, at least 32 bytes long")
+	httpbinRate := flag.Int("httpbin-rate", 0, "requests per minute each client IP may send to /httpbin/, or 0 for no limit")
+	corsOrigins := flag.String("cors-origins", "", "comma-separated origins allowed to make cross-origin requests, such as https://*.example.com")
+	allow := flag.String("allow", "", "comma-separated CIDR ranges of the only clients allowed to connect")
+	deny := flag.String("deny", "", "comma-separated CIDR ranges of clients refused as soon as they connect")
+	trustedProxies := flag.String("trusted-proxies", "", "comma-separated CIDR ranges of proxies whose Forwarded and X-Forwarded-For headers are believed")
+	proxyProtocol := flag.String("proxy-protocol", "", `accept PROXY protocol headers from a load balancer: "optional" or "required"`)
+	proxyProtocolFrom := flag.String("proxy-protocol-from", "", "comma-separated CIDR ranges of the load balancers allowed to send PROXY protocol headers; empty allows any")
+	accessLog := flag.Bool("access-log", false, "log a line with the request and trace IDs for every request")
+	traceExporter := flag.String("trace", "", `record spans of every request and export them: "stdout" or "otlp"`)
+	otlpEndpoint := flag.String("otlp-endpoint", tracing.DefaultOTLPEndpoint, "URL of the OpenTelemetry collector -trace=otlp posts spans to")
+	traceSampleRatio := flag.Float64("trace-sample-ratio", 1, "fraction of new traces to record; callers' sampling decisions are followed")
+	httpbinTimeout := flag.Duration("httpbin-timeout", 0, "answer /httpbin/ requests with 503 if httpbin.org takes longer than this, or 0 for no limit")
+	flag.Parse()
+
+	if *httpbinTimeout > 0 {
+		httpbinHandler = timeout.Handler(timeout.Config{Timeout: *httpbinTimeout}, httpbinHandler)
+	}
+	if *httpbinRate > 0 {
+		// Allow short bursts, but no more than the rate over a minute.
+		limiter := ratelimit.NewTokenBucket(*httpbinRate, time.Minute, max(*httpbinRate/10, 1), 0)
+		httpbinHandler = ratelimit.Handler(ratelimit.Config{Limiter: limiter}, httpbinHandler)
+	}
+
+	app := server.Handler(handler)
+	if *htpasswd != "" || *jwtSecretFile != "" {
+		cfg, err := authConfig(*htpasswd, *jwtSecretFile)
+		if err != nil {
+			log.Fatalf("Error configuring authentication: %v", err)
+		}
+		app = auth.Handler(cfg, app)
+	}
+	if *corsOrigins != "" {
+		// CORS goes outside authentication, since browsers send preflight
+		// requests without credentials.
+		app = cors.Handler(cors.Config{
+			AllowedOrigins: strings.Split(*corsOrigins, ","),
+			AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+			AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "X-Requested-With"},
+		}, app)
+	}
+
+	if *trustedProxies != "" {
+		trusted, err := ipfilter.ParsePrefixes(strings.Split(*trustedProxies, ","))
+		if err != nil {
+			log.Fatalf("Error parsing -trusted-proxies: %v", err)
+		}
+		app = ipfilter.TrustedProxies(trusted, app)
+	}
+
+	h := app
+	if *proxyMode {
+		cfg, err := proxyConfig(*proxyPorts, *proxyForwardPorts, *proxyAuth)
+		if err != nil {
+			log.Fatalf("Error configuring proxy: %v", err)
+		}
+		cfg.AllowPrivateDestinations = *proxyAllowPrivate
+		h = proxy.Handler(cfg, app)
+	}
+	if *accessLog {
+		h = accesslog.Handler(accesslog.Config{}, h)
+	}
+	// Every request gets a request ID and a span of its trace, which are
+	// passed on to httpbin.org and to proxied servers.
+	h = tracecontext.Handler(tracecontext.Config{}, h)
+
+	opts := []server.Option{
+		server.WithPipelining(*pipelining),
+		server.WithMaxConnections(*maxConns),
+		server.WithMaxConnectionsPerIP(*maxConnsPerIP),
+		server.WithMaxBodySize(*maxBodySize),
+		server.WithShutdownTimeout(*shutdownTimeout),
+	}
+	if *allow != "" || *deny != "" {
+		f, err := ipFilter(*allow, *deny)
+		if err != nil {
+			log.Fatalf("Error configuring IP filter: %v", err)
+		}
+		opts = append(opts, server.WithConnFilter(f.Allowed))
+	}
+	switch *proxyProtocol {
+	case "":
+	case "optional", "required":
+		var sources []netip.Prefix
+		if *proxyProtocolFrom != "" {
+			var err error
+			if sources, err = ipfilter.ParsePrefixes(strings.Split(*proxyProtocolFrom, ",")); err != nil {
+				log.Fatalf("Error parsing -proxy-protocol-from: %v", err)
+			}
+		}
+		opts = append(opts, server.WithProxyProtocol(*proxyProtocol == "required", sources...))
+	default:
+		log.Fatalf("Error: -proxy-protocol must be \"optional\" or \"required\", not %q", *proxyProtocol)
+	}
+	if *rejectOverLimit {
+		opts = append(opts, server.WithRejectOverLimit())
+	}
+	if *traceExporter != "" {
+		t, err := newTracer(*traceExporter, *otlpEndpoint, *traceSampleRatio)
+		if err != nil {
+			log.Fatalf("Error configuring tracing: %v", err)
+		}
+		// Deferred before the server is closed, so it runs after that and
+		// exports the spans of the last requests.
+		defer t.Close()
+		opts = append(opts, server.WithTracer(t))
+	}
+	server, err := server.Serve(port, h, opts...)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
@@ -33,34 +169,144 @@ func main() {
 	log.Println("Server gracefully stopped")
 }
 
+// newTracer builds the tracer from the -trace, -otlp-endpoint and
+// -trace-sample-ratio flags.
+func newTracer(exporter, endpoint string, ratio float64) (*tracing.Tracer, error) {
+	cfg := tracing.Config{Sampler: tracing.ParentBased(tracing.TraceIDRatio(ratio))}
+	switch exporter {
+	case "stdout":
+		cfg.Exporter = tracing.NewJSONExporter(os.Stdout)
+	case "otlp":
+		cfg.Exporter = tracing.NewOTLPExporter(tracing.OTLPConfig{Endpoint: endpoint})
+	default:
+		return nil, fmt.Errorf(`-trace must be "stdout" or "otlp", not %q`, exporter)
+	}
+	return tracing.New(cfg), nil
+}
+
+// ipFilter builds the connection filter from the -allow and -deny flags.
+func ipFilter(allow, deny string) (*ipfilter.Filter, error) {
+	f := &ipfilter.Filter{}
+	var err error
+	if allow != "" {
+		if f.Allow, err = ipfilter.ParsePrefixes(strings.Split(allow, ",")); err != nil {
+			return nil, err
+		}
+	}
+	if deny != "" {
+		if f.Deny, err = ipfilter.ParsePrefixes(strings.Split(deny, ",")); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// proxyConfig builds the forward proxy configuration from the command-line
+// flags.
+func proxyConfig(ports, forwardPorts, auth string) (proxy.Config, error) {
+	var cfg proxy.Config
+	var err error
+	if cfg.AllowedPorts, err = parsePorts(ports); err != nil {
+		return cfg, err
+	}
+	if cfg.ForwardPorts, err = parsePorts(forwardPorts); err != nil {
+		return cfg, err
+	}
+	if auth != "" {
+		user, pass, ok := strings.Cut(auth, ":")
+		if !ok {
+			return cfg, fmt.Errorf("proxy credentials must be user:password")
+		}
+		cfg.Credentials = map[string]string{user: pass}
+	}
+	return cfg, nil
+}
+
+// parsePorts parses a comma-separated list of port numbers.
+func parsePorts(list string) ([]int, error) {
+	var ports []int
+	for _, p := range strings.Split(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		ports = append(ports, n)
+	}
+	return ports, nil
+}
+
+// authConfig builds the authentication configuration from the
+// command-line flags.
+func authConfig(htpasswd, jwtSecretFile string) (auth.Config, error) {
+	var cfg auth.Config
+	if htpasswd != "" {
+		h, err := auth.LoadHtpasswd(htpasswd)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Basic = h.Authenticate
+	}
+	if jwtSecretFile != "" {
+		secret, err := os.ReadFile(jwtSecretFile)
+		if err != nil {
+			return cfg, err
+		}
+		jwt, err := auth.NewJWT(bytes.TrimSpace(secret))
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", jwtSecretFile, err)
+		}
+		cfg.Bearer = jwt.Validate
+	}
+	return cfg, nil
+}
+
+// httpbinHandler serves "/httpbin/", rate limited if the -httpbin-rate flag
+// is set and with a deadline if -httpbin-timeout is.
+var httpbinHandler server.Handler = proxyHandler
+
 // handler is the main handler function for our server.
 // It takes a Writer and a Request, and writes a response to the client.
-// The response depends on the RequestTarget of the request.
+// The response depends on the path of the request target, so that a query
+// string like "/video?x=1" still reaches the "/video" route.
 func handler(w *response.Writer, req *request.Request) {
+	path := req.RequestLine.Target.Path
+
 	// If the request is for "/yourproblem", we handle it specially with handler400.
-	if req.RequestLine.RequestTarget == "/yourproblem" {
+	if path == "/yourproblem" {
 		handler400(w, req)
 		return
 	}
 
 	// If the request is for "/myproblem", we handle it specially with handler500.
-	if req.RequestLine.RequestTarget == "/myproblem" {
+	if path == "/myproblem" {
 		handler500(w, req)
 		return
 	}
 
 	// Check if the request is for the proxy endpoint
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-		proxyHandler(w, req)
+	if strings.HasPrefix(path, "/httpbin/") {
+		httpbinHandler(w, req)
 		return
 	}
 
 	// Check if the request is for the video endpoint
-	if req.RequestLine.RequestTarget == "/video" {
+	if path == "/video" {
 		handlerVideo(w, req)
 		return
 	}
 
+	// Check if the request is for the WebSocket echo endpoint
+	if path == "/ws" {
+		handlerWebSocket(w, req)
+		return
+	}
+
+	// Check if the request is for the server-sent events endpoint
+	if path == "/events" {
+		handlerEvents(w, req)
+		return
+	}
+
 	// If the request is for any other URL, we handle it with handler200.
 	handler200(w, req)
 }
@@ -159,11 +405,21 @@ func handler200(w *response.Writer, _ *request.Request) {
 
 // proxyHandler handles requests to /httpbin/* by proxying to httpbin.org
 func proxyHandler(w *response.Writer, req *request.Request) {
-	// Extract the path after /httpbin/
-	path := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
+	// Extract the path after /httpbin/, keeping the query string
+	path := strings.TrimPrefix(req.RequestLine.Target.Path, "/httpbin/")
+	if req.RequestLine.Target.RawQuery != "" {
+		path += "?" + req.RequestLine.Target.RawQuery
+	}
 
-	// Make the request to httpbin.org
-	resp, err := http.Get("https://httpbin.org/" + path)
+	// Make the request to httpbin.org, giving up when the client does
+	var resp *http.Response
+	upstreamReq, err := http.NewRequestWithContext(req.Context(), "GET", "https://httpbin.org/"+path, nil)
+	if err == nil {
+		if t := tracecontext.Get(req); t != nil {
+			t.Inject(upstreamReq.Header)
+		}
+		resp, err = http.DefaultClient.Do(upstreamReq)
+	}
 	if err != nil {
 		// If there's an error, return a 500 status
 		w.WriteStatusLine(response.StatusCodeInternalServerError)
@@ -184,10 +440,20 @@ func proxyHandler(w *response.Writer, req *request.Request) {
 	// Read the headers from the response
 	hdrs := headers.NewHeaders()
 	for key, value := range resp.Header {
+		// Cookies are passed on separately, since joining them breaks them.
+		if key == "Set-Cookie" {
+			continue
+		}
 		for _, v := range value {
 			hdrs.Set(key, v)
 		}
 	}
+	for _, v := range resp.Header.Values("Set-Cookie") {
+		// A cookie that a browser would reject is dropped.
+		if c, err := cookie.ParseSetCookie(v); err == nil {
+			w.SetCookie(c)
+		}
+	}
 
 	// Set Trailer header to indicate we will send X-Content-SHA256 and X-Content-Length
 	hdrs.Override("Trailer", "x-content-sha256, x-content-length")
@@ -195,8 +461,13 @@ func proxyHandler(w *response.Writer, req *request.Request) {
 	// Set Transfer-Encoding to chunked
 	hdrs.Override("Transfer-Encoding", "chunked")
 
-	// Write the headers to the client
-	w.WriteHeaders(hdrs)
+	// Write the headers to the client. Headers that would corrupt the
+	// response are refused, and the connection closed after the bare status
+	// line, so there is no point in downloading the body.
+	if err := w.WriteHeaders(hdrs); err != nil {
+		log.Printf("Error writing httpbin headers: %v", err)
+		return
+	}
 
 	// Read the response body in chunks and write them immediately
 	var responseBody []byte
@@ -215,8 +486,11 @@ func proxyHandler(w *response.Writer, req *request.Request) {
 		// Append the chunk
 		responseBody = append(responseBody, buffer[:n]...)
 
-		// Write the chunk
-		w.WriteChunkedBody(buffer[:n])
+		// Write the chunk, giving up if the client is gone
+		if _, err := w.WriteChunkedBody(buffer[:n]); err != nil {
+			log.Printf("Error writing response: %v", err)
+			return
+		}
 
 		// Log the chunk size
 		contentLength += n
@@ -234,10 +508,15 @@ func proxyHandler(w *response.Writer, req *request.Request) {
 	trailers.Set("X-Content-Length", fmt.Sprintf("%d", contentLength))
 
 	// Signal end of chunked body
-	w.WriteChunkedBodyDone()
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		log.Printf("Error writing response: %v", err)
+		return
+	}
 
 	// Write the trailers to the client
-	w.WriteTrailers(trailers)
+	if err := w.WriteTrailers(trailers); err != nil {
+		log.Printf("Error writing trailers: %v", err)
+	}
 }
 
 // handlerVideo handles requests to /video
@@ -286,3 +565,62 @@ func handlerVideo(w *response.Writer, req *request.Request) {
 	// Write the video to the client
 	w.WriteBody(video)
 }
+
+// handlerWebSocket handles requests to /ws by upgrading the connection to a
+// WebSocket and echoing every message back until the client closes it.
+func handlerWebSocket(w *response.Writer, req *request.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, req)
+	if err != nil {
+		log.Printf("Error upgrading to websocket: %v", err)
+		return
+	}
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Printf("WebSocket closed: %v", err)
+			return
+		}
+		if err := conn.WriteMessage(messageType, data); err != nil {
+			log.Printf("Error writing websocket message: %v", err)
+			return
+		}
+	}
+}
+
+// handlerEvents handles requests to /events by streaming a numbered tick
+// every second as server-sent events. A reconnecting client resumes counting
+// after the last event it received.
+func handlerEvents(w *response.Writer, req *request.Request) {
+	stream, err := sse.NewStream(w, req)
+	if err != nil {
+		log.Printf("Error starting event stream: %v", err)
+		return
+	}
+	defer stream.Close()
+	stream.Heartbeat(15 * time.Second)
+
+	// Resume after the last event the client saw, if any
+	n, _ := strconv.Atoi(stream.LastEventID())
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stream.Done():
+			log.Printf("Event stream client disconnected")
+			return
+		case t := <-ticker.C:
+			n++
+			err := stream.Send(sse.Event{
+				ID:    strconv.Itoa(n),
+				Event: "tick",
+				Data:  t.Format(time.RFC3339),
+			})
+			if err != nil {
+				return
+			}
+		}
+	}
+}
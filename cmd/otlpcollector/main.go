@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+)
+
+// exportRequest is the part of an OTLP/HTTP JSON export request that gets
+// printed.
+type exportRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []struct {
+				TraceID           string `json:"traceId"`
+				SpanID            string `json:"spanId"`
+				ParentSpanID      string `json:"parentSpanId"`
+				Name              string `json:"name"`
+				StartTimeUnixNano string `json:"startTimeUnixNano"`
+				EndTimeUnixNano   string `json:"endTimeUnixNano"`
+			} `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// A stand-in for an OpenTelemetry collector, which prints the spans that
+// httpserver -trace=otlp posts to it.
+func main() {
+	port := flag.Int("port", 4318, "port to accept OTLP/HTTP JSON exports on")
+	flag.Parse()
+
+	s, err := server.Serve(*port, handler)
+	if err != nil {
+		log.Fatalf("error starting collector: %v", err)
+	}
+	defer s.Close()
+	fmt.Println("Collector is listening on", s.Addr())
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+}
+
+func handler(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method != "POST" || req.RequestLine.Target.Path != "/v1/traces" {
+		reply(w, response.StatusCodeBadRequest, `{"message":"POST spans to /v1/traces"}`)
+		return
+	}
+	body, err := req.ReadBody()
+	if err != nil {
+		reply(w, response.StatusCodeBadRequest, `{"message":"error reading body"}`)
+		return
+	}
+	var export exportRequest
+	if err := json.Unmarshal(body, &export); err != nil {
+		reply(w, response.StatusCodeBadRequest, `{"message":"invalid JSON"}`)
+		return
+	}
+
+	for _, rs := range export.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				parent := span.ParentSpanID
+				if parent == "" {
+					parent = "-"
+				}
+				fmt.Printf("trace=%s span=%s parent=%s %-8s %v\n", span.TraceID, span.SpanID, parent, span.Name,
+					duration(span.StartTimeUnixNano, span.EndTimeUnixNano))
+			}
+		}
+	}
+	reply(w, response.StatusCodeSuccess, `{}`)
+}
+
+func duration(start, end string) time.Duration {
+	s, _ := strconv.ParseInt(start, 10, 64)
+	e, _ := strconv.ParseInt(end, 10, 64)
+	return time.Duration(e - s)
+}
+
+func reply(w *response.Writer, statusCode response.StatusCode, body string) {
+	w.WriteStatusLine(statusCode)
+	h := response.GetDefaultHeaders(len(body))
+	h.Override("Content-Type", "application/json")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
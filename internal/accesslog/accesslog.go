@@ -0,0 +1,50 @@
+// Package accesslog logs a line for every request a server handles.
+package accesslog
+
+import (
+	"log"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+	"github.com/Fepozopo/httpfromtcp/internal/tracecontext"
+)
+
+// Config configures the access log.
+type Config struct {
+	// Logger receives the lines. If nil, the standard logger is used.
+	Logger *log.Logger
+}
+
+// Handler returns a handler that passes requests on to next and logs each
+// once next returns, such as:
+//
+//	192.0.2.1 "GET /index.html HTTP/1.1" 200 1.2ms request_id=9f1c2b7e-… trace_id=4bf92f35… span_id=00f067aa…
+//
+// The request and trace IDs are those of the tracecontext middleware, or
+// "-" if the request did not pass through it. The status is 0 when next
+// wrote no response, such as when the client went away.
+func Handler(cfg Config, next server.Handler) server.Handler {
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		start := time.Now()
+		next(w, req)
+		elapsed := time.Since(start)
+
+		requestID, traceID, spanID := "-", "-", "-"
+		if t := tracecontext.Get(req); t != nil {
+			requestID, traceID, spanID = t.RequestID, t.Span.TraceID.String(), t.Span.SpanID.String()
+		}
+		cfg.Logger.Printf("%s %q %d %s request_id=%s trace_id=%s span_id=%s",
+			req.ClientIP, requestLine(req), w.StatusCode(), elapsed.Round(time.Microsecond),
+			requestID, traceID, spanID)
+	}
+}
+
+func requestLine(req *request.Request) string {
+	return req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " HTTP/" + req.RequestLine.HttpVersion
+}
@@ -0,0 +1,65 @@
+package accesslog
+
+import (
+	"bytes"
+	"log"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/Fepozopo/httpfromtcp/internal/handlertest"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/tracecontext"
+	"github.com/stretchr/testify/assert"
+)
+
+// newRequest returns a request from 192.0.2.1 with the given header lines.
+func newRequest(t *testing.T, hdrs ...string) *request.Request {
+	t.Helper()
+	req := handlertest.NewRequest(t, "GET", "/path?q=1", hdrs...)
+	req.ClientIP = netip.MustParseAddr("192.0.2.1")
+	return req
+}
+
+func forbidden(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.StatusCodeForbidden)
+	w.WriteHeaders(response.GetDefaultHeaders(0))
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := Handler(Config{Logger: log.New(&buf, "", 0)}, forbidden)
+
+	// Test: A line with the client, request line and status is logged, with
+	// "-" for missing IDs
+	handlertest.Record(h, newRequest(t))
+	line := buf.String()
+	assert.True(t, strings.HasPrefix(line, `192.0.2.1 "GET /path?q=1 HTTP/1.1" 403 `), line)
+	assert.True(t, strings.HasSuffix(line, " request_id=- trace_id=- span_id=-\n"), line)
+
+	// Test: The IDs of the tracecontext middleware are logged
+	buf.Reset()
+	h = tracecontext.Handler(tracecontext.Config{}, h)
+	handlertest.Record(h, newRequest(t, "X-Request-ID: abc-123",
+		"Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+	line = buf.String()
+	assert.Contains(t, line, " request_id=abc-123 trace_id=4bf92f3577b34da6a3ce929d0e0e4736 span_id=")
+	assert.NotContains(t, line, "span_id=00f067aa0ba902b7")
+
+	// Test: Quotes in the target cannot break the line apart
+	buf.Reset()
+	req := newRequest(t)
+	req.RequestLine.RequestTarget = `/"x`
+	handlertest.Record(h, req)
+	assert.Contains(t, buf.String(), `"GET /\"x HTTP/1.1"`)
+}
+
+func TestHandlerNoResponse(t *testing.T) {
+	var buf bytes.Buffer
+	h := Handler(Config{Logger: log.New(&buf, "", 0)}, func(w *response.Writer, req *request.Request) {})
+
+	// Test: A request that got no response is logged with status 0
+	handlertest.Record(h, newRequest(t))
+	assert.Contains(t, buf.String(), `"GET /path?q=1 HTTP/1.1" 0 `)
+}
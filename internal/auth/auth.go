@@ -0,0 +1,133 @@
+// Package auth authenticates requests with the Basic and Bearer schemes of
+// the Authorization header.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+)
+
+// DefaultRealm is the protection space named in challenges when
+// Config.Realm is empty.
+const DefaultRealm = "restricted"
+
+// Config configures the authentication middleware. At least one of Basic
+// and Bearer must be set; the schemes that are set are accepted.
+type Config struct {
+	// Realm names the protection space in challenges, so that clients know
+	// which credentials to send.
+	Realm string
+	// Basic checks a user name and password sent with the Basic scheme.
+	// Htpasswd.Authenticate can be used here.
+	Basic func(user, password string) bool
+	// Bearer checks a token sent with the Bearer scheme and returns whom
+	// it belongs to. JWT.Validate can be used here. Errors other than
+	// ErrInvalidToken are logged and answered like an invalid token.
+	Bearer func(token string) (*Principal, error)
+}
+
+// Principal is the authenticated client of a request.
+type Principal struct {
+	// Name is the Basic user name, or the subject of a bearer token.
+	Name string
+	// Scheme is "Basic" or "Bearer".
+	Scheme string
+	// Claims holds the claims of a JWT bearer token.
+	Claims map[string]any
+}
+
+// principalKey is the request value key the principal is stored under.
+type principalKey struct{}
+
+// Get returns the principal of a request that passed the authentication
+// middleware, or nil.
+func Get(req *request.Request) *Principal {
+	p, _ := req.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// Handler returns a handler that only passes requests with valid
+// credentials on to next, where Get returns who sent them. Other requests
+// are answered with 401 Unauthorized and a challenge for every accepted
+// scheme.
+func Handler(cfg Config, next server.Handler) server.Handler {
+	if cfg.Basic == nil && cfg.Bearer == nil {
+		panic("auth: Config.Basic or Config.Bearer is required")
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = DefaultRealm
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		p, bearerErr := authenticate(cfg, req)
+		if p == nil {
+			unauthorized(w, cfg, bearerErr)
+			return
+		}
+		req.SetValue(principalKey{}, p)
+		next(w, req)
+	}
+}
+
+// authenticate returns the principal for the request's credentials, or nil.
+// When a bearer token was rejected, ErrInvalidToken is returned too.
+func authenticate(cfg Config, req *request.Request) (*Principal, error) {
+	if cfg.Basic != nil {
+		if user, password, ok := req.BasicAuth(); ok {
+			if cfg.Basic(user, password) {
+				return &Principal{Name: user, Scheme: "Basic"}, nil
+			}
+			return nil, nil
+		}
+	}
+	if cfg.Bearer != nil {
+		if token, ok := req.BearerToken(); ok {
+			p, err := cfg.Bearer(token)
+			if err != nil {
+				if !errors.Is(err, ErrInvalidToken) {
+					log.Printf("Error validating bearer token: %v", err)
+				}
+				return nil, ErrInvalidToken
+			}
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// unauthorized writes a 401 response challenging the client for every
+// accepted scheme. A rejected bearer token is reported as in RFC 6750
+// section 3.1.
+func unauthorized(w *response.Writer, cfg Config, bearerErr error) {
+	realm := quote(cfg.Realm)
+	var challenges []string
+	if cfg.Basic != nil {
+		challenges = append(challenges, fmt.Sprintf(`Basic realm=%s, charset="UTF-8"`, realm))
+	}
+	if cfg.Bearer != nil {
+		challenge := "Bearer realm=" + realm
+		if bearerErr != nil {
+			challenge += `, error="invalid_token"`
+		}
+		challenges = append(challenges, challenge)
+	}
+
+	w.WriteStatusLine(response.StatusCodeUnauthorized)
+	body := []byte("Unauthorized")
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("WWW-Authenticate", strings.Join(challenges, ", "))
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// quote returns s as a quoted-string.
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/handlertest"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// whoami answers with the name and scheme of the principal.
+func whoami(w *response.Writer, req *request.Request) {
+	p := Get(req)
+	body := []byte(p.Scheme + " " + p.Name)
+	w.WriteStatusLine(response.StatusCodeSuccess)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func TestHandler(t *testing.T) {
+	htpasswd, err := ParseHtpasswd(strings.NewReader(testHtpasswd))
+	require.NoError(t, err)
+	jwt := &JWT{Secret: testSecret}
+	token := signJWT(t, testSecret, map[string]any{"alg": "HS256"}, map[string]any{"sub": "carol", "exp": time.Now().Unix() + 60})
+	both := Handler(Config{Realm: "internal tools", Basic: htpasswd.Authenticate, Bearer: jwt.Validate}, whoami)
+
+	tests := []struct {
+		name          string
+		handler       server.Handler
+		authorization string
+		status        int
+		body          string
+		challenge     string
+	}{
+		// Test: Valid credentials reach the handler with a principal
+		{"basic", both, "Basic Ym9iOnNlY3JldA==", 200, "Basic bob", ""},
+		{"bearer", both, "Bearer " + token, 200, "Bearer carol", ""},
+		// Test: Missing credentials get a challenge for every scheme
+		{"missing", both, "", 401, "Unauthorized", `Basic realm="internal tools", charset="UTF-8", Bearer realm="internal tools"`},
+		{"unknown scheme", both, "Digest abc", 401, "Unauthorized", `Basic realm="internal tools", charset="UTF-8", Bearer realm="internal tools"`},
+		// Test: Wrong credentials
+		{"wrong password", both, "Basic Ym9iOndyb25n", 401, "Unauthorized", `Basic realm="internal tools", charset="UTF-8", Bearer realm="internal tools"`},
+		{"invalid token", both, "Bearer " + token + "x", 401, "Unauthorized", `Basic realm="internal tools", charset="UTF-8", Bearer realm="internal tools", error="invalid_token"`},
+		// Test: Only configured schemes are accepted and challenged
+		{"basic only", Handler(Config{Basic: htpasswd.Authenticate}, whoami), "Bearer " + token, 401, "Unauthorized", `Basic realm="restricted", charset="UTF-8"`},
+		{"bearer only", Handler(Config{Bearer: jwt.Validate}, whoami), "Basic Ym9iOnNlY3JldA==", 401, "Unauthorized", `Bearer realm="restricted"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var hdrs []string
+			if tc.authorization != "" {
+				hdrs = append(hdrs, "Authorization: "+tc.authorization)
+			}
+			resp := handlertest.Do(t, tc.handler, handlertest.NewRequest(t, "GET", "/", hdrs...))
+			assert.Equal(t, tc.status, resp.StatusCode)
+			assert.Equal(t, tc.body, handlertest.Body(t, resp))
+			assert.Equal(t, tc.challenge, resp.Header.Get("WWW-Authenticate"))
+		})
+	}
+
+	// Test: A config without schemes is rejected
+	assert.Panics(t, func() { Handler(Config{}, whoami) })
+}
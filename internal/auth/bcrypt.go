@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// errBcryptHash is returned for strings that are not bcrypt hashes.
+var errBcryptHash = errors.New("auth: malformed bcrypt hash")
+
+const (
+	bcryptMinCost = 4
+	bcryptMaxCost = 31
+	// bcryptMaxKey is how many bytes of the password bcrypt uses. Anything
+	// after that is ignored, as in every other implementation.
+	bcryptMaxKey = 72
+)
+
+// bcryptEncoding is the base64 alphabet of bcrypt hashes, which differs
+// from the standard one.
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+// bcryptMagic is the text bcrypt encrypts with the password-derived key.
+var bcryptMagic = []byte("OrpheanBeholderScryDoubt")
+
+// bcryptHash is a parsed "$2b$cost$salthash" string.
+type bcryptHash struct {
+	cost int
+	salt []byte
+	sum  []byte
+}
+
+// parseBcrypt parses a bcrypt hash. The $2a$, $2b$ and $2y$ variants only
+// differ for passwords longer than 255 bytes, or in buggy implementations,
+// and are treated alike.
+func parseBcrypt(s string) (*bcryptHash, error) {
+	if len(s) != 60 || s[0] != '$' || s[1] != '2' || s[3] != '$' || s[6] != '$' {
+		return nil, errBcryptHash
+	}
+	switch s[2] {
+	case 'a', 'b', 'y':
+	default:
+		return nil, errBcryptHash
+	}
+	cost, err := strconv.Atoi(s[4:6])
+	if err != nil || cost < bcryptMinCost || cost > bcryptMaxCost {
+		return nil, errBcryptHash
+	}
+	salt, err := bcryptEncoding.DecodeString(s[7:29])
+	if err != nil {
+		return nil, errBcryptHash
+	}
+	sum, err := bcryptEncoding.DecodeString(s[29:])
+	if err != nil {
+		return nil, errBcryptHash
+	}
+	return &bcryptHash{cost: cost, salt: salt, sum: sum}, nil
+}
+
+// matches reports whether password hashes to h.
+func (h *bcryptHash) matches(password string) bool {
+	return subtle.ConstantTimeCompare(bcrypt([]byte(password), h.cost, h.salt), h.sum) == 1
+}
+
+// bcrypt computes the 23 byte bcrypt digest of a password.
+func bcrypt(password []byte, cost int, salt []byte) []byte {
+	// The key includes the terminating NUL of the C string.
+	key := append(append([]byte(nil), password...), 0)
+	if len(key) > bcryptMaxKey {
+		key = key[:bcryptMaxKey]
+	}
+
+	c := newBlowfish()
+	c.expandKey(key, salt)
+	for i := uint64(0); i < 1<<cost; i++ {
+		c.expandKey(key, nil)
+		c.expandKey(salt, nil)
+	}
+
+	var text [6]uint32
+	for i := range text {
+		text[i] = binary.BigEndian.Uint32(bcryptMagic[4*i:])
+	}
+	for range 64 {
+		for i := 0; i < len(text); i += 2 {
+			text[i], text[i+1] = c.encrypt(text[i], text[i+1])
+		}
+	}
+	out := make([]byte, 0, len(bcryptMagic))
+	for _, v := range text {
+		out = binary.BigEndian.AppendUint32(out, v)
+	}
+	return out[:23]
+}
+
+// blowfish is the Blowfish cipher, with the expensive key schedule of
+// bcrypt.
+type blowfish struct {
+	p [18]uint32
+	s [4][256]uint32
+}
+
+func newBlowfish() *blowfish {
+	return &blowfish{p: blowfishP, s: blowfishS}
+}
+
+func (c *blowfish) f(x uint32) uint32 {
+	return ((c.s[0][x>>24] + c.s[1][x>>16&0xff]) ^ c.s[2][x>>8&0xff]) + c.s[3][x&0xff]
+}
+
+// encrypt encrypts one 64-bit block given as two halves.
+func (c *blowfish) encrypt(l, r uint32) (uint32, uint32) {
+	for i := 0; i < 16; i += 2 {
+		l ^= c.p[i]
+		r ^= c.f(l)
+		r ^= c.p[i+1]
+		l ^= c.f(r)
+	}
+	l ^= c.p[16]
+	r ^= c.p[17]
+	return r, l
+}
+
+// expandKey mixes key into the subkeys. When salt is not nil, it is mixed
+// into the blocks encrypted along the way, which is the "expensive key
+// schedule" bcrypt adds to Blowfish.
+func (c *blowfish) expandKey(key, salt []byte) {
+	pos := 0
+	for i := range c.p {
+		c.p[i] ^= nextWord(key, &pos)
+	}
+
+	var l, r uint32
+	pos = 0
+	next := func(dst []uint32) {
+		for i := 0; i < len(dst); i += 2 {
+			if salt != nil {
+				l ^= nextWord(salt, &pos)
+				r ^= nextWord(salt, &pos)
+			}
+			l, r = c.encrypt(l, r)
+			dst[i], dst[i+1] = l, r
+		}
+	}
+	next(c.p[:])
+	for i := range c.s {
+		next(c.s[i][:])
+	}
+}
+
+// nextWord reads a big-endian word from data at *pos, wrapping around at
+// its end.
+func nextWord(data []byte, pos *int) uint32 {
+	var w uint32
+	for range 4 {
+		w = w<<8 | uint32(data[*pos])
+		*pos = (*pos + 1) % len(data)
+	}
+	return w
+}
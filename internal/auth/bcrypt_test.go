@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlowfish(t *testing.T) {
+	// Test: Zero key and plaintext, from Eric Young's test vectors
+	c := newBlowfish()
+	c.expandKey(make([]byte, 8), nil)
+	l, r := c.encrypt(0, 0)
+	assert.Equal(t, [2]uint32{0x4ef99745, 0x6198dd78}, [2]uint32{l, r})
+}
+
+func TestBcrypt(t *testing.T) {
+	// Test vectors from the crypt_blowfish reference implementation.
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+	}{
+		{"short", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+		{"longer", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.VGOzA784oUp/Z0DY336zx7pLYAy0lwK", "U*U*"},
+		{"other salt", "$2a$05$XXXXXXXXXXXXXXXXXXXXXOAcXxm9kjPGEMsLznoKqmqw7tc8WCx4a", "U*U*U"},
+		{"empty", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.7uG0VCzI2bS7j6ymqJi9CdcdxiRTWNy", ""},
+		{"72 bytes", "$2a$05$abcdefghijklmnopqrstuu5s2v8.iXieOjg/.AySBTTZIIVFJeBui", "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789chars after 72 are ignored"},
+		// Test: $2b$ and $2y$ hash the same way
+		{"2b", "$2b$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+		{"2y", "$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := parseBcrypt(tc.hash)
+			require.NoError(t, err)
+			assert.True(t, h.matches(tc.password))
+			assert.False(t, h.matches(tc.password[:len(tc.password)/2]+"!"))
+		})
+	}
+
+	// Test: Malformed hashes
+	for _, hash := range []string{
+		"",
+		"$2x$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a$03$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOe",
+		"$2a$05$CCCCCCCCCCCCCCCCCCCCC!E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+	} {
+		_, err := parseBcrypt(hash)
+		require.ErrorIs(t, err, errBcryptHash, hash)
+	}
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Htpasswd holds users and password hashes in the format of Apache's
+// htpasswd files: one "user:hash" line per user. Hashes made with
+// "htpasswd -B" (bcrypt) and "htpasswd -s" ({SHA}) are supported; {SHA} is
+// a single unsalted SHA-1 and should only be used for existing files.
+type Htpasswd struct {
+	users map[string]passwordHash
+	// decoy is checked for unknown users, so that the response time does
+	// not reveal which users exist.
+	decoy passwordHash
+}
+
+// passwordHash checks passwords against one stored hash.
+type passwordHash interface {
+	matches(password string) bool
+}
+
+// shaHash is a "{SHA}base64(sha1(password))" hash.
+type shaHash []byte
+
+func (h shaHash) matches(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	return subtle.ConstantTimeCompare(sum[:], h) == 1
+}
+
+// LoadHtpasswd reads an htpasswd file.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	defer f.Close()
+	return ParseHtpasswd(f)
+}
+
+// ParseHtpasswd reads htpasswd lines from r. Blank lines and lines starting
+// with "#" are skipped. A hash in an unsupported format is an error, rather
+// than a user who can never log in.
+func ParseHtpasswd(r io.Reader) (*Htpasswd, error) {
+	h := &Htpasswd{users: map[string]passwordHash{}}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, encoded, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("auth: htpasswd line %d: missing user name", n)
+		}
+		hash, err := parseHash(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("auth: htpasswd line %d: %w", n, err)
+		}
+		h.users[user] = hash
+		if h.decoy == nil {
+			h.decoy = hash
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	return h, nil
+}
+
+func parseHash(s string) (passwordHash, error) {
+	switch {
+	case strings.HasPrefix(s, "$2"):
+		return parseBcrypt(s)
+	case strings.HasPrefix(s, "{SHA}"):
+		sum, err := base64.StdEncoding.DecodeString(s[len("{SHA}"):])
+		if err != nil || len(sum) != sha1.Size {
+			return nil, fmt.Errorf("malformed {SHA} hash")
+		}
+		return shaHash(sum), nil
+	case strings.HasPrefix(s, "$apr1$"):
+		return nil, fmt.Errorf("unsupported MD5 hash; recreate it with htpasswd -B")
+	default:
+		return nil, fmt.Errorf("unsupported hash format")
+	}
+}
+
+// Authenticate reports whether password is the password of user. It can
+// be used as Config.Basic.
+func (h *Htpasswd) Authenticate(user, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		if h.decoy != nil {
+			h.decoy.matches(password)
+		}
+		return false
+	}
+	return hash.matches(password)
+}
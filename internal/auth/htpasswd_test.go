@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testHtpasswd = `# users
+alice:$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW
+
+bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+`
+
+func TestHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".htpasswd")
+	require.NoError(t, os.WriteFile(path, []byte(testHtpasswd), 0o600))
+	h, err := LoadHtpasswd(path)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		want     bool
+	}{
+		// Test: bcrypt and {SHA} hashes
+		{"bcrypt", "alice", "U*U", true},
+		{"bcrypt wrong", "alice", "secret", false},
+		{"sha", "bob", "secret", true},
+		{"sha wrong", "bob", "U*U", false},
+		// Test: Unknown users
+		{"unknown", "carol", "secret", false},
+		{"empty", "", "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, h.Authenticate(tc.user, tc.password))
+		})
+	}
+
+	// Test: Unsupported and malformed lines are errors
+	for _, line := range []string{
+		"alice:$apr1$salt$hash",
+		"alice:plaintext",
+		"alice:{SHA}short",
+		"no-colon",
+		":{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+	} {
+		_, err := ParseHtpasswd(strings.NewReader(line))
+		assert.Error(t, err, line)
+	}
+
+	// Test: Missing file
+	_, err = LoadHtpasswd(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
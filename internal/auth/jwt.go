@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned for bearer tokens that are malformed, forged
+// or no longer valid. The error text says which.
+var ErrInvalidToken = errors.New("auth: invalid token")
+
+// MinSecretSize is the shortest JWT secret accepted. Anyone can sign tokens
+// with an empty key, and short ones are easier to guess.
+const MinSecretSize = 32
+
+// ErrWeakSecret is returned for a JWT whose secret is shorter than
+// MinSecretSize.
+var ErrWeakSecret = fmt.Errorf("auth: JWT secret must be at least %d bytes", MinSecretSize)
+
+// JWT verifies JSON Web Tokens (RFC 7519) signed with HMAC-SHA256. Its
+// Validate method can be used as Config.Bearer.
+type JWT struct {
+	// Secret is the HMAC key tokens are signed with.
+	Secret []byte
+	// Issuer, if set, must match the "iss" claim.
+	Issuer string
+	// Audience, if set, must be in the "aud" claim.
+	Audience string
+	// Leeway allows for clock skew when checking "exp" and "nbf".
+	Leeway time.Duration
+
+	// now returns the current time. Tests replace it.
+	now func() time.Time
+}
+
+// NewJWT returns a JWT that verifies tokens signed with secret, which must
+// be at least MinSecretSize bytes long.
+func NewJWT(secret []byte) (*JWT, error) {
+	if len(secret) < MinSecretSize {
+		return nil, ErrWeakSecret
+	}
+	return &JWT{Secret: secret}, nil
+}
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Alg  string   `json:"alg"`
+	Crit []string `json:"crit"`
+}
+
+// Validate checks the signature and the registered claims of a token and
+// returns a principal named after its "sub" claim, carrying all its claims.
+// Every token is refused with ErrWeakSecret if the secret is too short.
+func (j *JWT) Validate(token string) (*Principal, error) {
+	if len(j.Secret) < MinSecretSize {
+		return nil, ErrWeakSecret
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidToken("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, invalidToken("malformed header")
+	}
+	// Only the algorithm configured here is accepted, never "none" or
+	// whatever else the token asks for.
+	if header.Alg != "HS256" {
+		return nil, invalidToken("unsupported algorithm")
+	}
+	if len(header.Crit) > 0 {
+		return nil, invalidToken("unsupported critical header")
+	}
+
+	mac := hmac.New(sha256.New, j.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, invalidToken("bad signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, invalidToken("malformed claims")
+	}
+	if err := j.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	sub, _ := claims["sub"].(string)
+	return &Principal{Name: sub, Scheme: "Bearer", Claims: claims}, nil
+}
+
+func (j *JWT) checkClaims(claims map[string]any) error {
+	now := time.Now()
+	if j.now != nil {
+		now = j.now()
+	}
+	if v, ok := claims["exp"]; ok {
+		exp, ok := v.(float64)
+		if !ok {
+			return invalidToken("malformed exp claim")
+		}
+		if !now.Before(unixTime(exp).Add(j.Leeway)) {
+			return invalidToken("token expired")
+		}
+	}
+	if v, ok := claims["nbf"]; ok {
+		nbf, ok := v.(float64)
+		if !ok {
+			return invalidToken("malformed nbf claim")
+		}
+		if now.Add(j.Leeway).Before(unixTime(nbf)) {
+			return invalidToken("token not valid yet")
+		}
+	}
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return invalidToken("wrong issuer")
+	}
+	if j.Audience != "" && !hasAudience(claims["aud"], j.Audience) {
+		return invalidToken("wrong audience")
+	}
+	return nil
+}
+
+// hasAudience reports whether an "aud" claim, a string or an array of
+// strings, contains audience.
+func hasAudience(claim any, audience string) bool {
+	switch aud := claim.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		return slices.Contains(aud, any(audience))
+	}
+	return false
+}
+
+// unixTime converts a NumericDate, which may have a fraction, to a time.
+func unixTime(seconds float64) time.Time {
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func invalidToken(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidToken, reason)
+}
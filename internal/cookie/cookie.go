@@ -0,0 +1,265 @@
+package cookie
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SameSite is the SameSite attribute of a cookie, which controls whether it
+// is sent with cross-site requests.
+type SameSite int
+
+const (
+	// SameSiteDefault omits the attribute and leaves the choice to the
+	// browser, which nowadays treats the cookie as Lax.
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+func (s SameSite) String() string {
+	switch s {
+	case SameSiteLax:
+		return "Lax"
+	case SameSiteStrict:
+		return "Strict"
+	case SameSiteNone:
+		return "None"
+	default:
+		return ""
+	}
+}
+
+// timeFormat is the IMF-fixdate format of the Expires attribute.
+const timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// ErrInvalid is wrapped by the errors of Valid and ParseSetCookie.
+var ErrInvalid = errors.New("invalid cookie")
+
+// Cookie is an HTTP cookie as sent by a client in the Cookie header, or by
+// a server in a Set-Cookie header (RFC 6265bis). A client only sends the
+// name and value; the other fields are attributes of Set-Cookie.
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path   string
+	Domain string
+	// Expires is omitted when zero.
+	Expires time.Time
+	// MaxAge is the lifetime of the cookie in seconds. Zero omits the
+	// attribute, and a negative value deletes the cookie right away.
+	MaxAge   int
+	Secure   bool
+	HttpOnly bool
+	SameSite SameSite
+	// Partitioned keeps a third-party cookie in storage partitioned by the
+	// top-level site (CHIPS). It requires Secure.
+	Partitioned bool
+}
+
+// String returns the cookie serialized for a Set-Cookie header. Invalid
+// attributes are left out; use Valid to find them.
+func (c *Cookie) String() string {
+	var b strings.Builder
+	b.WriteString(c.Name)
+	b.WriteByte('=')
+	b.WriteString(c.Value)
+
+	if c.Path != "" && validPath(c.Path) {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" && validDomain(c.Domain) {
+		// A leading dot is ignored by clients, so it is not sent.
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(timeFormat))
+	}
+	switch {
+	case c.MaxAge > 0:
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	case c.MaxAge < 0:
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.SameSite != SameSiteDefault {
+		b.WriteString("; SameSite=" + c.SameSite.String())
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
+
+// Valid reports whether the cookie can be sent in a Set-Cookie header, and
+// whether its attributes agree with each other and with its name prefix.
+func (c *Cookie) Valid() error {
+	if !validName(c.Name) {
+		return fmt.Errorf("%w: name %q", ErrInvalid, c.Name)
+	}
+	if !validValue(c.Value) {
+		return fmt.Errorf("%w: value of %s", ErrInvalid, c.Name)
+	}
+	if c.Path != "" && !validPath(c.Path) {
+		return fmt.Errorf("%w: path of %s", ErrInvalid, c.Name)
+	}
+	if c.Domain != "" && !validDomain(c.Domain) {
+		return fmt.Errorf("%w: domain of %s", ErrInvalid, c.Name)
+	}
+	if !c.Expires.IsZero() && c.Expires.Year() < 1601 {
+		return fmt.Errorf("%w: expiry of %s", ErrInvalid, c.Name)
+	}
+	if c.SameSite < SameSiteDefault || c.SameSite > SameSiteNone {
+		return fmt.Errorf("%w: SameSite of %s", ErrInvalid, c.Name)
+	}
+	if (c.SameSite == SameSiteNone || c.Partitioned) && !c.Secure {
+		return fmt.Errorf("%w: %s must be Secure with SameSite=None or Partitioned", ErrInvalid, c.Name)
+	}
+	if strings.HasPrefix(c.Name, "__Secure-") && !c.Secure {
+		return fmt.Errorf("%w: %s must be Secure", ErrInvalid, c.Name)
+	}
+	if strings.HasPrefix(c.Name, "__Host-") && (!c.Secure || c.Domain != "" || c.Path != "/") {
+		return fmt.Errorf("%w: %s must be Secure, with Path=/ and no Domain", ErrInvalid, c.Name)
+	}
+	return nil
+}
+
+// Parse parses the value of a Cookie request header into its cookies, in
+// order. Pairs that are not valid cookies are skipped. Since a cookie value
+// cannot contain a comma, several Cookie headers joined with commas are
+// parsed as well.
+func Parse(header string) []*Cookie {
+	var cookies []*Cookie
+	for _, part := range strings.FieldsFunc(header, func(r rune) bool { return r == ';' || r == ',' }) {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || !validName(name) || !validValue(value) {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: value})
+	}
+	return cookies
+}
+
+// ParseSetCookie parses the value of a Set-Cookie header. Unknown attributes
+// and attributes with invalid values are ignored, as a client would.
+func ParseSetCookie(line string) (*Cookie, error) {
+	parts := strings.Split(line, ";")
+	name, value, ok := strings.Cut(strings.TrimSpace(parts[0]), "=")
+	if !ok || !validName(name) || !validValue(value) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalid, parts[0])
+	}
+	c := &Cookie{Name: name, Value: value}
+
+	for _, part := range parts[1:] {
+		attr, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+		val = strings.TrimSpace(val)
+		switch strings.ToLower(strings.TrimSpace(attr)) {
+		case "path":
+			if validPath(val) {
+				c.Path = val
+			}
+		case "domain":
+			if validDomain(val) {
+				c.Domain = strings.TrimPrefix(val, ".")
+			}
+		case "expires":
+			if t, err := time.Parse(timeFormat, val); err == nil {
+				c.Expires = t
+			}
+		case "max-age":
+			if n, err := strconv.Atoi(val); err == nil {
+				c.MaxAge = n
+				if n <= 0 {
+					c.MaxAge = -1
+				}
+			}
+		case "secure":
+			c.Secure = true
+		case "httponly":
+			c.HttpOnly = true
+		case "samesite":
+			switch strings.ToLower(val) {
+			case "lax":
+				c.SameSite = SameSiteLax
+			case "strict":
+				c.SameSite = SameSiteStrict
+			case "none":
+				c.SameSite = SameSiteNone
+			}
+		case "partitioned":
+			c.Partitioned = true
+		}
+	}
+	return c, nil
+}
+
+// validName reports whether a cookie name is a token.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7F || strings.IndexByte(`()<>@,;:\"/[]?={}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validValue reports whether a cookie value is made of cookie-octets,
+// optionally surrounded by double quotes.
+func validValue(value string) bool {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c <= ' ' || c >= 0x7F || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// validPath reports whether a path attribute value contains no control
+// characters or semicolons.
+func validPath(path string) bool {
+	for i := 0; i < len(path); i++ {
+		if c := path[i]; c < ' ' || c >= 0x7F || c == ';' {
+			return false
+		}
+	}
+	return true
+}
+
+// validDomain reports whether a domain attribute value looks like a host
+// name, with an optional leading dot.
+func validDomain(domain string) bool {
+	domain = strings.TrimPrefix(domain, ".")
+	if domain == "" || len(domain) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
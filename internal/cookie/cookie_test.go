@@ -0,0 +1,115 @@
+package cookie
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie Cookie
+		want   string
+	}{
+		// Test: Name and value only
+		{"plain", Cookie{Name: "id", Value: "a3fWa"}, "id=a3fWa"},
+		// Test: Every attribute
+		{"attributes", Cookie{
+			Name:        "__Host-id",
+			Value:       "a3fWa",
+			Path:        "/",
+			Expires:     time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC),
+			MaxAge:      3600,
+			Secure:      true,
+			HttpOnly:    true,
+			SameSite:    SameSiteNone,
+			Partitioned: true,
+		}, "__Host-id=a3fWa; Path=/; Expires=Wed, 21 Oct 2015 07:28:00 GMT; Max-Age=3600; Secure; HttpOnly; SameSite=None; Partitioned"},
+		// Test: Leading dot of the domain is dropped
+		{"domain", Cookie{Name: "id", Value: "1", Domain: ".example.com", SameSite: SameSiteLax}, "id=1; Domain=example.com; SameSite=Lax"},
+		// Test: Negative MaxAge deletes the cookie
+		{"delete", Cookie{Name: "id", Value: "", MaxAge: -1}, "id=; Max-Age=0"},
+		// Test: Quoted value is kept as is
+		{"quoted", Cookie{Name: "id", Value: `"abc"`}, `id="abc"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.cookie.String())
+			assert.NoError(t, tc.cookie.Valid())
+		})
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie Cookie
+	}{
+		// Test: Separators are not allowed in names
+		{"name", Cookie{Name: "a;b", Value: "1"}},
+		// Test: Spaces, commas and semicolons are not allowed in values
+		{"value space", Cookie{Name: "a", Value: "1 2"}},
+		{"value comma", Cookie{Name: "a", Value: "1,2"}},
+		{"value semicolon", Cookie{Name: "a", Value: "1;Secure"}},
+		// Test: Control characters are not allowed in paths
+		{"path", Cookie{Name: "a", Value: "1", Path: "/\r\nX-Injected: 1"}},
+		// Test: Domains must be host names
+		{"domain", Cookie{Name: "a", Value: "1", Domain: "exa mple.com"}},
+		// Test: SameSite=None and Partitioned require Secure
+		{"samesite none", Cookie{Name: "a", Value: "1", SameSite: SameSiteNone}},
+		{"partitioned", Cookie{Name: "a", Value: "1", Partitioned: true}},
+		// Test: Name prefixes constrain the attributes
+		{"secure prefix", Cookie{Name: "__Secure-a", Value: "1"}},
+		{"host prefix domain", Cookie{Name: "__Host-a", Value: "1", Secure: true, Path: "/", Domain: "example.com"}},
+		{"host prefix path", Cookie{Name: "__Host-a", Value: "1", Secure: true, Path: "/app"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.ErrorIs(t, tc.cookie.Valid(), ErrInvalid)
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	// Test: Several cookies in one header, in order
+	cookies := Parse("a=1; b=2;c=\"3\"")
+	assert.Equal(t, []*Cookie{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}, {Name: "c", Value: `"3"`}}, cookies)
+
+	// Test: Cookie headers joined with commas
+	cookies = Parse("a=1, b=2")
+	assert.Equal(t, []*Cookie{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, cookies)
+
+	// Test: Malformed pairs are skipped
+	cookies = Parse("a; =1; b=2 3; c=4")
+	assert.Equal(t, []*Cookie{{Name: "c", Value: "4"}}, cookies)
+}
+
+func TestParseSetCookie(t *testing.T) {
+	// Test: Attributes are case-insensitive and round trip
+	c, err := ParseSetCookie("id=a3fWa; expires=Wed, 21 Oct 2015 07:28:00 GMT; path=/; domain=.example.com; max-age=60; secure; httponly; samesite=strict; partitioned; unknown=1")
+	require.NoError(t, err)
+	assert.Equal(t, &Cookie{
+		Name:        "id",
+		Value:       "a3fWa",
+		Path:        "/",
+		Domain:      "example.com",
+		Expires:     time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC),
+		MaxAge:      60,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteStrict,
+		Partitioned: true,
+	}, c)
+
+	// Test: Max-Age of zero deletes the cookie
+	c, err = ParseSetCookie("id=; Max-Age=0")
+	require.NoError(t, err)
+	assert.Equal(t, -1, c.MaxAge)
+
+	// Test: A line without a name is rejected
+	_, err = ParseSetCookie("=1; Path=/")
+	require.ErrorIs(t, err, ErrInvalid)
+}
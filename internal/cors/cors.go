@@ -0,0 +1,199 @@
+// Package cors implements Cross-Origin Resource Sharing, which lets pages
+// from other origins call the server from a browser.
+package cors
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+)
+
+var (
+	// DefaultMethods are the methods allowed when Config.AllowedMethods is
+	// empty.
+	DefaultMethods = []string{"GET", "HEAD", "POST"}
+	// DefaultHeaders are the request headers allowed when
+	// Config.AllowedHeaders is empty.
+	DefaultHeaders = []string{"Accept", "Content-Type", "X-Requested-With"}
+)
+
+// Config configures the CORS middleware.
+type Config struct {
+	// AllowedOrigins lists the origins, such as "https://app.example.com",
+	// that may call the server. An entry may contain one "*" standing for
+	// any non-empty text, as in "https://*.example.com", and "*" alone
+	// allows every origin. Surrounding whitespace is ignored, as are empty
+	// entries, so a comma-separated list can be split as it is.
+	AllowedOrigins []string
+	// AllowedOriginPatterns allows origins the whole of which match one of
+	// the expressions.
+	AllowedOriginPatterns []*regexp.Regexp
+	// AllowedMethods lists the methods cross-origin requests may use.
+	AllowedMethods []string
+	// AllowedHeaders lists the request headers cross-origin requests may
+	// send. "*" allows any header.
+	AllowedHeaders []string
+	// ExposedHeaders lists the response headers, beyond the safelisted
+	// ones, that pages may read.
+	ExposedHeaders []string
+	// AllowCredentials lets requests include cookies and Authorization
+	// headers. The allowed origin is then always named, never "*".
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache the answer to a preflight
+	// request. Zero leaves it to the browser, a negative value disables
+	// caching.
+	MaxAge time.Duration
+}
+
+type cors struct {
+	cfg       Config
+	allowAll  bool
+	origins   []string
+	wildcards [][2]string
+}
+
+// Handler returns a handler that adds CORS headers to the responses of
+// next for allowed origins and answers preflight requests itself with 204
+// No Content. Every response varies by Origin, so that caches keep them
+// apart.
+func Handler(cfg Config, next server.Handler) server.Handler {
+	if len(cfg.AllowedMethods) == 0 {
+		cfg.AllowedMethods = DefaultMethods
+	}
+	if len(cfg.AllowedHeaders) == 0 {
+		cfg.AllowedHeaders = DefaultHeaders
+	}
+	c := &cors{cfg: cfg}
+	for _, origin := range cfg.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+		switch {
+		case origin == "":
+		case origin == "*":
+			c.allowAll = true
+		case strings.Contains(origin, "*"):
+			prefix, suffix, _ := strings.Cut(origin, "*")
+			c.wildcards = append(c.wildcards, [2]string{prefix, suffix})
+		default:
+			c.origins = append(c.origins, origin)
+		}
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		origin := req.Headers.Get("origin")
+		if req.RequestLine.Method == "OPTIONS" && origin != "" && req.Headers.Get("access-control-request-method") != "" {
+			c.preflight(w, req, origin)
+			return
+		}
+		w.OnWriteHeaders(func(h headers.Headers) {
+			addVary(h, "Origin")
+			if origin == "" || !c.allowed(origin) {
+				return
+			}
+			c.allowOrigin(h, origin)
+			if len(c.cfg.ExposedHeaders) > 0 {
+				h.Override("Access-Control-Expose-Headers", strings.Join(c.cfg.ExposedHeaders, ", "))
+			}
+		})
+		next(w, req)
+	}
+}
+
+// preflight answers the OPTIONS request a browser sends before a
+// cross-origin request that is not simple. A request that is not allowed
+// gets no CORS headers, which makes the browser refuse to send it.
+func (c *cors) preflight(w *response.Writer, req *request.Request, origin string) {
+	h := headers.NewHeaders()
+	h.Set("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+
+	method := req.Headers.Get("access-control-request-method")
+	requested := splitList(req.Headers.Get("access-control-request-headers"))
+	if c.allowed(origin) && slices.Contains(c.cfg.AllowedMethods, method) && c.headersAllowed(requested) {
+		c.allowOrigin(h, origin)
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.cfg.AllowedMethods, ", "))
+		if len(requested) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+		}
+		if c.cfg.MaxAge != 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(max(int(c.cfg.MaxAge/time.Second), 0)))
+		}
+	}
+
+	w.WriteStatusLine(response.StatusCodeNoContent)
+	w.WriteHeaders(h)
+}
+
+// allowOrigin adds the headers that allow origin to read the response.
+func (c *cors) allowOrigin(h headers.Headers, origin string) {
+	if c.allowAll && !c.cfg.AllowCredentials {
+		h.Override("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Override("Access-Control-Allow-Origin", origin)
+	}
+	if c.cfg.AllowCredentials {
+		h.Override("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// allowed reports whether origin may call the server.
+func (c *cors) allowed(origin string) bool {
+	if c.allowAll {
+		return true
+	}
+	lower := strings.ToLower(origin)
+	if slices.Contains(c.origins, lower) {
+		return true
+	}
+	for _, w := range c.wildcards {
+		prefix, suffix := w[0], w[1]
+		if len(lower) > len(prefix)+len(suffix) && strings.HasPrefix(lower, prefix) && strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	for _, re := range c.cfg.AllowedOriginPatterns {
+		if loc := re.FindStringIndex(origin); loc != nil && loc[0] == 0 && loc[1] == len(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// headersAllowed reports whether every requested header is allowed.
+func (c *cors) headersAllowed(requested []string) bool {
+	if slices.Contains(c.cfg.AllowedHeaders, "*") {
+		return true
+	}
+	for _, name := range requested {
+		if !slices.ContainsFunc(c.cfg.AllowedHeaders, func(allowed string) bool {
+			return strings.EqualFold(allowed, name)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// addVary adds name to the Vary header unless it is already listed.
+func addVary(h headers.Headers, name string) {
+	if !h.HasToken("vary", name) && !h.HasToken("vary", "*") {
+		h.Set("Vary", name)
+	}
+}
+
+// splitList splits a comma-separated header value, dropping empty
+// elements.
+func splitList(value string) []string {
+	var out []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, strings.ToLower(v))
+		}
+	}
+	return out
+}
@@ -0,0 +1,154 @@
+package cors
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/handlertest"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+)
+
+// ok answers every request with a short body and its own Vary header.
+func ok(w *response.Writer, _ *request.Request) {
+	body := []byte("ok")
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Vary", "Accept-Encoding")
+	w.WriteStatusLine(response.StatusCodeSuccess)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func TestOrigins(t *testing.T) {
+	h := Handler(Config{
+		AllowedOrigins:        []string{"https://app.example.com", "https://*.example.org"},
+		AllowedOriginPatterns: []*regexp.Regexp{regexp.MustCompile(`https://pr-\d+\.preview\.dev`)},
+		ExposedHeaders:        []string{"X-Request-Id"},
+	}, ok)
+
+	tests := []struct {
+		name    string
+		origin  string
+		allowed bool
+	}{
+		// Test: Exact origins, case-insensitively
+		{"exact", "https://app.example.com", true},
+		{"exact case", "https://APP.example.com", true},
+		{"other scheme", "http://app.example.com", false},
+		// Test: Wildcards need something in place of the star
+		{"wildcard", "https://api.example.org", true},
+		{"wildcard nested", "https://a.b.example.org", true},
+		{"wildcard empty", "https://.example.org", false},
+		{"wildcard apex", "https://example.org", false},
+		{"wildcard suffix", "https://evil-example.org", false},
+		// Test: Patterns must match the whole origin
+		{"pattern", "https://pr-42.preview.dev", true},
+		{"pattern prefix", "https://pr-42.preview.dev.evil.com", false},
+		{"pattern inside", "https://evil.com/https://pr-42.preview.dev", false},
+		// Test: Unknown origins
+		{"unknown", "https://evil.com", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := handlertest.Do(t, h, handlertest.NewRequest(t, "GET", "/api", "Origin: "+tc.origin))
+			assert.Equal(t, 200, resp.StatusCode)
+			assert.Equal(t, "Accept-Encoding, Origin", resp.Header.Get("Vary"))
+			if tc.allowed {
+				assert.Equal(t, tc.origin, resp.Header.Get("Access-Control-Allow-Origin"))
+				assert.Equal(t, "X-Request-Id", resp.Header.Get("Access-Control-Expose-Headers"))
+			} else {
+				assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+				assert.Empty(t, resp.Header.Get("Access-Control-Expose-Headers"))
+			}
+		})
+	}
+
+	// Test: Same-origin requests without Origin still vary by it
+	resp := handlertest.Do(t, h, handlertest.NewRequest(t, "GET", "/api"))
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Accept-Encoding, Origin", resp.Header.Get("Vary"))
+
+	// Test: Origins split from a list are trimmed, and empty ones allow
+	// nothing
+	h = Handler(Config{AllowedOrigins: strings.Split("https://app.example.com, ,https://b.example.com ,", ",")}, ok)
+	for origin, allowed := range map[string]bool{"https://app.example.com": true, "https://b.example.com": true, "null": false} {
+		resp = handlertest.Do(t, h, handlertest.NewRequest(t, "GET", "/api", "Origin: "+origin))
+		if allowed {
+			assert.Equal(t, origin, resp.Header.Get("Access-Control-Allow-Origin"))
+		} else {
+			assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+		}
+	}
+}
+
+func TestAllowAll(t *testing.T) {
+	// Test: Any origin gets "*"
+	h := Handler(Config{AllowedOrigins: []string{"*"}}, ok)
+	resp := handlertest.Do(t, h, handlertest.NewRequest(t, "GET", "/api", "Origin: https://anywhere.com"))
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Credentials"))
+
+	// Test: With credentials the origin is named instead
+	h = Handler(Config{AllowedOrigins: []string{"*"}, AllowCredentials: true}, ok)
+	resp = handlertest.Do(t, h, handlertest.NewRequest(t, "GET", "/api", "Origin: https://anywhere.com"))
+	assert.Equal(t, "https://anywhere.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+}
+
+func TestPreflight(t *testing.T) {
+	h := Handler(Config{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowedMethods:   []string{"GET", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}, func(w *response.Writer, req *request.Request) {
+		t.Error("preflight reached the handler")
+	})
+
+	// Test: Allowed preflight
+	resp := handlertest.Do(t, h, handlertest.NewRequest(t, "OPTIONS", "/api",
+		"Origin: https://app.example.com",
+		"Access-Control-Request-Method: PUT",
+		"Access-Control-Request-Headers: content-type, Authorization"))
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, PUT, DELETE", resp.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "content-type, authorization", resp.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "600", resp.Header.Get("Access-Control-Max-Age"))
+	assert.Equal(t, "Origin, Access-Control-Request-Method, Access-Control-Request-Headers", resp.Header.Get("Vary"))
+	assert.Zero(t, resp.ContentLength)
+
+	// Test: Refused preflights get no CORS headers
+	refused := map[string][]string{
+		"origin":  {"Origin: https://evil.com", "Access-Control-Request-Method: PUT"},
+		"method":  {"Origin: https://app.example.com", "Access-Control-Request-Method: PATCH"},
+		"headers": {"Origin: https://app.example.com", "Access-Control-Request-Method: PUT", "Access-Control-Request-Headers: X-Secret"},
+	}
+	for name, hdrs := range refused {
+		t.Run(name, func(t *testing.T) {
+			resp := handlertest.Do(t, h, handlertest.NewRequest(t, "OPTIONS", "/api", hdrs...))
+			assert.Equal(t, 204, resp.StatusCode)
+			assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+			assert.Empty(t, resp.Header.Get("Access-Control-Allow-Methods"))
+		})
+	}
+
+	// Test: Any header is allowed with "*", and negative MaxAge disables caching
+	h = Handler(Config{AllowedOrigins: []string{"https://app.example.com"}, AllowedHeaders: []string{"*"}, MaxAge: -1}, ok)
+	resp = handlertest.Do(t, h, handlertest.NewRequest(t, "OPTIONS", "/api",
+		"Origin: https://app.example.com",
+		"Access-Control-Request-Method: POST",
+		"Access-Control-Request-Headers: X-Anything"))
+	assert.Equal(t, "x-anything", resp.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "0", resp.Header.Get("Access-Control-Max-Age"))
+
+	// Test: OPTIONS without a preflight reaches the handler
+	resp = handlertest.Do(t, h, handlertest.NewRequest(t, "OPTIONS", "/api", "Origin: https://app.example.com"))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,60 @@
+// Package handlertest runs handlers in tests without a server or a
+// connection, the way net/http/httptest does for net/http.
+package handlertest
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+// NewRequest parses an HTTP/1.1 request for target with a Host header and
+// the given header lines, each without its CRLF, such as
+// "X-Request-ID: abc-123".
+func NewRequest(t testing.TB, method, target string, headerLines ...string) *request.Request {
+	t.Helper()
+	raw := method + " " + target + " HTTP/1.1\r\nHost: localhost:42069\r\n"
+	for _, line := range headerLines {
+		raw += line + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+// Record runs h for req and returns the response it wrote as it would have
+// been sent, which is empty if it wrote nothing.
+func Record(h server.Handler, req *request.Request) string {
+	var buf strings.Builder
+	h(response.NewWriter(&buf), req)
+	return buf.String()
+}
+
+// Do runs h for req and returns the response it wrote.
+func Do(t testing.TB, h server.Handler, req *request.Request) *http.Response {
+	t.Helper()
+	return ReadResponse(t, Record(h, req))
+}
+
+// ReadResponse parses a response that Record returned.
+func ReadResponse(t testing.TB, raw string) *http.Response {
+	t.Helper()
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), nil)
+	require.NoError(t, err)
+	return resp
+}
+
+// Body reads the body of resp.
+func Body(t testing.TB, resp *http.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
@@ -2,6 +2,7 @@ package headers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -32,6 +33,9 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 
 	// Split the header line into key and value at the first colon
 	parts := bytes.SplitN(data[:idx], []byte(":"), 2)
+	if len(parts) != 2 {
+		return 0, false, fmt.Errorf("malformed header line: %s", data[:idx])
+	}
 	key := strings.ToLower(string(parts[0])) // Convert the key to lowercase
 
 	// Check for invalid header name (trailing spaces)
@@ -81,6 +85,71 @@ func (h Headers) Override(key, value string) {
 	h[key] = value
 }
 
+// HasToken reports whether the comma-separated header value for the given key
+// contains the given token, compared case-insensitively. It is used for list
+// headers such as Connection, where "Connection: keep-alive, Upgrade" contains
+// both the "keep-alive" and "upgrade" tokens.
+func (h Headers) HasToken(key, token string) bool {
+	for _, v := range strings.Split(h.Get(key), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete removes the header for the given key, keeping case insensitivity in mind
+func (h Headers) Delete(key string) {
+	delete(h, strings.ToLower(key))
+}
+
+// Clone returns a copy of the headers that can be changed independently
+func (h Headers) Clone() Headers {
+	out := NewHeaders()
+	for k, v := range h {
+		out[k] = v
+	}
+	return out
+}
+
+// ErrInvalidField is returned for a header field that cannot be written as
+// it is: its name is not a token, or its value contains control characters
+// such as CR and LF, which would end the line early and let the rest of the
+// value add fields of its own or split the message.
+var ErrInvalidField = errors.New("invalid header field")
+
+// ValidName reports whether name can be the name of a header field, which
+// is a token (RFC 9110 section 5.1).
+func ValidName(name string) bool {
+	return name != "" && validTokens([]byte(name))
+}
+
+// ValidValue reports whether value can be the value of a header field
+// (RFC 9110 section 5.5): visible ASCII, spaces and horizontal tabs, and
+// bytes above 0x7f, but no other control characters.
+func ValidValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that every field can be written as it is, returning an
+// error wrapping ErrInvalidField for the first one that cannot.
+func (h Headers) Validate() error {
+	for k, v := range h {
+		if !ValidName(k) {
+			return fmt.Errorf("%w: name %q", ErrInvalidField, k)
+		}
+		if !ValidValue(v) {
+			return fmt.Errorf("%w: value of %s: %q", ErrInvalidField, k, v)
+		}
+	}
+	return nil
+}
+
 // tokenChars contains valid characters for HTTP header tokens
 var tokenChars = []byte{'!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~'}
 
@@ -64,4 +64,82 @@ func TestHeadersParse(t *testing.T) {
 	require.Error(t, err)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
+
+	// Test: Missing colon
+	headers = NewHeaders()
+	data = []byte("Host\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.Error(t, err)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+}
+
+func TestHeadersHasToken(t *testing.T) {
+	// Test: Single token
+	headers := NewHeaders()
+	headers.Set("Connection", "close")
+	assert.True(t, headers.HasToken("connection", "close"))
+	assert.False(t, headers.HasToken("connection", "keep-alive"))
+
+	// Test: Token list with mixed case and whitespace
+	headers = NewHeaders()
+	headers.Set("Connection", "Keep-Alive ,  Upgrade")
+	assert.True(t, headers.HasToken("Connection", "keep-alive"))
+	assert.True(t, headers.HasToken("Connection", "upgrade"))
+
+	// Test: Tokens from repeated headers
+	headers = NewHeaders()
+	headers.Set("Connection", "upgrade")
+	headers.Set("Connection", "close")
+	assert.True(t, headers.HasToken("connection", "close"))
+
+	// Test: Missing header
+	headers = NewHeaders()
+	assert.False(t, headers.HasToken("connection", "close"))
+}
+
+func TestHeadersClone(t *testing.T) {
+	// Test: Changes to the copy leave the original untouched
+	headers := NewHeaders()
+	headers.Set("Vary", "Accept")
+	clone := headers.Clone()
+	clone.Set("Vary", "Origin")
+	clone.Set("X-Extra", "1")
+	assert.Equal(t, "Accept", headers.Get("vary"))
+	assert.Equal(t, "Accept, Origin", clone.Get("vary"))
+	assert.Len(t, headers, 1)
+
+	// Test: Cloning nil headers gives usable headers
+	clone = Headers(nil).Clone()
+	clone.Set("X-Extra", "1")
+	assert.Equal(t, "1", clone.Get("x-extra"))
+}
+
+func TestHeadersValidate(t *testing.T) {
+	// Test: Tokens are valid names, and visible characters, spaces, tabs and
+	// obs-text valid values
+	headers := NewHeaders()
+	headers.Set("X-Custom_Header!", "a value\twith tabs, \"quotes\" and caf\xc3\xa9")
+	headers.Set("X-Empty", "")
+	require.NoError(t, headers.Validate())
+	assert.True(t, ValidName("content-type"))
+	assert.True(t, ValidValue("text/html; charset=utf-8"))
+
+	// Test: Names that are not tokens are rejected
+	for _, name := range []string{"", "x header", "x:header", "x\r\nheader", "x\"header"} {
+		assert.False(t, ValidName(name), name)
+		err := Headers{name: "v"}.Validate()
+		assert.ErrorIs(t, err, ErrInvalidField, name)
+	}
+
+	// Test: Values with control characters, which could inject fields or
+	// split the message, are rejected
+	for _, value := range []string{"a\r\nSet-Cookie: x=1", "a\rb", "a\nb", "a\x00b", "a\x7fb", "a\x1bb"} {
+		assert.False(t, ValidValue(value), value)
+		err := Headers{"x-header": value}.Validate()
+		assert.ErrorIs(t, err, ErrInvalidField, value)
+	}
+
+	// Test: Nil headers are valid
+	assert.NoError(t, Headers(nil).Validate())
 }
@@ -0,0 +1,164 @@
+package hpack
+
+import (
+	"fmt"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+)
+
+// Decoder decodes header blocks. It keeps the dynamic table across blocks,
+// so every block sent by one encoder must pass through the same decoder in
+// order.
+type Decoder struct {
+	table dynamicTable
+	// maxTableSize is the table size the encoder was allowed. It may shrink
+	// the table below it with a size update, but not grow it.
+	maxTableSize uint32
+	// maxHeaderListSize limits the total size of the fields in a block. Zero
+	// means no limit.
+	maxHeaderListSize uint32
+}
+
+// NewDecoder returns a decoder whose dynamic table starts at, and may not
+// grow beyond, maxTableSize bytes. The encoder must start with the same
+// table size.
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{
+		table:        dynamicTable{maxSize: maxTableSize},
+		maxTableSize: maxTableSize,
+	}
+}
+
+// SetMaxTableSize changes the limit on the table size, for example after
+// advertising a new SETTINGS_HEADER_TABLE_SIZE. The encoder is expected to
+// follow with a table size update.
+func (d *Decoder) SetMaxTableSize(n uint32) {
+	d.maxTableSize = n
+	if d.table.maxSize > n {
+		d.table.setMaxSize(n)
+	}
+}
+
+// SetMaxHeaderListSize limits the total size of the fields in a block, as
+// counted by HeaderField.Size. Zero means no limit.
+func (d *Decoder) SetMaxHeaderListSize(n uint32) {
+	d.maxHeaderListSize = n
+}
+
+// Decode decodes a complete header block into its fields.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var (
+		fields   []HeaderField
+		listSize uint32
+		tooLarge bool
+	)
+	for len(block) > 0 {
+		b := block[0]
+		var (
+			f   HeaderField
+			err error
+		)
+		switch {
+		case b&0x80 != 0:
+			// Indexed header field (section 6.1)
+			var i uint64
+			i, block, err = readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			f, ok = d.table.field(i)
+			if !ok {
+				return nil, fmt.Errorf("%w: index %d out of range", ErrCompression, i)
+			}
+		case b&0xC0 == 0x40:
+			// Literal with incremental indexing (section 6.2.1)
+			f, block, err = d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.table.add(f)
+		case b&0xE0 == 0x20:
+			// Dynamic table size update (section 6.3). It may only appear
+			// at the start of a block.
+			if len(fields) > 0 || listSize > 0 {
+				return nil, fmt.Errorf("%w: table size update after a field", ErrCompression)
+			}
+			var size uint64
+			size, block, err = readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.maxTableSize) {
+				return nil, fmt.Errorf("%w: table size %d above limit", ErrCompression, size)
+			}
+			d.table.setMaxSize(uint32(size))
+			continue
+		default:
+			// Literal without indexing (section 6.2.2) or never indexed
+			// (section 6.2.3)
+			sensitive := b&0xF0 == 0x10
+			f, block, err = d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			f.Sensitive = sensitive
+		}
+
+		// A block that is too large is still decoded to the end, so that the
+		// dynamic table stays in step with the encoder.
+		listSize += f.Size()
+		if d.maxHeaderListSize > 0 && listSize > d.maxHeaderListSize {
+			tooLarge = true
+		}
+		if !tooLarge {
+			fields = append(fields, f)
+		}
+	}
+	if tooLarge {
+		return nil, ErrHeaderListTooLarge
+	}
+	return fields, nil
+}
+
+// DecodeHeaders decodes a header block into Headers. Pseudo-headers are
+// kept under their own names, and repeated fields are joined as by
+// Headers.Set.
+func (d *Decoder) DecodeHeaders(block []byte) (headers.Headers, error) {
+	fields, err := d.Decode(block)
+	if err != nil {
+		return nil, err
+	}
+	h := headers.NewHeaders()
+	for _, f := range fields {
+		h.Set(f.Name, f.Value)
+	}
+	return h, nil
+}
+
+// readLiteral reads a literal field whose name is either indexed with an
+// n-bit prefix or, if the index is zero, follows as a string.
+func (d *Decoder) readLiteral(block []byte, n uint8) (HeaderField, []byte, error) {
+	i, block, err := readInt(block, n)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	var f HeaderField
+	if i == 0 {
+		f.Name, block, err = readString(block)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+	} else {
+		named, ok := d.table.field(i)
+		if !ok {
+			return HeaderField{}, nil, fmt.Errorf("%w: index %d out of range", ErrCompression, i)
+		}
+		f.Name = named.Name
+	}
+	f.Value, block, err = readString(block)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	return f, block, nil
+}
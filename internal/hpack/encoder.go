@@ -0,0 +1,99 @@
+package hpack
+
+import (
+	"sort"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+)
+
+// sensitiveHeaders are the headers EncodeHeaders sends as never-indexed
+// literals. Credentials in a shared table could be recovered by an
+// attacker who can inject headers and observe the compressed size.
+var sensitiveHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+}
+
+// Encoder encodes header blocks. Like a Decoder it keeps the dynamic table
+// across blocks, so every block it produces must reach the peer's decoder,
+// in order.
+type Encoder struct {
+	table dynamicTable
+	// sizeChanged is set when the table size has changed since the last
+	// block, and minSize is the smallest size it had in the meantime. Both
+	// have to be signaled at the start of the next block.
+	sizeChanged bool
+	minSize     uint32
+
+	// DisableHuffman sends every string literal as is, even when Huffman
+	// coding would make it shorter.
+	DisableHuffman bool
+}
+
+// NewEncoder returns an encoder whose dynamic table starts at tableSize
+// bytes. The peer's decoder must start with the same table size.
+func NewEncoder(tableSize uint32) *Encoder {
+	return &Encoder{table: dynamicTable{maxSize: tableSize}}
+}
+
+// SetMaxTableSize changes the size of the dynamic table, for example to
+// follow the peer's SETTINGS_HEADER_TABLE_SIZE. The change is signaled at
+// the start of the next block.
+func (e *Encoder) SetMaxTableSize(n uint32) {
+	if !e.sizeChanged || n < e.minSize {
+		e.minSize = n
+	}
+	e.sizeChanged = true
+	e.table.setMaxSize(n)
+}
+
+// Encode encodes fields into a header block. Fields already in the static
+// or dynamic table are sent as an index, sensitive fields as never-indexed
+// literals, and all others as literals added to the dynamic table.
+func (e *Encoder) Encode(fields []HeaderField) []byte {
+	var block []byte
+	if e.sizeChanged {
+		// A shrink followed by a grow must show the peer both sizes, so
+		// that it evicts the same entries (RFC 7541 section 4.2).
+		if e.minSize < e.table.maxSize {
+			block = appendInt(block, 0x20, 5, uint64(e.minSize))
+		}
+		block = appendInt(block, 0x20, 5, uint64(e.table.maxSize))
+		e.sizeChanged = false
+	}
+
+	for _, f := range fields {
+		index, exact := e.table.search(f)
+		switch {
+		case exact && !f.Sensitive:
+			block = appendInt(block, 0x80, 7, index)
+			continue
+		case f.Sensitive:
+			block = appendInt(block, 0x10, 4, index)
+		default:
+			block = appendInt(block, 0x40, 6, index)
+			e.table.add(f)
+		}
+		if index == 0 {
+			block = appendString(block, f.Name, !e.DisableHuffman)
+		}
+		block = appendString(block, f.Value, !e.DisableHuffman)
+	}
+	return block
+}
+
+// EncodeHeaders encodes h into a header block, in the order of the header
+// names. Credentials such as Authorization are marked sensitive.
+func (e *Encoder) EncodeHeaders(h headers.Headers) []byte {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]HeaderField, 0, len(names))
+	for _, name := range names {
+		fields = append(fields, HeaderField{Name: name, Value: h[name], Sensitive: sensitiveHeaders[name]})
+	}
+	return e.Encode(fields)
+}
@@ -0,0 +1,261 @@
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCompression is returned when a header block cannot be decoded. The
+// decoder state is then unknown, so the connection that carried the block
+// cannot be used any further.
+var ErrCompression = errors.New("hpack: invalid header block")
+
+// ErrHeaderListTooLarge is returned when a header block decodes to more
+// than the decoder's header list size limit. Unlike ErrCompression, the
+// decoder is still in step with the encoder.
+var ErrHeaderListTooLarge = errors.New("hpack: header list too large")
+
+// HeaderField is a single header, or pseudo-header such as ":path". A
+// sensitive field is sent as a never-indexed literal, so that neither the
+// encoder nor any intermediary compresses it.
+type HeaderField struct {
+	Name, Value string
+	Sensitive   bool
+}
+
+// Size is the size of the field as counted against the dynamic table and
+// the header list size limit, as defined in RFC 7541 section 4.1.
+func (f HeaderField) Size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+// staticTable is the static table of RFC 7541 Appendix A. Index 1 is the
+// first entry.
+var staticTable = [...]HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// dynamicTable is the FIFO table of recently indexed fields. The newest
+// entry is at the end of entries but has the lowest index.
+type dynamicTable struct {
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+// add inserts a field, evicting the oldest entries to make room. A field
+// larger than the whole table empties it.
+func (t *dynamicTable) add(f HeaderField) {
+	f.Sensitive = false
+	t.evict(t.maxSize - min(f.Size(), t.maxSize))
+	if f.Size() > t.maxSize {
+		return
+	}
+	t.entries = append(t.entries, f)
+	t.size += f.Size()
+}
+
+// setMaxSize changes the size of the table, evicting entries that no longer
+// fit.
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict(n)
+}
+
+// evict removes the oldest entries until the table is at most size bytes.
+func (t *dynamicTable) evict(size uint32) {
+	n := 0
+	for t.size > size {
+		t.size -= t.entries[n].Size()
+		n++
+	}
+	t.entries = t.entries[n:]
+}
+
+// field returns the field at an index of the combined static and dynamic
+// index space.
+func (t *dynamicTable) field(i uint64) (HeaderField, bool) {
+	if i == 0 {
+		return HeaderField{}, false
+	}
+	if i <= uint64(len(staticTable)) {
+		return staticTable[i-1], true
+	}
+	i -= uint64(len(staticTable))
+	if i > uint64(len(t.entries)) {
+		return HeaderField{}, false
+	}
+	return t.entries[uint64(len(t.entries))-i], true
+}
+
+// search looks a field up in the static table and then the dynamic table.
+// It returns the index of an entry with the same name and value if there
+// is one, and otherwise the index of an entry with the same name, or zero.
+func (t *dynamicTable) search(f HeaderField) (index uint64, exact bool) {
+	for i, s := range staticTable {
+		if s.Name != f.Name {
+			continue
+		}
+		if index == 0 {
+			index = uint64(i + 1)
+		}
+		if s.Value == f.Value {
+			return uint64(i + 1), true
+		}
+	}
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		e := t.entries[i]
+		if e.Name != f.Name {
+			continue
+		}
+		dynIndex := uint64(len(staticTable) + len(t.entries) - i)
+		if index == 0 {
+			index = dynIndex
+		}
+		if e.Value == f.Value {
+			return dynIndex, true
+		}
+	}
+	return index, false
+}
+
+// readInt decodes an integer with an n-bit prefix (RFC 7541 section 5.1).
+func readInt(block []byte, n uint8) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, fmt.Errorf("%w: truncated integer", ErrCompression)
+	}
+	mask := uint64(1)<<n - 1
+	v := uint64(block[0]) & mask
+	block = block[1:]
+	if v < mask {
+		return v, block, nil
+	}
+
+	for shift := uint(0); ; shift += 7 {
+		// Anything needing more than 32 bits is not a sensible length or
+		// index, and would eventually overflow.
+		if shift > 28 {
+			return 0, nil, fmt.Errorf("%w: integer too large", ErrCompression)
+		}
+		if len(block) == 0 {
+			return 0, nil, fmt.Errorf("%w: truncated integer", ErrCompression)
+		}
+		b := block[0]
+		block = block[1:]
+		v += uint64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return v, block, nil
+		}
+	}
+}
+
+// appendInt encodes an integer with an n-bit prefix, keeping the bits above
+// the prefix of the first byte set to first.
+func appendInt(dst []byte, first byte, n uint8, v uint64) []byte {
+	mask := uint64(1)<<n - 1
+	if v < mask {
+		return append(dst, first|byte(v))
+	}
+	dst = append(dst, first|byte(mask))
+	v -= mask
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+// readString decodes a string literal (RFC 7541 section 5.2).
+func readString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrCompression)
+	}
+	huffman := block[0]&0x80 != 0
+	length, block, err := readInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(block)) < length {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrCompression)
+	}
+	raw, block := block[:length], block[length:]
+	if !huffman {
+		return string(raw), block, nil
+	}
+	s, err := HuffmanDecode(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, block, nil
+}
+
+// appendString encodes a string literal, Huffman-coded if that is no longer
+// and huffman is set.
+func appendString(dst []byte, s string, huffman bool) []byte {
+	if n := HuffmanEncodedLen(s); huffman && n <= len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return AppendHuffmanString(dst, s)
+	}
+	dst = appendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
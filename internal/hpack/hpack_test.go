@@ -0,0 +1,304 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+// step is one header block of an RFC 7541 Appendix C sequence, with the
+// dynamic table expected after it, newest entry first.
+type step struct {
+	block     string
+	fields    []HeaderField
+	table     []HeaderField
+	tableSize uint32
+}
+
+// runSequence decodes and encodes the blocks of a sequence in order, each
+// with one decoder or encoder, as a connection would.
+func runSequence(t *testing.T, tableSize uint32, huffman bool, steps []step) {
+	t.Helper()
+	d := NewDecoder(tableSize)
+	e := NewEncoder(tableSize)
+	e.DisableHuffman = !huffman
+	for i, s := range steps {
+		fields, err := d.Decode(mustHex(t, s.block))
+		require.NoError(t, err, "block %d", i+1)
+		assert.Equal(t, s.fields, fields, "block %d", i+1)
+		assert.Equal(t, s.tableSize, d.table.size, "block %d", i+1)
+		assert.Equal(t, s.table, newestFirst(d.table.entries), "block %d", i+1)
+
+		assert.Equal(t, s.block, spacedHex(e.Encode(s.fields)), "block %d", i+1)
+		assert.Equal(t, s.tableSize, e.table.size, "block %d", i+1)
+	}
+}
+
+func newestFirst(entries []HeaderField) []HeaderField {
+	out := make([]HeaderField, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		out = append(out, entries[i])
+	}
+	return out
+}
+
+// spacedHex formats b in groups of two bytes, as the RFC does.
+func spacedHex(b []byte) string {
+	s := hex.EncodeToString(b)
+	var groups []string
+	for len(s) > 4 {
+		groups = append(groups, s[:4])
+		s = s[4:]
+	}
+	return strings.Join(append(groups, s), " ")
+}
+
+func TestIntegers(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   uint64
+		prefix  uint8
+		encoded []byte
+	}{
+		// Test: RFC 7541 C.1.1, 10 with a 5-bit prefix
+		{"C.1.1", 10, 5, []byte{0x0a}},
+		// Test: RFC 7541 C.1.2, 1337 with a 5-bit prefix
+		{"C.1.2", 1337, 5, []byte{0x1f, 0x9a, 0x0a}},
+		// Test: RFC 7541 C.1.3, 42 starting at an octet boundary
+		{"C.1.3", 42, 8, []byte{0x2a}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.encoded, appendInt(nil, 0, tc.prefix, tc.value))
+			v, rest, err := readInt(tc.encoded, tc.prefix)
+			require.NoError(t, err)
+			assert.Equal(t, tc.value, v)
+			assert.Empty(t, rest)
+		})
+	}
+
+	// Test: Integers that would not fit in 32 bits are rejected
+	_, _, err := readInt([]byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 5)
+	require.ErrorIs(t, err, ErrCompression)
+}
+
+func TestFieldRepresentations(t *testing.T) {
+	tests := []struct {
+		name      string
+		block     string
+		field     HeaderField
+		tableSize uint32
+	}{
+		// Test: RFC 7541 C.2.1, literal with indexing
+		{"C.2.1", "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572",
+			HeaderField{Name: "custom-key", Value: "custom-header"}, 55},
+		// Test: RFC 7541 C.2.2, literal without indexing
+		{"C.2.2", "040c 2f73 616d 706c 652f 7061 7468",
+			HeaderField{Name: ":path", Value: "/sample/path"}, 0},
+		// Test: RFC 7541 C.2.3, never-indexed literal
+		{"C.2.3", "1008 7061 7373 776f 7264 0673 6563 7265 74",
+			HeaderField{Name: "password", Value: "secret", Sensitive: true}, 0},
+		// Test: RFC 7541 C.2.4, indexed field
+		{"C.2.4", "82",
+			HeaderField{Name: ":method", Value: "GET"}, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewDecoder(4096)
+			fields, err := d.Decode(mustHex(t, tc.block))
+			require.NoError(t, err)
+			assert.Equal(t, []HeaderField{tc.field}, fields)
+			assert.Equal(t, tc.tableSize, d.table.size)
+		})
+	}
+
+	// Test: The encoder produces C.2.1, C.2.3 and C.2.4 for the same fields
+	e := NewEncoder(4096)
+	e.DisableHuffman = true
+	assert.Equal(t, tests[0].block, spacedHex(e.Encode([]HeaderField{tests[0].field})))
+	assert.Equal(t, tests[2].block, spacedHex(e.Encode([]HeaderField{tests[2].field})))
+	assert.Equal(t, tests[3].block, spacedHex(e.Encode([]HeaderField{tests[3].field})))
+}
+
+var (
+	request1 = []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	}
+	request2 = append(request1[:4:4], HeaderField{Name: "cache-control", Value: "no-cache"})
+	request3 = []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: "/index.html"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "custom-key", Value: "custom-value"},
+	}
+	requestTables = [][]HeaderField{
+		{{Name: ":authority", Value: "www.example.com"}},
+		{{Name: "cache-control", Value: "no-cache"}, {Name: ":authority", Value: "www.example.com"}},
+		{{Name: "custom-key", Value: "custom-value"}, {Name: "cache-control", Value: "no-cache"}, {Name: ":authority", Value: "www.example.com"}},
+	}
+)
+
+func TestRequestSequences(t *testing.T) {
+	// Test: RFC 7541 C.3, requests without Huffman coding
+	t.Run("C.3", func(t *testing.T) {
+		runSequence(t, 4096, false, []step{
+			{"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", request1, requestTables[0], 57},
+			{"8286 84be 5808 6e6f 2d63 6163 6865", request2, requestTables[1], 110},
+			{"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65", request3, requestTables[2], 164},
+		})
+	})
+
+	// Test: RFC 7541 C.4, the same requests with Huffman coding
+	t.Run("C.4", func(t *testing.T) {
+		runSequence(t, 4096, true, []step{
+			{"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff", request1, requestTables[0], 57},
+			{"8286 84be 5886 a8eb 1064 9cbf", request2, requestTables[1], 110},
+			{"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf", request3, requestTables[2], 164},
+		})
+	})
+}
+
+var (
+	date1     = HeaderField{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"}
+	date2     = HeaderField{Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"}
+	location  = HeaderField{Name: "location", Value: "https://www.example.com"}
+	private   = HeaderField{Name: "cache-control", Value: "private"}
+	gzip      = HeaderField{Name: "content-encoding", Value: "gzip"}
+	setCookie = HeaderField{Name: "set-cookie", Value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"}
+	status302 = HeaderField{Name: ":status", Value: "302"}
+	status307 = HeaderField{Name: ":status", Value: "307"}
+	status200 = HeaderField{Name: ":status", Value: "200"}
+
+	response1 = []HeaderField{status302, private, date1, location}
+	response2 = []HeaderField{status307, private, date1, location}
+	response3 = []HeaderField{status200, private, date2, location, gzip, setCookie}
+	// With a 256 byte table, each response evicts the oldest entries.
+	responseTables = [][]HeaderField{
+		{location, date1, private, status302},
+		{status307, location, date1, private},
+		{setCookie, gzip, date2},
+	}
+)
+
+func TestResponseSequences(t *testing.T) {
+	// Test: RFC 7541 C.5, responses without Huffman coding
+	t.Run("C.5", func(t *testing.T) {
+		runSequence(t, 256, false, []step{
+			{"4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+				response1, responseTables[0], 222},
+			{"4803 3330 37c1 c0bf", response2, responseTables[1], 222},
+			{"88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d 54c0 5a04 677a 6970 7738 666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 5541 5851 5745 4f49 553b 206d 6178 2d61 6765 3d33 3630 303b 2076 6572 7369 6f6e 3d31",
+				response3, responseTables[2], 215},
+		})
+	})
+
+	// Test: RFC 7541 C.6, the same responses with Huffman coding
+	t.Run("C.6", func(t *testing.T) {
+		runSequence(t, 256, true, []step{
+			{"4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3",
+				response1, responseTables[0], 222},
+			{"4883 640e ffc1 c0bf", response2, responseTables[1], 222},
+			{"88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07",
+				response3, responseTables[2], 215},
+		})
+	})
+}
+
+func TestTableSizeUpdates(t *testing.T) {
+	e := NewEncoder(4096)
+	d := NewDecoder(4096)
+	_, err := d.Decode(e.Encode(request1))
+	require.NoError(t, err)
+	require.Equal(t, uint32(57), d.table.size)
+
+	// Test: A shrink followed by a grow signals both sizes, so the decoder
+	// evicts what the encoder evicted
+	e.SetMaxTableSize(0)
+	e.SetMaxTableSize(1024)
+	block := e.Encode(nil)
+	assert.Equal(t, "203f e107", spacedHex(block))
+	_, err = d.Decode(block)
+	require.NoError(t, err)
+	assert.Empty(t, d.table.entries)
+	assert.Equal(t, uint32(1024), d.table.maxSize)
+
+	// Test: A size change is only signaled once
+	assert.Empty(t, e.Encode(nil))
+
+	// Test: A size above the decoder's limit is rejected
+	d.SetMaxTableSize(512)
+	_, err = d.Decode(mustHex(t, "3fe2 1f"))
+	require.ErrorIs(t, err, ErrCompression)
+
+	// Test: A size update after the first field is rejected
+	_, err = d.Decode(mustHex(t, "8220"))
+	require.ErrorIs(t, err, ErrCompression)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		block string
+	}{
+		// Test: Index zero is never valid
+		{"zero index", "80"},
+		// Test: Index beyond the static and dynamic tables
+		{"index out of range", "ff00"},
+		// Test: String longer than the block
+		{"truncated string", "4005 6162"},
+		// Test: Huffman padding that is not all ones
+		{"invalid padding", "0085 f2b2 4a84 00"},
+		// Test: Huffman padding longer than seven bits
+		{"padding too long", "0081 ff00"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewDecoder(4096).Decode(mustHex(t, tc.block))
+			require.ErrorIs(t, err, ErrCompression)
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Set("X-Custom", "value")
+	h.Set("Authorization", "Bearer secret")
+
+	// Test: Headers survive a round trip
+	e := NewEncoder(4096)
+	d := NewDecoder(4096)
+	decoded, err := d.DecodeHeaders(e.EncodeHeaders(h))
+	require.NoError(t, err)
+	assert.Equal(t, h, decoded)
+
+	// Test: Credentials are never indexed, everything else is
+	assert.Len(t, d.table.entries, 2)
+	fields, err := d.Decode(e.EncodeHeaders(h))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: "authorization", Value: "Bearer secret", Sensitive: true}, fields[0])
+
+	// Test: Header list size limit, with the table kept in step
+	d.SetMaxHeaderListSize(64)
+	_, err = d.Decode(e.Encode([]HeaderField{{Name: "x-large", Value: strings.Repeat("a", 64)}}))
+	require.ErrorIs(t, err, ErrHeaderListTooLarge)
+	d.SetMaxHeaderListSize(0)
+	fields, err = d.Decode(e.Encode([]HeaderField{{Name: "x-large", Value: strings.Repeat("a", 64)}}))
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a", 64), fields[0].Value)
+}
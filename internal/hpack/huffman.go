@@ -0,0 +1,93 @@
+package hpack
+
+import "fmt"
+
+// huffmanNode is a node of the tree used to decode Huffman-coded strings.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+	leaf     bool
+}
+
+// huffmanRoot is the root of the decoding tree built from huffmanCodes.
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{}
+	for sym, code := range huffmanCodes {
+		n := root
+		for i := int(huffmanCodeLens[sym]) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{}
+			}
+			n = n.children[bit]
+		}
+		n.sym = byte(sym)
+		n.leaf = true
+	}
+	return root
+}
+
+// HuffmanDecode decodes a Huffman-coded string. The string must end with
+// at most seven bits of padding, all set to one, and must not contain the
+// end-of-string symbol.
+func HuffmanDecode(src []byte) (string, error) {
+	out := make([]byte, 0, len(src)*8/5)
+	n := huffmanRoot
+	pending := 0
+	allOnes := true
+	for _, b := range src {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			n = n.children[bit]
+			if n == nil {
+				// Only the end-of-string symbol leads off the tree.
+				return "", fmt.Errorf("%w: invalid Huffman code", ErrCompression)
+			}
+			pending++
+			allOnes = allOnes && bit == 1
+			if n.leaf {
+				out = append(out, n.sym)
+				n = huffmanRoot
+				pending = 0
+				allOnes = true
+			}
+		}
+	}
+	if pending > 7 || !allOnes {
+		return "", fmt.Errorf("%w: invalid Huffman padding", ErrCompression)
+	}
+	return string(out), nil
+}
+
+// HuffmanEncodedLen returns the number of bytes AppendHuffmanString would
+// append for s.
+func HuffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLens[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+// AppendHuffmanString appends the Huffman coding of s to dst, padding the
+// last byte with the most significant bits of the end-of-string symbol.
+func AppendHuffmanString(dst []byte, s string) []byte {
+	var (
+		acc   uint64
+		nbits uint
+	)
+	for i := 0; i < len(s); i++ {
+		acc = acc<<huffmanCodeLens[s[i]] | uint64(huffmanCodes[s[i]])
+		nbits += uint(huffmanCodeLens[s[i]])
+		for nbits >= 8 {
+			nbits -= 8
+			dst = append(dst, byte(acc>>nbits))
+		}
+	}
+	if nbits > 0 {
+		dst = append(dst, byte(acc<<(8-nbits))|byte(0xFF>>nbits))
+	}
+	return dst
+}
@@ -0,0 +1,225 @@
+package http2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameType is the type of a frame, as defined in RFC 9113 section 6.
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+// Frame flags. Each is only meaningful for some frame types.
+const (
+	FlagEndStream  uint8 = 0x1
+	FlagAck        uint8 = 0x1
+	FlagEndHeaders uint8 = 0x4
+	FlagPadded     uint8 = 0x8
+	FlagPriority   uint8 = 0x20
+)
+
+const (
+	// frameHeaderLen is the size of the fixed header of every frame.
+	frameHeaderLen = 9
+	// minMaxFrameSize and maxMaxFrameSize bound SETTINGS_MAX_FRAME_SIZE.
+	minMaxFrameSize = 1 << 14
+	maxMaxFrameSize = 1<<24 - 1
+	// maxWindowSize is the largest allowed flow-control window.
+	maxWindowSize = 1<<31 - 1
+	// defaultWindowSize is the initial flow-control window of every stream
+	// and of the connection.
+	defaultWindowSize = 65535
+)
+
+// ErrCode is an error code sent in RST_STREAM and GOAWAY frames, as defined
+// in RFC 9113 section 7.
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+// ConnError is an error that ends the whole connection with a GOAWAY frame.
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnError) Error() string {
+	return fmt.Sprintf("http2: connection error %d: %s", e.Code, e.Reason)
+}
+
+// StreamError is an error that ends a single stream with a RST_STREAM frame.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %d: %s", e.StreamID, e.Code, e.Reason)
+}
+
+// Frame is a single HTTP/2 frame. The payload still contains any padding.
+type Frame struct {
+	Type     FrameType
+	Flags    uint8
+	StreamID uint32
+	Payload  []byte
+}
+
+// Has reports whether the flag is set on the frame.
+func (f Frame) Has(flag uint8) bool {
+	return f.Flags&flag != 0
+}
+
+// ReadFrame reads a single frame. Frames with a payload larger than
+// maxFrameSize are a connection error of type FRAME_SIZE_ERROR.
+func ReadFrame(r io.Reader, maxFrameSize uint32) (Frame, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, err
+	}
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	if length > maxFrameSize {
+		return Frame{}, ConnError{ErrCodeFrameSize, fmt.Sprintf("frame of %d bytes exceeds limit", length)}
+	}
+	f := Frame{
+		Type:     FrameType(header[3]),
+		Flags:    header[4],
+		StreamID: binary.BigEndian.Uint32(header[5:]) & 0x7FFFFFFF,
+		Payload:  make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	return f, nil
+}
+
+// WriteFrame writes a single frame.
+func WriteFrame(w io.Writer, f Frame) error {
+	buf := make([]byte, frameHeaderLen, frameHeaderLen+len(f.Payload))
+	buf[0] = byte(len(f.Payload) >> 16)
+	buf[1] = byte(len(f.Payload) >> 8)
+	buf[2] = byte(len(f.Payload))
+	buf[3] = byte(f.Type)
+	buf[4] = f.Flags
+	binary.BigEndian.PutUint32(buf[5:], f.StreamID&0x7FFFFFFF)
+	buf = append(buf, f.Payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// removePadding strips the padding of a DATA, HEADERS or PUSH_PROMISE frame
+// with the PADDED flag.
+func removePadding(f Frame) ([]byte, error) {
+	if !f.Has(FlagPadded) {
+		return f.Payload, nil
+	}
+	if len(f.Payload) == 0 {
+		return nil, ConnError{ErrCodeFrameSize, "padded frame without pad length"}
+	}
+	padLen := int(f.Payload[0])
+	if padLen >= len(f.Payload) {
+		return nil, ConnError{ErrCodeProtocol, "padding longer than payload"}
+	}
+	return f.Payload[1 : len(f.Payload)-padLen], nil
+}
+
+// SettingID identifies a setting in a SETTINGS frame, as defined in RFC 9113
+// section 6.5.2.
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+// Setting is a single parameter of a SETTINGS frame.
+type Setting struct {
+	ID  SettingID
+	Val uint32
+}
+
+// validate checks the value of a setting against the ranges allowed by RFC
+// 9113 section 6.5.2.
+func (s Setting) validate() error {
+	switch s.ID {
+	case SettingEnablePush:
+		if s.Val > 1 {
+			return ConnError{ErrCodeProtocol, "invalid SETTINGS_ENABLE_PUSH"}
+		}
+	case SettingInitialWindowSize:
+		if s.Val > maxWindowSize {
+			return ConnError{ErrCodeFlowControl, "invalid SETTINGS_INITIAL_WINDOW_SIZE"}
+		}
+	case SettingMaxFrameSize:
+		if s.Val < minMaxFrameSize || s.Val > maxMaxFrameSize {
+			return ConnError{ErrCodeProtocol, "invalid SETTINGS_MAX_FRAME_SIZE"}
+		}
+	}
+	return nil
+}
+
+// parseSettings decodes the payload of a SETTINGS frame.
+func parseSettings(payload []byte) ([]Setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, ConnError{ErrCodeFrameSize, "SETTINGS payload is not a multiple of 6"}
+	}
+	settings := make([]Setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		s := Setting{
+			ID:  SettingID(binary.BigEndian.Uint16(payload[i:])),
+			Val: binary.BigEndian.Uint32(payload[i+2:]),
+		}
+		if err := s.validate(); err != nil {
+			return nil, err
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+// encodeSettings encodes the payload of a SETTINGS frame.
+func encodeSettings(settings []Setting) []byte {
+	payload := make([]byte, 0, len(settings)*6)
+	for _, s := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s.ID))
+		payload = binary.BigEndian.AppendUint32(payload, s.Val)
+	}
+	return payload
+}
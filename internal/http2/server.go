@@ -0,0 +1,900 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/hpack"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+)
+
+// Handler serves a single request. It has the same shape as server.Handler,
+// so one handler serves both HTTP/1.x and HTTP/2.
+type Handler func(w *response.Writer, req *request.Request)
+
+// ClientPreface is sent by every client before its first frame.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	// maxConcurrentStreams is the number of requests a client may have in
+	// flight on one connection.
+	maxConcurrentStreams = 100
+	// maxHeaderListSize limits the decoded size of a request's headers.
+	maxHeaderListSize = 1 << 16
+	// maxHeaderBlockSize limits the encoded header block collected from a
+	// HEADERS frame and its CONTINUATION frames.
+	maxHeaderBlockSize = 1 << 16
+	// headerTableSize is the size of the dynamic table the client may use
+	// when encoding headers for us, and the largest table we keep when
+	// encoding headers for the client.
+	headerTableSize = 4096
+)
+
+// errConnClosed is returned when writing to a stream of a connection that
+// has been closed.
+var errConnClosed = errors.New("http2: connection closed")
+
+// ServerConn serves HTTP/2 on a single connection.
+type ServerConn struct {
+	rw      io.ReadWriteCloser
+	handler Handler
+
+	// br and dec are only used by the read loop.
+	br  *bufio.Reader
+	dec *hpack.Decoder
+
+	// writeMu serializes frames, so that a header block and its
+	// CONTINUATION frames are never interleaved with other frames.
+	writeMu sync.Mutex
+	bw      *bufio.Writer
+	enc     *hpack.Encoder
+
+	// mu protects the fields below and the guarded fields of every stream.
+	// cond is signaled whenever a send window grows or a stream or the
+	// connection is closed.
+	mu                sync.Mutex
+	cond              sync.Cond
+	streams           map[uint32]*stream
+	lastStreamID      uint32
+	peerMaxFrameSize  uint32
+	peerInitialWindow int64
+	connSendWindow    int64
+	goingAway         bool
+	closed            bool
+
+	handlers sync.WaitGroup
+}
+
+// NewServerConn creates a connection that serves requests with handler
+// once Serve or ServeUpgrade is called.
+func NewServerConn(rw io.ReadWriteCloser, handler Handler) *ServerConn {
+	sc := &ServerConn{
+		rw:                rw,
+		handler:           handler,
+		br:                bufio.NewReader(rw),
+		dec:               hpack.NewDecoder(headerTableSize),
+		bw:                bufio.NewWriter(rw),
+		enc:               hpack.NewEncoder(headerTableSize),
+		streams:           map[uint32]*stream{},
+		peerMaxFrameSize:  minMaxFrameSize,
+		peerInitialWindow: defaultWindowSize,
+		connSendWindow:    defaultWindowSize,
+	}
+	sc.dec.SetMaxHeaderListSize(maxHeaderListSize)
+	sc.cond.L = &sc.mu
+	return sc
+}
+
+// DecodeSettingsHeader decodes the HTTP2-Settings header of a request asking
+// to upgrade to h2c.
+func DecodeSettingsHeader(value string) ([]Setting, error) {
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP2-Settings header: %w", err)
+	}
+	return parseSettings(payload)
+}
+
+// Serve serves a connection whose client started speaking HTTP/2 right away
+// ("prior knowledge"). It returns once the connection is closed and every
+// handler has returned.
+func (sc *ServerConn) Serve() error {
+	return sc.serve(nil, nil)
+}
+
+// ServeUpgrade serves a connection that was switched from HTTP/1.1 with
+// "Upgrade: h2c", after the "101 Switching Protocols" response has been
+// sent. The upgrade request becomes stream 1, whose body must already have
+// been read, and settings are the client's settings from its HTTP2-Settings
+// header.
+func (sc *ServerConn) ServeUpgrade(req *request.Request, settings []Setting) error {
+	return sc.serve(req, settings)
+}
+
+// Shutdown stops the connection gracefully: the client is told with a
+// GOAWAY frame that no new requests will be served, and the connection is
+// closed once the requests in flight are done.
+func (sc *ServerConn) Shutdown() {
+	sc.mu.Lock()
+	if sc.goingAway || sc.closed {
+		sc.mu.Unlock()
+		return
+	}
+	sc.goingAway = true
+	lastStreamID := sc.lastStreamID
+	idle := len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	sc.writeGoAway(lastStreamID, ErrCodeNo, "")
+	if idle {
+		sc.rw.Close()
+	}
+}
+
+func (sc *ServerConn) serve(upgrade *request.Request, settings []Setting) error {
+	err := sc.readLoop(upgrade, settings)
+
+	var connErr ConnError
+	if errors.As(err, &connErr) {
+		sc.mu.Lock()
+		lastStreamID := sc.lastStreamID
+		sc.mu.Unlock()
+		sc.writeGoAway(lastStreamID, connErr.Code, connErr.Reason)
+	}
+
+	// Fail every stream still in flight, so handlers blocked on a body or
+	// on flow control return.
+	sc.mu.Lock()
+	sc.closed = true
+	goingAway := sc.goingAway
+	for id, st := range sc.streams {
+		st.reset = true
+		if st.body != nil {
+			st.body.closeWithError(errConnClosed)
+		}
+		if st.cancel != nil {
+			st.cancel()
+		}
+		delete(sc.streams, id)
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	sc.rw.Close()
+	sc.handlers.Wait()
+
+	// The client hanging up, or the connection being closed after a
+	// graceful shutdown, is the normal end of a connection.
+	if errors.Is(err, io.EOF) || (goingAway && connErr == (ConnError{})) {
+		return nil
+	}
+	return err
+}
+
+// readLoop sends our settings and then reads and processes frames until the
+// connection fails or is closed.
+func (sc *ServerConn) readLoop(upgrade *request.Request, settings []Setting) error {
+	// Our SETTINGS frame is the server's connection preface.
+	err := sc.writeFrame(Frame{Type: FrameSettings, Payload: encodeSettings([]Setting{
+		{SettingMaxConcurrentStreams, maxConcurrentStreams},
+		{SettingMaxHeaderListSize, maxHeaderListSize},
+	})})
+	if err != nil {
+		return err
+	}
+
+	if upgrade != nil {
+		// The settings from the HTTP2-Settings header are acknowledged by
+		// the 101 response itself.
+		if err := sc.applySettings(settings); err != nil {
+			return err
+		}
+		sc.mu.Lock()
+		st := sc.newStream(1)
+		st.remoteClosed = true
+		sc.lastStreamID = 1
+		sc.mu.Unlock()
+		sc.startHandler(st, upgrade)
+	}
+
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.br, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		return ConnError{ErrCodeProtocol, "invalid connection preface"}
+	}
+
+	first := true
+	for {
+		f, err := ReadFrame(sc.br, minMaxFrameSize)
+		if err != nil {
+			return err
+		}
+		// The client's preface ends with a SETTINGS frame.
+		if first && (f.Type != FrameSettings || f.Has(FlagAck)) {
+			return ConnError{ErrCodeProtocol, "expected SETTINGS frame after preface"}
+		}
+		first = false
+
+		err = sc.processFrame(f)
+		var streamErr StreamError
+		if errors.As(err, &streamErr) {
+			sc.resetStream(streamErr.StreamID, streamErr.Code)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// processFrame handles a single frame from the client.
+func (sc *ServerConn) processFrame(f Frame) error {
+	switch f.Type {
+	case FrameData:
+		return sc.processData(f)
+	case FrameHeaders:
+		return sc.processHeaders(f)
+	case FramePriority:
+		if f.StreamID == 0 {
+			return ConnError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.Payload) != 5 {
+			return StreamError{f.StreamID, ErrCodeFrameSize, "invalid PRIORITY frame"}
+		}
+		// Prioritization is advisory and not implemented.
+		return nil
+	case FrameRSTStream:
+		return sc.processRSTStream(f)
+	case FrameSettings:
+		return sc.processSettings(f)
+	case FramePushPromise:
+		return ConnError{ErrCodeProtocol, "client sent PUSH_PROMISE"}
+	case FramePing:
+		if f.StreamID != 0 {
+			return ConnError{ErrCodeProtocol, "PING on a stream"}
+		}
+		if len(f.Payload) != 8 {
+			return ConnError{ErrCodeFrameSize, "invalid PING frame"}
+		}
+		if f.Has(FlagAck) {
+			return nil
+		}
+		return sc.writeFrame(Frame{Type: FramePing, Flags: FlagAck, Payload: f.Payload})
+	case FrameGoAway:
+		if f.StreamID != 0 {
+			return ConnError{ErrCodeProtocol, "GOAWAY on a stream"}
+		}
+		// The client will not start new streams; the ones in flight are
+		// still answered.
+		return nil
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	case FrameContinuation:
+		return ConnError{ErrCodeProtocol, "unexpected CONTINUATION frame"}
+	default:
+		// Unknown frame types must be ignored.
+		return nil
+	}
+}
+
+// lookupStream returns an open stream, or an error suited to a frame that
+// needs one when there is none.
+func (sc *ServerConn) lookupStream(id uint32, frameType string) (*stream, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st := sc.streams[id]
+	if st != nil {
+		return st, nil
+	}
+	if id > sc.lastStreamID {
+		return nil, ConnError{ErrCodeProtocol, frameType + " on idle stream"}
+	}
+	return nil, nil
+}
+
+func (sc *ServerConn) processData(f Frame) error {
+	if f.StreamID == 0 {
+		return ConnError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+	data, err := removePadding(f)
+	if err != nil {
+		return err
+	}
+
+	// The connection window is reopened as soon as data arrives; the
+	// stream windows keep any single request from buffering too much.
+	if len(f.Payload) > 0 {
+		if err := sc.writeWindowUpdate(0, len(f.Payload)); err != nil {
+			return err
+		}
+	}
+
+	st, err := sc.lookupStream(f.StreamID, "DATA")
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	if st == nil || st.remoteClosed {
+		sc.mu.Unlock()
+		return StreamError{f.StreamID, ErrCodeStreamClosed, "DATA on closed stream"}
+	}
+	st.recvWindow -= int64(len(f.Payload))
+	if st.recvWindow < 0 {
+		sc.mu.Unlock()
+		return StreamError{f.StreamID, ErrCodeFlowControl, "stream window exceeded"}
+	}
+	sc.mu.Unlock()
+
+	// Padding is never read by the handler, so its share of the window is
+	// returned right away.
+	if padding := len(f.Payload) - len(data); padding > 0 {
+		sc.addRecvWindow(st, padding)
+	}
+
+	st.received += int64(len(data))
+	if st.declaredLength >= 0 && st.received > st.declaredLength {
+		return StreamError{f.StreamID, ErrCodeProtocol, "body longer than content-length"}
+	}
+	if len(data) > 0 {
+		st.body.write(data)
+	}
+	if f.Has(FlagEndStream) {
+		return sc.endRemote(st)
+	}
+	return nil
+}
+
+// endRemote marks the request of a stream as complete.
+func (sc *ServerConn) endRemote(st *stream) error {
+	if st.declaredLength >= 0 && st.received != st.declaredLength {
+		return StreamError{st.id, ErrCodeProtocol, "body shorter than content-length"}
+	}
+	sc.mu.Lock()
+	st.remoteClosed = true
+	sc.mu.Unlock()
+	if st.body != nil {
+		st.body.closeWithError(io.EOF)
+	}
+	return nil
+}
+
+func (sc *ServerConn) processHeaders(f Frame) error {
+	if f.StreamID == 0 || f.StreamID%2 == 0 {
+		return ConnError{ErrCodeProtocol, "HEADERS on invalid stream"}
+	}
+	payload, err := removePadding(f)
+	if err != nil {
+		return err
+	}
+	if f.Has(FlagPriority) {
+		if len(payload) < 5 {
+			return ConnError{ErrCodeFrameSize, "HEADERS priority truncated"}
+		}
+		payload = payload[5:]
+	}
+
+	// A header block continues in CONTINUATION frames on the same stream,
+	// with no other frame in between.
+	block := append([]byte(nil), payload...)
+	for cont := f; !cont.Has(FlagEndHeaders); {
+		cont, err = ReadFrame(sc.br, minMaxFrameSize)
+		if err != nil {
+			return err
+		}
+		if cont.Type != FrameContinuation || cont.StreamID != f.StreamID {
+			return ConnError{ErrCodeProtocol, "expected CONTINUATION frame"}
+		}
+		block = append(block, cont.Payload...)
+		if len(block) > maxHeaderBlockSize {
+			return ConnError{ErrCodeEnhanceYourCalm, "header block too large"}
+		}
+	}
+
+	// The block has to be decoded even if the stream is refused, to keep
+	// the decoder in step with the client.
+	fields, decodeErr := sc.dec.Decode(block)
+	if decodeErr != nil && !errors.Is(decodeErr, hpack.ErrHeaderListTooLarge) {
+		return ConnError{ErrCodeCompression, decodeErr.Error()}
+	}
+	return sc.processHeaderBlock(f.StreamID, fields, decodeErr, f.Has(FlagEndStream))
+}
+
+// processHeaderBlock handles a decoded header block: either the start of a
+// new request or the trailers of one in progress.
+func (sc *ServerConn) processHeaderBlock(id uint32, fields []hpack.HeaderField, decodeErr error, endStream bool) error {
+	sc.mu.Lock()
+	st := sc.streams[id]
+	if st != nil {
+		remoteClosed := st.remoteClosed
+		sc.mu.Unlock()
+		// Trailers must end the stream and cannot carry pseudo-headers.
+		if remoteClosed {
+			return StreamError{id, ErrCodeStreamClosed, "HEADERS on closed stream"}
+		}
+		if !endStream || decodeErr != nil {
+			return StreamError{id, ErrCodeProtocol, "invalid trailers"}
+		}
+		for _, hf := range fields {
+			if strings.HasPrefix(hf.Name, ":") {
+				return StreamError{id, ErrCodeProtocol, "pseudo-header in trailers"}
+			}
+		}
+		return sc.endRemote(st)
+	}
+
+	if id <= sc.lastStreamID {
+		sc.mu.Unlock()
+		return ConnError{ErrCodeStreamClosed, "HEADERS on closed stream"}
+	}
+	sc.lastStreamID = id
+	switch {
+	case sc.goingAway:
+		// Streams started after GOAWAY are ignored; the client retries
+		// them on a new connection.
+		sc.mu.Unlock()
+		return nil
+	case len(sc.streams) >= maxConcurrentStreams:
+		sc.mu.Unlock()
+		return StreamError{id, ErrCodeRefusedStream, "too many streams"}
+	}
+	sc.mu.Unlock()
+
+	if decodeErr != nil {
+		return StreamError{id, ErrCodeProtocol, decodeErr.Error()}
+	}
+	method, target, h, err := requestFields(fields)
+	if err != nil {
+		return StreamError{id, ErrCodeProtocol, err.Error()}
+	}
+
+	declaredLength := int64(-1)
+	if cl := h.Get("content-length"); cl != "" {
+		declaredLength, err = strconv.ParseInt(cl, 10, 64)
+		if err != nil || declaredLength < 0 {
+			return StreamError{id, ErrCodeProtocol, "invalid content-length"}
+		}
+	}
+
+	sc.mu.Lock()
+	st = sc.newStream(id)
+	st.declaredLength = declaredLength
+	var body io.Reader
+	if endStream {
+		st.remoteClosed = true
+	} else {
+		st.body = newPipe(func(n int) { sc.addRecvWindow(st, n) })
+		body = st.body
+	}
+	sc.mu.Unlock()
+
+	if endStream && declaredLength > 0 {
+		sc.resetStream(id, ErrCodeProtocol)
+		return nil
+	}
+
+	req, err := request.NewRequest(method, target, "2.0", h, body)
+	if err != nil {
+		return StreamError{id, ErrCodeProtocol, err.Error()}
+	}
+	sc.startHandler(st, req)
+	return nil
+}
+
+// requestFields turns the fields of a request header block into the method,
+// request-target and headers of a request, checking the rules of RFC 9113
+// section 8.3.
+func requestFields(fields []hpack.HeaderField) (method, target string, h headers.Headers, err error) {
+	pseudo := map[string]string{}
+	h = headers.NewHeaders()
+	var cookies []string
+	regular := false
+
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return "", "", nil, fmt.Errorf("pseudo-header %s after regular header", f.Name)
+			}
+			switch f.Name {
+			case ":method", ":scheme", ":authority", ":path":
+			default:
+				return "", "", nil, fmt.Errorf("invalid pseudo-header %s", f.Name)
+			}
+			if _, dup := pseudo[f.Name]; dup {
+				return "", "", nil, fmt.Errorf("duplicate pseudo-header %s", f.Name)
+			}
+			pseudo[f.Name] = f.Value
+			continue
+		}
+		regular = true
+
+		if !validFieldName(f.Name) {
+			return "", "", nil, fmt.Errorf("invalid header name %q", f.Name)
+		}
+		if !validFieldValue(f.Value) {
+			return "", "", nil, fmt.Errorf("invalid value for header %s", f.Name)
+		}
+		switch f.Name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			return "", "", nil, fmt.Errorf("connection-specific header %s", f.Name)
+		case "te":
+			if f.Value != "trailers" {
+				return "", "", nil, fmt.Errorf("invalid te header")
+			}
+		case "cookie":
+			// Cookies may be split into several fields for better
+			// compression; they are joined back with "; ".
+			cookies = append(cookies, f.Value)
+			continue
+		}
+		h.Set(f.Name, f.Value)
+	}
+	if len(cookies) > 0 {
+		h["cookie"] = strings.Join(cookies, "; ")
+	}
+
+	method = pseudo[":method"]
+	authority, hasAuthority := pseudo[":authority"]
+	if hasAuthority && h.Get("host") == "" {
+		h["host"] = authority
+	}
+
+	if method == "CONNECT" {
+		_, hasScheme := pseudo[":scheme"]
+		_, hasPath := pseudo[":path"]
+		if !hasAuthority || hasScheme || hasPath {
+			return "", "", nil, fmt.Errorf("invalid CONNECT request")
+		}
+		return method, authority, h, nil
+	}
+	if method == "" || pseudo[":scheme"] == "" || pseudo[":path"] == "" {
+		return "", "", nil, fmt.Errorf("missing pseudo-header")
+	}
+	return method, pseudo[":path"], h, nil
+}
+
+// validFieldName reports whether a name is a token without upper case
+// letters, as HTTP/2 requires.
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'A' && c <= 'Z' || c <= ' ' || c >= 0x7F || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validFieldValue reports whether a value is free of the characters RFC
+// 9113 section 8.2.1 forbids.
+func validFieldValue(value string) bool {
+	if strings.ContainsAny(value, "\x00\r\n") {
+		return false
+	}
+	return value == strings.Trim(value, " \t")
+}
+
+func (sc *ServerConn) processRSTStream(f Frame) error {
+	if f.StreamID == 0 {
+		return ConnError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(f.Payload) != 4 {
+		return ConnError{ErrCodeFrameSize, "invalid RST_STREAM frame"}
+	}
+	st, err := sc.lookupStream(f.StreamID, "RST_STREAM")
+	if err != nil || st == nil {
+		return err
+	}
+	sc.mu.Lock()
+	sc.removeStream(st)
+	sc.mu.Unlock()
+	return nil
+}
+
+func (sc *ServerConn) processSettings(f Frame) error {
+	if f.StreamID != 0 {
+		return ConnError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.Has(FlagAck) {
+		if len(f.Payload) != 0 {
+			return ConnError{ErrCodeFrameSize, "SETTINGS ack with payload"}
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.Payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(Frame{Type: FrameSettings, Flags: FlagAck})
+}
+
+// applySettings applies the client's settings to the connection.
+func (sc *ServerConn) applySettings(settings []Setting) error {
+	for _, s := range settings {
+		if s.ID == SettingHeaderTableSize {
+			// The encoder is only used while holding writeMu. There is no
+			// need to keep a larger table than our own default.
+			sc.writeMu.Lock()
+			sc.enc.SetMaxTableSize(min(s.Val, headerTableSize))
+			sc.writeMu.Unlock()
+		}
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.ID {
+		case SettingInitialWindowSize:
+			// The change applies to the windows of all open streams, which
+			// may become negative.
+			delta := int64(s.Val) - sc.peerInitialWindow
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return ConnError{ErrCodeFlowControl, "stream window too large"}
+				}
+			}
+			sc.peerInitialWindow = int64(s.Val)
+		case SettingMaxFrameSize:
+			sc.peerMaxFrameSize = s.Val
+		}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *ServerConn) processWindowUpdate(f Frame) error {
+	if len(f.Payload) != 4 {
+		return ConnError{ErrCodeFrameSize, "invalid WINDOW_UPDATE frame"}
+	}
+	increment := int64(binary.BigEndian.Uint32(f.Payload) & 0x7FFFFFFF)
+
+	if f.StreamID == 0 {
+		if increment == 0 {
+			return ConnError{ErrCodeProtocol, "zero window increment"}
+		}
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		sc.connSendWindow += increment
+		if sc.connSendWindow > maxWindowSize {
+			return ConnError{ErrCodeFlowControl, "connection window too large"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	st, err := sc.lookupStream(f.StreamID, "WINDOW_UPDATE")
+	if err != nil || st == nil {
+		return err
+	}
+	if increment == 0 {
+		return StreamError{f.StreamID, ErrCodeProtocol, "zero window increment"}
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return StreamError{f.StreamID, ErrCodeFlowControl, "stream window too large"}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+// newStream registers a new stream. sc.mu must be held.
+func (sc *ServerConn) newStream(id uint32) *stream {
+	st := &stream{
+		sc:             sc,
+		id:             id,
+		declaredLength: -1,
+		sendWindow:     sc.peerInitialWindow,
+		recvWindow:     defaultWindowSize,
+	}
+	sc.streams[id] = st
+	return st
+}
+
+// removeStream forgets a stream and fails anything still waiting on it.
+// sc.mu must be held.
+func (sc *ServerConn) removeStream(st *stream) {
+	if _, ok := sc.streams[st.id]; !ok {
+		return
+	}
+	delete(sc.streams, st.id)
+	st.reset = true
+	if st.body != nil {
+		st.body.closeWithError(errStreamReset)
+	}
+	if st.cancel != nil {
+		st.cancel()
+	}
+	sc.cond.Broadcast()
+
+	// After a graceful shutdown, the connection ends with its last stream.
+	if sc.goingAway && len(sc.streams) == 0 {
+		sc.rw.Close()
+	}
+}
+
+// startHandler runs the handler for a request on its own goroutine.
+func (sc *ServerConn) startHandler(st *stream, req *request.Request) {
+	// The context of the request is cancelled when the stream is reset or
+	// the connection ends, and when the handler returns at the latest.
+	ctx, cancel := context.WithCancel(req.Context())
+	req.SetContext(ctx)
+	sc.mu.Lock()
+	st.cancel = cancel
+	sc.mu.Unlock()
+
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		defer cancel()
+		w := response.NewBackendWriter(st)
+		if err := req.ValidateHost(); err != nil {
+			body := []byte(fmt.Sprintf("Error parsing request: %v", err))
+			w.WriteStatusLine(response.StatusCodeBadRequest)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody(body)
+		} else {
+			req.OnContinue(func() error {
+				return w.WriteInformational(response.StatusCodeContinue, nil)
+			})
+			sc.handler(w, req)
+		}
+		st.finish()
+	}()
+}
+
+// closeStream forgets a stream whose response is complete. If the client
+// is still sending the request, it is told to stop.
+func (sc *ServerConn) closeStream(st *stream) {
+	sc.mu.Lock()
+	remoteOpen := !st.remoteClosed && !st.reset
+	sc.mu.Unlock()
+	if remoteOpen {
+		sc.resetStream(st.id, ErrCodeNo)
+		return
+	}
+	sc.mu.Lock()
+	sc.removeStream(st)
+	sc.mu.Unlock()
+}
+
+// resetStream sends RST_STREAM and forgets the stream.
+func (sc *ServerConn) resetStream(id uint32, code ErrCode) {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(code))
+	sc.writeFrame(Frame{Type: FrameRSTStream, StreamID: id, Payload: payload})
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if st := sc.streams[id]; st != nil {
+		sc.removeStream(st)
+	}
+}
+
+// addRecvWindow reopens the receive window of a stream once n bytes of its
+// body have been consumed.
+func (sc *ServerConn) addRecvWindow(st *stream, n int) {
+	sc.mu.Lock()
+	open := !st.remoteClosed && !st.reset
+	if open {
+		st.recvWindow += int64(n)
+	}
+	sc.mu.Unlock()
+	if open && n > 0 {
+		sc.writeWindowUpdate(st.id, n)
+	}
+}
+
+// writeFrame writes and flushes a single frame.
+func (sc *ServerConn) writeFrame(f Frame) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	if err := WriteFrame(sc.bw, f); err != nil {
+		return err
+	}
+	return sc.bw.Flush()
+}
+
+func (sc *ServerConn) writeWindowUpdate(id uint32, n int) error {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(n))
+	return sc.writeFrame(Frame{Type: FrameWindowUpdate, StreamID: id, Payload: payload})
+}
+
+func (sc *ServerConn) writeGoAway(lastStreamID uint32, code ErrCode, debug string) error {
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	payload = append(payload, debug...)
+	return sc.writeFrame(Frame{Type: FrameGoAway, Payload: payload})
+}
+
+// writeHeaders encodes and writes a header block for a stream, split into
+// CONTINUATION frames as needed.
+func (sc *ServerConn) writeHeaders(st *stream, fields []hpack.HeaderField, endStream bool) error {
+	sc.mu.Lock()
+	reset, closed, maxFrameSize := st.reset, sc.closed, int(sc.peerMaxFrameSize)
+	sc.mu.Unlock()
+	if closed {
+		return errConnClosed
+	}
+	if reset {
+		return errStreamReset
+	}
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	// The encoder is shared by all streams, so encoding happens in the
+	// same order as writing.
+	block := sc.enc.Encode(fields)
+	frameType := FrameHeaders
+	for first := true; first || len(block) > 0; first = false {
+		n := min(len(block), maxFrameSize)
+		var flags uint8
+		if n == len(block) {
+			flags |= FlagEndHeaders
+		}
+		if first && endStream {
+			flags |= FlagEndStream
+		}
+		if err := WriteFrame(sc.bw, Frame{Type: frameType, Flags: flags, StreamID: st.id, Payload: block[:n]}); err != nil {
+			return err
+		}
+		block = block[n:]
+		frameType = FrameContinuation
+	}
+	return sc.bw.Flush()
+}
+
+// writeData writes p as DATA frames, waiting for the flow-control windows
+// of the stream and of the connection to allow it.
+func (sc *ServerConn) writeData(st *stream, p []byte, endStream bool) (int, error) {
+	written := 0
+	for {
+		sc.mu.Lock()
+		for len(p) > 0 && !st.reset && !sc.closed && (st.sendWindow <= 0 || sc.connSendWindow <= 0) {
+			sc.cond.Wait()
+		}
+		if sc.closed {
+			sc.mu.Unlock()
+			return written, errConnClosed
+		}
+		if st.reset {
+			sc.mu.Unlock()
+			return written, errStreamReset
+		}
+		n := int(min(int64(len(p)), st.sendWindow, sc.connSendWindow, int64(sc.peerMaxFrameSize)))
+		st.sendWindow -= int64(n)
+		sc.connSendWindow -= int64(n)
+		sc.mu.Unlock()
+
+		var flags uint8
+		if endStream && n == len(p) {
+			flags = FlagEndStream
+		}
+		if err := sc.writeFrame(Frame{Type: FrameData, Flags: flags, StreamID: st.id, Payload: p[:n]}); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		if len(p) == 0 {
+			return written, nil
+		}
+	}
+}
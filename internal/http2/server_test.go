@@ -0,0 +1,329 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/hpack"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient speaks raw HTTP/2 frames to a ServerConn.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	enc  *hpack.Encoder
+	dec  *hpack.Decoder
+}
+
+// startConn serves handler on one end of a TCP connection and returns a
+// client for the other end that has completed the preface exchange.
+func startConn(t *testing.T, handler Handler, settings ...Setting) *testClient {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		NewServerConn(conn, handler).Serve()
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() {
+		conn.Close()
+		<-served
+	})
+
+	c := &testClient{t: t, conn: conn, br: bufio.NewReader(conn), enc: hpack.NewEncoder(4096), dec: hpack.NewDecoder(4096)}
+	_, err = io.WriteString(conn, ClientPreface)
+	require.NoError(t, err)
+	c.writeFrame(Frame{Type: FrameSettings, Payload: encodeSettings(settings)})
+
+	// The server's preface is its SETTINGS frame.
+	f := c.readFrame()
+	require.Equal(t, FrameSettings, f.Type)
+	require.False(t, f.Has(FlagAck))
+	c.writeFrame(Frame{Type: FrameSettings, Flags: FlagAck})
+	return c
+}
+
+func (c *testClient) writeFrame(f Frame) {
+	c.t.Helper()
+	require.NoError(c.t, WriteFrame(c.conn, f))
+}
+
+func (c *testClient) readFrame() Frame {
+	c.t.Helper()
+	f, err := ReadFrame(c.br, maxMaxFrameSize)
+	require.NoError(c.t, err)
+	return f
+}
+
+// next returns the next frame of one of the given types, skipping others.
+func (c *testClient) next(types ...FrameType) Frame {
+	c.t.Helper()
+	for {
+		f := c.readFrame()
+		for _, typ := range types {
+			if f.Type == typ {
+				return f
+			}
+		}
+	}
+}
+
+// request starts a request on a stream.
+func (c *testClient) request(id uint32, method, path string, extra []hpack.HeaderField, endStream bool) {
+	c.t.Helper()
+	fields := append([]hpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "localhost"},
+	}, extra...)
+	flags := FlagEndHeaders
+	if endStream {
+		flags |= FlagEndStream
+	}
+	c.writeFrame(Frame{Type: FrameHeaders, Flags: flags, StreamID: id, Payload: c.enc.Encode(fields)})
+}
+
+// testResponse is a response collected from the frames of one stream.
+type testResponse struct {
+	status  string
+	headers map[string]string
+	body    string
+}
+
+// readResponses reads frames until the given streams have all ended and
+// returns their responses.
+func (c *testClient) readResponses(ids ...uint32) map[uint32]*testResponse {
+	c.t.Helper()
+	responses := map[uint32]*testResponse{}
+	for _, id := range ids {
+		responses[id] = &testResponse{headers: map[string]string{}}
+	}
+	pending := len(ids)
+	for pending > 0 {
+		f := c.next(FrameHeaders, FrameData, FrameRSTStream, FrameGoAway)
+		require.NotEqual(c.t, FrameGoAway, f.Type, "unexpected GOAWAY")
+		require.NotEqual(c.t, FrameRSTStream, f.Type, "unexpected RST_STREAM on stream %d", f.StreamID)
+		resp := responses[f.StreamID]
+		require.NotNil(c.t, resp, "frame on unexpected stream %d", f.StreamID)
+
+		switch f.Type {
+		case FrameHeaders:
+			fields, err := c.dec.Decode(f.Payload)
+			require.NoError(c.t, err)
+			for _, hf := range fields {
+				if hf.Name == ":status" {
+					resp.status = hf.Value
+				} else {
+					resp.headers[hf.Name] = hf.Value
+				}
+			}
+		case FrameData:
+			resp.body += string(f.Payload)
+		}
+		if f.Has(FlagEndStream) {
+			pending--
+		}
+	}
+	return responses
+}
+
+// textHandler answers every request with its method and path.
+func textHandler(w *response.Writer, req *request.Request) {
+	body := []byte(req.RequestLine.Method + " " + req.RequestLine.Target.Path)
+	w.WriteStatusLine(response.StatusCodeSuccess)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func TestServeRequests(t *testing.T) {
+	c := startConn(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Method == "POST" {
+			body, err := req.ReadBody()
+			if err != nil {
+				t.Errorf("read body: %v", err)
+			}
+			w.WriteStatusLine(response.StatusCodeSuccess)
+			h := headers.NewHeaders()
+			h.Set("Transfer-Encoding", "chunked")
+			h.Set("Trailer", "x-length")
+			w.WriteHeaders(h)
+			w.WriteChunkedBody([]byte("got "))
+			w.WriteChunkedBody(body)
+			w.WriteChunkedBodyDone()
+			trailers := headers.NewHeaders()
+			trailers.Set("X-Length", "5")
+			w.WriteTrailers(trailers)
+			return
+		}
+		textHandler(w, req)
+	})
+
+	// Test: Simple GET
+	c.request(1, "GET", "/hello", nil, true)
+	resp := c.readResponses(1)[1]
+	assert.Equal(t, "200", resp.status)
+	assert.Equal(t, "GET /hello", resp.body)
+
+	// Test: Connection-specific headers are not sent
+	assert.NotContains(t, resp.headers, "connection")
+	assert.Equal(t, "text/plain", resp.headers["content-type"])
+
+	// Test: POST with a body split across DATA frames, answered with a
+	// streamed body and trailers
+	c.request(3, "POST", "/echo", []hpack.HeaderField{{Name: "content-length", Value: "5"}}, false)
+	c.writeFrame(Frame{Type: FrameData, StreamID: 3, Payload: []byte("hel")})
+	c.writeFrame(Frame{Type: FrameData, Flags: FlagEndStream, StreamID: 3, Payload: []byte("lo")})
+	resp = c.readResponses(3)[3]
+	assert.Equal(t, "got hello", resp.body)
+	assert.Equal(t, "5", resp.headers["x-length"])
+	assert.NotContains(t, resp.headers, "transfer-encoding")
+
+	// Test: PING is acknowledged
+	c.writeFrame(Frame{Type: FramePing, Payload: []byte("12345678")})
+	f := c.next(FramePing)
+	assert.True(t, f.Has(FlagAck))
+	assert.Equal(t, "12345678", string(f.Payload))
+}
+
+func TestMultiplexing(t *testing.T) {
+	release := make(chan struct{})
+	c := startConn(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Target.Path == "/slow" {
+			<-release
+		}
+		textHandler(w, req)
+	})
+
+	// Test: A slow request does not hold up a later one
+	c.request(1, "GET", "/slow", nil, true)
+	c.request(3, "GET", "/fast", nil, true)
+	resp := c.readResponses(3)[3]
+	assert.Equal(t, "GET /fast", resp.body)
+
+	close(release)
+	resp = c.readResponses(1)[1]
+	assert.Equal(t, "GET /slow", resp.body)
+}
+
+func TestRequestContext(t *testing.T) {
+	cancelled := make(chan uint32, 2)
+	c := startConn(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Target.Path == "/wait" {
+			<-req.Context().Done()
+			cancelled <- 1
+			return
+		}
+		textHandler(w, req)
+	})
+
+	// Test: Resetting a stream cancels the context of its request
+	c.request(1, "GET", "/wait", nil, true)
+	c.writeFrame(Frame{Type: FrameRSTStream, StreamID: 1, Payload: binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel))})
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not cancelled by RST_STREAM")
+	}
+
+	// Test: Other streams go on
+	c.request(3, "GET", "/fast", nil, true)
+	assert.Equal(t, "GET /fast", c.readResponses(3)[3].body)
+
+	// Test: The connection ending cancels the requests in flight
+	c.request(5, "GET", "/wait", nil, true)
+	time.Sleep(20 * time.Millisecond)
+	c.conn.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not cancelled when the connection ended")
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	body := strings.Repeat("x", 25)
+	c := startConn(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}, Setting{SettingInitialWindowSize, 10})
+
+	// Test: The server stops at the stream window
+	c.request(1, "GET", "/", nil, true)
+	c.next(FrameHeaders)
+	f := c.next(FrameData)
+	assert.Equal(t, 10, len(f.Payload))
+	assert.False(t, f.Has(FlagEndStream))
+
+	// Test: A WINDOW_UPDATE lets it continue
+	c.writeFrame(Frame{Type: FrameWindowUpdate, StreamID: 1, Payload: binary.BigEndian.AppendUint32(nil, 100)})
+	var rest string
+	for {
+		f = c.next(FrameData)
+		rest += string(f.Payload)
+		if f.Has(FlagEndStream) {
+			break
+		}
+	}
+	assert.Equal(t, 15, len(rest))
+}
+
+func TestProtocolErrors(t *testing.T) {
+	c := startConn(t, textHandler)
+
+	// Test: Upper case header names are malformed
+	c.request(1, "GET", "/", []hpack.HeaderField{{Name: "X-Upper", Value: "1"}}, true)
+	f := c.next(FrameRSTStream)
+	assert.Equal(t, uint32(1), f.StreamID)
+	assert.Equal(t, ErrCodeProtocol, ErrCode(binary.BigEndian.Uint32(f.Payload)))
+
+	// Test: Missing pseudo-headers are malformed
+	c.writeFrame(Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 3, Payload: c.enc.Encode([]hpack.HeaderField{{Name: ":method", Value: "GET"}})})
+	f = c.next(FrameRSTStream)
+	assert.Equal(t, uint32(3), f.StreamID)
+
+	// Test: DATA on stream 0 ends the connection
+	c.writeFrame(Frame{Type: FrameData, StreamID: 0, Payload: []byte("x")})
+	f = c.next(FrameGoAway)
+	assert.Equal(t, ErrCodeProtocol, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])))
+	_, err := ReadFrame(c.br, maxMaxFrameSize)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestDecodeSettingsHeader(t *testing.T) {
+	// Test: Base64url without padding
+	settings, err := DecodeSettingsHeader("AAMAAABkAAQAoAAAAAIAAAAA")
+	require.NoError(t, err)
+	assert.Equal(t, []Setting{
+		{SettingMaxConcurrentStreams, 100},
+		{SettingInitialWindowSize, 10485760},
+		{SettingEnablePush, 0},
+	}, settings)
+
+	// Test: Invalid values are rejected
+	_, err = DecodeSettingsHeader("AAIAAAAC")
+	require.Error(t, err)
+}
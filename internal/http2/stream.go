@@ -0,0 +1,186 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/hpack"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+)
+
+// errStreamReset is returned when reading the body of, or writing to, a
+// stream that was reset.
+var errStreamReset = errors.New("http2: stream reset")
+
+// stream is a single request and its response. Fields marked as guarded are
+// protected by the connection's mutex; the others are only used by the
+// goroutine running the handler.
+type stream struct {
+	sc *ServerConn
+	id uint32
+
+	// body receives the DATA frames of the request. It is nil if the
+	// request had no body.
+	body *pipe
+	// declaredLength is the Content-Length of the request, or -1, and
+	// received counts the body bytes so far. Both are only used by the read
+	// loop.
+	declaredLength int64
+	received       int64
+
+	// cancel cancels the context of the request. It is guarded, and nil
+	// until the handler starts.
+	cancel context.CancelFunc
+
+	// Guarded.
+	remoteClosed bool
+	reset        bool
+	sendWindow   int64
+	recvWindow   int64
+
+	wroteHeaders bool
+	ended        bool
+}
+
+// WriteHeaders implements response.Backend.
+func (st *stream) WriteHeaders(statusCode response.StatusCode, h headers.Headers, cookies []string) error {
+	if statusCode == response.StatusCodeSwitchingProtocols {
+		return fmt.Errorf("http2: status %d is not allowed", statusCode)
+	}
+	if !statusCode.IsInformational() {
+		st.wroteHeaders = true
+	}
+	fields := append([]hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(statusCode))}}, sortedFields(h)...)
+	for _, c := range cookies {
+		fields = append(fields, hpack.HeaderField{Name: "set-cookie", Value: c})
+	}
+	return st.sc.writeHeaders(st, fields, false)
+}
+
+// WriteBody implements response.Backend.
+func (st *stream) WriteBody(p []byte) (int, error) {
+	if !st.wroteHeaders || st.ended {
+		return 0, fmt.Errorf("http2: cannot write body of stream %d now", st.id)
+	}
+	return st.sc.writeData(st, p, false)
+}
+
+// WriteTrailers implements response.Backend. It ends the stream.
+func (st *stream) WriteTrailers(h headers.Headers) error {
+	if !st.wroteHeaders || st.ended {
+		return fmt.Errorf("http2: cannot write trailers of stream %d now", st.id)
+	}
+	st.ended = true
+	if len(h) == 0 {
+		_, err := st.sc.writeData(st, nil, true)
+		return err
+	}
+	return st.sc.writeHeaders(st, sortedFields(h), true)
+}
+
+// Flush implements response.Backend. Frames are flushed as they are
+// written, so there is nothing left to do.
+func (st *stream) Flush() error {
+	return nil
+}
+
+// finish ends the response once the handler has returned. A response the
+// handler never started is reset, since there is nothing sensible to send.
+func (st *stream) finish() {
+	switch {
+	case !st.wroteHeaders:
+		// A stream the client reset, which is why handlers usually give
+		// up, must not be reset again.
+		st.sc.mu.Lock()
+		reset := st.reset
+		st.sc.mu.Unlock()
+		if !reset {
+			st.sc.resetStream(st.id, ErrCodeInternal)
+		}
+		return
+	case !st.ended:
+		st.ended = true
+		st.sc.writeData(st, nil, true)
+	}
+	st.sc.closeStream(st)
+}
+
+// sortedFields converts headers into header fields, sorted by name so that
+// responses are deterministic.
+func sortedFields(h headers.Headers) []hpack.HeaderField {
+	fields := make([]hpack.HeaderField, 0, len(h))
+	for k, v := range h {
+		fields = append(fields, hpack.HeaderField{Name: k, Value: v})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
+
+// pipe buffers the body of a request between the read loop, which writes
+// DATA frames to it, and the handler reading the body. The flow-control
+// window bounds how much it holds.
+type pipe struct {
+	mu   sync.Mutex
+	cond sync.Cond
+	buf  bytes.Buffer
+	// err is returned once buf is drained: io.EOF when the body is
+	// complete.
+	err error
+	// onRead is called with the number of bytes the handler consumed, so
+	// the window can be reopened.
+	onRead func(n int)
+}
+
+func newPipe(onRead func(n int)) *pipe {
+	p := &pipe{onRead: onRead}
+	p.cond.L = &p.mu
+	return p
+}
+
+func (p *pipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	for p.buf.Len() == 0 && p.err == nil {
+		p.cond.Wait()
+	}
+	if p.buf.Len() == 0 {
+		err := p.err
+		p.mu.Unlock()
+		return 0, err
+	}
+	n, _ := p.buf.Read(b)
+	p.mu.Unlock()
+
+	p.onRead(n)
+	return n, nil
+}
+
+func (p *pipe) write(b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.buf.Write(b)
+		p.cond.Broadcast()
+	}
+}
+
+// closeWithError ends the body. Buffered data can still be read unless the
+// error is not io.EOF, in which case it is discarded.
+func (p *pipe) closeWithError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return
+	}
+	p.err = err
+	if err != io.EOF {
+		p.buf.Reset()
+	}
+	p.cond.Broadcast()
+}
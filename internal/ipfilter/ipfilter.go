@@ -0,0 +1,83 @@
+// Package ipfilter controls access by client IP address, and finds the
+// address of clients behind trusted proxies.
+package ipfilter
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+)
+
+// Filter decides which client addresses are allowed. An address in Deny is
+// refused; otherwise it is allowed if Allow is empty or contains it.
+type Filter struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// ParsePrefixes parses CIDR ranges such as "10.0.0.0/8" or "2001:db8::/32".
+// A single address stands for a range containing only itself.
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("ipfilter: %w", err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("ipfilter: %w", err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// Allowed reports whether addr is allowed. It can be passed to
+// server.WithConnFilter to check connections as soon as they are accepted.
+func (f *Filter) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if contains(f.Deny, addr) {
+		return false
+	}
+	return len(f.Allow) == 0 || contains(f.Allow, addr)
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns a handler that passes requests from allowed clients on to
+// next and answers the others with 403 Forbidden. Unlike a connection
+// filter, it can protect single routes, and it sees the client address
+// found by TrustedProxies.
+func Handler(f *Filter, next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		if !f.Allowed(req.ClientIP) {
+			w.WriteStatusLine(response.StatusCodeForbidden)
+			body := []byte("Forbidden")
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody(body)
+			return
+		}
+		next(w, req)
+	}
+}
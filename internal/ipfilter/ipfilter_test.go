@@ -0,0 +1,104 @@
+package ipfilter
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/Fepozopo/httpfromtcp/internal/handlertest"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoIP answers with the client IP of the request.
+func echoIP(w *response.Writer, req *request.Request) {
+	body := []byte(req.ClientIP.String())
+	w.WriteStatusLine(response.StatusCodeSuccess)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+// from returns a request from clientIP with the given header lines.
+func from(t *testing.T, clientIP string, hdrs ...string) *request.Request {
+	t.Helper()
+	req := handlertest.NewRequest(t, "GET", "/", hdrs...)
+	req.ClientIP = netip.MustParseAddr(clientIP)
+	return req
+}
+
+func mustPrefixes(t *testing.T, list ...string) []netip.Prefix {
+	t.Helper()
+	prefixes, err := ParsePrefixes(list)
+	require.NoError(t, err)
+	return prefixes
+}
+
+func TestParsePrefixes(t *testing.T) {
+	// Test: Ranges, single addresses and unmasked ranges
+	prefixes := mustPrefixes(t, "10.0.0.0/8", " 192.0.2.1 ", "2001:db8::1/32", "::ffff:198.51.100.7", "")
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("198.51.100.7/32"),
+	}, prefixes)
+
+	// Test: Malformed entries
+	for _, s := range []string{"10.0.0.0/33", "example.com", "10.0.0"} {
+		_, err := ParsePrefixes([]string{s})
+		assert.Error(t, err, s)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f := &Filter{
+		Allow: mustPrefixes(t, "10.0.0.0/8", "2001:db8::/32"),
+		Deny:  mustPrefixes(t, "10.0.0.13"),
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		// Test: Allowed ranges
+		{"10.1.2.3", true},
+		{"2001:db8::42", true},
+		// Test: IPv4-mapped addresses match IPv4 ranges
+		{"::ffff:10.1.2.3", true},
+		// Test: Deny wins over allow
+		{"10.0.0.13", false},
+		// Test: Addresses outside the allow list
+		{"192.0.2.1", false},
+		{"2001:db9::1", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.addr, func(t *testing.T) {
+			assert.Equal(t, tc.want, f.Allowed(netip.MustParseAddr(tc.addr)))
+		})
+	}
+
+	// Test: Without an allow list, everything not denied is allowed
+	f = &Filter{Deny: mustPrefixes(t, "192.0.2.0/24")}
+	assert.True(t, f.Allowed(netip.MustParseAddr("198.51.100.1")))
+	assert.False(t, f.Allowed(netip.MustParseAddr("192.0.2.200")))
+}
+
+func TestHandler(t *testing.T) {
+	h := Handler(&Filter{Allow: mustPrefixes(t, "10.0.0.0/8")}, echoIP)
+
+	// Test: Allowed clients reach the handler
+	resp := handlertest.Do(t, h, from(t, "10.0.0.1"))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "10.0.0.1", handlertest.Body(t, resp))
+
+	// Test: Other clients are forbidden
+	resp = handlertest.Do(t, h, from(t, "192.0.2.1"))
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Test: The filter sees the client behind trusted proxies
+	h = TrustedProxies(mustPrefixes(t, "192.0.2.0/24"), h)
+	resp = handlertest.Do(t, h, from(t, "192.0.2.1", "X-Forwarded-For: 10.0.0.7"))
+	assert.Equal(t, 200, resp.StatusCode)
+	resp = handlertest.Do(t, h, from(t, "192.0.2.1", "X-Forwarded-For: 198.51.100.7"))
+	assert.Equal(t, 403, resp.StatusCode)
+}
@@ -0,0 +1,86 @@
+package ipfilter
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+)
+
+// TrustedProxies returns a handler that sets the ClientIP of requests
+// coming from a trusted proxy to the address the proxy forwarded the
+// request for, then passes them on to next.
+//
+// The addresses in the Forwarded header (RFC 7239), or in X-Forwarded-For
+// if there is none, are walked from the nearest hop backwards. Every proxy
+// appends the address it received the request from, so the client is the
+// first address that is not a trusted proxy; anything before it may have
+// been made up by the client. Requests from other addresses keep their
+// ClientIP, whatever headers they send.
+func TrustedProxies(trusted []netip.Prefix, next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		req.ClientIP = clientIP(trusted, req)
+		next(w, req)
+	}
+}
+
+func clientIP(trusted []netip.Prefix, req *request.Request) netip.Addr {
+	ip := req.ClientIP.Unmap()
+	if !contains(trusted, ip) {
+		return ip
+	}
+	hops := forwardedFor(req)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseNode(hops[i])
+		if !ok {
+			// An unknown or obfuscated hop hides where the request came
+			// from, so the last known address is the best there is.
+			break
+		}
+		ip = hop
+		if !contains(trusted, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedFor returns the addresses the request was forwarded for, the
+// client first.
+func forwardedFor(req *request.Request) []string {
+	var hops []string
+	if forwarded := req.Headers.Get("forwarded"); forwarded != "" {
+		for _, element := range strings.Split(forwarded, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					hops = append(hops, value)
+				}
+			}
+		}
+		return hops
+	}
+	for _, hop := range strings.Split(req.Headers.Get("x-forwarded-for"), ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseNode parses a node of the Forwarded header, such as 192.0.2.43,
+// "192.0.2.43:47011" or "[2001:db8:cafe::17]:4711", or an X-Forwarded-For
+// address.
+func parseNode(node string) (netip.Addr, bool) {
+	node = strings.Trim(node, `"`)
+	if addrPort, err := netip.ParseAddrPort(node); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
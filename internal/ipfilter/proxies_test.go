@@ -0,0 +1,52 @@
+package ipfilter
+
+import (
+	"testing"
+
+	"github.com/Fepozopo/httpfromtcp/internal/handlertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	h := TrustedProxies(mustPrefixes(t, "10.0.0.0/8", "2001:db8::/32"), echoIP)
+	tests := []struct {
+		name   string
+		remote string
+		header string
+		want   string
+	}{
+		// Test: Untrusted peers are taken at their word
+		{"untrusted peer", "198.51.100.1", "X-Forwarded-For: 203.0.113.9", "198.51.100.1"},
+		// Test: A trusted peer without forwarding headers
+		{"no header", "10.0.0.1", "", "10.0.0.1"},
+		// Test: The nearest untrusted hop is the client
+		{"x-forwarded-for", "10.0.0.1", "X-Forwarded-For: 203.0.113.9", "203.0.113.9"},
+		{"chain", "10.0.0.1", "X-Forwarded-For: 203.0.113.9, 10.0.0.2", "203.0.113.9"},
+		// Test: Addresses before the client may be spoofed and are ignored
+		{"spoofed", "10.0.0.1", "X-Forwarded-For: 1.1.1.1, 203.0.113.9, 10.0.0.2", "203.0.113.9"},
+		// Test: Only trusted hops leaves the first one
+		{"all trusted", "10.0.0.1", "X-Forwarded-For: 10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		// Test: Forwarded is preferred and its node forms are understood
+		{"forwarded", "10.0.0.1", `Forwarded: for=192.0.2.60;proto=http;by=203.0.113.43`, "192.0.2.60"},
+		{"forwarded port", "10.0.0.1", `Forwarded: for="203.0.113.9:47011", for=10.0.0.2`, "203.0.113.9"},
+		{"forwarded ipv6", "2001:db8::1", `Forwarded: For="[2001:db9:cafe::17]:4711"`, "2001:db9:cafe::17"},
+		{"forwarded wins", "10.0.0.1", "Forwarded: for=192.0.2.60", "192.0.2.60"},
+		// Test: Unknown and obfuscated hops stop the walk
+		{"unknown", "10.0.0.1", "Forwarded: for=203.0.113.9, for=unknown, for=10.0.0.2", "10.0.0.2"},
+		{"obfuscated", "10.0.0.1", "Forwarded: for=_hidden", "10.0.0.1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var hdrs []string
+			if tc.header != "" {
+				hdrs = append(hdrs, tc.header)
+			}
+			if tc.name == "forwarded wins" {
+				hdrs = append(hdrs, "X-Forwarded-For: 203.0.113.9")
+			}
+			resp := handlertest.Do(t, h, from(t, tc.remote, hdrs...))
+			assert.Equal(t, 200, resp.StatusCode)
+			assert.Equal(t, tc.want, handlertest.Body(t, resp))
+		})
+	}
+}
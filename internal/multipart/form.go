@@ -0,0 +1,222 @@
+package multipart
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+)
+
+var (
+	// ErrPartTooLarge is returned when a single part exceeds
+	// Limits.MaxPartSize. Handlers should answer with 413 Content Too Large.
+	ErrPartTooLarge = errors.New("multipart part too large")
+	// ErrFormTooLarge is returned when the parts together exceed
+	// Limits.MaxTotalSize or there are more than Limits.MaxParts parts.
+	// Handlers should answer with 413 Content Too Large.
+	ErrFormTooLarge = errors.New("multipart form too large")
+)
+
+// Limits bounds the resources used by ReadForm. A zero value for any field
+// means that the corresponding default is used.
+type Limits struct {
+	// MaxMemory is the number of bytes of file contents kept in memory.
+	// Files that do not fit in what is left of it are streamed to temporary
+	// files on disk. Non-file values always stay in memory and count
+	// against MaxMemory too.
+	MaxMemory int64
+	// MaxPartSize is the maximum size of a single part.
+	MaxPartSize int64
+	// MaxTotalSize is the maximum size of all parts together.
+	MaxTotalSize int64
+	// MaxParts is the maximum number of parts.
+	MaxParts int
+}
+
+// DefaultLimits are used for every field left at zero in Limits.
+var DefaultLimits = Limits{
+	MaxMemory:    10 << 20,
+	MaxPartSize:  100 << 20,
+	MaxTotalSize: 1 << 30,
+	MaxParts:     1000,
+}
+
+// WithDefaults returns l with every zero field replaced by its default.
+func (l Limits) WithDefaults() Limits {
+	if l.MaxMemory <= 0 {
+		l.MaxMemory = DefaultLimits.MaxMemory
+	}
+	if l.MaxPartSize <= 0 {
+		l.MaxPartSize = DefaultLimits.MaxPartSize
+	}
+	if l.MaxTotalSize <= 0 {
+		l.MaxTotalSize = DefaultLimits.MaxTotalSize
+	}
+	if l.MaxParts <= 0 {
+		l.MaxParts = DefaultLimits.MaxParts
+	}
+	return l
+}
+
+// Form is a parsed multipart form. Value holds the non-file parts and File
+// the file parts, both keyed by form name.
+type Form struct {
+	Value map[string][]string
+	File  map[string][]*FileHeader
+}
+
+// RemoveAll removes the temporary files created for the form.
+func (f *Form) RemoveAll() error {
+	var errs []error
+	for _, fhs := range f.File {
+		for _, fh := range fhs {
+			if fh.tmpFile == "" {
+				continue
+			}
+			if err := os.Remove(fh.tmpFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FileHeader describes an uploaded file. Its contents are either held in
+// memory or stored in a temporary file, depending on its size.
+type FileHeader struct {
+	Filename string
+	Headers  headers.Headers
+	Size     int64
+
+	content []byte
+	tmpFile string
+}
+
+// Open returns a reader for the contents of the file. The caller must close
+// it when done.
+func (fh *FileHeader) Open() (io.ReadCloser, error) {
+	if fh.tmpFile != "" {
+		return os.Open(fh.tmpFile)
+	}
+	return io.NopCloser(bytes.NewReader(fh.content)), nil
+}
+
+// OnDisk reports whether the contents were spilled to a temporary file.
+func (fh *FileHeader) OnDisk() bool {
+	return fh.tmpFile != ""
+}
+
+// ReadForm reads all parts of the body and returns them as a Form, within
+// the given limits. On error, any temporary files already created are
+// removed.
+func (r *Reader) ReadForm(limits Limits) (form *Form, err error) {
+	limits = limits.WithDefaults()
+	form = &Form{
+		Value: map[string][]string{},
+		File:  map[string][]*FileHeader{},
+	}
+	defer func() {
+		if err != nil {
+			form.RemoveAll()
+			form = nil
+		}
+	}()
+
+	memoryLeft := limits.MaxMemory
+	totalLeft := limits.MaxTotalSize
+	for parts := 0; ; parts++ {
+		p, err := r.NextPart()
+		if errors.Is(err, io.EOF) {
+			return form, nil
+		}
+		if err != nil {
+			return form, err
+		}
+		if parts >= limits.MaxParts {
+			return form, fmt.Errorf("%w: more than %d parts", ErrFormTooLarge, limits.MaxParts)
+		}
+
+		name := p.FormName()
+		if name == "" {
+			// Parts without a form name cannot be addressed; skip them.
+			continue
+		}
+
+		// Never read more than the remaining budget, plus one byte to tell
+		// that the budget was exceeded.
+		limit := min(limits.MaxPartSize, totalLeft)
+		lr := &io.LimitedReader{R: p, N: limit + 1}
+
+		filename := p.FileName()
+		if filename == "" {
+			var buf bytes.Buffer
+			n, err := io.Copy(&buf, io.LimitReader(lr, memoryLeft+1))
+			if err != nil {
+				return form, err
+			}
+			if err := checkSize(n, limits, totalLeft); err != nil {
+				return form, err
+			}
+			if n > memoryLeft {
+				return form, fmt.Errorf("%w: value %q does not fit in memory", ErrFormTooLarge, name)
+			}
+			memoryLeft -= n
+			totalLeft -= n
+			form.Value[name] = append(form.Value[name], buf.String())
+			continue
+		}
+
+		fh := &FileHeader{Filename: filename, Headers: p.Headers}
+		form.File[name] = append(form.File[name], fh)
+
+		// Keep the file in memory if it fits, otherwise spill to disk.
+		var buf bytes.Buffer
+		n, err := io.Copy(&buf, io.LimitReader(lr, memoryLeft+1))
+		if err != nil {
+			return form, err
+		}
+		if n <= memoryLeft {
+			if err := checkSize(n, limits, totalLeft); err != nil {
+				return form, err
+			}
+			fh.content = buf.Bytes()
+			fh.Size = n
+			memoryLeft -= n
+			totalLeft -= n
+			continue
+		}
+
+		tmp, err := os.CreateTemp("", "multipart-")
+		if err != nil {
+			return form, err
+		}
+		fh.tmpFile = tmp.Name()
+		written, err := io.Copy(tmp, io.MultiReader(&buf, lr))
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return form, err
+		}
+		if err := checkSize(written, limits, totalLeft); err != nil {
+			return form, err
+		}
+		fh.Size = written
+		totalLeft -= written
+	}
+}
+
+// checkSize reports whether a part of n bytes exceeds the part or total
+// limits.
+func checkSize(n int64, limits Limits, totalLeft int64) error {
+	if n > limits.MaxPartSize {
+		return fmt.Errorf("%w: more than %d bytes", ErrPartTooLarge, limits.MaxPartSize)
+	}
+	if n > totalLeft {
+		return fmt.Errorf("%w: more than %d bytes", ErrFormTooLarge, limits.MaxTotalSize)
+	}
+	return nil
+}
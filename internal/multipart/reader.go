@@ -0,0 +1,272 @@
+package multipart
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+)
+
+const (
+	// maxBoundaryLen is the longest boundary allowed by RFC 2046.
+	maxBoundaryLen = 70
+	// maxLineLen bounds boundary and preamble lines.
+	maxLineLen = 4096
+	// DefaultMaxPartHeaderBytes is the default limit on the size of the
+	// headers of a single part.
+	DefaultMaxPartHeaderBytes = 10 << 10
+)
+
+// ErrMalformed is returned (possibly wrapped) when the multipart body does
+// not follow RFC 2046. Handlers should answer with 400 Bad Request.
+var ErrMalformed = errors.New("malformed multipart body")
+
+// Reader iterates over the parts of a multipart body. It reads the body as a
+// stream, so parts can be processed without buffering the whole body.
+type Reader struct {
+	br *bufio.Reader
+
+	dashBoundary   []byte // "--boundary"
+	nlDashBoundary []byte // "\r\n--boundary"
+
+	// MaxPartHeaderBytes limits the size of the headers of each part.
+	MaxPartHeaderBytes int
+
+	current   *Part
+	partsRead int
+	done      bool
+}
+
+// NewReader creates a new Reader reading from r using the given boundary.
+func NewReader(r io.Reader, boundary string) *Reader {
+	return &Reader{
+		br:                 bufio.NewReaderSize(r, maxLineLen),
+		dashBoundary:       []byte("--" + boundary),
+		nlDashBoundary:     []byte("\r\n--" + boundary),
+		MaxPartHeaderBytes: DefaultMaxPartHeaderBytes,
+	}
+}
+
+// Boundary extracts the boundary parameter from a "multipart/form-data"
+// Content-Type header value.
+func Boundary(contentType string) (string, error) {
+	mediaType, params, _ := strings.Cut(contentType, ";")
+	if !strings.EqualFold(strings.TrimSpace(mediaType), "multipart/form-data") {
+		return "", fmt.Errorf("unsupported content type: %s", contentType)
+	}
+
+	for params != "" {
+		var param string
+		param, params = cutParam(params)
+		key, value, ok := strings.Cut(param, "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "boundary") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if value == "" || len(value) > maxBoundaryLen || strings.HasSuffix(value, " ") {
+			return "", fmt.Errorf("%w: invalid boundary %q", ErrMalformed, value)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("%w: missing boundary", ErrMalformed)
+}
+
+// cutParam returns the next ";"-separated parameter, honouring quoted strings.
+func cutParam(s string) (param, rest string) {
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case ';':
+			if !inQuotes {
+				return s[:i], s[i+1:]
+			}
+		}
+	}
+	return s, ""
+}
+
+// NextPart returns the next part of the body, or io.EOF when there are no
+// more parts. Any unread data of the previous part is discarded.
+func (r *Reader) NextPart() (*Part, error) {
+	if r.current != nil {
+		if _, err := io.Copy(io.Discard, r.current); err != nil {
+			return nil, err
+		}
+		r.current = nil
+	}
+	if r.done {
+		return nil, io.EOF
+	}
+
+	for {
+		line, err := r.br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, fmt.Errorf("%w: line too long", ErrMalformed)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		// Strip the line ending and any transport padding after the boundary.
+		eof := err != nil
+		line = bytes.TrimRight(line, " \t\r\n")
+		switch {
+		case r.isCloseDelimiter(line):
+			// The CRLF after the close delimiter is optional (RFC 2046
+			// section 5.1.1), so the body may end right after it.
+			r.done = true
+			return nil, io.EOF
+		case eof:
+			return nil, fmt.Errorf("%w: unexpected end of body", ErrMalformed)
+		case bytes.Equal(line, r.dashBoundary):
+			return r.readPartHeaders()
+		case r.partsRead == 0:
+			// Anything before the first boundary is a preamble to be ignored.
+			continue
+		default:
+			return nil, fmt.Errorf("%w: expected boundary, got %q", ErrMalformed, line)
+		}
+	}
+}
+
+// isCloseDelimiter reports whether line is "--boundary--".
+func (r *Reader) isCloseDelimiter(line []byte) bool {
+	return len(line) == len(r.dashBoundary)+2 && bytes.HasPrefix(line, r.dashBoundary) && bytes.HasSuffix(line, []byte("--"))
+}
+
+// readPartHeaders reads the headers following a boundary line and returns
+// the new part.
+func (r *Reader) readPartHeaders() (*Part, error) {
+	h := headers.NewHeaders()
+	total := 0
+	for {
+		line, err := r.br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, fmt.Errorf("%w: part header line too long", ErrMalformed)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: unexpected end of part headers", ErrMalformed)
+		}
+		if !bytes.HasSuffix(line, []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: part header line without CRLF", ErrMalformed)
+		}
+		total += len(line)
+		if total > r.MaxPartHeaderBytes {
+			return nil, fmt.Errorf("%w: part headers too large", ErrMalformed)
+		}
+
+		_, done, err := h.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+		}
+		if done {
+			break
+		}
+	}
+
+	r.partsRead++
+	r.current = &Part{Headers: h, mr: r}
+	return r.current, nil
+}
+
+// Part is a single part of a multipart body.
+type Part struct {
+	Headers headers.Headers
+
+	mr  *Reader
+	eof bool
+}
+
+// FormName returns the "name" parameter of the Content-Disposition header if
+// it is "form-data", or "" otherwise.
+func (p *Part) FormName() string {
+	disposition, params := p.disposition()
+	if disposition != "form-data" {
+		return ""
+	}
+	return params["name"]
+}
+
+// FileName returns the "filename" parameter of the Content-Disposition
+// header, reduced to its last path element so that it cannot be used to
+// escape a directory.
+func (p *Part) FileName() string {
+	_, params := p.disposition()
+	name := params["filename"]
+	if i := strings.LastIndexAny(name, `/\`); i != -1 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// disposition parses the Content-Disposition header of the part.
+func (p *Part) disposition() (string, map[string]string) {
+	disposition, rest := cutParam(p.Headers.Get("content-disposition"))
+	params := map[string]string{}
+	for rest != "" {
+		var param string
+		param, rest = cutParam(rest)
+		key, value, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`)
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return strings.ToLower(strings.TrimSpace(disposition)), params
+}
+
+// Read reads the body of the part, stopping right before the next boundary.
+func (p *Part) Read(d []byte) (int, error) {
+	if p.eof {
+		return 0, io.EOF
+	}
+	br := p.mr.br
+	delim := p.mr.nlDashBoundary
+
+	// Make sure enough data is buffered to recognise a delimiter.
+	peek, err := br.Peek(br.Buffered())
+	if len(peek) < len(delim) {
+		peek, err = br.Peek(len(delim))
+		if len(peek) < len(delim) {
+			if errors.Is(err, io.EOF) {
+				return 0, fmt.Errorf("%w: unexpected end of part", ErrMalformed)
+			}
+			return 0, err
+		}
+	}
+
+	if idx := bytes.Index(peek, delim); idx != -1 {
+		n := copy(d, peek[:idx])
+		br.Discard(n)
+		if n == idx {
+			// Consume the CRLF preceding the boundary so that NextPart
+			// finds the boundary at the start of a line.
+			br.Discard(2)
+			p.eof = true
+			if n == 0 {
+				return 0, io.EOF
+			}
+		}
+		return n, nil
+	}
+
+	// The last len(delim)-1 bytes may be the start of a delimiter, so keep
+	// them buffered until more data arrives.
+	safe := len(peek) - len(delim) + 1
+	n := copy(d, peek[:safe])
+	br.Discard(n)
+	return n, nil
+}
@@ -0,0 +1,156 @@
+package multipart
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBody = "This is the preamble.\r\n" +
+	"--xyz\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n" +
+	"\r\n" +
+	"My holiday\r\n" +
+	"--xyz\r\n" +
+	"Content-Disposition: form-data; name=\"photo\"; filename=\"../../beach.txt\"\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"sand\r\nsea\r\n--not-the-boundary\r\n" +
+	"--xyz\r\n" +
+	"Content-Disposition: form-data; name=\"empty\"\r\n" +
+	"\r\n" +
+	"\r\n" +
+	"--xyz--\r\n" +
+	"This is the epilogue.\r\n"
+
+func TestBoundary(t *testing.T) {
+	// Test: Plain boundary
+	boundary, err := Boundary("multipart/form-data; boundary=xyz")
+	require.NoError(t, err)
+	assert.Equal(t, "xyz", boundary)
+
+	// Test: Quoted boundary with other parameters
+	boundary, err = Boundary(`Multipart/Form-Data; charset=utf-8; boundary="a;b c"`)
+	require.NoError(t, err)
+	assert.Equal(t, "a;b c", boundary)
+
+	// Test: Missing boundary
+	_, err = Boundary("multipart/form-data")
+	require.ErrorIs(t, err, ErrMalformed)
+
+	// Test: Wrong media type
+	_, err = Boundary("application/json; boundary=xyz")
+	require.Error(t, err)
+}
+
+func TestNextPart(t *testing.T) {
+	// Test: Parts are streamed one byte at a time
+	r := NewReader(iotest.OneByteReader(strings.NewReader(testBody)), "xyz")
+
+	p, err := r.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "title", p.FormName())
+	assert.Equal(t, "", p.FileName())
+	data, err := io.ReadAll(p)
+	require.NoError(t, err)
+	assert.Equal(t, "My holiday", string(data))
+
+	p, err = r.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "photo", p.FormName())
+	assert.Equal(t, "beach.txt", p.FileName())
+	assert.Equal(t, "text/plain", p.Headers.Get("content-type"))
+	data, err = io.ReadAll(p)
+	require.NoError(t, err)
+	assert.Equal(t, "sand\r\nsea\r\n--not-the-boundary", string(data))
+
+	// Test: Unread parts are skipped
+	p, err = r.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "empty", p.FormName())
+
+	_, err = r.NextPart()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: The close delimiter may end the body without a CRLF
+	r = NewReader(iotest.OneByteReader(strings.NewReader("--xyz\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nvalue\r\n--xyz--")), "xyz")
+	p, err = r.NextPart()
+	require.NoError(t, err)
+	data, err = io.ReadAll(p)
+	require.NoError(t, err)
+	assert.Equal(t, "value", string(data))
+	_, err = r.NextPart()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: A body ending within a boundary line is malformed
+	r = NewReader(strings.NewReader("--xyz\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nvalue\r\n--xyz-"), "xyz")
+	p, err = r.NextPart()
+	require.NoError(t, err)
+	_, err = io.ReadAll(p)
+	require.NoError(t, err)
+	_, err = r.NextPart()
+	require.ErrorIs(t, err, ErrMalformed)
+
+	// Test: Missing final boundary
+	r = NewReader(strings.NewReader("--xyz\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nvalue"), "xyz")
+	p, err = r.NextPart()
+	require.NoError(t, err)
+	_, err = io.ReadAll(p)
+	require.ErrorIs(t, err, ErrMalformed)
+
+	// Test: Malformed part header
+	r = NewReader(strings.NewReader("--xyz\r\nContent-Disposition\r\n\r\nvalue\r\n--xyz--\r\n"), "xyz")
+	_, err = r.NextPart()
+	require.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestReadForm(t *testing.T) {
+	// Test: Values and files in memory
+	form, err := NewReader(strings.NewReader(testBody), "xyz").ReadForm(Limits{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"My holiday"}, form.Value["title"])
+	assert.Equal(t, []string{""}, form.Value["empty"])
+	require.Len(t, form.File["photo"], 1)
+	fh := form.File["photo"][0]
+	assert.Equal(t, "beach.txt", fh.Filename)
+	assert.Equal(t, int64(29), fh.Size)
+	assert.False(t, fh.OnDisk())
+	f, err := fh.Open()
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, "sand\r\nsea\r\n--not-the-boundary", string(data))
+
+	// Test: Files above the memory threshold are written to disk
+	form, err = NewReader(strings.NewReader(testBody), "xyz").ReadForm(Limits{MaxMemory: 16})
+	require.NoError(t, err)
+	fh = form.File["photo"][0]
+	assert.True(t, fh.OnDisk())
+	assert.Equal(t, int64(29), fh.Size)
+	f, err = fh.Open()
+	require.NoError(t, err)
+	data, err = io.ReadAll(f)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, "sand\r\nsea\r\n--not-the-boundary", string(data))
+	require.NoError(t, form.RemoveAll())
+	_, err = fh.Open()
+	require.Error(t, err)
+
+	// Test: Part too large
+	_, err = NewReader(strings.NewReader(testBody), "xyz").ReadForm(Limits{MaxPartSize: 20})
+	require.ErrorIs(t, err, ErrPartTooLarge)
+
+	// Test: Total too large
+	_, err = NewReader(strings.NewReader(testBody), "xyz").ReadForm(Limits{MaxTotalSize: 35})
+	require.ErrorIs(t, err, ErrFormTooLarge)
+
+	// Test: Too many parts
+	_, err = NewReader(strings.NewReader(testBody), "xyz").ReadForm(Limits{MaxParts: 2})
+	require.ErrorIs(t, err, ErrFormTooLarge)
+}
@@ -0,0 +1,455 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/cookie"
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+	"github.com/Fepozopo/httpfromtcp/internal/tracecontext"
+)
+
+const (
+	// DefaultIdleTimeout is how long a tunnel may sit idle before it is
+	// closed when Config.IdleTimeout is zero.
+	DefaultIdleTimeout = 5 * time.Minute
+	// DefaultDialTimeout is how long connecting to a CONNECT destination may
+	// take when Config.DialTimeout is zero.
+	DefaultDialTimeout = 10 * time.Second
+)
+
+// Config configures a forward proxy.
+type Config struct {
+	// AllowedPorts lists the destination ports CONNECT may tunnel to. If it
+	// is empty, only 443 is allowed.
+	AllowedPorts []int
+	// ForwardPorts lists the destination ports absolute-form requests may be
+	// forwarded to. If it is empty, only 80 and 443 are allowed.
+	ForwardPorts []int
+	// AllowPrivateDestinations lets the proxy connect to loopback, private,
+	// link-local and other non-public addresses. By default it refuses to,
+	// so that clients cannot reach services only meant for this host or its
+	// network. The check applies to the resolved address, so host names
+	// pointing at such addresses are refused too.
+	AllowPrivateDestinations bool
+	// IdleTimeout closes a tunnel once neither side has sent anything for
+	// this long.
+	IdleTimeout time.Duration
+	// DialTimeout limits how long connecting to a CONNECT destination may
+	// take.
+	DialTimeout time.Duration
+	// Credentials maps user names to passwords. When it is not empty,
+	// clients must authenticate with Basic credentials in the
+	// Proxy-Authorization header.
+	Credentials map[string]string
+	// Transport sends forwarded requests. If nil, a transport that does not
+	// itself use a proxy and passes content codings through untouched is
+	// used. A Transport given here must check destinations itself;
+	// AllowPrivateDestinations only applies to the default one and to
+	// CONNECT.
+	Transport http.RoundTripper
+}
+
+// hopByHopHeaders apply to a single connection and are never forwarded, as
+// listed in RFC 9110 section 7.6.1.
+var hopByHopHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"proxy-connection",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// errForbiddenDestination is returned when dialing an address the proxy may
+// not connect to.
+var errForbiddenDestination = errors.New("destination not allowed")
+
+type proxy struct {
+	cfg    Config
+	dialer *net.Dialer
+}
+
+// Handler returns a handler that acts as a forward proxy. Requests with an
+// absolute-form target ("GET http://example.com/ HTTP/1.1") are forwarded to
+// their destination, and CONNECT requests open a TCP tunnel to theirs. Every
+// other request is passed on to next, so the proxy can share a port with an
+// ordinary server.
+func Handler(cfg Config, next server.Handler) server.Handler {
+	if len(cfg.AllowedPorts) == 0 {
+		cfg.AllowedPorts = []int{443}
+	}
+	if len(cfg.ForwardPorts) == 0 {
+		cfg.ForwardPorts = []int{80, 443}
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = DefaultIdleTimeout
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = DefaultDialTimeout
+	}
+	p := &proxy{cfg: cfg}
+	p.dialer = &net.Dialer{Timeout: cfg.DialTimeout, Control: p.checkDestination}
+	if cfg.Transport == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = nil
+		t.DisableCompression = true
+		t.DialContext = p.dialer.DialContext
+		p.cfg.Transport = t
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		switch {
+		case req.RequestLine.Method == "CONNECT":
+			if p.authorize(w, req) {
+				p.tunnel(w, req)
+			}
+		case req.RequestLine.Target.Form == request.TargetFormAbsolute:
+			if p.authorize(w, req) {
+				p.forward(w, req)
+			}
+		case next != nil:
+			next(w, req)
+		default:
+			writeError(w, response.StatusCodeBadRequest, "This is a proxy; send an absolute-form request target", nil)
+		}
+	}
+}
+
+// authorize checks the Proxy-Authorization header when credentials are
+// configured, answering 407 Proxy Authentication Required when they do not
+// match.
+func (p *proxy) authorize(w *response.Writer, req *request.Request) bool {
+	if len(p.cfg.Credentials) == 0 {
+		return true
+	}
+
+	user, pass, ok := request.ParseBasicAuth(req.Headers.Get("proxy-authorization"))
+	if ok {
+		want, found := p.cfg.Credentials[user]
+		// Compare even when the user is unknown, so the timing does not
+		// reveal which user names exist.
+		match := subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1
+		if found && match {
+			return true
+		}
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Proxy-Authenticate", `Basic realm="proxy", charset="UTF-8"`)
+	writeError(w, response.StatusCodeProxyAuthRequired, "Proxy authentication required", h)
+	return false
+}
+
+// tunnel handles a CONNECT request: it connects to the destination, tells
+// the client the tunnel is established and then copies bytes in both
+// directions until either side is done or the tunnel goes idle.
+func (p *proxy) tunnel(w *response.Writer, req *request.Request) {
+	authority := req.RequestLine.Target.Authority
+	_, portStr, err := net.SplitHostPort(authority)
+	if err != nil {
+		writeError(w, response.StatusCodeBadRequest, fmt.Sprintf("Invalid CONNECT target: %v", err), nil)
+		return
+	}
+	if !allowedPort(portStr, p.cfg.AllowedPorts) {
+		writeError(w, response.StatusCodeForbidden, fmt.Sprintf("Tunneling to port %s is not allowed", portStr), nil)
+		return
+	}
+
+	upstream, err := p.dialer.DialContext(req.Context(), "tcp", authority)
+	if errors.Is(err, errForbiddenDestination) {
+		writeError(w, response.StatusCodeForbidden, fmt.Sprintf("Tunneling to %s is not allowed", authority), nil)
+		return
+	}
+	if err != nil {
+		writeError(w, response.StatusCodeBadGateway, fmt.Sprintf("Error connecting to %s: %v", authority, err), nil)
+		return
+	}
+
+	// A 2xx response to CONNECT has no body; the tunnel starts right after
+	// the headers.
+	if err := w.WriteStatusLine(response.StatusCodeSuccess); err != nil {
+		upstream.Close()
+		return
+	}
+	if err := w.WriteHeaders(headers.NewHeaders()); err != nil {
+		upstream.Close()
+		return
+	}
+	client, buffered, err := w.Hijack()
+	if err != nil {
+		log.Printf("Error hijacking connection for tunnel: %v", err)
+		upstream.Close()
+		return
+	}
+
+	// The client may have sent the start of the tunneled stream along with
+	// the request.
+	if len(buffered) > 0 {
+		if _, err := upstream.Write(buffered); err != nil {
+			upstream.Close()
+			client.Close()
+			return
+		}
+	}
+
+	newTunnel(client, upstream, p.cfg.IdleTimeout).run()
+}
+
+// forward sends an absolute-form request on to its destination and streams
+// the response back to the client.
+func (p *proxy) forward(w *response.Writer, req *request.Request) {
+	target := req.RequestLine.Target
+	port := map[string]string{"http": "80", "https": "443"}[target.Scheme]
+	// Without an explicit port the request goes to the default one of its
+	// scheme.
+	if _, explicit, err := net.SplitHostPort(target.Authority); err == nil {
+		port = explicit
+	}
+	if !allowedPort(port, p.cfg.ForwardPorts) {
+		writeError(w, response.StatusCodeForbidden, fmt.Sprintf("Forwarding to port %s is not allowed", port), nil)
+		return
+	}
+
+	url := target.Scheme + "://" + target.Authority + target.Path
+	if target.Path == "" {
+		url += "/"
+	}
+	if target.RawQuery != "" {
+		url += "?" + target.RawQuery
+	}
+
+	var body io.Reader
+	contentLength := int64(0)
+	if cl := req.Headers.Get("content-length"); cl != "" && cl != "0" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil {
+			writeError(w, response.StatusCodeBadRequest, "Invalid Content-Length", nil)
+			return
+		}
+		body, err = req.BodyReader()
+		if err != nil {
+			writeError(w, response.StatusCodeBadRequest, fmt.Sprintf("Error reading body: %v", err), nil)
+			return
+		}
+		contentLength = n
+	}
+
+	// Cancelling the context when the client goes away stops the upstream
+	// request, and the download of its response, too.
+	outReq, err := http.NewRequestWithContext(req.Context(), req.RequestLine.Method, url, body)
+	if err != nil {
+		writeError(w, response.StatusCodeBadRequest, fmt.Sprintf("Invalid request: %v", err), nil)
+		return
+	}
+	outReq.ContentLength = contentLength
+	outReq.Host = target.Authority
+	for key, value := range req.Headers {
+		if key == "host" || key == "content-length" || isHopByHop(key, req.Headers) {
+			continue
+		}
+		outReq.Header.Set(key, value)
+	}
+	// The upstream request is a child of this one in its trace.
+	if t := tracecontext.Get(req); t != nil {
+		t.Inject(outReq.Header)
+	}
+
+	resp, err := p.cfg.Transport.RoundTrip(outReq)
+	if errors.Is(err, errForbiddenDestination) {
+		writeError(w, response.StatusCodeForbidden, fmt.Sprintf("Forwarding to %s is not allowed", target.Authority), nil)
+		return
+	}
+	if err != nil {
+		writeError(w, response.StatusCodeBadGateway, fmt.Sprintf("Error forwarding request: %v", err), nil)
+		return
+	}
+	defer resp.Body.Close()
+
+	respHeaders := headers.NewHeaders()
+	for key, values := range resp.Header {
+		// Cookies are passed on separately, since joining them breaks them.
+		if key == "Set-Cookie" {
+			continue
+		}
+		for _, v := range values {
+			respHeaders.Set(key, v)
+		}
+	}
+	for key := range respHeaders {
+		if isHopByHop(key, respHeaders) {
+			respHeaders.Delete(key)
+		}
+	}
+
+	w.WriteStatusLine(response.StatusCode(resp.StatusCode))
+	for _, v := range resp.Header.Values("Set-Cookie") {
+		// A cookie that a browser would reject is dropped.
+		if c, err := cookie.ParseSetCookie(v); err == nil {
+			w.SetCookie(c)
+		}
+	}
+
+	// Responses without a body keep the upstream headers as they are.
+	if req.RequestLine.Method == "HEAD" || resp.StatusCode == 204 || resp.StatusCode == 304 {
+		if err := w.WriteHeaders(respHeaders); err != nil {
+			log.Printf("Error writing forwarded headers: %v", err)
+		}
+		return
+	}
+
+	// Otherwise the body is streamed as it arrives, which needs chunked
+	// transfer coding since the Writer sends a length-delimited body in one
+	// piece.
+	respHeaders.Delete("content-length")
+	respHeaders.Override("Transfer-Encoding", "chunked")
+	if len(resp.Trailer) > 0 {
+		names := make([]string, 0, len(resp.Trailer))
+		for key := range resp.Trailer {
+			names = append(names, strings.ToLower(key))
+		}
+		respHeaders.Override("Trailer", strings.Join(names, ", "))
+	}
+	// Headers that would corrupt the response are refused, and the
+	// connection closed after the bare status line.
+	if err := w.WriteHeaders(respHeaders); err != nil {
+		log.Printf("Error writing forwarded headers: %v", err)
+		return
+	}
+
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			if _, err := w.WriteChunkedBody(buffer[:n]); err != nil {
+				return
+			}
+			w.Flush()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The response is already under way, so the only way to tell
+			// the client is to cut it short by closing the connection.
+			log.Printf("Error reading forwarded response: %v", err)
+			if conn, _, err := w.Hijack(); err == nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+
+	w.WriteChunkedBodyDone()
+	trailers := headers.NewHeaders()
+	for key, values := range resp.Trailer {
+		for _, v := range values {
+			trailers.Set(key, v)
+		}
+	}
+	if err := w.WriteTrailers(trailers); err != nil {
+		log.Printf("Error writing forwarded trailers: %v", err)
+	}
+}
+
+// allowedPort reports whether port is one of ports.
+func allowedPort(port string, ports []int) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && slices.Contains(ports, n)
+}
+
+// checkDestination refuses to connect to addresses that are not public,
+// unless the configuration allows it. It runs once the host name of the
+// destination has been resolved, so that a name cannot lead elsewhere.
+func (p *proxy) checkDestination(network, address string, _ syscall.RawConn) error {
+	if p.cfg.AllowPrivateDestinations {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := addrPort.Addr().Unmap(); !isPublic(ip) {
+		return fmt.Errorf("%w: %s", errForbiddenDestination, ip)
+	}
+	return nil
+}
+
+// specialPurposePrefixes lists the ranges of the IANA special-purpose
+// address registries that the netip predicates do not cover and that do not
+// lead to hosts on the public internet.
+var specialPurposePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this network", RFC 791
+	netip.MustParsePrefix("100.64.0.0/10"),   // shared address space (CGNAT), RFC 6598
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments, RFC 6890
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation, RFC 5737
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking, RFC 2544
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation, RFC 5737
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation, RFC 5737
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, and the broadcast address
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64, RFC 8215
+	netip.MustParsePrefix("100::/64"),        // discard-only, RFC 6666
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation, RFC 3849
+}
+
+// nat64Prefix is the well-known NAT64 prefix of RFC 6052, whose addresses
+// reach the IPv4 address in their last four bytes.
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// isPublic reports whether ip is a unicast address on the public internet.
+func isPublic(ip netip.Addr) bool {
+	if nat64Prefix.Contains(ip) {
+		b := ip.As16()
+		return isPublic(netip.AddrFrom4([4]byte(b[12:])))
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, prefix := range specialPurposePrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// isHopByHop reports whether a header must not be forwarded, either because
+// it is always connection-specific or because the Connection header of the
+// message names it.
+func isHopByHop(key string, h headers.Headers) bool {
+	key = strings.ToLower(key)
+	return slices.Contains(hopByHopHeaders, key) || h.HasToken("connection", key)
+}
+
+// writeError writes a complete plain text response with the given status
+// code, message and extra headers.
+func writeError(w *response.Writer, statusCode response.StatusCode, message string, extra headers.Headers) {
+	w.WriteStatusLine(statusCode)
+
+	body := []byte(message)
+	h := response.GetDefaultHeaders(len(body))
+	for k, v := range extra {
+		h.Override(k, v)
+	}
+	w.WriteHeaders(h)
+
+	w.WriteBody(body)
+}
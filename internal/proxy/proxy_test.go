@@ -0,0 +1,410 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+	"github.com/Fepozopo/httpfromtcp/internal/tracecontext"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startProxy serves a proxy with the given config and returns a connection
+// to it.
+func startProxy(t *testing.T, cfg Config) net.Conn {
+	t.Helper()
+	s, err := server.Serve(0, Handler(cfg, nil))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// startEcho starts a TCP server that echoes everything back and returns its
+// address.
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// readHead reads a response status line and headers.
+func readHead(t *testing.T, br *bufio.Reader) (string, string) {
+	t.Helper()
+	statusLine, err := br.ReadString('\n')
+	require.NoError(t, err)
+	var head strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+		head.WriteString(line)
+	}
+	return strings.TrimSuffix(statusLine, "\r\n"), head.String()
+}
+
+func portOf(t *testing.T, addr string) int {
+	t.Helper()
+	_, portStr, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	return port
+}
+
+func TestForward(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Seen-Host", r.Host)
+		w.Header().Set("X-Seen-Query", r.URL.RawQuery)
+		w.Header().Set("X-Seen-Secret", r.Header.Get("X-Secret"))
+		w.Header().Add("Set-Cookie", "a=1; Path=/")
+		w.Header().Add("Set-Cookie", "b=2; HttpOnly")
+		io.WriteString(w, r.Method+":"+string(body))
+	}))
+	defer upstream.Close()
+
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	conn := startProxy(t, Config{ForwardPorts: []int{portOf(t, host)}, AllowPrivateDestinations: true})
+	br := bufio.NewReader(conn)
+
+	// Test: Absolute-form request is forwarded with its body and query
+	_, err := io.WriteString(conn, "POST http://"+host+"/echo?a=1 HTTP/1.1\r\n"+
+		"Host: "+host+"\r\n"+
+		"Connection: X-Secret\r\n"+
+		"X-Secret: hop\r\n"+
+		"Content-Length: 5\r\n\r\nhello")
+	require.NoError(t, err)
+
+	statusLine, head := readHead(t, br)
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine)
+	assert.Contains(t, head, "x-seen-host: "+host+"\r\n")
+	assert.Contains(t, head, "x-seen-query: a=1\r\n")
+	assert.Contains(t, head, "transfer-encoding: chunked\r\n")
+
+	// Test: Headers named by Connection are not forwarded
+	assert.Contains(t, head, "x-seen-secret: \r\n")
+
+	// Test: Each cookie keeps a Set-Cookie header of its own
+	assert.Contains(t, head, "Set-Cookie: a=1; Path=/\r\n")
+	assert.Contains(t, head, "Set-Cookie: b=2; HttpOnly\r\n")
+
+	size, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "a\r\n", size)
+	chunk := make([]byte, 12)
+	_, err = io.ReadFull(br, chunk)
+	require.NoError(t, err)
+	assert.Equal(t, "POST:hello\r\n", string(chunk))
+	end, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "0\r\n", end)
+	end, err = br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", end)
+
+	// Test: The connection stays open for the next request
+	_, err = io.WriteString(conn, "HEAD http://"+host+"/ HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	require.NoError(t, err)
+	statusLine, _ = readHead(t, br)
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine)
+}
+
+func TestForwardUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	conn := startProxy(t, Config{ForwardPorts: []int{portOf(t, addr)}, AllowPrivateDestinations: true})
+
+	// Test: An upstream that cannot be reached gives 502
+	_, err = io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	require.NoError(t, err)
+	statusLine, _ := readHead(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway", statusLine)
+}
+
+func TestForwardRejected(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the upstream server")
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	tests := []struct {
+		name   string
+		cfg    Config
+		req    string
+		status string
+	}{
+		{
+			name:   "port not allowed",
+			cfg:    Config{AllowPrivateDestinations: true},
+			req:    "GET http://" + host + "/ HTTP/1.1\r\nHost: " + host + "\r\n\r\n",
+			status: "HTTP/1.1 403 Forbidden",
+		},
+		{
+			name:   "loopback destination",
+			cfg:    Config{ForwardPorts: []int{portOf(t, host)}},
+			req:    "GET http://" + host + "/ HTTP/1.1\r\nHost: " + host + "\r\n\r\n",
+			status: "HTTP/1.1 403 Forbidden",
+		},
+		{
+			name:   "host name of a loopback destination",
+			cfg:    Config{ForwardPorts: []int{portOf(t, host)}},
+			req:    "GET http://localhost:" + strconv.Itoa(portOf(t, host)) + "/ HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status: "HTTP/1.1 403 Forbidden",
+		},
+		{
+			name:   "loopback CONNECT destination",
+			cfg:    Config{AllowedPorts: []int{portOf(t, host)}},
+			req:    "CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n",
+			status: "HTTP/1.1 403 Forbidden",
+		},
+		{
+			name:   "shared address space CONNECT destination",
+			cfg:    Config{},
+			req:    "CONNECT 100.64.0.1:443 HTTP/1.1\r\nHost: 100.64.0.1:443\r\n\r\n",
+			status: "HTTP/1.1 403 Forbidden",
+		},
+		{
+			name:   "NAT64 address of a loopback CONNECT destination",
+			cfg:    Config{},
+			req:    "CONNECT [64:ff9b::7f00:1]:443 HTTP/1.1\r\nHost: [64:ff9b::7f00:1]:443\r\n\r\n",
+			status: "HTTP/1.1 403 Forbidden",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := startProxy(t, tt.cfg)
+			_, err := io.WriteString(conn, tt.req)
+			require.NoError(t, err)
+			statusLine, _ := readHead(t, bufio.NewReader(conn))
+			assert.Equal(t, tt.status, statusLine)
+		})
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		// Test: Public addresses
+		{"93.184.215.14", true},
+		{"1.1.1.1", true},
+		{"2606:2800:21f:cb07:6820:80da:af6b:8b2c", true},
+		{"64:ff9b::5db8:d70e", true},
+		// Test: Addresses the netip predicates cover
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"169.254.169.254", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		// Test: Special-purpose ranges
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"192.0.0.170", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"2001:db8::1", false},
+		{"64:ff9b:1::a00:1", false},
+		// Test: NAT64 addresses are judged by the IPv4 address they embed
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b::6440:1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			assert.Equal(t, tt.public, isPublic(netip.MustParseAddr(tt.addr)))
+		})
+	}
+}
+
+func TestConnect(t *testing.T) {
+	addr := startEcho(t)
+	conn := startProxy(t, Config{AllowedPorts: []int{portOf(t, addr)}, AllowPrivateDestinations: true})
+	br := bufio.NewReader(conn)
+
+	// Test: The tunnel is established and carries bytes both ways,
+	// including any sent together with the request
+	_, err := io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\nearly")
+	require.NoError(t, err)
+	statusLine, _ := readHead(t, br)
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine)
+
+	got := make([]byte, 5)
+	_, err = io.ReadFull(br, got)
+	require.NoError(t, err)
+	assert.Equal(t, "early", string(got))
+
+	_, err = io.WriteString(conn, "ping")
+	require.NoError(t, err)
+	got = make([]byte, 4)
+	_, err = io.ReadFull(br, got)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(got))
+
+	// Test: Closing the client side ends the tunnel
+	conn.(*net.TCPConn).CloseWrite()
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestConnectIdleTimeout(t *testing.T) {
+	addr := startEcho(t)
+	conn := startProxy(t, Config{AllowedPorts: []int{portOf(t, addr)}, AllowPrivateDestinations: true, IdleTimeout: 50 * time.Millisecond})
+	br := bufio.NewReader(conn)
+
+	_, err := io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	require.NoError(t, err)
+	statusLine, _ := readHead(t, br)
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine)
+
+	// Test: An idle tunnel is closed
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestConnectRejected(t *testing.T) {
+	addr := startEcho(t)
+	creds := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	wrong := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:guess"))
+
+	tests := []struct {
+		name   string
+		cfg    Config
+		target string
+		auth   string
+		status string
+	}{
+		{
+			name:   "port not allowed",
+			cfg:    Config{},
+			target: addr,
+			status: "HTTP/1.1 403 Forbidden",
+		},
+		{
+			name:   "missing credentials",
+			cfg:    Config{AllowedPorts: []int{portOf(t, addr)}, AllowPrivateDestinations: true, Credentials: map[string]string{"alice": "secret"}},
+			target: addr,
+			status: "HTTP/1.1 407 Proxy Authentication Required",
+		},
+		{
+			name:   "wrong credentials",
+			cfg:    Config{AllowedPorts: []int{portOf(t, addr)}, AllowPrivateDestinations: true, Credentials: map[string]string{"alice": "secret"}},
+			target: addr,
+			auth:   wrong,
+			status: "HTTP/1.1 407 Proxy Authentication Required",
+		},
+		{
+			name:   "valid credentials",
+			cfg:    Config{AllowedPorts: []int{portOf(t, addr)}, AllowPrivateDestinations: true, Credentials: map[string]string{"alice": "secret"}},
+			target: addr,
+			auth:   creds,
+			status: "HTTP/1.1 200 OK",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := startProxy(t, tt.cfg)
+			req := "CONNECT " + tt.target + " HTTP/1.1\r\nHost: " + tt.target + "\r\n"
+			if tt.auth != "" {
+				req += "Proxy-Authorization: " + tt.auth + "\r\n"
+			}
+			_, err := io.WriteString(conn, req+"\r\n")
+			require.NoError(t, err)
+			statusLine, head := readHead(t, bufio.NewReader(conn))
+			assert.Equal(t, tt.status, statusLine)
+			if strings.Contains(tt.status, "407") {
+				assert.Contains(t, head, "proxy-authenticate: Basic realm=\"proxy\"")
+			}
+		})
+	}
+}
+
+func TestNotProxyRequest(t *testing.T) {
+	conn := startProxy(t, Config{})
+
+	// Test: Origin-form requests without a fallback handler are rejected
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	statusLine, _ := readHead(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 400 Bad Request", statusLine)
+}
+
+func TestForwardTraceContext(t *testing.T) {
+	seen := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	cfg := Config{ForwardPorts: []int{portOf(t, host)}, AllowPrivateDestinations: true}
+	s, err := server.Serve(0, tracecontext.Handler(tracecontext.Config{}, Handler(cfg, nil)))
+	require.NoError(t, err)
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: The upstream request carries the request ID and a child span of
+	// the incoming trace, with its state
+	_, err = io.WriteString(conn, "GET http://"+host+"/ HTTP/1.1\r\n"+
+		"Host: "+host+"\r\n"+
+		"X-Request-ID: abc-123\r\n"+
+		"Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n"+
+		"Tracestate: congo=t61rcWkgMzE\r\n\r\n")
+	require.NoError(t, err)
+	statusLine, head := readHead(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 200 OK", statusLine)
+	assert.Contains(t, head, "x-request-id: abc-123\r\n")
+
+	h := <-seen
+	assert.Equal(t, "abc-123", h.Get("X-Request-ID"))
+	sc, err := tracecontext.ParseTraceparent(h.Get("Traceparent"))
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.NotEqual(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled())
+	assert.Equal(t, "congo=t61rcWkgMzE", h.Get("Tracestate"))
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnel copies bytes between a client and its CONNECT destination.
+type tunnel struct {
+	client, upstream net.Conn
+	idleTimeout      time.Duration
+
+	// lastActivity is the time, in Unix nanoseconds, at which either side
+	// last sent something. A read that times out in one direction is not
+	// idle if the other direction is busy, as with a large download.
+	lastActivity atomic.Int64
+	closeOnce    sync.Once
+}
+
+func newTunnel(client, upstream net.Conn, idleTimeout time.Duration) *tunnel {
+	t := &tunnel{client: client, upstream: upstream, idleTimeout: idleTimeout}
+	t.touch()
+	return t
+}
+
+// run copies in both directions and returns once both are done. Both
+// connections are closed when it returns.
+func (t *tunnel) run() {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		t.pipe(t.upstream, t.client)
+	}()
+	go func() {
+		defer wg.Done()
+		t.pipe(t.client, t.upstream)
+	}()
+	wg.Wait()
+	t.close()
+}
+
+// pipe copies from src to dst until src is done. A clean end of src is
+// passed on as a half-close, so the other direction can finish; anything
+// else tears down the whole tunnel.
+func (t *tunnel) pipe(dst, src net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		src.SetReadDeadline(time.Now().Add(t.idleTimeout))
+		n, err := src.Read(buf)
+		if n > 0 {
+			t.touch()
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				t.close()
+				return
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) && !t.idle() {
+			continue
+		}
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cw.CloseWrite()
+			return
+		}
+		t.close()
+		return
+	}
+}
+
+// touch records activity on the tunnel.
+func (t *tunnel) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idle reports whether nothing has been sent in either direction for the
+// idle timeout.
+func (t *tunnel) idle() bool {
+	return time.Since(time.Unix(0, t.lastActivity.Load())) >= t.idleTimeout
+}
+
+// close closes both connections, unblocking any pending reads.
+func (t *tunnel) close() {
+	t.closeOnce.Do(func() {
+		t.client.Close()
+		t.upstream.Close()
+	})
+}
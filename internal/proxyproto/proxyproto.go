@@ -0,0 +1,287 @@
+// Package proxyproto reads the PROXY protocol header that load balancers
+// such as HAProxy send at the start of a connection to pass on the
+// addresses of the original one.
+//
+// Both the text format of version 1 and the binary format of version 2,
+// with its type-length-value extensions, are supported, as specified in
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ErrNoHeader is returned by Read when the connection does not start with a
+// PROXY protocol header.
+var ErrNoHeader = errors.New("proxyproto: no PROXY protocol header")
+
+// Command tells whether a connection was proxied on behalf of a client.
+type Command byte
+
+const (
+	// CommandLocal marks connections the proxy made on its own, such as
+	// health checks. Their header carries no addresses.
+	CommandLocal Command = 0x0
+	// CommandProxy marks connections relayed for a client.
+	CommandProxy Command = 0x1
+)
+
+// Types of TLVs defined by the specification.
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02
+	TypeCRC32C    byte = 0x03
+	TypeNoop      byte = 0x04
+	TypeUniqueID  byte = 0x05
+	TypeSSL       byte = 0x20
+	TypeNetNS     byte = 0x30
+)
+
+// Header is a PROXY protocol header.
+type Header struct {
+	// Version is 1 or 2.
+	Version int
+	Command Command
+	// Source and Destination are the client and server addresses of the
+	// original connection. They are invalid for local connections and for
+	// address families that are unknown or not IP, such as Unix sockets.
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+	// TLVs holds the extensions of a version 2 header, in order.
+	TLVs []TLV
+}
+
+// TLV is a type-length-value extension of a version 2 header.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// TLV returns the value of the first extension of the given type.
+func (h *Header) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+var (
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// v1MaxLength is the longest a version 1 header may be, CRLF included.
+	v1MaxLength = 107
+	// v2HeaderLength is the length of the fixed part of a version 2 header.
+	v2HeaderLength = 16
+)
+
+// Read reads a PROXY protocol header from the start of a connection. If
+// the connection starts with something else, it returns ErrNoHeader and
+// leaves everything in br to be read again. Read never consumes more than
+// the header, so that what follows it can be read from br.
+func Read(br *bufio.Reader) (*Header, error) {
+	for n := 1; ; n++ {
+		b, err := br.Peek(n)
+		switch {
+		case bytes.Equal(b, v1Signature):
+			return readV1(br)
+		case bytes.Equal(b, v2Signature):
+			return readV2(br)
+		case !bytes.HasPrefix(v1Signature, b) && !bytes.HasPrefix(v2Signature, b):
+			return nil, ErrNoHeader
+		case err != nil:
+			if len(b) > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
+
+// readV1 reads a header in the text format, such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readV1(br *bufio.Reader) (*Header, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == v1MaxLength {
+			return nil, errors.New("proxyproto: header line too long")
+		}
+		c, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1, Command: CommandProxy}
+	switch fields[1] {
+	case "UNKNOWN":
+		// The proxy does not know the addresses; the rest of the line is
+		// to be ignored.
+		return h, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("proxyproto: malformed header line")
+	}
+
+	var err error
+	if h.Source, err = parseV1Address(fields[1], fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if h.Destination, err = parseV1Address(fields[1], fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseV1Address(protocol, ip, port string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Zone() != "" || addr.Is4() != (protocol == "TCP4") {
+		return netip.AddrPort{}, fmt.Errorf("proxyproto: invalid %s address %q", protocol, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return netip.AddrPort{}, fmt.Errorf("proxyproto: invalid port %q", port)
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+// Address families and their lengths in a version 2 header.
+const (
+	familyUnspec = 0x0
+	familyInet   = 0x1
+	familyInet6  = 0x2
+	familyUnix   = 0x3
+
+	inetLength  = 12
+	inet6Length = 36
+	unixLength  = 216
+)
+
+// readV2 reads a header in the binary format.
+func readV2(br *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, v2HeaderLength)
+	if _, err := io.ReadFull(br, fixed); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if version := fixed[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("proxyproto: unsupported version %d", version)
+	}
+	h := &Header{Version: 2, Command: Command(fixed[12] & 0x0f)}
+	if h.Command != CommandLocal && h.Command != CommandProxy {
+		return nil, fmt.Errorf("proxyproto: unsupported command %#x", h.Command)
+	}
+	family := fixed[13] >> 4
+	rest := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	// The receiver must ignore the addresses of local connections and of
+	// unknown families, and everything else with them.
+	if h.Command == CommandLocal || family == familyUnspec {
+		return h, nil
+	}
+
+	var tlvs []byte
+	switch family {
+	case familyInet:
+		if len(rest) < inetLength {
+			return nil, errors.New("proxyproto: truncated addresses")
+		}
+		src, dst := [4]byte(rest[0:4]), [4]byte(rest[4:8])
+		h.Source = netip.AddrPortFrom(netip.AddrFrom4(src), binary.BigEndian.Uint16(rest[8:]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom4(dst), binary.BigEndian.Uint16(rest[10:]))
+		tlvs = rest[inetLength:]
+	case familyInet6:
+		if len(rest) < inet6Length {
+			return nil, errors.New("proxyproto: truncated addresses")
+		}
+		src, dst := [16]byte(rest[0:16]), [16]byte(rest[16:32])
+		h.Source = netip.AddrPortFrom(netip.AddrFrom16(src), binary.BigEndian.Uint16(rest[32:]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom16(dst), binary.BigEndian.Uint16(rest[34:]))
+		tlvs = rest[inet6Length:]
+	case familyUnix:
+		if len(rest) < unixLength {
+			return nil, errors.New("proxyproto: truncated addresses")
+		}
+		tlvs = rest[unixLength:]
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported address family %#x", family)
+	}
+
+	var err error
+	if h.TLVs, err = ParseTLVs(tlvs); err != nil {
+		return nil, err
+	}
+	if sum, ok := h.TLV(TypeCRC32C); ok {
+		if err := checkCRC32C(fixed, rest, sum); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// ParseTLVs parses a sequence of type-length-values, such as the
+// extensions of a header or the sub-extensions that follow the client and
+// verify fields of a TypeSSL value.
+func ParseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.New("proxyproto: truncated TLV")
+		}
+		n := int(binary.BigEndian.Uint16(b[1:]))
+		if len(b) < 3+n {
+			return nil, errors.New("proxyproto: truncated TLV")
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+n]})
+		b = b[3+n:]
+	}
+	return tlvs, nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checkCRC32C checks the checksum of a header, which is computed over the
+// whole header with the checksum itself set to zero. sum is the value of
+// the checksum TLV within rest.
+func checkCRC32C(fixed, rest, sum []byte) error {
+	if len(sum) != 4 {
+		return errors.New("proxyproto: invalid CRC32C TLV")
+	}
+	want := binary.BigEndian.Uint32(sum)
+	clear(sum)
+	defer binary.BigEndian.PutUint32(sum, want)
+	if crc32.Update(crc32.Checksum(fixed, castagnoli), castagnoli, rest) != want {
+		return errors.New("proxyproto: CRC32C mismatch")
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
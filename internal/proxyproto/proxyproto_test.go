@@ -0,0 +1,207 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// v2Header builds a version 2 header with the given command, family and
+// transport, address block and TLVs.
+func v2Header(verCmd, famProto byte, addrs []byte, tlvs ...TLV) []byte {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, verCmd, famProto, 0, 0)
+	b = append(b, addrs...)
+	for _, tlv := range tlvs {
+		b = append(b, tlv.Type, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(tlv.Value)))
+		b = append(b, tlv.Value...)
+	}
+	binary.BigEndian.PutUint16(b[14:], uint16(len(b)-v2HeaderLength))
+	return b
+}
+
+var inetAddrs = []byte{
+	192, 0, 2, 1, // source
+	198, 51, 100, 1, // destination
+	0xdc, 0x04, // source port 56324
+	0x01, 0xbb, // destination port 443
+}
+
+func read(t *testing.T, input string) (*Header, string, error) {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(input))
+	h, err := Read(br)
+	rest, readErr := io.ReadAll(br)
+	require.NoError(t, readErr)
+	return h, string(rest), err
+}
+
+func TestReadV1(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		src   string
+		dst   string
+	}{
+		// Test: TCP over IPv4
+		{"tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", "198.51.100.1:443"},
+		// Test: TCP over IPv6
+		{"tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		// Test: Unknown protocols carry no addresses
+		{"unknown", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", ""},
+		{"unknown bare", "PROXY UNKNOWN\r\n", "", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h, rest, err := read(t, tc.input+"GET / HTTP/1.1\r\n")
+			require.NoError(t, err)
+			assert.Equal(t, 1, h.Version)
+			assert.Equal(t, CommandProxy, h.Command)
+			if tc.src == "" {
+				assert.False(t, h.Source.IsValid())
+				assert.False(t, h.Destination.IsValid())
+			} else {
+				assert.Equal(t, netip.MustParseAddrPort(tc.src), h.Source)
+				assert.Equal(t, netip.MustParseAddrPort(tc.dst), h.Destination)
+			}
+			// Test: What follows the header is left unread
+			assert.Equal(t, "GET / HTTP/1.1\r\n", rest)
+		})
+	}
+}
+
+func TestReadV1Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"missing fields", "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"},
+		{"family mismatch", "PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n"},
+		{"bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"},
+		{"leading zero", "PROXY TCP4 192.0.2.1 198.51.100.1 056324 443\r\n"},
+		{"unsupported protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"},
+		{"bare LF", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"},
+		{"too long", "PROXY UNKNOWN " + strings.Repeat("x", 100) + "\r\n"},
+		{"truncated", "PROXY TCP4 192.0.2.1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := read(t, tc.input)
+			assert.Error(t, err)
+			assert.NotErrorIs(t, err, ErrNoHeader)
+		})
+	}
+}
+
+func TestReadV2(t *testing.T) {
+	// Test: TCP over IPv4 with TLVs
+	input := v2Header(0x21, 0x11, inetAddrs,
+		TLV{TypeALPN, []byte("h2")},
+		TLV{TypeAuthority, []byte("example.com")},
+	)
+	h, rest, err := read(t, string(input)+"GET /")
+	require.NoError(t, err)
+	assert.Equal(t, 2, h.Version)
+	assert.Equal(t, CommandProxy, h.Command)
+	assert.Equal(t, netip.MustParseAddrPort("192.0.2.1:56324"), h.Source)
+	assert.Equal(t, netip.MustParseAddrPort("198.51.100.1:443"), h.Destination)
+	assert.Equal(t, []TLV{{TypeALPN, []byte("h2")}, {TypeAuthority, []byte("example.com")}}, h.TLVs)
+	authority, ok := h.TLV(TypeAuthority)
+	assert.True(t, ok)
+	assert.Equal(t, "example.com", string(authority))
+	_, ok = h.TLV(TypeUniqueID)
+	assert.False(t, ok)
+	assert.Equal(t, "GET /", rest)
+
+	// Test: TCP over IPv6
+	addrs := append(netip.MustParseAddr("2001:db8::1").AsSlice(), netip.MustParseAddr("2001:db8::2").AsSlice()...)
+	addrs = append(addrs, 0xdc, 0x04, 0x01, 0xbb)
+	h, _, err = read(t, string(v2Header(0x21, 0x21, addrs)))
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("[2001:db8::1]:56324"), h.Source)
+	assert.Equal(t, netip.MustParseAddrPort("[2001:db8::2]:443"), h.Destination)
+
+	// Test: Unix sockets have TLVs but no IP addresses
+	h, _, err = read(t, string(v2Header(0x21, 0x31, make([]byte, unixLength), TLV{TypeNoop, nil})))
+	require.NoError(t, err)
+	assert.False(t, h.Source.IsValid())
+	assert.Equal(t, []TLV{{TypeNoop, []byte{}}}, h.TLVs)
+
+	// Test: Local connections ignore everything after the fixed part
+	h, rest, err = read(t, string(v2Header(0x20, 0x11, inetAddrs, TLV{0xff, []byte("x")}))+"GET /")
+	require.NoError(t, err)
+	assert.Equal(t, CommandLocal, h.Command)
+	assert.False(t, h.Source.IsValid())
+	assert.Empty(t, h.TLVs)
+	assert.Equal(t, "GET /", rest)
+}
+
+func TestReadV2CRC32C(t *testing.T) {
+	input := v2Header(0x21, 0x11, inetAddrs, TLV{TypeCRC32C, make([]byte, 4)})
+	sum := crc32.Checksum(input, crc32.MakeTable(crc32.Castagnoli))
+	binary.BigEndian.PutUint32(input[len(input)-4:], sum)
+
+	// Test: A correct checksum is accepted and kept
+	h, _, err := read(t, string(input))
+	require.NoError(t, err)
+	value, ok := h.TLV(TypeCRC32C)
+	require.True(t, ok)
+	assert.Equal(t, sum, binary.BigEndian.Uint32(value))
+
+	// Test: A header that does not match its checksum is rejected
+	input[16] ^= 1
+	_, _, err = read(t, string(input))
+	assert.ErrorContains(t, err, "CRC32C mismatch")
+}
+
+func TestReadV2Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"version", v2Header(0x11, 0x11, inetAddrs)},
+		{"command", v2Header(0x22, 0x11, inetAddrs)},
+		{"family", v2Header(0x21, 0x41, inetAddrs)},
+		{"short addresses", v2Header(0x21, 0x21, inetAddrs)},
+		{"truncated TLV", v2Header(0x21, 0x11, append(inetAddrs[:12:12], TypeNoop, 0, 9, 'x'))},
+		{"truncated", v2Header(0x21, 0x11, inetAddrs)[:20]},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := read(t, string(tc.input))
+			assert.Error(t, err)
+			assert.NotErrorIs(t, err, ErrNoHeader)
+		})
+	}
+}
+
+func TestReadNoHeader(t *testing.T) {
+	tests := []string{
+		"GET / HTTP/1.1\r\n",
+		"PRI * HTTP/2.0\r\n",
+		"PROXYX",
+		"\r\n\r\nGET",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			// Test: Connections without a header are left to be read again
+			_, rest, err := read(t, input)
+			assert.ErrorIs(t, err, ErrNoHeader)
+			assert.Equal(t, input, rest)
+		})
+	}
+
+	// Test: A connection that ends before telling
+	_, _, err := read(t, "")
+	assert.ErrorIs(t, err, io.EOF)
+	_, _, err = read(t, "PROX")
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
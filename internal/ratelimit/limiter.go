@@ -0,0 +1,232 @@
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// DefaultMaxKeys is how many keys a limiter tracks when maxKeys is not
+// positive.
+const DefaultMaxKeys = 10000
+
+// Result is the outcome of checking a request against a limit.
+type Result struct {
+	// Allowed is set if the request is within the limit.
+	Allowed bool
+	// Limit is the number of requests the limit allows in a burst.
+	Limit int
+	// Remaining is the number of requests left right now.
+	Remaining int
+	// Reset is how long until the full limit is available again.
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, for a
+	// request that was not.
+	RetryAfter time.Duration
+}
+
+// Limiter decides whether the next request of a client, identified by key,
+// is within the limit. Each call counts as a request.
+type Limiter interface {
+	Allow(key string) Result
+}
+
+// TokenBucket allows bursts of up to burst requests, refilled at a steady
+// rate. Clients that stay within the rate are never limited.
+type TokenBucket struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   int
+	buckets *lru[*bucket]
+
+	// now returns the current time. Tests replace it.
+	now func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a limiter that allows n requests per period on
+// average, and bursts of up to burst requests. It keeps state for at most
+// maxKeys clients, forgetting those that were seen longest ago first. It
+// panics unless n and period are positive.
+func NewTokenBucket(n int, period time.Duration, burst, maxKeys int) *TokenBucket {
+	if n <= 0 || period <= 0 {
+		panic("ratelimit: NewTokenBucket needs a positive n and period")
+	}
+	return &TokenBucket{
+		rate:    float64(n) / period.Seconds(),
+		burst:   max(burst, 1),
+		buckets: newLRU[*bucket](maxKeys),
+		now:     time.Now,
+	}
+}
+
+func (l *TokenBucket) Allow(key string) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b := l.buckets.get(key, func() *bucket {
+		return &bucket{tokens: float64(l.burst), last: now}
+	})
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*l.rate, float64(l.burst))
+	b.last = now
+
+	r := Result{Limit: l.burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		r.Allowed = true
+	} else {
+		r.RetryAfter = l.duration(1 - b.tokens)
+	}
+	r.Remaining = int(b.tokens)
+	r.Reset = l.duration(float64(l.burst) - b.tokens)
+	return r
+}
+
+// duration returns how long refilling the given number of tokens takes.
+func (l *TokenBucket) duration(tokens float64) time.Duration {
+	return time.Duration(math.Ceil(tokens / l.rate * float64(time.Second)))
+}
+
+// SlidingWindow allows limit requests in any window of the given length.
+// It estimates the requests in the window from the counts of the current
+// and the previous fixed window, weighting the previous one by how much of
+// it the sliding window still covers, which needs little memory per client.
+type SlidingWindow struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	windows *lru[*window]
+
+	// now returns the current time. Tests replace it.
+	now func() time.Time
+}
+
+type window struct {
+	start    time.Time
+	previous int
+	current  int
+}
+
+// NewSlidingWindow returns a limiter that allows limit requests in any
+// window of the given length. It keeps state for at most maxKeys clients,
+// forgetting those that were seen longest ago first. It panics unless
+// length is positive.
+func NewSlidingWindow(limit int, length time.Duration, maxKeys int) *SlidingWindow {
+	if length <= 0 {
+		panic("ratelimit: NewSlidingWindow needs a positive length")
+	}
+	return &SlidingWindow{
+		limit:   max(limit, 1),
+		window:  length,
+		windows: newLRU[*window](maxKeys),
+		now:     time.Now,
+	}
+}
+
+func (l *SlidingWindow) Allow(key string) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	start := now.Truncate(l.window)
+	w := l.windows.get(key, func() *window { return &window{start: start} })
+	switch elapsed := start.Sub(w.start); {
+	case elapsed == l.window:
+		w.previous, w.current = w.current, 0
+		w.start = start
+	case elapsed > l.window:
+		w.previous, w.current = 0, 0
+		w.start = start
+	}
+
+	// weight is how much of the previous window the sliding window covers.
+	weight := 1 - float64(now.Sub(start))/float64(l.window)
+	count := int(math.Floor(float64(w.previous)*weight)) + w.current
+
+	r := Result{Limit: l.limit}
+	if count < l.limit {
+		w.current++
+		count++
+		r.Allowed = true
+	} else {
+		r.RetryAfter = l.retryAfter(w, now.Sub(start))
+	}
+	r.Remaining = max(l.limit-count, 0)
+	// Requests of the previous window stop counting when the current one
+	// ends, and those of the current window when the next one ends.
+	switch end := start.Add(l.window).Sub(now); {
+	case w.current > 0:
+		r.Reset = end + l.window
+	case w.previous > 0:
+		r.Reset = end
+	}
+	return r
+}
+
+// retryAfter returns how long after elapsed, measured from the start of
+// the current window, the estimated count drops below the limit.
+func (l *SlidingWindow) retryAfter(w *window, elapsed time.Duration) time.Duration {
+	free := float64(l.limit - 1 - w.current)
+	if free >= 0 && w.previous > 0 {
+		// previous*(1-t/window) + current <= limit-1
+		t := time.Duration(math.Ceil((1 - free/float64(w.previous)) * float64(l.window)))
+		if t > elapsed {
+			return t - elapsed
+		}
+	}
+	// Wait for the next window, where the current count becomes the
+	// previous one.
+	wait := l.window - elapsed
+	if w.current >= l.limit {
+		wait += time.Duration(math.Ceil((1 - float64(l.limit-1)/float64(w.current)) * float64(l.window)))
+	}
+	return wait
+}
+
+// lru maps keys to values, dropping the least recently used key once it
+// holds more than max keys.
+type lru[V any] struct {
+	max   int
+	order *list.List // of *lruEntry[V], most recently used first
+	items map[string]*list.Element
+}
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+func newLRU[V any](maxKeys int) *lru[V] {
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+	return &lru[V]{max: maxKeys, order: list.New(), items: map[string]*list.Element{}}
+}
+
+// get returns the value of key, creating it if needed, and marks it as the
+// most recently used.
+func (c *lru[V]) get(key string, create func() V) V {
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*lruEntry[V]).value
+	}
+	v := create()
+	c.items[key] = c.order.PushFront(&lruEntry[V]{key: key, value: v})
+	if c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[V]).key)
+	}
+	return v
+}
+
+// len returns the number of keys.
+func (c *lru[V]) len() int {
+	return c.order.Len()
+}
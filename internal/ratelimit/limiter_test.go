@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// clock is a fake time source.
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time { return c.now }
+
+func (c *clock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestTokenBucket(t *testing.T) {
+	clk := &clock{now: time.Unix(1700000000, 0)}
+	l := NewTokenBucket(1, time.Second, 3, 0)
+	l.now = clk.Now
+
+	// Test: A full bucket allows a burst
+	for i := 2; i >= 0; i-- {
+		r := l.Allow("a")
+		assert.True(t, r.Allowed)
+		assert.Equal(t, 3, r.Limit)
+		assert.Equal(t, i, r.Remaining)
+	}
+
+	// Test: An empty bucket refuses until a token is back
+	r := l.Allow("a")
+	assert.False(t, r.Allowed)
+	assert.Equal(t, time.Second, r.RetryAfter)
+	assert.Equal(t, 3*time.Second, r.Reset)
+
+	clk.advance(500 * time.Millisecond)
+	r = l.Allow("a")
+	assert.False(t, r.Allowed)
+	assert.Equal(t, 500*time.Millisecond, r.RetryAfter)
+
+	clk.advance(500 * time.Millisecond)
+	assert.True(t, l.Allow("a").Allowed)
+	assert.False(t, l.Allow("a").Allowed)
+
+	// Test: Keys have buckets of their own
+	assert.True(t, l.Allow("b").Allowed)
+
+	// Test: Buckets refill up to the burst only
+	clk.advance(time.Hour)
+	r = l.Allow("a")
+	assert.True(t, r.Allowed)
+	assert.Equal(t, 2, r.Remaining)
+	assert.Equal(t, time.Second, r.Reset)
+}
+
+func TestLimiterArguments(t *testing.T) {
+	// Test: Rates and windows that are not positive are refused
+	assert.Panics(t, func() { NewTokenBucket(0, time.Second, 1, 0) })
+	assert.Panics(t, func() { NewTokenBucket(-1, time.Second, 1, 0) })
+	assert.Panics(t, func() { NewTokenBucket(1, 0, 1, 0) })
+	assert.Panics(t, func() { NewSlidingWindow(1, 0, 0) })
+}
+
+func TestSlidingWindow(t *testing.T) {
+	clk := &clock{now: time.Unix(1700000000, 0).Truncate(time.Minute)}
+	l := NewSlidingWindow(10, time.Minute, 0)
+	l.now = clk.Now
+
+	// Test: The limit applies within a window
+	for i := 9; i >= 0; i-- {
+		r := l.Allow("a")
+		assert.True(t, r.Allowed)
+		assert.Equal(t, i, r.Remaining)
+		assert.Equal(t, 2*time.Minute, r.Reset)
+	}
+	r := l.Allow("a")
+	assert.False(t, r.Allowed)
+	assert.Equal(t, 0, r.Remaining)
+	// The next window starts with all ten requests still counted, and
+	// one of them leaves after a tenth of it.
+	assert.Equal(t, time.Minute+6*time.Second, r.RetryAfter)
+
+	// Test: Requests of the previous window count for the part of it the
+	// sliding window still covers
+	clk.advance(time.Minute + 30*time.Second)
+	for range 5 {
+		assert.True(t, l.Allow("a").Allowed)
+	}
+	r = l.Allow("a")
+	assert.False(t, r.Allowed)
+	// 10*(1-t/60) + 5 <= 9 once t reaches 36 seconds.
+	assert.Equal(t, 6*time.Second, r.RetryAfter)
+
+	clk.advance(6 * time.Second)
+	assert.True(t, l.Allow("a").Allowed)
+
+	// Test: Windows long past are forgotten
+	clk.advance(time.Hour)
+	r = l.Allow("a")
+	assert.True(t, r.Allowed)
+	assert.Equal(t, 9, r.Remaining)
+}
+
+func TestLRU(t *testing.T) {
+	l := NewTokenBucket(1, time.Hour, 1, 3)
+
+	// Test: The least recently used key is dropped
+	for i := range 3 {
+		assert.True(t, l.Allow(strconv.Itoa(i)).Allowed)
+	}
+	assert.False(t, l.Allow("0").Allowed)
+	assert.True(t, l.Allow("3").Allowed)
+	assert.Equal(t, 3, l.buckets.len())
+
+	// "1" was dropped and starts over with a full bucket, while "0" was
+	// used recently and is still limited.
+	assert.True(t, l.Allow("1").Allowed)
+	assert.False(t, l.Allow("0").Allowed)
+}
@@ -0,0 +1,126 @@
+// Package ratelimit limits how many requests each client may make.
+//
+// A limiter is shared by every request passing through one middleware, so
+// routes get limits of their own by wrapping them separately.
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/auth"
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+)
+
+// Config configures the rate limiting middleware.
+type Config struct {
+	// Limiter decides which requests are allowed. It is required.
+	Limiter Limiter
+	// Key returns the key that identifies the client of a request.
+	// Requests for which it returns "" are not limited. If nil,
+	// ByRemoteAddr is used.
+	Key func(req *request.Request) string
+}
+
+// ByRemoteAddr keys requests by the IP address of the client, which is the
+// one behind trusted proxies if ipfilter.TrustedProxies runs first. IPv6
+// clients are keyed by their /64 network, since a client is usually given
+// a whole one and can pick a new address from it for every request.
+func ByRemoteAddr(req *request.Request) string {
+	ip := req.ClientIP
+	if !ip.IsValid() {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		if ip, err = netip.ParseAddr(host); err != nil {
+			return "ip:" + host
+		}
+	}
+	ip = ip.Unmap()
+	if ip.Is6() {
+		network, _ := ip.Prefix(64)
+		return "ip:" + network.String()
+	}
+	return "ip:" + ip.String()
+}
+
+// ByHeader keys requests by the value of a header, such as an API key.
+// Requests without the header are keyed by their remote address.
+func ByHeader(name string) func(req *request.Request) string {
+	return func(req *request.Request) string {
+		if v := req.Headers.Get(name); v != "" {
+			return "header:" + v
+		}
+		return ByRemoteAddr(req)
+	}
+}
+
+// ByPrincipal keys requests by the principal the auth middleware attached,
+// so that it must run first. Anonymous requests are keyed by their remote
+// address.
+func ByPrincipal(req *request.Request) string {
+	if p := auth.Get(req); p != nil {
+		return "principal:" + p.Scheme + ":" + p.Name
+	}
+	return ByRemoteAddr(req)
+}
+
+// Handler returns a handler that passes requests within the limit on to
+// next, and answers the others with 429 Too Many Requests and a
+// Retry-After header. Every response carries the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers of the IETF draft.
+func Handler(cfg Config, next server.Handler) server.Handler {
+	if cfg.Limiter == nil {
+		panic("ratelimit: Config.Limiter is required")
+	}
+	if cfg.Key == nil {
+		cfg.Key = ByRemoteAddr
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		key := cfg.Key(req)
+		if key == "" {
+			next(w, req)
+			return
+		}
+
+		r := cfg.Limiter.Allow(key)
+		if !r.Allowed {
+			tooManyRequests(w, r)
+			return
+		}
+		w.OnWriteHeaders(func(h headers.Headers) {
+			setHeaders(h, r)
+		})
+		next(w, req)
+	}
+}
+
+func tooManyRequests(w *response.Writer, r Result) {
+	w.WriteStatusLine(response.StatusCodeTooManyRequests)
+	body := []byte("Too many requests")
+	h := response.GetDefaultHeaders(len(body))
+	setHeaders(h, r)
+	h.Override("Retry-After", strconv.Itoa(seconds(r.RetryAfter)))
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func setHeaders(h headers.Headers, r Result) {
+	h.Override("RateLimit-Limit", strconv.Itoa(r.Limit))
+	h.Override("RateLimit-Remaining", strconv.Itoa(r.Remaining))
+	h.Override("RateLimit-Reset", strconv.Itoa(seconds(r.Reset)))
+}
+
+// seconds rounds d up to whole seconds, so that clients waiting that long
+// are not limited again.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
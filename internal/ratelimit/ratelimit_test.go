@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/auth"
+	"github.com/Fepozopo/httpfromtcp/internal/handlertest"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+)
+
+func ok(w *response.Writer, _ *request.Request) {
+	body := []byte("ok")
+	w.WriteStatusLine(response.StatusCodeSuccess)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+// from returns a request from remoteAddr with the given header lines.
+func from(t *testing.T, remoteAddr string, hdrs ...string) *request.Request {
+	t.Helper()
+	req := handlertest.NewRequest(t, "GET", "/", hdrs...)
+	req.RemoteAddr = remoteAddr
+	return req
+}
+
+func TestHandler(t *testing.T) {
+	h := Handler(Config{Limiter: NewTokenBucket(1, time.Minute, 2, 0)}, ok)
+
+	// Test: Allowed responses carry the limit headers
+	resp := handlertest.Do(t, h, from(t, "192.0.2.1:50000"))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("RateLimit-Limit"))
+	assert.Equal(t, "1", resp.Header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", resp.Header.Get("RateLimit-Reset"))
+
+	// Test: Other ports of the same address share the limit
+	resp = handlertest.Do(t, h, from(t, "192.0.2.1:50001"))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+
+	// Test: Requests over the limit get 429 with Retry-After
+	resp = handlertest.Do(t, h, from(t, "192.0.2.1:50002"))
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	assert.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+
+	// Test: Other addresses are not affected
+	resp = handlertest.Do(t, h, from(t, "[2001:db8::1]:50000"))
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		key  func(req *request.Request) string
+		hdrs []string
+		want string
+	}{
+		// Test: Remote address without the port
+		{"remote addr", ByRemoteAddr, nil, "ip:192.0.2.1"},
+		// Test: Header value, falling back to the address
+		{"header", ByHeader("X-Api-Key"), []string{"X-Api-Key: k1"}, "header:k1"},
+		{"header missing", ByHeader("X-Api-Key"), nil, "ip:192.0.2.1"},
+		// Test: Authenticated principal
+		{"principal", ByPrincipal, []string{"Authorization: Basic YWxpY2U6cHc="}, "principal:Basic:alice"},
+		{"anonymous", ByPrincipal, nil, "ip:192.0.2.1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got string
+			h := Handler(Config{
+				Limiter: NewTokenBucket(1, time.Minute, 1, 0),
+				Key: func(req *request.Request) string {
+					got = tc.key(req)
+					return got
+				},
+			}, ok)
+			if len(tc.hdrs) > 0 && strings.HasPrefix(tc.hdrs[0], "Authorization") {
+				h = auth.Handler(auth.Config{Basic: func(user, password string) bool { return password == "pw" }}, h)
+			}
+			handlertest.Do(t, h, from(t, "192.0.2.1:50000", tc.hdrs...))
+			assert.Equal(t, tc.want, got)
+		})
+	}
+
+	// Test: IPv6 clients are keyed by their /64 network
+	var got string
+	h := Handler(Config{
+		Limiter: NewTokenBucket(1, time.Minute, 1, 0),
+		Key: func(req *request.Request) string {
+			got = ByRemoteAddr(req)
+			return got
+		},
+	}, ok)
+	handlertest.Do(t, h, from(t, "[2001:db8:1:2:3:4:5:6]:50000"))
+	assert.Equal(t, "ip:2001:db8:1:2::/64", got)
+	resp := handlertest.Do(t, h, from(t, "[2001:db8:1:2:ffff::1]:50000"))
+	assert.Equal(t, 429, resp.StatusCode)
+	handlertest.Do(t, h, from(t, "[::ffff:192.0.2.1]:50000"))
+	assert.Equal(t, "ip:192.0.2.1", got)
+
+	// Test: Requests without a key are not limited
+	h = Handler(Config{Limiter: NewTokenBucket(1, time.Minute, 1, 0), Key: func(*request.Request) string { return "" }}, ok)
+	for range 3 {
+		resp := handlertest.Do(t, h, from(t, "192.0.2.1:50000"))
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("RateLimit-Limit"))
+	}
+}
@@ -0,0 +1,37 @@
+package request
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// BasicAuth returns the user name and password sent in the Authorization
+// header with the Basic scheme.
+func (r *Request) BasicAuth() (user, password string, ok bool) {
+	return ParseBasicAuth(r.Headers.Get("authorization"))
+}
+
+// ParseBasicAuth decodes "Basic base64(user:password)" credentials, as sent
+// in the Authorization and Proxy-Authorization headers.
+func ParseBasicAuth(value string) (user, password string, ok bool) {
+	scheme, encoded, found := strings.Cut(value, " ")
+	if !found || !strings.EqualFold(scheme, "basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// BearerToken returns the token sent in the Authorization header with the
+// Bearer scheme.
+func (r *Request) BearerToken() (string, bool) {
+	scheme, token, found := strings.Cut(r.Headers.Get("authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
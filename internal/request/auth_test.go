@@ -0,0 +1,56 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorization(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		user          string
+		password      string
+		basic         bool
+		token         string
+		bearer        bool
+	}{
+		// Test: Basic credentials
+		{"basic", "Basic YWxpY2U6c2VjcmV0", "alice", "secret", true, "", false},
+		// Test: Schemes are case-insensitive
+		{"basic lowercase", "basic YWxpY2U6c2VjcmV0", "alice", "secret", true, "", false},
+		// Test: Passwords may contain colons
+		{"colon", "Basic YWxpY2U6YTpi", "alice", "a:b", true, "", false},
+		// Test: Malformed Basic credentials
+		{"bad base64", "Basic !!!", "", "", false, "", false},
+		{"no colon", "Basic YWxpY2U=", "", "", false, "", false},
+		// Test: Bearer token
+		{"bearer", "Bearer abc.def.ghi", "", "", false, "abc.def.ghi", true},
+		{"bearer lowercase", "bearer abc", "", "", false, "abc", true},
+		// Test: Bearer without a token
+		{"bearer empty", "Bearer ", "", "", false, "", false},
+		// Test: No Authorization header
+		{"missing", "", "", "", false, "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := "GET / HTTP/1.1\r\nHost: localhost:42069\r\n"
+			if tc.authorization != "" {
+				data += "Authorization: " + tc.authorization + "\r\n"
+			}
+			r, err := RequestFromReader(&chunkReader{data: data + "\r\n", numBytesPerRead: 8})
+			assert.NoError(t, err)
+
+			user, password, ok := r.BasicAuth()
+			assert.Equal(t, tc.basic, ok)
+			if ok {
+				assert.Equal(t, tc.user, user)
+				assert.Equal(t, tc.password, password)
+			}
+			token, ok := r.BearerToken()
+			assert.Equal(t, tc.bearer, ok)
+			assert.Equal(t, tc.token, token)
+		})
+	}
+}
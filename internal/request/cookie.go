@@ -0,0 +1,26 @@
+package request
+
+import (
+	"errors"
+
+	"github.com/Fepozopo/httpfromtcp/internal/cookie"
+)
+
+// ErrNoCookie is returned by Cookie when the request has no such cookie.
+var ErrNoCookie = errors.New("named cookie not present")
+
+// Cookies returns the cookies sent with the request, in the order the
+// client sent them. Malformed cookies are skipped.
+func (r *Request) Cookies() []*cookie.Cookie {
+	return cookie.Parse(r.Headers.Get("cookie"))
+}
+
+// Cookie returns the first cookie with the given name, or ErrNoCookie.
+func (r *Request) Cookie(name string) (*cookie.Cookie, error) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, ErrNoCookie
+}
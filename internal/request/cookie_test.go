@@ -0,0 +1,37 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookies(t *testing.T) {
+	reader := &chunkReader{
+		data: "GET / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Cookie: session=abc; theme=dark\r\n" +
+			"Cookie: lang=en\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+
+	// Test: Cookies from every Cookie header
+	var names []string
+	for _, c := range r.Cookies() {
+		names = append(names, c.Name+"="+c.Value)
+	}
+	assert.Equal(t, []string{"session=abc", "theme=dark", "lang=en"}, names)
+
+	// Test: Cookie by name
+	c, err := r.Cookie("theme")
+	require.NoError(t, err)
+	assert.Equal(t, "dark", c.Value)
+
+	// Test: Missing cookie
+	_, err = r.Cookie("missing")
+	require.ErrorIs(t, err, ErrNoCookie)
+}
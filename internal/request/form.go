@@ -0,0 +1,165 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MaxFormParams is the maximum number of parameters accepted in a query string
+// or in a URL-encoded body. Parsing more than that fails with ErrTooManyParams,
+// which keeps a single request from allocating an unbounded number of values.
+var MaxFormParams = 1000
+
+var (
+	// ErrMalformedForm is returned (possibly wrapped) for any query string or
+	// form body that cannot be parsed. Handlers should answer with 400 Bad
+	// Request when errors.Is(err, ErrMalformedForm).
+	ErrMalformedForm = errors.New("malformed form data")
+	// ErrTooManyParams is returned when more than MaxFormParams parameters
+	// are sent. It wraps ErrMalformedForm.
+	ErrTooManyParams = fmt.Errorf("%w: too many parameters", ErrMalformedForm)
+)
+
+// Values maps a parameter name to all of its values, in the order in which
+// they were sent.
+type Values map[string][]string
+
+// Get returns the first value for the given key, or "" if there is none.
+func (v Values) Get(key string) string {
+	if vs := v[key]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// Add appends a value to the list of values for the given key.
+func (v Values) Add(key, value string) {
+	v[key] = append(v[key], value)
+}
+
+// Has reports whether the given key is present, even with an empty value.
+func (v Values) Has(key string) bool {
+	_, ok := v[key]
+	return ok
+}
+
+// Query parses the query string of the request target and returns its
+// parameters. The result is cached, so calling Query repeatedly is cheap.
+func (r *Request) Query() (Values, error) {
+	if r.query == nil {
+		query, err := parseValues(r.RequestLine.Target.RawQuery)
+		if err != nil {
+			return nil, err
+		}
+		r.query = query
+	}
+	return r.query, nil
+}
+
+// ParseForm populates Form and PostForm. PostForm holds the parameters of an
+// "application/x-www-form-urlencoded" body sent with POST, PUT or PATCH, and
+// Form holds those body parameters followed by the query parameters.
+//
+// Reading the body goes through ReadBody, so a client waiting for
+// "100 Continue" is told to send it. ParseForm is idempotent.
+func (r *Request) ParseForm() error {
+	if r.Form != nil {
+		return nil
+	}
+
+	postForm := Values{}
+	switch r.RequestLine.Method {
+	case "POST", "PUT", "PATCH":
+		if mediaType(r.Headers.Get("content-type")) == "application/x-www-form-urlencoded" {
+			body, err := r.ReadBody()
+			if err != nil {
+				return err
+			}
+			postForm, err = parseValues(string(body))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	query, err := r.Query()
+	if err != nil {
+		return err
+	}
+
+	form := Values{}
+	count := 0
+	for _, src := range []Values{postForm, query} {
+		for k, vs := range src {
+			form[k] = append(form[k], vs...)
+			count += len(vs)
+		}
+	}
+	if count > MaxFormParams {
+		return ErrTooManyParams
+	}
+
+	r.PostForm = postForm
+	r.Form = form
+	return nil
+}
+
+// FormValue returns the first value for the given key from Form, calling
+// ParseForm if necessary. Parse errors are ignored; use ParseForm to see them.
+func (r *Request) FormValue(key string) string {
+	r.ParseForm()
+	return r.Form.Get(key)
+}
+
+// parseValues parses a URL-encoded "a=1&b=2" string. Both names and values
+// are percent-decoded and "+" is decoded as a space.
+func parseValues(s string) (Values, error) {
+	values := Values{}
+	count := 0
+	for s != "" {
+		var pair string
+		pair, s, _ = strings.Cut(s, "&")
+		if pair == "" {
+			continue
+		}
+		// A semicolon used to be a separator too; accepting it silently
+		// would make us disagree with proxies about the parameters.
+		if strings.Contains(pair, ";") {
+			return nil, fmt.Errorf("%w: invalid semicolon separator in %q", ErrMalformedForm, pair)
+		}
+
+		count++
+		if count > MaxFormParams {
+			return nil, ErrTooManyParams
+		}
+
+		key, value, _ := strings.Cut(pair, "=")
+		key, err := formUnescape(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err = formUnescape(value)
+		if err != nil {
+			return nil, err
+		}
+		values.Add(key, value)
+	}
+	return values, nil
+}
+
+// formUnescape decodes a single name or value of a URL-encoded string.
+func formUnescape(s string) (string, error) {
+	decoded, err := percentDecode(strings.ReplaceAll(s, "+", " "))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrMalformedForm, err)
+	}
+	return decoded, nil
+}
+
+// mediaType returns the lowercased media type of a Content-Type value,
+// without any parameters.
+func mediaType(contentType string) string {
+	mt, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mt))
+}
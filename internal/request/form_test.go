@@ -0,0 +1,92 @@
+package request
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuery(t *testing.T) {
+	// Test: Multi-value query with decoding
+	reader := &chunkReader{
+		data:            "GET /search?q=hello+world&tag=a&tag=b%26c&empty=&flag HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	query, err := r.Query()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", query.Get("q"))
+	assert.Equal(t, []string{"a", "b&c"}, query["tag"])
+	assert.True(t, query.Has("empty"))
+	assert.True(t, query.Has("flag"))
+	assert.Equal(t, "", query.Get("flag"))
+	assert.False(t, query.Has("missing"))
+
+	// Test: Invalid percent-encoding in a value
+	_, err = parseValues("a=%zz")
+	require.ErrorIs(t, err, ErrMalformedForm)
+
+	// Test: Semicolon separators are rejected
+	_, err = parseValues("a=1;b=2")
+	require.ErrorIs(t, err, ErrMalformedForm)
+
+	// Test: Too many parameters
+	_, err = parseValues(strings.Repeat("a=1&", MaxFormParams+1))
+	require.ErrorIs(t, err, ErrTooManyParams)
+	require.ErrorIs(t, err, ErrMalformedForm)
+}
+
+func TestParseForm(t *testing.T) {
+	// Test: URL-encoded body and query
+	body := "name=Ada+Lovelace&lang=en"
+	reader := &chunkReader{
+		data: "POST /submit?lang=fr HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: application/x-www-form-urlencoded; charset=utf-8\r\n" +
+			"Content-Length: 25\r\n" +
+			"\r\n" +
+			body,
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, "Ada Lovelace", r.PostForm.Get("name"))
+	assert.Equal(t, []string{"en"}, r.PostForm["lang"])
+	assert.Equal(t, []string{"en", "fr"}, r.Form["lang"])
+	assert.Equal(t, "Ada Lovelace", r.FormValue("name"))
+
+	// Test: Other content types are not parsed
+	reader = &chunkReader{
+		data: "POST /submit?a=1 HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: application/json\r\n" +
+			"Content-Length: 2\r\n" +
+			"\r\n" +
+			"{}",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ParseForm())
+	assert.Empty(t, r.PostForm)
+	assert.Equal(t, "1", r.Form.Get("a"))
+
+	// Test: Malformed body
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: application/x-www-form-urlencoded\r\n" +
+			"Content-Length: 4\r\n" +
+			"\r\n" +
+			"a=%4",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.ErrorIs(t, r.ParseForm(), ErrMalformedForm)
+	assert.Nil(t, r.Form)
+}
@@ -0,0 +1,58 @@
+package request
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Fepozopo/httpfromtcp/internal/multipart"
+)
+
+// MultipartReader returns a reader that streams the parts of a
+// "multipart/form-data" body one at a time. Use it instead of
+// ParseMultipartForm to process uploads without storing them.
+func (r *Request) MultipartReader() (*multipart.Reader, error) {
+	boundary, err := multipart.Boundary(r.Headers.Get("content-type"))
+	if err != nil {
+		return nil, err
+	}
+	body, err := r.BodyReader()
+	if err != nil {
+		return nil, err
+	}
+	return multipart.NewReader(body, boundary), nil
+}
+
+// ParseMultipartForm reads a "multipart/form-data" body into MultipartForm.
+// File parts are kept in memory up to limits.MaxMemory and streamed to
+// temporary files beyond that; the caller should call
+// MultipartForm.RemoveAll when done with them.
+//
+// A Content-Length above limits.MaxTotalSize is rejected before the body is
+// read, so a client waiting for "100 Continue" never sends it. Only such a
+// deferred body is streamed; any other body was read with the request, up to
+// the limit of the Reader (see server.WithMaxBodySize).
+// ParseMultipartForm is idempotent.
+func (r *Request) ParseMultipartForm(limits multipart.Limits) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+
+	limits = limits.WithDefaults()
+	if cl := r.Headers.Get("content-length"); cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err == nil && n > limits.MaxTotalSize {
+			return fmt.Errorf("%w: content-length %d exceeds %d bytes", multipart.ErrFormTooLarge, n, limits.MaxTotalSize)
+		}
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	form, err := mr.ReadForm(limits)
+	if err != nil {
+		return err
+	}
+	r.MultipartForm = form
+	return nil
+}
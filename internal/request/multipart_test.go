@@ -0,0 +1,67 @@
+package request
+
+import (
+	"io"
+	"testing"
+
+	"github.com/Fepozopo/httpfromtcp/internal/multipart"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMultipartForm(t *testing.T) {
+	body := "--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\n" +
+		"\r\n" +
+		"hello\r\n" +
+		"--xyz--\r\n"
+
+	// Test: Deferred body is streamed after 100 Continue
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: multipart/form-data; boundary=xyz\r\n" +
+			"Content-Length: 88\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n" +
+			body,
+		numBytesPerRead: 7,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	continued := false
+	r.OnContinue(func() error {
+		continued = true
+		return nil
+	})
+	require.NoError(t, r.ParseMultipartForm(multipart.Limits{}))
+	assert.True(t, continued)
+	assert.False(t, r.BodyPending())
+	f, err := r.MultipartForm.File["file"][0].Open()
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// Test: Content-Length above the limit is rejected without reading
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: multipart/form-data; boundary=xyz\r\n" +
+			"Content-Length: 88\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	continued = false
+	r.OnContinue(func() error {
+		continued = true
+		return nil
+	})
+	err = r.ParseMultipartForm(multipart.Limits{MaxTotalSize: 10})
+	require.ErrorIs(t, err, multipart.ErrFormTooLarge)
+	assert.False(t, continued)
+	assert.True(t, r.BodyPending())
+}
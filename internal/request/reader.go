@@ -0,0 +1,73 @@
+package request
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrBodyPending is returned by Reader.ReadRequest and Reader.Detach when
+// the body of the previous request has not been read completely, so the
+// next request cannot be found.
+var ErrBodyPending = errors.New("body of the previous request has not been read")
+
+// Reader reads the successive requests of one connection. Bytes read past
+// the end of a request, such as the start of a request the client pipelined
+// behind it, are kept and parsed as part of the next request.
+type Reader struct {
+	// MaxBodySize, if positive, is the largest body a request may announce
+	// with Content-Length. Larger requests are rejected with ErrBodyTooLarge
+	// before their body is read, since it is otherwise held in memory.
+	MaxBodySize int64
+
+	reader io.Reader
+	// last is the last request read, which holds the bytes read past its
+	// end until the next request is read or it is detached.
+	last *Request
+	// leftover holds the bytes read past the end of a detached request.
+	leftover []byte
+}
+
+// NewReader creates a Reader for the requests sent on reader.
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{reader: reader}
+}
+
+// ReadRequest reads the next request. The body of the previous request must
+// have been read completely. It returns io.EOF if the client closed the
+// connection between requests.
+func (rr *Reader) ReadRequest() (*Request, error) {
+	if rr.last != nil {
+		if err := rr.Detach(rr.last); err != nil {
+			return nil, err
+		}
+	}
+	leftover := rr.leftover
+	rr.leftover = nil
+
+	req, err := readRequest(rr.reader, leftover, rr.MaxBodySize)
+	if err != nil {
+		return nil, err
+	}
+	rr.last = req
+	return req, nil
+}
+
+// Detach takes the bytes read past the end of req, the last request read,
+// so that the next request can be read while req is still being handled.
+// The body of req must have been read completely. Afterwards req no longer
+// has a connection of its own: it cannot be upgraded and Buffered returns
+// nothing.
+//
+// Detach must be called before req is handed to another goroutine.
+func (rr *Reader) Detach(req *Request) error {
+	if req != rr.last {
+		return nil
+	}
+	if req.BodyPending() {
+		return ErrBodyPending
+	}
+	rr.leftover = req.Buffered()
+	rr.last = nil
+	req.detached = true
+	return nil
+}
@@ -0,0 +1,100 @@
+package request
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	// Test: Pipelined requests, one with a body, read from one stream
+	rr := NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 50,
+	})
+	r, err := rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(r.Body))
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+
+	// Test: EOF between requests
+	_, err = rr.ReadRequest()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: A detached request keeps its body but cannot be upgraded
+	rr = NewReader(&chunkReader{
+		data: "GET /first HTTP/1.1\r\n" +
+			"\r\n" +
+			"GET /second HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 100,
+	})
+	first, err := rr.ReadRequest()
+	require.NoError(t, err)
+	require.NoError(t, rr.Detach(first))
+	_, err = first.Upgrade()
+	require.Error(t, err)
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+
+	// Test: The next request cannot be read before a deferred body
+	rr = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n" +
+			"hello",
+		numBytesPerRead: 50,
+	})
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	require.ErrorIs(t, rr.Detach(r), ErrBodyPending)
+	_, err = rr.ReadRequest()
+	require.ErrorIs(t, err, ErrBodyPending)
+}
+
+func TestReaderMaxBodySize(t *testing.T) {
+	body := "POST /upload HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"hello"
+
+	// Test: A body within the limit is read
+	rr := NewReader(&chunkReader{data: body, numBytesPerRead: 50})
+	rr.MaxBodySize = 5
+	r, err := rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: A larger body is rejected from its Content-Length, without
+	// waiting for it, even if the client waits for "100 Continue"
+	rr = NewReader(&chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nContent-Length: 10000000000\r\n\r\n",
+		numBytesPerRead: 50,
+	})
+	rr.MaxBodySize = 4
+	_, err = rr.ReadRequest()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	rr = NewReader(&chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n",
+		numBytesPerRead: 50,
+	})
+	rr.MaxBodySize = 4
+	_, err = rr.ReadRequest()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+}
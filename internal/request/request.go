@@ -2,13 +2,17 @@ package request
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net/netip"
 	"strconv"
 	"strings"
 
 	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/multipart"
+	"github.com/Fepozopo/httpfromtcp/internal/proxyproto"
 )
 
 // Request represents a parsed HTTP request.
@@ -17,6 +21,56 @@ type Request struct {
 	Headers     headers.Headers
 	state       requestState
 	Body        []byte
+
+	// RemoteAddr is the "host:port" address of the client, set by the
+	// server.
+	RemoteAddr string
+	// ClientIP is the IP address of the client. The server sets it to the
+	// address of RemoteAddr; behind trusted proxies, ipfilter.TrustedProxies
+	// replaces it with the address they forwarded the request for.
+	ClientIP netip.Addr
+	// LocalAddr is the "host:port" address the client connected to, set
+	// by the server.
+	LocalAddr string
+	// ProxyHeader is the PROXY protocol header the connection started
+	// with, if the server accepts them and there was one. RemoteAddr and
+	// LocalAddr then hold the addresses of the original connection.
+	ProxyHeader *proxyproto.Header
+
+	// Form and PostForm hold the parsed form data once ParseForm has been
+	// called. Form contains both body and query parameters, PostForm only the
+	// body parameters.
+	Form     Values
+	PostForm Values
+	query    Values
+
+	// MultipartForm holds the parsed multipart form once ParseMultipartForm
+	// has been called.
+	MultipartForm *multipart.Form
+
+	// reader and buf hold the connection and any bytes read from it that have
+	// not been parsed yet, so that a deferred body can be read later.
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+
+	// continueFunc is called before a deferred body is read, giving the
+	// server a chance to send "100 Continue" to the client.
+	continueFunc func() error
+
+	// maxBodySize, if positive, is the largest Content-Length accepted.
+	maxBodySize int64
+
+	// framed is set for requests created by NewRequest, whose body ends
+	// where reader ends rather than after Content-Length bytes.
+	framed bool
+	// detached is set once the connection has moved on to the next request
+	// while this one is still being handled.
+	detached bool
+
+	// ctx is the context of the request, which also holds what middleware
+	// attached to it with SetValue.
+	ctx context.Context
 }
 
 // RequestLine contains details parsed from the start-line of the HTTP request.
@@ -24,6 +78,8 @@ type RequestLine struct {
 	HttpVersion   string
 	RequestTarget string
 	Method        string
+	// Target is RequestTarget parsed into its components.
+	Target Target
 }
 
 // requestState represents different stages in processing a request.
@@ -32,6 +88,8 @@ type requestState int
 const (
 	requestStateInitialized requestState = iota
 	requestStateParsingHeaders
+	requestStateAwaitingContinue
+	requestStateStreamingBody
 	requestStateParsingBody
 	requestStateDone
 )
@@ -41,55 +99,341 @@ const (
 	bufferSize = 8
 )
 
+// ErrHTTPVersionNotSupported is returned when the request-line carries a
+// well-formed HTTP-version whose major version this server does not speak.
+var ErrHTTPVersionNotSupported = errors.New("http version not supported")
+
+// ErrTransferEncodingNotSupported is returned when a request carries a
+// Transfer-Encoding header. Its body cannot be framed without decoding the
+// transfer codings, so the server answers 501 and closes the connection
+// rather than mistake the body for the next request.
+var ErrTransferEncodingNotSupported = errors.New("transfer-encoding not supported")
+
+// ErrBodyTooLarge is returned when a request announces a body larger than
+// Reader.MaxBodySize, before any of the body is read.
+var ErrBodyTooLarge = errors.New("request body too large")
+
 // RequestFromReader reads data from the provided io.Reader, parses it as an HTTP request,
 // and returns a pointer to the Request structure.
+//
+// If the request carries "Expect: 100-continue" and announces a body, parsing
+// stops after the headers and the body is left unread until ReadBody is called.
+//
+// Bytes read past the end of the request are kept by the request (see
+// Buffered). To read several requests from one connection, use a Reader.
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	// Create an initial buffer for reading data.
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
+	return NewReader(reader).ReadRequest()
+}
 
-	// Initialize the Request structure with the initial state.
+// readRequest parses a request from the bytes left over by the previous
+// request on the connection, followed by whatever is read from reader.
+func readRequest(reader io.Reader, leftover []byte, maxBodySize int64) (*Request, error) {
+	// Initialize the Request structure with the initial state and an initial
+	// buffer for reading data.
 	req := &Request{
-		state:   requestStateInitialized,
-		Headers: headers.NewHeaders(),
+		state:       requestStateInitialized,
+		Headers:     headers.NewHeaders(),
+		reader:      reader,
+		buf:         make([]byte, max(bufferSize, len(leftover))),
+		maxBodySize: maxBodySize,
 	}
+	req.readToIndex = copy(req.buf, leftover)
 
+	// A pipelined request may already be complete in the leftover bytes, in
+	// which case reading more would wait for a request that never comes.
+	if err := req.parseBuffered(); err != nil {
+		return nil, err
+	}
+	if err := req.readUntilPaused(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// NewRequest creates a request that did not arrive as HTTP/1.x text, such as
+// one carried by an HTTP/2 stream. The target is parsed as a request-target
+// and the body, if not nil, is read from body until it returns io.EOF. Like a
+// deferred body, it is only read once the handler asks for it.
+func NewRequest(method, target, httpVersion string, h headers.Headers, body io.Reader) (*Request, error) {
+	parsed, err := parseTarget(method, target)
+	if err != nil {
+		return nil, err
+	}
+	req := &Request{
+		RequestLine: RequestLine{
+			HttpVersion:   httpVersion,
+			RequestTarget: target,
+			Method:        method,
+			Target:        parsed,
+		},
+		Headers: h,
+		state:   requestStateDone,
+		framed:  true,
+	}
+	if body != nil {
+		req.reader = body
+		req.state = requestStateAwaitingContinue
+	}
+	return req, nil
+}
+
+// readUntilPaused reads from the underlying reader and parses the data until
+// the request is either done or waiting for the handler to ask for the body.
+func (r *Request) readUntilPaused() error {
 	// Loop until the whole HTTP request is parsed (state becomes requestStateDone).
-	for req.state != requestStateDone {
+	for r.state != requestStateDone && r.state != requestStateAwaitingContinue {
 		// If our buffer is full, double its size to accommodate more data.
-		if readToIndex >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
+		if r.readToIndex >= len(r.buf) {
+			newBuf := make([]byte, len(r.buf)*2)
+			copy(newBuf, r.buf)
+			r.buf = newBuf
 		}
 
 		// Read data into the buffer starting at the current index.
-		numBytesRead, err := reader.Read(buf[readToIndex:])
+		numBytesRead, err := r.reader.Read(r.buf[r.readToIndex:])
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				// If we get an EOF and the request is still incomplete we return an error.
-				if req.state != requestStateDone {
-					return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", req.state, numBytesRead)
+				// If the connection was closed before a single byte of a new
+				// request arrived, report a clean EOF so that callers reading
+				// requests in a loop can tell it apart from a truncated request.
+				if r.state == requestStateInitialized && r.readToIndex == 0 && numBytesRead == 0 {
+					return io.EOF
 				}
-				break
+				// If we get an EOF and the request is still incomplete we return an error.
+				return fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", r.state, numBytesRead)
 			}
 			// Return any other error encountered during reading.
-			return nil, err
+			return err
 		}
 		// Increase index by the number of newly read bytes.
-		readToIndex += numBytesRead
+		r.readToIndex += numBytesRead
+
+		if err := r.parseBuffered(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseBuffered parses the data currently in the buffer and shifts any
+// unparsed data to the beginning of the buffer for the next read.
+func (r *Request) parseBuffered() error {
+	numBytesParsed, err := r.parse(r.buf[:r.readToIndex])
+	if err != nil {
+		return err
+	}
+	copy(r.buf, r.buf[numBytesParsed:r.readToIndex])
+	r.readToIndex -= numBytesParsed
+	return nil
+}
 
-		// Parse the data currently in the buffer.
-		numBytesParsed, err := req.parse(buf[:readToIndex])
+// Context returns the context of the request. The server cancels it when
+// the client disconnects, the server shuts down or the handler returns, so
+// that work done on behalf of the request, such as calls to upstream
+// servers, can stop early. It is never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetContext replaces the context of the request. Middleware use it to
+// derive a context from Context, for example with a deadline. Values
+// attached with SetValue are kept only if ctx is derived from Context.
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// SetValue attaches a value to the context of the request under key, so
+// that middleware can pass what it found out, such as the session, to later
+// handlers and to anything the context is handed to. Keys should be of an
+// unexported type to avoid collisions between packages.
+func (r *Request) SetValue(key, value any) {
+	r.ctx = context.WithValue(r.Context(), key, value)
+}
+
+// Value returns the value attached to the request under key, or nil.
+func (r *Request) Value(key any) any {
+	return r.Context().Value(key)
+}
+
+// ExpectsContinue reports whether the client sent "Expect: 100-continue" and
+// is waiting for the server before sending the body.
+func (r *Request) ExpectsContinue() bool {
+	return strings.EqualFold(r.Headers.Get("expect"), "100-continue")
+}
+
+// OnContinue registers a function that is called once, right before a
+// deferred body is read. The server uses it to send "100 Continue".
+func (r *Request) OnContinue(f func() error) {
+	r.continueFunc = f
+}
+
+// ReadBody returns the body of the request. If the body was deferred because
+// the client is waiting for "100 Continue", the continue function is invoked
+// first and the body is then read from the connection.
+//
+// A handler that wants to reject the request (e.g. with 417 or 413) should do
+// so without calling ReadBody, in which case the client never sends the body.
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.state == requestStateStreamingBody {
+		return nil, fmt.Errorf("cannot read body while it is being streamed")
+	}
+	if r.state != requestStateAwaitingContinue {
+		return r.Body, nil
+	}
+
+	if r.framed {
+		body, err := r.BodyReader()
 		if err != nil {
 			return nil, err
 		}
+		if r.Body, err = io.ReadAll(body); err != nil {
+			return nil, err
+		}
+		return r.Body, nil
+	}
 
-		// Shift any unparsed data to the beginning of the buffer for the next iteration.
-		copy(buf, buf[numBytesParsed:])
-		readToIndex -= numBytesParsed
+	if err := r.sendContinue(); err != nil {
+		return nil, err
 	}
-	return req, nil
+
+	// Some clients send the body without waiting, so parse anything that is
+	// already buffered before reading more.
+	r.state = requestStateParsingBody
+	if err := r.parseBuffered(); err != nil {
+		return nil, err
+	}
+	if err := r.readUntilPaused(); err != nil {
+		return nil, err
+	}
+	return r.Body, nil
+}
+
+// BodyReader returns a reader for the body of the request. A body that was
+// already parsed is served from memory. A deferred body is streamed straight
+// from the connection instead of being buffered, which lets large uploads be
+// processed without holding them in memory; in that case Body stays empty.
+//
+// The body can only be consumed once, either through BodyReader or ReadBody.
+func (r *Request) BodyReader() (io.Reader, error) {
+	switch r.state {
+	case requestStateStreamingBody:
+		return nil, fmt.Errorf("body is already being streamed")
+	case requestStateAwaitingContinue:
+	default:
+		return bytes.NewReader(r.Body), nil
+	}
+
+	if r.framed {
+		if err := r.sendContinue(); err != nil {
+			return nil, err
+		}
+		r.state = requestStateStreamingBody
+		return &bodyReader{req: r, remaining: -1}, nil
+	}
+
+	contentLength, err := strconv.Atoi(r.Headers.Get("content-length"))
+	if err != nil || contentLength < 0 {
+		return nil, fmt.Errorf("invalid content-length header: %s", r.Headers.Get("content-length"))
+	}
+	if err := r.sendContinue(); err != nil {
+		return nil, err
+	}
+
+	r.state = requestStateStreamingBody
+	return &bodyReader{req: r, remaining: contentLength}, nil
+}
+
+// Upgrade returns a reader for everything the client sends after this
+// request: first any bytes that were already read from the connection but
+// not parsed, then the connection itself. It is used by protocols such as
+// WebSocket that take over the connection after a "101 Switching Protocols"
+// response. The body of the request must have been read completely.
+func (r *Request) Upgrade() (io.Reader, error) {
+	if r.framed || r.detached {
+		return nil, fmt.Errorf("cannot upgrade a request without a connection of its own")
+	}
+	if r.state != requestStateDone {
+		return nil, fmt.Errorf("cannot upgrade in state %d", r.state)
+	}
+	return io.MultiReader(bytes.NewReader(r.Buffered()), r.reader), nil
+}
+
+// Buffered returns the bytes that were read from the connection but not
+// parsed as part of this request, such as the start of the next request or
+// of an unread deferred body, and removes them from the request.
+func (r *Request) Buffered() []byte {
+	buffered := make([]byte, r.readToIndex)
+	copy(buffered, r.buf[:r.readToIndex])
+	r.readToIndex = 0
+	return buffered
+}
+
+// BodyPending reports whether the body of the request has not been read
+// completely yet.
+func (r *Request) BodyPending() bool {
+	return r.state == requestStateAwaitingContinue || r.state == requestStateStreamingBody
+}
+
+// sendContinue invokes the continue function, if any, exactly once.
+func (r *Request) sendContinue() error {
+	if r.continueFunc == nil {
+		return nil
+	}
+	f := r.continueFunc
+	r.continueFunc = nil
+	return f()
+}
+
+// bodyReader streams a deferred body of known length, first from the bytes
+// that are already buffered and then from the underlying reader. A negative
+// remaining length means the body ends with the underlying reader.
+type bodyReader struct {
+	req       *Request
+	remaining int
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.remaining == 0 {
+		return 0, io.EOF
+	}
+	if b.remaining < 0 {
+		n, err := b.req.reader.Read(p)
+		if errors.Is(err, io.EOF) {
+			b.remaining = 0
+			b.req.state = requestStateDone
+		}
+		return n, err
+	}
+	if len(p) > b.remaining {
+		p = p[:b.remaining]
+	}
+
+	r := b.req
+	var n int
+	var err error
+	if r.readToIndex > 0 {
+		// Serve the bytes that were read together with the headers first.
+		n = copy(p, r.buf[:r.readToIndex])
+		copy(r.buf, r.buf[n:r.readToIndex])
+		r.readToIndex -= n
+	} else {
+		n, err = r.reader.Read(p)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+
+	b.remaining -= n
+	if b.remaining == 0 {
+		r.state = requestStateDone
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = nil
+		}
+	}
+	return n, err
 }
 
 // parseRequestLine searches for the CRLF indicating end of the request-line,
@@ -130,6 +474,10 @@ func requestLineFromString(str string) (*RequestLine, error) {
 	}
 
 	requestTarget := parts[1]
+	target, err := parseTarget(method, requestTarget)
+	if err != nil {
+		return nil, err
+	}
 
 	// Split the HTTP version (it should be in the form "HTTP/1.1").
 	versionParts := strings.Split(parts[2], "/")
@@ -141,19 +489,45 @@ func requestLineFromString(str string) (*RequestLine, error) {
 	if httpPart != "HTTP" {
 		return nil, fmt.Errorf("unrecognized HTTP-version: %s", httpPart)
 	}
+	// The version must be in the form "<digit>.<digit>". HTTP/1.0 and HTTP/1.1
+	// are supported; any other well-formed version is reported separately so
+	// that the server can answer with 505 instead of 400.
 	version := versionParts[1]
-	if version != "1.1" {
+	if len(version) != 3 || version[1] != '.' || !isDigit(version[0]) || !isDigit(version[2]) {
 		return nil, fmt.Errorf("unrecognized HTTP-version: %s", version)
 	}
+	if version != "1.0" && version != "1.1" {
+		return nil, fmt.Errorf("%w: %s", ErrHTTPVersionNotSupported, version)
+	}
 
 	// Return the constructed RequestLine structure.
 	return &RequestLine{
 		Method:        method,
 		RequestTarget: requestTarget,
 		HttpVersion:   versionParts[1],
+		Target:        target,
 	}, nil
 }
 
+// isDigit reports whether c is an ASCII digit.
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// KeepAlive reports whether the client wants the connection to stay open
+// after the response. HTTP/1.1 connections are persistent unless the client
+// sends "Connection: close"; HTTP/1.0 connections are closed unless the client
+// asks for "Connection: keep-alive".
+func (r *Request) KeepAlive() bool {
+	if r.Headers.HasToken("connection", "close") {
+		return false
+	}
+	if r.RequestLine.HttpVersion == "1.0" {
+		return r.Headers.HasToken("connection", "keep-alive")
+	}
+	return true
+}
+
 // parse iteratively calls parseSingle until no more bytes can be parsed in the current state.
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
@@ -197,34 +571,57 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if err != nil {
 			return 0, err
 		}
-		// When done parsing all headers, update the state.
+		// When done parsing all headers, update the state. If the client
+		// expects a 100 Continue before sending a body, stop here.
 		if done {
+			// A body framed by Transfer-Encoding would be read as the next
+			// request on the connection. Together with Content-Length, the
+			// framing is ambiguous (RFC 9112 section 6.3).
+			if _, ok := r.Headers["transfer-encoding"]; ok {
+				if _, ok := r.Headers["content-length"]; ok {
+					return 0, fmt.Errorf("both transfer-encoding and content-length headers present")
+				}
+				return 0, ErrTransferEncodingNotSupported
+			}
+			// Refuse a body too large to be held before reading any of it.
+			if cl, ok := r.Headers["content-length"]; ok && r.maxBodySize > 0 {
+				if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n > r.maxBodySize {
+					return 0, fmt.Errorf("%w: content-length %d exceeds %d bytes", ErrBodyTooLarge, n, r.maxBodySize)
+				}
+			}
 			r.state = requestStateParsingBody
+			if r.ExpectsContinue() && r.Headers.Get("content-length") != "" && r.Headers.Get("content-length") != "0" {
+				r.state = requestStateAwaitingContinue
+			}
 		}
 		return n, nil
 
 	case requestStateParsingBody:
-		// If there is no Content-Length header, we're done.
+		// If there is no Content-Length header, we're done. Whatever follows
+		// belongs to the next request (or to an upgraded protocol), so none
+		// of it is consumed.
 		if _, ok := r.Headers["content-length"]; !ok {
 			r.state = requestStateDone
-			return len(data), nil
+			return 0, nil
 		}
-		// Append all the data to the requests .Body field.
-		r.Body = append(r.Body, data...)
-		// If the length of the body is greater than the Content-Length header, return an error.
 		contentLength, err := strconv.Atoi(r.Headers["content-length"])
-		if err != nil {
-			return 0, fmt.Errorf("invalid content-length header: %w", err)
-		}
-		if len(r.Body) > contentLength {
-			return 0, fmt.Errorf("error: body length greater than Content-Length")
+		if err != nil || contentLength < 0 {
+			return 0, fmt.Errorf("invalid content-length header: %s", r.Headers["content-length"])
 		}
+		// Append the data to the requests .Body field, up to the
+		// Content-Length. Anything after it is the next pipelined request.
+		n := min(len(data), contentLength-len(r.Body))
+		r.Body = append(r.Body, data[:n]...)
 		// If the length of the body is equal to the Content-Length header, move to the done state.
 		if len(r.Body) == contentLength {
 			r.state = requestStateDone
 		}
-		// Report that you've consumed the entire length of the data you were given.
-		return len(data), nil
+		// Report how much of the data belonged to the body.
+		return n, nil
+
+	case requestStateAwaitingContinue:
+		// The body is deferred until ReadBody is called, so consume nothing.
+		return 0, nil
 
 	case requestStateDone:
 		// If parsing is already complete, any additional data is unexpected.
@@ -1,6 +1,7 @@
 package request
 
 import (
+	"context"
 	"io"
 	"testing"
 
@@ -70,6 +71,70 @@ func TestRequestLineParse(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestHTTPVersions(t *testing.T) {
+	// Test: Good HTTP/1.0 Request line without Host
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 keep-alive
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: HTTP/1.1 is persistent unless closed
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nConnection: close\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// Test: Unsupported major version
+	reader = &chunkReader{
+		data:            "GET / HTTP/2.0\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrHTTPVersionNotSupported)
+
+	// Test: Malformed version is not reported as unsupported
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrHTTPVersionNotSupported)
+
+	// Test: Connection closed before any request
+	reader = &chunkReader{
+		data:            "",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, io.EOF)
+}
+
 func TestHeadersParse(t *testing.T) {
 	// Test: Standard Headers
 	reader := &chunkReader{
@@ -185,6 +250,139 @@ func TestBodyParse(t *testing.T) {
 	assert.Equal(t, "", string(r.Body))
 }
 
+func TestTransferEncoding(t *testing.T) {
+	// Test: A chunked body is rejected rather than read as the next request
+	rr := NewReader(&chunkReader{
+		data: "POST /a HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"1c\r\nGET /smuggled HTTP/1.1\r\n\r\n\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	_, err := rr.ReadRequest()
+	require.ErrorIs(t, err, ErrTransferEncodingNotSupported)
+
+	// Test: Transfer-Encoding together with Content-Length is malformed
+	_, err = RequestFromReader(&chunkReader{
+		data: "POST /a HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrTransferEncodingNotSupported)
+}
+
+func TestExpectContinue(t *testing.T) {
+	// Test: Body is deferred until ReadBody is called
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.True(t, r.ExpectsContinue())
+	assert.True(t, r.BodyPending())
+	assert.Empty(t, r.Body)
+
+	continued := 0
+	r.OnContinue(func() error {
+		continued++
+		return nil
+	})
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+	assert.Equal(t, 1, continued)
+	assert.False(t, r.BodyPending())
+
+	// Test: Reading the body again does not trigger another continue
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+	assert.Equal(t, 1, continued)
+
+	// Test: Expect with no body is parsed immediately
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 0\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.False(t, r.BodyPending())
+
+	// Test: Continue function errors are returned from ReadBody
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"Expect: 100-Continue\r\n" +
+			"\r\n" +
+			"hello",
+		numBytesPerRead: 50,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	r.OnContinue(func() error { return io.ErrClosedPipe })
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func TestValues(t *testing.T) {
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+
+	// Test: Missing values are nil
+	type key struct{}
+	assert.Nil(t, r.Value(key{}))
+
+	// Test: Values are returned by key
+	r.SetValue(key{}, "alice")
+	assert.Equal(t, "alice", r.Value(key{}))
+	assert.Nil(t, r.Value("key"))
+
+	// Test: Values live on the context of the request
+	assert.Equal(t, "alice", r.Context().Value(key{}))
+
+	// Test: A derived context keeps the values, and its cancellation shows
+	ctx, cancel := context.WithCancel(r.Context())
+	r.SetContext(ctx)
+	r.SetValue(key{}, "bob")
+	assert.Equal(t, "bob", r.Value(key{}))
+	cancel()
+	assert.ErrorIs(t, r.Context().Err(), context.Canceled)
+}
+
+func TestContext(t *testing.T) {
+	r, err := RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 5,
+	})
+	require.NoError(t, err)
+
+	// Test: Requests have a context even if the server set none
+	require.NotNil(t, r.Context())
+	assert.NoError(t, r.Context().Err())
+}
+
 type chunkReader struct {
 	data            string
 	numBytesPerRead int
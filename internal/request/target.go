@@ -0,0 +1,323 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TargetForm identifies which of the four request-target forms described in
+// RFC 9112 section 3.2 was used in the request-line.
+type TargetForm int
+
+const (
+	// TargetFormOrigin is an absolute path with an optional query, e.g.
+	// "/video?x=1". It is used by almost all requests.
+	TargetFormOrigin TargetForm = iota
+	// TargetFormAbsolute is a complete URI, e.g. "http://host/path". It is
+	// used for requests sent to a proxy.
+	TargetFormAbsolute
+	// TargetFormAuthority is a bare "host:port", used only by CONNECT.
+	TargetFormAuthority
+	// TargetFormAsterisk is a single "*", used only by server-wide OPTIONS.
+	TargetFormAsterisk
+)
+
+// String returns the name of the form as used in RFC 9112.
+func (f TargetForm) String() string {
+	switch f {
+	case TargetFormOrigin:
+		return "origin-form"
+	case TargetFormAbsolute:
+		return "absolute-form"
+	case TargetFormAuthority:
+		return "authority-form"
+	case TargetFormAsterisk:
+		return "asterisk-form"
+	}
+	return fmt.Sprintf("TargetForm(%d)", int(f))
+}
+
+// Target is a parsed request-target.
+type Target struct {
+	// Form is the form used in the request-line.
+	Form TargetForm
+	// Scheme is the lowercased scheme of an absolute-form target.
+	Scheme string
+	// Authority is the "host[:port]" of an absolute-form or authority-form
+	// target.
+	Authority string
+	// Path is the path exactly as sent, still percent-encoded. It is "/" for
+	// an absolute-form target without a path and empty for the authority and
+	// asterisk forms.
+	Path string
+	// DecodedPath is Path with percent-encoding removed.
+	DecodedPath string
+	// RawQuery is the query without the leading "?", still percent-encoded.
+	RawQuery string
+}
+
+// ErrInvalidHost is returned by ValidateHost when the Host header is missing,
+// repeated or malformed.
+var ErrInvalidHost = errors.New("invalid host")
+
+// parseTarget parses the raw request-target of a request with the given
+// method, enforcing which forms are allowed for which methods.
+func parseTarget(method, raw string) (Target, error) {
+	switch {
+	case raw == "":
+		return Target{}, fmt.Errorf("empty request-target")
+
+	case method == "CONNECT":
+		// CONNECT must use authority-form and always carries a port.
+		host, port, ok := splitHostPort(raw)
+		if !ok || host == "" || port == "" || !validHost(raw) {
+			return Target{}, fmt.Errorf("invalid authority-form request-target: %s", raw)
+		}
+		return Target{Form: TargetFormAuthority, Authority: raw}, nil
+
+	case raw == "*":
+		if method != "OPTIONS" {
+			return Target{}, fmt.Errorf("asterisk-form request-target not allowed for %s", method)
+		}
+		return Target{Form: TargetFormAsterisk}, nil
+
+	case raw[0] == '/':
+		t := Target{Form: TargetFormOrigin}
+		if err := t.setPathAndQuery(raw); err != nil {
+			return Target{}, err
+		}
+		return t, nil
+	}
+
+	// Anything else has to be an absolute URI: scheme "://" authority path.
+	scheme, rest, ok := strings.Cut(raw, "://")
+	if !ok || !validScheme(scheme) {
+		return Target{}, fmt.Errorf("invalid request-target: %s", raw)
+	}
+	t := Target{Form: TargetFormAbsolute, Scheme: strings.ToLower(scheme)}
+	if t.Scheme != "http" && t.Scheme != "https" {
+		return Target{}, fmt.Errorf("unsupported scheme in request-target: %s", scheme)
+	}
+
+	// The authority runs until the first "/" or "?".
+	end := strings.IndexAny(rest, "/?")
+	if end == -1 {
+		end = len(rest)
+	}
+	t.Authority = rest[:end]
+	// Userinfo is deprecated for http(s) URIs and is a common phishing vector,
+	// so it is rejected outright.
+	if t.Authority == "" || strings.Contains(t.Authority, "@") || !validHost(t.Authority) {
+		return Target{}, fmt.Errorf("invalid authority in request-target: %s", raw)
+	}
+
+	pathAndQuery := rest[end:]
+	if pathAndQuery == "" || pathAndQuery[0] == '?' {
+		pathAndQuery = "/" + pathAndQuery
+	}
+	if err := t.setPathAndQuery(pathAndQuery); err != nil {
+		return Target{}, err
+	}
+	return t, nil
+}
+
+// setPathAndQuery splits "path[?query]", validates both parts and decodes
+// the path.
+func (t *Target) setPathAndQuery(s string) error {
+	path, query, _ := strings.Cut(s, "?")
+	for i := 0; i < len(path); i++ {
+		if !isPchar(path[i]) && path[i] != '/' {
+			return fmt.Errorf("invalid character %q in request-target path", path[i])
+		}
+	}
+	for i := 0; i < len(query); i++ {
+		if !isPchar(query[i]) && query[i] != '/' && query[i] != '?' {
+			return fmt.Errorf("invalid character %q in request-target query", query[i])
+		}
+	}
+
+	decoded, err := percentDecode(path)
+	if err != nil {
+		return err
+	}
+
+	t.Path = path
+	t.DecodedPath = decoded
+	t.RawQuery = query
+	return nil
+}
+
+// Host returns the host the request is addressed to. For an absolute-form
+// target the authority of the target wins over the Host header, as required
+// by RFC 9112 section 3.2.2.
+func (r *Request) Host() string {
+	if r.RequestLine.Target.Form == TargetFormAbsolute || r.RequestLine.Target.Form == TargetFormAuthority {
+		return r.RequestLine.Target.Authority
+	}
+	return r.Headers.Get("host")
+}
+
+// ValidateHost checks the Host header as required by RFC 9112 section 3.2:
+// an HTTP/1.1 request must carry exactly one Host header, and its value must
+// be a valid "host[:port]". HTTP/1.0 requests may omit the header. The server
+// answers requests that fail this check with 400 Bad Request.
+func (r *Request) ValidateHost() error {
+	host, ok := r.Headers["host"]
+	if !ok {
+		if r.RequestLine.HttpVersion == "1.0" {
+			return nil
+		}
+		return fmt.Errorf("%w: missing Host header", ErrInvalidHost)
+	}
+
+	// Repeated headers are joined with commas, which can never appear in a
+	// valid host.
+	if strings.Contains(host, ",") {
+		return fmt.Errorf("%w: multiple Host headers", ErrInvalidHost)
+	}
+
+	// An empty Host is allowed when the target has no authority to send.
+	if host == "" {
+		return nil
+	}
+	if !validHost(host) {
+		return fmt.Errorf("%w: %s", ErrInvalidHost, host)
+	}
+	return nil
+}
+
+// validHost reports whether s is a valid "uri-host [ ":" port ]" as defined in
+// RFC 3986, where the host is an IP literal in brackets, an IPv4 address or a
+// registered name.
+func validHost(s string) bool {
+	host, port, ok := splitHostPort(s)
+	if !ok {
+		return false
+	}
+	for i := 0; i < len(port); i++ {
+		if !isDigit(port[i]) {
+			return false
+		}
+	}
+
+	if strings.HasPrefix(host, "[") {
+		// IP-literal: only hex digits, colons and dots (for embedded IPv4)
+		// are allowed between the brackets.
+		inner := host[1 : len(host)-1]
+		if inner == "" {
+			return false
+		}
+		for i := 0; i < len(inner); i++ {
+			c := inner[i]
+			if !isHexDigit(c) && c != ':' && c != '.' {
+				return false
+			}
+		}
+		return true
+	}
+
+	// reg-name (which also covers IPv4 addresses)
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if !isUnreserved(c) && !isSubDelim(c) && c != '%' {
+			return false
+		}
+	}
+	_, err := percentDecode(host)
+	return err == nil
+}
+
+// splitHostPort splits "host[:port]" into its parts, taking care of
+// bracketed IPv6 literals. The port is empty if there is none.
+func splitHostPort(s string) (host, port string, ok bool) {
+	if strings.HasPrefix(s, "[") {
+		end := strings.IndexByte(s, ']')
+		if end == -1 {
+			return "", "", false
+		}
+		host, rest := s[:end+1], s[end+1:]
+		if rest == "" {
+			return host, "", true
+		}
+		if rest[0] != ':' {
+			return "", "", false
+		}
+		return host, rest[1:], true
+	}
+
+	host, port, _ = strings.Cut(s, ":")
+	if strings.Contains(port, ":") {
+		return "", "", false
+	}
+	return host, port, true
+}
+
+// percentDecode replaces every "%XX" escape in s with the byte it encodes.
+func percentDecode(s string) (string, error) {
+	if !strings.Contains(s, "%") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) || !isHexDigit(s[i+1]) || !isHexDigit(s[i+2]) {
+			return "", fmt.Errorf("invalid percent-encoding in %q", s)
+		}
+		b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// validScheme reports whether s matches ALPHA *( ALPHA / DIGIT / "+" / "-" / "." ).
+func validScheme(s string) bool {
+	if s == "" || !isAlpha(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !isAlpha(c) && !isDigit(c) && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// isPchar reports whether c may appear in a path segment: unreserved,
+// sub-delims, ":", "@" and the "%" that starts a percent-encoding.
+func isPchar(c byte) bool {
+	return isUnreserved(c) || isSubDelim(c) || c == ':' || c == '@' || c == '%'
+}
+
+func isUnreserved(c byte) bool {
+	return isAlpha(c) || isDigit(c) || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isSubDelim(c byte) bool {
+	return strings.IndexByte("!$&'()*+,;=", c) != -1
+}
+
+func isAlpha(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// unhex returns the value of a hex digit.
+func unhex(c byte) byte {
+	switch {
+	case isDigit(c):
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
@@ -0,0 +1,138 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTargetParse(t *testing.T) {
+	// Test: Origin-form with query
+	target, err := parseTarget("GET", "/video?x=1&y=2")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormOrigin, target.Form)
+	assert.Equal(t, "/video", target.Path)
+	assert.Equal(t, "/video", target.DecodedPath)
+	assert.Equal(t, "x=1&y=2", target.RawQuery)
+
+	// Test: Origin-form with percent-encoding
+	target, err = parseTarget("GET", "/my%20files/a%2Fb")
+	require.NoError(t, err)
+	assert.Equal(t, "/my%20files/a%2Fb", target.Path)
+	assert.Equal(t, "/my files/a/b", target.DecodedPath)
+	assert.Empty(t, target.RawQuery)
+
+	// Test: Invalid percent-encoding
+	_, err = parseTarget("GET", "/bad%2")
+	require.Error(t, err)
+	_, err = parseTarget("GET", "/bad%zz")
+	require.Error(t, err)
+
+	// Test: Fragments and control characters are not allowed
+	_, err = parseTarget("GET", "/page#section")
+	require.Error(t, err)
+	_, err = parseTarget("GET", "/a\"b")
+	require.Error(t, err)
+
+	// Test: Absolute-form
+	target, err = parseTarget("GET", "HTTP://example.com:8080/path?q=1")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAbsolute, target.Form)
+	assert.Equal(t, "http", target.Scheme)
+	assert.Equal(t, "example.com:8080", target.Authority)
+	assert.Equal(t, "/path", target.Path)
+	assert.Equal(t, "q=1", target.RawQuery)
+
+	// Test: Absolute-form without a path
+	target, err = parseTarget("GET", "http://example.com?q=1")
+	require.NoError(t, err)
+	assert.Equal(t, "/", target.Path)
+	assert.Equal(t, "q=1", target.RawQuery)
+
+	// Test: Absolute-form with userinfo or unknown scheme
+	_, err = parseTarget("GET", "http://user@example.com/")
+	require.Error(t, err)
+	_, err = parseTarget("GET", "ftp://example.com/")
+	require.Error(t, err)
+
+	// Test: Authority-form for CONNECT
+	target, err = parseTarget("CONNECT", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAuthority, target.Form)
+	assert.Equal(t, "example.com:443", target.Authority)
+	target, err = parseTarget("CONNECT", "[::1]:443")
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]:443", target.Authority)
+
+	// Test: CONNECT requires a port and authority-form
+	_, err = parseTarget("CONNECT", "example.com")
+	require.Error(t, err)
+	_, err = parseTarget("CONNECT", "/path")
+	require.Error(t, err)
+
+	// Test: Asterisk-form only for OPTIONS
+	target, err = parseTarget("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAsterisk, target.Form)
+	_, err = parseTarget("GET", "*")
+	require.Error(t, err)
+}
+
+func TestValidateHost(t *testing.T) {
+	// Test: Valid Host
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ValidateHost())
+	assert.Equal(t, "localhost:42069", r.Host())
+
+	// Test: Missing Host in HTTP/1.1
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.ErrorIs(t, r.ValidateHost(), ErrInvalidHost)
+
+	// Test: Missing Host in HTTP/1.0 is fine
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ValidateHost())
+
+	// Test: Duplicate Host
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nHost: duplicate:8080\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.ErrorIs(t, r.ValidateHost(), ErrInvalidHost)
+
+	// Test: Malformed Host
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: local host\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.ErrorIs(t, r.ValidateHost(), ErrInvalidHost)
+
+	// Test: Absolute-form target overrides Host
+	reader = &chunkReader{
+		data:            "GET http://example.com/ HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ValidateHost())
+	assert.Equal(t, "example.com", r.Host())
+}
@@ -7,22 +7,72 @@ import (
 type StatusCode int
 
 const (
-	StatusCodeSuccess             StatusCode = 200
-	StatusCodeBadRequest          StatusCode = 400
-	StatusCodeInternalServerError StatusCode = 500
+	StatusCodeContinue                StatusCode = 100
+	StatusCodeSwitchingProtocols      StatusCode = 101
+	StatusCodeEarlyHints              StatusCode = 103
+	StatusCodeSuccess                 StatusCode = 200
+	StatusCodeNoContent               StatusCode = 204
+	StatusCodeBadRequest              StatusCode = 400
+	StatusCodeUnauthorized            StatusCode = 401
+	StatusCodeForbidden               StatusCode = 403
+	StatusCodeProxyAuthRequired       StatusCode = 407
+	StatusCodeContentTooLarge         StatusCode = 413
+	StatusCodeExpectationFailed       StatusCode = 417
+	StatusCodeUpgradeRequired         StatusCode = 426
+	StatusCodeTooManyRequests         StatusCode = 429
+	StatusCodeInternalServerError     StatusCode = 500
+	StatusCodeNotImplemented          StatusCode = 501
+	StatusCodeBadGateway              StatusCode = 502
+	StatusCodeServiceUnavailable      StatusCode = 503
+	StatusCodeHTTPVersionNotSupported StatusCode = 505
 )
 
-// getStatusLine constructs the HTTP status line based on the provided status code.
-// It returns a byte slice representing the status line in the format "HTTP/1.1 <statusCode> <reasonPhrase>\r\n".
-func getStatusLine(statusCode StatusCode) []byte {
+// getStatusLine constructs the HTTP status line based on the provided HTTP version and status code.
+// It returns a byte slice representing the status line in the format "HTTP/<version> <statusCode> <reasonPhrase>\r\n".
+func getStatusLine(httpVersion string, statusCode StatusCode) []byte {
 	reasonPhrase := ""
 	switch statusCode {
+	case StatusCodeContinue:
+		reasonPhrase = "Continue"
+	case StatusCodeSwitchingProtocols:
+		reasonPhrase = "Switching Protocols"
+	case StatusCodeEarlyHints:
+		reasonPhrase = "Early Hints"
 	case StatusCodeSuccess:
 		reasonPhrase = "OK"
+	case StatusCodeNoContent:
+		reasonPhrase = "No Content"
 	case StatusCodeBadRequest:
 		reasonPhrase = "Bad Request"
+	case StatusCodeUnauthorized:
+		reasonPhrase = "Unauthorized"
+	case StatusCodeForbidden:
+		reasonPhrase = "Forbidden"
+	case StatusCodeProxyAuthRequired:
+		reasonPhrase = "Proxy Authentication Required"
+	case StatusCodeContentTooLarge:
+		reasonPhrase = "Content Too Large"
+	case StatusCodeExpectationFailed:
+		reasonPhrase = "Expectation Failed"
+	case StatusCodeUpgradeRequired:
+		reasonPhrase = "Upgrade Required"
+	case StatusCodeTooManyRequests:
+		reasonPhrase = "Too Many Requests"
 	case StatusCodeInternalServerError:
 		reasonPhrase = "Internal Server Error"
+	case StatusCodeNotImplemented:
+		reasonPhrase = "Not Implemented"
+	case StatusCodeBadGateway:
+		reasonPhrase = "Bad Gateway"
+	case StatusCodeServiceUnavailable:
+		reasonPhrase = "Service Unavailable"
+	case StatusCodeHTTPVersionNotSupported:
+		reasonPhrase = "HTTP Version Not Supported"
 	}
-	return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase))
+	return []byte(fmt.Sprintf("HTTP/%s %d %s\r\n", httpVersion, statusCode, reasonPhrase))
+}
+
+// IsInformational reports whether the status code is in the 1xx range.
+func (s StatusCode) IsInformational() bool {
+	return s >= 100 && s < 200
 }
@@ -1,9 +1,13 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"slices"
 
+	"github.com/Fepozopo/httpfromtcp/internal/cookie"
 	"github.com/Fepozopo/httpfromtcp/internal/headers"
 )
 
@@ -14,21 +18,105 @@ const (
 	writerStateHeaders
 	writerStateBody
 	writerStateTrailers
+	writerStateUpgraded
+	writerStateHijacked
+)
+
+// ErrHijacked is returned by Hijack when the connection was already taken
+// over, and ErrNotHijackable when the Writer is not backed by a connection.
+var (
+	ErrHijacked      = errors.New("connection already hijacked")
+	ErrNotHijackable = errors.New("connection cannot be hijacked")
 )
 
 type Writer struct {
 	writerState writerState
 	writer      io.Writer
+	httpVersion string
+	statusCode  StatusCode
+
+	// unchunked is set when a chunked response is sent to an HTTP/1.0
+	// client, which does not understand chunked transfer coding. The chunks
+	// are written as-is and the end of the body is marked by closing the
+	// connection.
+	unchunked bool
+	// closeConn is set when the response that was written requires the
+	// connection to be closed afterwards.
+	closeConn bool
+
+	// hijackFunc is provided by the server and hands the connection over.
+	hijackFunc func() (net.Conn, []byte, error)
+
+	// backend, if set, sends the response instead of writer.
+	backend Backend
+
+	// cookies holds the serialized cookies added by SetCookie, each of
+	// which is sent in a Set-Cookie header of its own.
+	cookies []string
+
+	// beforeHeaders are called right before the final headers are written.
+	beforeHeaders []func(h headers.Headers)
+}
+
+// Backend sends a response over a protocol that frames messages itself, such
+// as an HTTP/2 stream, so that handlers can use the same Writer for every
+// protocol. The Writer still enforces the order of the calls; the backend
+// only encodes them.
+type Backend interface {
+	// WriteHeaders sends an informational or final status code with its
+	// headers. Connection-specific headers have already been removed. Each
+	// of cookies is the value of a separate Set-Cookie header.
+	WriteHeaders(statusCode StatusCode, h headers.Headers, cookies []string) error
+	// WriteBody sends part of the body.
+	WriteBody(p []byte) (int, error)
+	// WriteTrailers sends the trailers, which end the response.
+	WriteTrailers(h headers.Headers) error
+	// Flush sends any buffered data to the client.
+	Flush() error
 }
 
+// connectionHeaders only apply to an HTTP/1.x connection and are dropped
+// when the response is sent through a Backend.
+var connectionHeaders = []string{"connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade"}
+
 // NewWriter creates a new Writer that writes to the provided io.Writer.
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
 		writerState: writerStateStatusLine,
 		writer:      w,
+		httpVersion: "1.1",
+		closeConn:   true,
+	}
+}
+
+// NewBackendWriter creates a new Writer that sends the response through b.
+func NewBackendWriter(b Backend) *Writer {
+	return &Writer{
+		writerState: writerStateStatusLine,
+		backend:     b,
 	}
 }
 
+// SetHTTPVersion sets the HTTP version used in the status line, so that the
+// response matches the version of the request. It must be called before the
+// status line is written. Only "1.0" and "1.1" are meaningful.
+func (w *Writer) SetHTTPVersion(version string) {
+	w.httpVersion = version
+}
+
+// ConnectionClose reports whether the connection must be closed after the
+// response, either because the response asked for it or because its body is
+// delimited by the end of the connection.
+func (w *Writer) ConnectionClose() bool {
+	return w.closeConn
+}
+
+// StatusCode returns the status code of the final response, or 0 if its
+// status line has not been written yet.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
 // WriteStatusLine writes the status line of the HTTP response to the Writer.
 //
 // The status line is written using the provided StatusCode, which must be one of
@@ -43,7 +131,52 @@ func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 	}
 	defer func() { w.writerState = writerStateHeaders }()
 
-	_, err := w.writer.Write(getStatusLine(statusCode))
+	w.statusCode = statusCode
+	if w.backend != nil {
+		// The status is sent together with the headers.
+		return nil
+	}
+	_, err := w.writer.Write(getStatusLine(w.httpVersion, statusCode))
+	return err
+}
+
+// WriteInformational writes an interim 1xx response, such as 100 Continue or
+// 103 Early Hints, to the Writer.
+//
+// The status line is followed by the provided headers (which may be nil) and a
+// blank line. Any number of informational responses may be sent before the
+// final response, so the Writer stays in the writerStateStatusLine state.
+func (w *Writer) WriteInformational(statusCode StatusCode, h headers.Headers) error {
+	if w.writerState != writerStateStatusLine {
+		return fmt.Errorf("cannot write informational response in state %d", w.writerState)
+	}
+	if !statusCode.IsInformational() {
+		return fmt.Errorf("status code %d is not informational", statusCode)
+	}
+	// HTTP/1.0 clients do not understand interim responses, so they are
+	// silently dropped.
+	if w.httpVersion == "1.0" {
+		return nil
+	}
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	if w.backend != nil {
+		return w.backend.WriteHeaders(statusCode, withoutConnectionHeaders(h), nil)
+	}
+
+	if _, err := w.writer.Write(getStatusLine(w.httpVersion, statusCode)); err != nil {
+		return err
+	}
+	for k, v := range h {
+		// Write each header in the format "key: value\r\n"
+		_, err := w.writer.Write([]byte(fmt.Sprintf("%s: %s\r\n", k, v)))
+		if err != nil {
+			return err
+		}
+	}
+	// Write a blank line to indicate the end of the interim response
+	_, err := w.writer.Write([]byte("\r\n"))
 	return err
 }
 
@@ -54,15 +187,60 @@ func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 //   - The final header is followed by a blank line ("\r\n") to
 //     indicate the end of the headers.
 //
+// For HTTP/1.0 responses, chunked transfer coding is removed and the
+// connection is marked for closing, since the body is then delimited by the
+// end of the connection.
+//
 // After writing the headers, the Writer transitions to the writerStateBody
 // state, so that the next call to WriteBody will write the body of the
 // response.
+//
+// Headers that cannot be written as they are, such as a value with a CRLF
+// in it, are rejected with an error wrapping headers.ErrInvalidField.
+// Nothing is written then, and the Writer stays in the writerStateHeaders
+// state; the connection is closed after the response unless valid headers
+// are written after all.
 func (w *Writer) WriteHeaders(h headers.Headers) error {
 	if w.writerState != writerStateHeaders {
 		return fmt.Errorf("cannot write headers in state %d", w.writerState)
 	}
+
+	// The functions may set cookies, which must not pile up if the headers
+	// are rejected and the handler tries again.
+	cookies := w.cookies
+	if len(w.beforeHeaders) > 0 {
+		// The functions may change the headers, so they get a copy to
+		// leave the caller's headers untouched.
+		h = h.Clone()
+		for _, f := range w.beforeHeaders {
+			f(h)
+		}
+	}
+	if err := h.Validate(); err != nil {
+		w.cookies = cookies
+		// The status line may be out already, so the connection cannot
+		// carry another response unless this one is completed.
+		w.closeConn = true
+		return err
+	}
 	defer func() { w.writerState = writerStateBody }()
 
+	if w.backend != nil {
+		w.closeConn = false
+		return w.backend.WriteHeaders(w.statusCode, withoutConnectionHeaders(h), w.cookies)
+	}
+
+	if w.httpVersion == "1.0" && h.HasToken("transfer-encoding", "chunked") {
+		// Work on a copy so that the caller's headers are left untouched.
+		downgraded := h.Clone()
+		downgraded.Delete("transfer-encoding")
+		downgraded.Delete("trailer")
+		downgraded.Override("connection", "close")
+		h = downgraded
+		w.unchunked = true
+	}
+	w.closeConn = connectionClose(w.httpVersion, h)
+
 	for k, v := range h {
 		// Write each header in the format "key: value\r\n"
 		_, err := w.writer.Write([]byte(fmt.Sprintf("%s: %s\r\n", k, v)))
@@ -70,11 +248,40 @@ func (w *Writer) WriteHeaders(h headers.Headers) error {
 			return err
 		}
 	}
+	// Cookies cannot be joined into one header, so each gets its own line.
+	for _, c := range w.cookies {
+		if _, err := w.writer.Write([]byte(fmt.Sprintf("Set-Cookie: %s\r\n", c))); err != nil {
+			return err
+		}
+	}
 	// Write a blank line to indicate the end of the headers
 	_, err := w.writer.Write([]byte("\r\n"))
 	return err
 }
 
+// OnWriteHeaders registers a function that is called right before the
+// final headers are written, with the headers about to be sent. It may
+// change them and set cookies. Middleware uses it to add headers and
+// cookies to whatever response the handler writes, such as CORS headers or
+// a session cookie.
+func (w *Writer) OnWriteHeaders(f func(h headers.Headers)) {
+	w.beforeHeaders = append(w.beforeHeaders, f)
+}
+
+// SetCookie adds a Set-Cookie header for c to the response. Unlike headers
+// set with Headers.Set, every cookie is sent in a header of its own. It must
+// be called before WriteHeaders, and returns an error for an invalid cookie.
+func (w *Writer) SetCookie(c *cookie.Cookie) error {
+	if w.writerState != writerStateStatusLine && w.writerState != writerStateHeaders {
+		return fmt.Errorf("cannot set cookie in state %d", w.writerState)
+	}
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	w.cookies = append(w.cookies, c.String())
+	return nil
+}
+
 // WriteBody writes the body of the HTTP response to the Writer.
 //
 // The body is written directly to the Writer, and the number of bytes
@@ -86,6 +293,10 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 	}
 	defer func() { w.writerState = writerStateTrailers }()
 
+	if w.backend != nil {
+		return w.backend.WriteBody(p)
+	}
+
 	// Write the body to the Writer and return the number of bytes written.
 	return w.writer.Write(p)
 }
@@ -96,10 +307,24 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 //   - The key-value pairs are written in the format "key: value\r\n"
 //   - The final trailer is followed by a blank line ("\r\n") to
 //     indicate the end of the trailers.
+//
+// Like WriteHeaders, it rejects trailers that cannot be written as they
+// are, without writing anything.
 func (w *Writer) WriteTrailers(h headers.Headers) error {
 	if w.writerState != writerStateTrailers {
 		return fmt.Errorf("cannot write trailers in state %d", w.writerState)
 	}
+	if err := h.Validate(); err != nil {
+		w.closeConn = true
+		return err
+	}
+	if w.backend != nil {
+		return w.backend.WriteTrailers(h)
+	}
+	// Trailers cannot be sent without chunked transfer coding.
+	if w.unchunked {
+		return nil
+	}
 	for k, v := range h {
 		// Write each trailer in the format "key: value\r\n"
 		_, err := w.writer.Write([]byte(fmt.Sprintf("%s: %s\r\n", k, v)))
@@ -113,6 +338,65 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 	return err
 }
 
+// Upgrade hands the underlying io.Writer over to another protocol once a
+// "101 Switching Protocols" status line and its headers have been written.
+// After that, the Writer can no longer be used to write HTTP.
+func (w *Writer) Upgrade() (io.Writer, error) {
+	if w.backend != nil {
+		return nil, fmt.Errorf("cannot upgrade a response sent through a backend")
+	}
+	if w.writerState != writerStateBody || w.statusCode != StatusCodeSwitchingProtocols {
+		return nil, fmt.Errorf("cannot upgrade in state %d with status %d", w.writerState, w.statusCode)
+	}
+	w.writerState = writerStateUpgraded
+	w.closeConn = true
+	return w.writer, nil
+}
+
+// Flush sends any buffered data to the client. The Writer itself does not
+// buffer, but the io.Writer it wraps may, in which case its Flush method is
+// called. Streaming handlers should call Flush after each piece of data they
+// want the client to see immediately.
+func (w *Writer) Flush() error {
+	if w.backend != nil {
+		return w.backend.Flush()
+	}
+	if f, ok := w.writer.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// OnHijack registers the function used by Hijack to take the connection away
+// from the server. The server calls it for every response it creates.
+func (w *Writer) OnHijack(f func() (net.Conn, []byte, error)) {
+	w.hijackFunc = f
+}
+
+// Hijack lets the handler take over the underlying connection, for protocols
+// such as CONNECT tunnels that speak something other than HTTP after the
+// request. It returns the connection and any bytes the client already sent
+// that were read from the connection but not consumed by the request.
+//
+// After Hijack, the server no longer closes the connection or waits for it
+// on shutdown; the caller is responsible for closing it. The Writer can no
+// longer be used.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.writerState == writerStateHijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.hijackFunc == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	conn, buffered, err := w.hijackFunc()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.writerState = writerStateHijacked
+	w.closeConn = true
+	return conn, buffered, nil
+}
+
 // WriteChunkedBody writes a chunk of the body of the HTTP response to the Writer.
 //
 // The body is written directly to the Writer, and the number of bytes
@@ -122,6 +406,13 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if w.writerState != writerStateBody {
 		return 0, fmt.Errorf("cannot write body in state %d", w.writerState)
 	}
+	// Backends frame the body themselves.
+	if w.backend != nil {
+		return w.backend.WriteBody(p)
+	}
+	if w.unchunked {
+		return w.writer.Write(p)
+	}
 
 	// Write the chunk size in hexadecimal, followed by "\r\n", and then the chunk data.
 	chunkSize := fmt.Sprintf("%x\r\n", len(p))
@@ -147,8 +438,39 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 		return 0, fmt.Errorf("cannot write body in state %d", w.writerState)
 	}
 	defer func() { w.writerState = writerStateTrailers }()
+	if w.unchunked || w.backend != nil {
+		return 0, nil
+	}
 
 	// Write "0\r\n" to indicate the end of the body and the start of the trailers
 	_, err := w.writer.Write([]byte("0\r\n"))
 	return 3, err
 }
+
+// withoutConnectionHeaders returns a copy of h without the headers that only
+// apply to an HTTP/1.x connection, along with any headers named in
+// Connection.
+func withoutConnectionHeaders(h headers.Headers) headers.Headers {
+	out := headers.NewHeaders()
+	for k, v := range h {
+		if slices.Contains(connectionHeaders, k) || h.HasToken("connection", k) {
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// connectionClose decides whether the connection has to be closed after a
+// response with the given headers.
+func connectionClose(httpVersion string, h headers.Headers) bool {
+	if h.HasToken("connection", "close") {
+		return true
+	}
+	if httpVersion == "1.0" && !h.HasToken("connection", "keep-alive") {
+		return true
+	}
+	// Without a length or chunked transfer coding the client can only find
+	// the end of the body by waiting for the connection to close.
+	return h.Get("content-length") == "" && !h.HasToken("transfer-encoding", "chunked")
+}
@@ -0,0 +1,79 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Fepozopo/httpfromtcp/internal/cookie"
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteTrailersInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("data"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.False(t, w.ConnectionClose())
+	written := buf.Len()
+
+	// Test: A trailer with a CRLF in its value is refused, nothing is
+	// written and the connection is closed after the response
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc\r\nX-Injected: 1")
+	require.ErrorIs(t, w.WriteTrailers(trailers), headers.ErrInvalidField)
+	assert.Equal(t, written, buf.Len())
+	assert.True(t, w.ConnectionClose())
+}
+
+func TestWriteInformationalInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	// Test: An interim response with a bad field is refused and nothing is
+	// written
+	h := headers.NewHeaders()
+	h.Set("Link", "</style.css>; rel=preload\r\nSet-Cookie: admin=1")
+	require.ErrorIs(t, w.WriteInformational(StatusCodeEarlyHints, h), headers.ErrInvalidField)
+	assert.Zero(t, buf.Len())
+
+	// Test: The final response can still be written
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+}
+
+func TestWriteHeadersRetry(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.SetCookie(&cookie.Cookie{Name: "theme", Value: "dark"}))
+	// Like session middleware, a hook sets a cookie on every response.
+	w.OnWriteHeaders(func(headers.Headers) {
+		w.SetCookie(&cookie.Cookie{Name: "session", Value: "1"})
+	})
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+
+	// Test: Rejected headers leave the cookies as they were before the hooks
+	// ran
+	h := GetDefaultHeaders(0)
+	h.Set("X-Echo", "a\r\nSet-Cookie: admin=1")
+	require.ErrorIs(t, w.WriteHeaders(h), headers.ErrInvalidField)
+	assert.Equal(t, []string{"theme=dark"}, w.cookies)
+	assert.True(t, w.ConnectionClose())
+
+	// Test: Valid headers written afterwards carry every cookie once
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	out := buf.String()
+	assert.Equal(t, 1, strings.Count(out, "Set-Cookie: theme=dark\r\n"))
+	assert.Equal(t, 1, strings.Count(out, "Set-Cookie: session=1\r\n"))
+	assert.NotContains(t, out, "admin")
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// aLongTimeAgo is a read deadline in the past, which interrupts a read in
+// progress.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// startBackgroundRead watches the connection for the client going away
+// while a request is being handled, and calls cancel if it does. A byte the
+// client sends meanwhile, such as the start of a pipelined request, ends
+// the watch and is kept for whoever reads the connection next.
+//
+// Reading from the connection, or hijacking it, stops the watch first, so
+// handlers that read the body or take over the connection are not affected.
+func (c *conn) startBackgroundRead(cancel context.CancelFunc) {
+	c.bgMu.Lock()
+	defer c.bgMu.Unlock()
+	done := make(chan struct{})
+	c.bgDone = done
+	c.bgAborted.Store(false)
+
+	go func() {
+		defer close(done)
+		var b [1]byte
+		n, err := c.Conn.Read(b[:])
+		if n > 0 {
+			c.peeked = append(c.peeked, b[0])
+		}
+		if err != nil && !c.bgAborted.Load() {
+			cancel()
+		}
+	}()
+}
+
+// stopBackgroundRead stops the watch started by startBackgroundRead, if
+// any, and waits for it to end.
+func (c *conn) stopBackgroundRead() {
+	c.bgMu.Lock()
+	defer c.bgMu.Unlock()
+	if c.bgDone == nil {
+		return
+	}
+	c.bgAborted.Store(true)
+	c.Conn.SetReadDeadline(aLongTimeAgo)
+	<-c.bgDone
+	c.bgDone = nil
+	c.Conn.SetReadDeadline(time.Time{})
+}
+
+// isDisconnect reports whether a read error means that the connection is
+// gone, rather than that what was read could not be parsed.
+func isDisconnect(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, io.EOF) || errors.As(err, &opErr)
+}
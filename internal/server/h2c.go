@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/http2"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+)
+
+// Read reads from the connection, returning any bytes kept by sniffPreface
+// or the background read first.
+func (c *conn) Read(p []byte) (int, error) {
+	c.stopBackgroundRead()
+	if len(c.peeked) > 0 {
+		n := copy(p, c.peeked)
+		c.peeked = c.peeked[n:]
+		c.noteRead(n)
+		return n, nil
+	}
+	n, err := c.Conn.Read(p)
+	c.noteRead(n)
+	return n, err
+}
+
+// takePeeked returns and forgets the bytes kept by sniffPreface that have
+// not been read yet.
+func (c *conn) takePeeked() []byte {
+	peeked := c.peeked
+	c.peeked = nil
+	return peeked
+}
+
+// sniffPreface reads just enough of a new connection to tell whether the
+// client starts with the HTTP/2 preface. The bytes are kept, so that they
+// are read again by whichever protocol serves the connection.
+func (c *conn) sniffPreface() (bool, error) {
+	preface := http2.ClientPreface
+	buf := append(make([]byte, 0, max(len(preface), len(c.peeked))), c.peeked...)
+	c.peeked = buf
+	for len(buf) < len(preface) {
+		if !strings.HasPrefix(preface, string(buf)) {
+			return false, nil
+		}
+		n, err := c.Conn.Read(buf[len(buf):len(preface)])
+		buf = buf[:len(buf)+n]
+		c.peeked = buf
+		if err != nil {
+			// Let the HTTP/1.x parser report a truncated request.
+			if len(buf) > 0 {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	return strings.HasPrefix(string(buf), preface), nil
+}
+
+// serveHTTP2 serves the rest of a connection as HTTP/2.
+func (s *Server) serveHTTP2(c *conn, rw io.ReadWriteCloser, upgrade *request.Request, settings []http2.Setting) {
+	remoteAddr, clientIP := c.RemoteAddr().String(), remoteIP(c)
+	localAddr, proxyHeader := c.LocalAddr().String(), c.proxyHeader
+	sc := http2.NewServerConn(rw, func(w *response.Writer, req *request.Request) {
+		req.RemoteAddr = remoteAddr
+		req.ClientIP = clientIP
+		req.LocalAddr = localAddr
+		req.ProxyHeader = proxyHeader
+		// The stream's context is also cancelled when the connection ends
+		// or the server shuts down.
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		stop := context.AfterFunc(c.ctx, cancel)
+		defer stop()
+		req.SetContext(ctx)
+
+		handlerStart := time.Now()
+		trace := s.startTrace(req, handlerStart)
+		defer trace.end(w)
+		s.handler(w, req)
+		trace.phase(PhaseHandler, handlerStart, time.Now())
+	})
+	c.h2.Store(sc)
+	// Close may have missed the connection while it was being set up.
+	if s.closed.Load() {
+		sc.Shutdown()
+	}
+
+	var err error
+	if upgrade != nil {
+		err = sc.ServeUpgrade(upgrade, settings)
+	} else {
+		err = sc.Serve()
+	}
+	// Clients going away are normal; protocol violations are worth noting.
+	var connErr http2.ConnError
+	if errors.As(err, &connErr) {
+		log.Printf("HTTP/2 connection error: %v", err)
+	}
+}
+
+// upgradeH2C switches the connection to HTTP/2 if the request asks for it
+// with "Upgrade: h2c" and a valid HTTP2-Settings header, as described in
+// RFC 7540 section 3.2. The request is then answered over HTTP/2 as stream 1.
+// It reports whether the connection was switched; if not, the request is
+// served as HTTP/1.1.
+func (s *Server) upgradeH2C(c *conn, w *response.Writer, req *request.Request) bool {
+	if req.RequestLine.HttpVersion != "1.1" ||
+		!req.Headers.HasToken("upgrade", "h2c") ||
+		!req.Headers.HasToken("connection", "upgrade") ||
+		!req.Headers.HasToken("connection", "http2-settings") {
+		return false
+	}
+	// A comma means the header was sent more than once.
+	value, ok := req.Headers["http2-settings"]
+	if !ok || strings.Contains(value, ",") {
+		return false
+	}
+	settings, err := http2.DecodeSettingsHeader(value)
+	if err != nil {
+		return false
+	}
+
+	// The whole request has to be read before the protocol changes.
+	if _, err := req.ReadBody(); err != nil {
+		return false
+	}
+	reader, err := req.Upgrade()
+	if err != nil {
+		return false
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "h2c")
+	if err := w.WriteStatusLine(response.StatusCodeSwitchingProtocols); err != nil {
+		return true
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return true
+	}
+	writer, err := w.Upgrade()
+	if err != nil {
+		return true
+	}
+
+	// Stream 1 carries the request as if it had been sent over HTTP/2.
+	req.Headers.Delete("connection")
+	req.Headers.Delete("upgrade")
+	req.Headers.Delete("http2-settings")
+	req.RequestLine.HttpVersion = "2.0"
+
+	rw := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{reader, writer, c}
+	s.serveHTTP2(c, rw, req, settings)
+	return true
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+)
+
+// rejectTimeout bounds how long answering a rejected connection may take.
+const rejectTimeout = time.Second
+
+// admit checks a new connection against the connection filter and limits,
+// waiting for a free slot if needed. It reports whether the connection may
+// be served; if not, the connection has been taken care of.
+//
+// Connections from a load balancer sending PROXY protocol headers are only
+// checked against the filter and the per-IP limit once the header has told
+// who the client is.
+func (s *Server) admit(c *conn) bool {
+	if s.proxyProtocol {
+		c.proxied = s.trustsProxy(remoteIP(c))
+		if !c.proxied && s.proxyProtocolRequired {
+			c.Close()
+			return false
+		}
+	}
+	if !c.proxied {
+		if allowed, full := s.allowClient(c); !allowed {
+			if full {
+				go reject(c)
+			} else {
+				c.Close()
+			}
+			return false
+		}
+	}
+
+	if s.slots != nil {
+		if s.rejectOverLimit {
+			select {
+			case s.slots <- struct{}{}:
+			default:
+				s.mu.Lock()
+				s.release(c)
+				s.mu.Unlock()
+				go reject(c)
+				return false
+			}
+		} else {
+			select {
+			case s.slots <- struct{}{}:
+			case <-s.done:
+				s.mu.Lock()
+				s.release(c)
+				s.mu.Unlock()
+				c.Close()
+				return false
+			}
+		}
+		c.slot = true
+	}
+	return true
+}
+
+// allowClient checks the client address of a connection against the
+// connection filter and the per-IP limit, counting the connection if it is
+// allowed. If it is not, full tells whether it is over the limit, and should
+// be answered with 503, rather than refused by the filter, in which case it
+// should be closed without a word, before anything it sent is read.
+func (s *Server) allowClient(c *conn) (allowed, full bool) {
+	if s.connFilter != nil && !s.connFilter(remoteIP(c)) {
+		return false, false
+	}
+
+	if s.maxConnsPerIP > 0 {
+		ip := remoteIP(c).String()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.perIP[ip] >= s.maxConnsPerIP {
+			return false, true
+		}
+		s.perIP[ip]++
+		c.ip = ip
+	}
+	return true, false
+}
+
+// trustsProxy reports whether a connection from addr may start with a PROXY
+// protocol header.
+func (s *Server) trustsProxy(addr netip.Addr) bool {
+	if len(s.proxySources) == 0 {
+		return true
+	}
+	for _, prefix := range s.proxySources {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// release gives back what admit took for a connection. It must be called
+// with s.mu held.
+func (s *Server) release(c *conn) {
+	if c.slot {
+		c.slot = false
+		<-s.slots
+	}
+	if c.ip != "" {
+		s.perIP[c.ip]--
+		if s.perIP[c.ip] == 0 {
+			delete(s.perIP, c.ip)
+		}
+		c.ip = ""
+	}
+}
+
+// remoteIP returns the IP address of the client of a connection, with
+// IPv4-mapped IPv6 addresses turned into plain IPv4 ones.
+func remoteIP(c net.Conn) netip.Addr {
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.AddrPort().Addr().Unmap()
+	}
+	addrPort, _ := netip.ParseAddrPort(c.RemoteAddr().String())
+	return addrPort.Addr().Unmap()
+}
+
+// reject answers a connection over a limit with 503 Service Unavailable,
+// without waiting for its request, and closes it.
+func reject(c *conn) {
+	c.SetDeadline(time.Now().Add(rejectTimeout))
+
+	w := response.NewWriter(c)
+	w.WriteStatusLine(response.StatusCodeServiceUnavailable)
+	body := []byte("Too many connections")
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Retry-After", "1")
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+
+	c.lingeringClose()
+}
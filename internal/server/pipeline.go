@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+)
+
+// pipelineBufferSize is how much of a response that is not yet at the head
+// of a pipeline is buffered. Its handler blocks in Write beyond that until
+// the response reaches the head.
+const pipelineBufferSize = 64 << 10
+
+// pipeline orders the responses to the pipelined requests of a connection
+// whose handlers run at the same time. The response at the head of the
+// queue is written straight to the connection, so it can be streamed; the
+// others are buffered, up to pipelineBufferSize, until every response before
+// them is complete.
+type pipeline struct {
+	s *Server
+	c *conn
+
+	// mu protects the fields below and the buffers of queued responses.
+	// cond is signaled whenever a response leaves the queue.
+	mu    sync.Mutex
+	cond  sync.Cond
+	queue []*pipelinedResponse
+	depth int
+	// reading is set while the connection waits for the next request.
+	reading bool
+	// closing is set once a response required the connection to be closed.
+	// The responses after it are discarded.
+	closing bool
+	// flushing is set while a finished response is being removed from the
+	// queue and the buffer of the next one written out. Only the goroutine
+	// that set it writes to the connection meanwhile.
+	flushing bool
+}
+
+// pipelinedResponse is the destination of one response in a pipeline.
+type pipelinedResponse struct {
+	p   *pipeline
+	buf bytes.Buffer
+	// done is set once the handler has finished, and closeConn if the
+	// connection cannot be reused after the response.
+	done      bool
+	closeConn bool
+	discard   bool
+}
+
+func newPipeline(s *Server, c *conn, depth int) *pipeline {
+	p := &pipeline{s: s, c: c, depth: depth}
+	p.cond.L = &p.mu
+	return p
+}
+
+// add queues a response, waiting while depth responses are in flight.
+func (p *pipeline) add() *pipelinedResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) >= p.depth {
+		p.cond.Wait()
+	}
+	r := &pipelinedResponse{p: p, discard: p.closing}
+	p.queue = append(p.queue, r)
+	return r
+}
+
+// wait waits until every queued response has been written.
+func (p *pipeline) wait() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) > 0 {
+		p.cond.Wait()
+	}
+}
+
+// isClosing reports whether a response required the connection to close.
+func (p *pipeline) isClosing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closing
+}
+
+// setReading records whether the connection is waiting for a request. It
+// is idle, and can be closed by Server.Close, only if no response is in
+// flight either.
+func (p *pipeline) setReading(reading bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reading = reading
+	p.c.idle.Store(reading && len(p.queue) == 0)
+}
+
+// Write buffers b while the response waits behind others, and writes it to
+// the connection, outside the lock, once the response is at the head of the
+// queue and its buffer has been written out.
+func (r *pipelinedResponse) Write(b []byte) (int, error) {
+	p := r.p
+	p.mu.Lock()
+	for {
+		switch {
+		case r.discard:
+			p.mu.Unlock()
+			return len(b), nil
+		case p.queue[0] == r && !p.flushing:
+			p.mu.Unlock()
+			return p.c.Write(b)
+		case p.queue[0] != r && r.buf.Len()+len(b) <= pipelineBufferSize:
+			n, err := r.buf.Write(b)
+			p.mu.Unlock()
+			return n, err
+		}
+		p.cond.Wait()
+	}
+}
+
+// finish marks a response as complete and writes out the responses that
+// were waiting for it.
+func (r *pipelinedResponse) finish(closeConn bool) {
+	p := r.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r.done = true
+	r.closeConn = closeConn
+	// A flush in progress takes this response out of the queue, too, if
+	// it reaches the head.
+	if p.flushing {
+		return
+	}
+
+	p.flushing = true
+	for len(p.queue) > 0 && p.queue[0].done {
+		head := p.queue[0]
+		p.queue = p.queue[1:]
+		if head.closeConn && !p.closing {
+			p.closing = true
+			for _, next := range p.queue {
+				next.discard = true
+				next.buf.Reset()
+			}
+		}
+		if len(p.queue) > 0 && !p.queue[0].discard && p.queue[0].buf.Len() > 0 {
+			// The handler of next cannot touch its buffer while flushing
+			// is set, so it can be written without holding the lock.
+			next := p.queue[0]
+			p.mu.Unlock()
+			_, err := p.c.Write(next.buf.Bytes())
+			p.mu.Lock()
+			if err != nil {
+				next.discard = true
+			}
+			next.buf.Reset()
+		}
+	}
+	p.flushing = false
+	p.cond.Broadcast()
+
+	if len(p.queue) > 0 || !p.reading {
+		return
+	}
+	// The connection became idle while waiting for the next request. If
+	// it is closing, or the server was closed while the responses were in
+	// flight, nobody else will stop the read.
+	p.c.idle.Store(true)
+	if p.closing || p.s.closed.Load() {
+		p.c.SetReadDeadline(time.Now())
+	}
+}
+
+// runsAhead reports whether the next request on the connection may be read
+// while req is being handled. Its body must have been read with it, and
+// neither the request nor its response may take over the connection.
+func runsAhead(req *request.Request) bool {
+	return !req.BodyPending() &&
+		req.KeepAlive() &&
+		req.Headers.Get("upgrade") == "" &&
+		req.RequestLine.Method != "CONNECT"
+}
+
+// servePipelined serves the requests of a connection, handling requests that
+// were pipelined behind each other at the same time.
+func (s *Server) servePipelined(c *conn, rr *request.Reader) {
+	p := newPipeline(s, c, s.pipelining)
+	defer p.wait()
+
+	for {
+		p.setReading(true)
+		if s.closed.Load() || p.isClosing() {
+			return
+		}
+		req, parse, err := c.readRequest(rr)
+		p.setReading(false)
+		if err != nil {
+			// The handlers still running have nobody to answer to if the
+			// client is gone.
+			if isDisconnect(err) {
+				c.cancel()
+			}
+			p.wait()
+			// Besides the reasons serveRequest ignores, the read may have
+			// been stopped because a response closed the connection.
+			if errors.Is(err, io.EOF) || s.closed.Load() || p.isClosing() {
+				return
+			}
+			writeRequestError(response.NewWriter(c), err)
+			return
+		}
+
+		if !runsAhead(req) || rr.Detach(req) != nil {
+			// The request may need the connection to itself, so it waits
+			// for the others and is then served like an unpipelined one.
+			p.wait()
+			if p.isClosing() || !s.respond(c, c, req, true, parse) {
+				return
+			}
+			continue
+		}
+
+		r := p.add()
+		go func() {
+			keepAlive := s.respond(c, r, req, false, parse)
+			r.finish(!keepAlive)
+		}()
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/proxyproto"
+)
+
+// proxyHeaderTimeout bounds how long a new connection may take to send its
+// PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// readProxyHeader reads the PROXY protocol header a connection starts with.
+// Bytes read past the header are kept, so that they are read again by
+// whichever protocol serves the connection.
+func (s *Server) readProxyHeader(c *conn) error {
+	c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReader(c.Conn)
+	h, err := proxyproto.Read(br)
+	c.peeked, _ = br.Peek(br.Buffered())
+	if errors.Is(err, proxyproto.ErrNoHeader) && !s.proxyProtocolRequired {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	c.proxyHeader = h
+	// Local connections, such as health checks of the load balancer, keep
+	// their own addresses.
+	if h.Command == proxyproto.CommandProxy && h.Source.IsValid() {
+		c.remoteAddr = net.TCPAddrFromAddrPort(h.Source)
+		c.localAddr = net.TCPAddrFromAddrPort(h.Destination)
+	}
+	return nil
+}
@@ -1,28 +1,259 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/netip"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/Fepozopo/httpfromtcp/internal/http2"
+	"github.com/Fepozopo/httpfromtcp/internal/proxyproto"
 	"github.com/Fepozopo/httpfromtcp/internal/request"
 	"github.com/Fepozopo/httpfromtcp/internal/response"
 )
 
 type Handler func(w *response.Writer, req *request.Request)
 
-// Server is an HTTP 1.1 server
+// Server is an HTTP/1.1 server that also accepts HTTP/1.0 requests, and
+// HTTP/2 over cleartext (h2c) from clients that either start with the
+// HTTP/2 preface or ask to upgrade.
 type Server struct {
 	handler  Handler
 	listener net.Listener
 	closed   atomic.Bool
+	// done is closed by Close, to wake up the accept loop.
+	done chan struct{}
+	// ctx is the parent of the contexts of all requests. Close cancels it.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// conns tracks the connections that are being served, so that Close can
+	// wait for them. Hijacked connections are removed from it.
+	mu    sync.Mutex
+	conns map[*conn]struct{}
+	wg    sync.WaitGroup
+
+	// pipelining is the number of pipelined requests of one connection that
+	// may be handled at the same time.
+	pipelining int
+
+	// slots holds a token for every connection being served when the
+	// number of connections is limited. perIP counts the connections of
+	// every client address when that is limited; it is guarded by mu.
+	slots           chan struct{}
+	maxConnsPerIP   int
+	perIP           map[string]int
+	rejectOverLimit bool
+
+	// connFilter decides which client addresses may connect at all.
+	connFilter func(netip.Addr) bool
+
+	// proxyProtocol is set if connections may start with a PROXY protocol
+	// header, and proxyProtocolRequired if they must. proxySources holds
+	// the addresses of the load balancers that may send one, or nothing if
+	// any connection may.
+	proxyProtocol         bool
+	proxyProtocolRequired bool
+	proxySources          []netip.Prefix
+
+	// maxBodySize is the largest body a request may announce, or 0 for no
+	// limit.
+	maxBodySize int64
+
+	// shutdownTimeout is how long Close waits for busy connections before
+	// closing them, or 0 to wait for ever.
+	shutdownTimeout time.Duration
+
+	// tracer, if set, records the phases of every request.
+	tracer Tracer
+}
+
+// DefaultMaxBodySize is the largest body a request may announce unless
+// WithMaxBodySize says otherwise.
+const DefaultMaxBodySize = 10 << 20
+
+// DefaultShutdownTimeout is how long Close waits for busy connections unless
+// WithShutdownTimeout says otherwise.
+const DefaultShutdownTimeout = 10 * time.Second
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithPipelining lets up to n requests that a client pipelined on one
+// connection be handled at the same time. Their responses are still sent in
+// the order the requests arrived, so a handler whose response waits behind
+// others blocks once it has written 64 KiB. By default, pipelined requests
+// are handled one after another.
+func WithPipelining(n int) Option {
+	return func(s *Server) {
+		s.pipelining = max(n, 1)
+	}
+}
+
+// WithMaxBodySize limits the body of HTTP/1.x requests to n bytes. A
+// request whose Content-Length is larger is answered with 413 Content Too
+// Large before any of its body is read, and the connection is closed. Bodies
+// are held in memory unless the client waits for "100 Continue", so without
+// a limit a single request could exhaust it. n <= 0 removes the limit.
+func WithMaxBodySize(n int64) Option {
+	return func(s *Server) {
+		s.maxBodySize = max(n, 0)
+	}
+}
+
+// WithShutdownTimeout sets how long Close waits for the connections that
+// are still busy, such as ones streaming events to a client that stays
+// connected, before closing them. d <= 0 makes Close wait for ever.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.shutdownTimeout = max(d, 0)
+	}
+}
+
+// WithMaxConnections limits the number of connections served at the same
+// time to n. Once the limit is reached, the server stops accepting
+// connections until one finishes, leaving new ones waiting in the
+// operating system's backlog, unless WithRejectOverLimit is used.
+// Hijacked connections no longer count.
+func WithMaxConnections(n int) Option {
+	return func(s *Server) {
+		s.slots = nil
+		if n > 0 {
+			s.slots = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithMaxConnectionsPerIP limits the number of connections served at the
+// same time for each client IP address to n. Connections over the limit are
+// always rejected with 503 Service Unavailable: waiting for them would let
+// a single client stall the server for everyone.
+func WithMaxConnectionsPerIP(n int) Option {
+	return func(s *Server) {
+		s.maxConnsPerIP = max(n, 0)
+	}
+}
+
+// WithRejectOverLimit makes the server accept connections over the limit of
+// WithMaxConnections and answer them right away with 503 Service
+// Unavailable, rather than leaving them waiting.
+func WithRejectOverLimit() Option {
+	return func(s *Server) {
+		s.rejectOverLimit = true
+	}
+}
+
+// WithConnFilter makes the server close connections from client addresses
+// for which allow returns false right after accepting them, before reading
+// anything. ipfilter.Filter.Allowed can be used here.
+func WithConnFilter(allow func(addr netip.Addr) bool) Option {
+	return func(s *Server) {
+		s.connFilter = allow
+	}
+}
+
+// WithProxyProtocol makes the server read the PROXY protocol header that a
+// load balancer sends at the start of each connection, and use the
+// addresses of the original connection it carries as the remote and local
+// addresses. The connection filter and the per-IP connection limit then
+// apply to the original client rather than to the load balancer.
+//
+// Only connections from the trusted ranges may send a header; if none are
+// given, any connection may, so that clients that can reach the server
+// directly can pretend to be anyone. If required is set, connections
+// without a header, and connections from outside the trusted ranges, are
+// closed; otherwise they are served as they are.
+func WithProxyProtocol(required bool, trusted ...netip.Prefix) Option {
+	return func(s *Server) {
+		s.proxyProtocol = true
+		s.proxyProtocolRequired = required
+		s.proxySources = trusted
+	}
+}
+
+// conn is an accepted connection together with its lifecycle state.
+type conn struct {
+	net.Conn
+	// slot is set if the connection holds a token of Server.slots, and ip
+	// is its client address if it is counted in Server.perIP.
+	slot bool
+	ip   string
+	// idle is set while the connection is waiting for the next request.
+	idle atomic.Bool
+	// hijacked is set once a handler has taken over the connection.
+	hijacked atomic.Bool
+	// h2 is set once the connection speaks HTTP/2.
+	h2 atomic.Pointer[http2.ServerConn]
+	// peeked holds bytes read while looking for the PROXY protocol header
+	// or the HTTP/2 preface that have not been consumed yet.
+	peeked []byte
+	// ctx is the parent of the contexts of the requests on the connection.
+	// It is cancelled when the connection ends or the client disconnects.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// bgDone is closed when the background read watching for the client
+	// to disconnect ends, and bgAborted is set when it is being stopped.
+	// bgMu serializes starting and stopping it.
+	bgMu      sync.Mutex
+	bgDone    chan struct{}
+	bgAborted atomic.Bool
+	// proxied is set if the connection comes from a trusted load balancer,
+	// so that it may start with a PROXY protocol header. proxyHeader is the
+	// header the connection started with, and remoteAddr and localAddr the
+	// addresses it carries.
+	proxied               bool
+	proxyHeader           *proxyproto.Header
+	remoteAddr, localAddr net.Addr
+	// readAt is when the first read since readRequest started returned
+	// data.
+	readAt time.Time
+}
+
+// RemoteAddr returns the address of the client, which is the one from the
+// PROXY protocol header if there was one.
+func (c *conn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to, which is the one
+// from the PROXY protocol header if there was one.
+func (c *conn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// lingerTimeout bounds how long a closing connection keeps reading what the
+// client is still sending.
+const lingerTimeout = 500 * time.Millisecond
+
+// lingeringClose closes the connection after telling the client that no
+// more data follows and reading what it is still sending, as RFC 9112
+// section 9.6 suggests. Closing a TCP connection with unread data, such as
+// requests pipelined behind one that closed the connection, makes it send a
+// reset, which may destroy responses the client has not read yet.
+func (c *conn) lingeringClose() {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		c.SetReadDeadline(time.Now().Add(lingerTimeout))
+		io.Copy(io.Discard, c.Conn)
+	}
+	c.Close()
 }
 
 // Serve initializes and starts a new HTTP server on the specified port using
-// the provided handler function. It returns a pointer to the Server instance
-// and any error encountered during the setup.
-func Serve(port int, handler Handler) (*Server, error) {
+// the provided handler function and options. It returns a pointer to the
+// Server instance and any error encountered during the setup.
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
@@ -30,8 +261,18 @@ func Serve(port int, handler Handler) (*Server, error) {
 
 	// Instantiate a new Server object with the provided handler and the created listener.
 	s := &Server{
-		handler:  handler,
-		listener: listener,
+		handler:         handler,
+		listener:        listener,
+		done:            make(chan struct{}),
+		conns:           map[*conn]struct{}{},
+		pipelining:      1,
+		perIP:           map[string]int{},
+		maxBodySize:     DefaultMaxBodySize,
+		shutdownTimeout: DefaultShutdownTimeout,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	// Start the server's listener in a new goroutine to handle incoming connections
@@ -42,21 +283,85 @@ func Serve(port int, handler Handler) (*Server, error) {
 	return s, nil
 }
 
+// Addr returns the address the server is listening on. It is useful when
+// the server was started on port 0 and the system picked a free port.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
 // Close will shut down the server gracefully. It will close the underlying
-// listener so that no new connections can be made, and then wait for all
-// existing connections to be closed. This ensures that the server is not
+// listener so that no new connections can be made, close connections that
+// are idle between requests, tell HTTP/2 clients to go away, cancel the
+// contexts of the requests in flight, and then wait for all other
+// connections to finish their current request. This ensures that the server is not
 // immediately terminated in the middle of a request, which would cause the
-// client to see a connection reset error.
+// client to see a connection reset error. Connections that are still busy
+// after the shutdown timeout (see WithShutdownTimeout) are closed, so that
+// handlers that ignore the context of their request fail to read and write.
+// Hijacked connections are not waited for; they belong to whoever hijacked
+// them.
 //
 // It is safe to call Close on a server that has already been closed.
 func (s *Server) Close() error {
-	s.closed.Store(true)
+	if !s.closed.Swap(true) {
+		close(s.done)
+		s.cancel()
+	}
 
+	var err error
 	if s.listener != nil {
-		return s.listener.Close()
+		err = s.listener.Close()
 	}
 
-	return nil
+	s.mu.Lock()
+	for c := range s.conns {
+		if c.idle.Load() {
+			c.Close()
+		} else if h2 := c.h2.Load(); h2 != nil {
+			h2.Shutdown()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	if s.shutdownTimeout > 0 {
+		select {
+		case <-done:
+		case <-time.After(s.shutdownTimeout):
+			s.mu.Lock()
+			for c := range s.conns {
+				c.Conn.Close()
+			}
+			s.mu.Unlock()
+		}
+	}
+	<-done
+	return err
+}
+
+// track registers a newly accepted connection.
+func (s *Server) track(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+}
+
+// untrack removes a connection from the server's bookkeeping. It is safe to
+// call more than once for the same connection.
+func (s *Server) untrack(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[c]; !ok {
+		return
+	}
+	delete(s.conns, c)
+	s.release(c)
+	s.wg.Done()
 }
 
 // listen is the main loop for the server. It runs in a goroutine when the
@@ -67,52 +372,243 @@ func (s *Server) Close() error {
 // method. When the server is closed, the "closed" flag is set, and the loop
 // will return immediately when a connection error occurs.
 func (s *Server) listen() {
+	var delay time.Duration
 	for {
-		conn, err := s.listener.Accept()
+		nc, err := s.listener.Accept()
 		if err != nil {
 			if s.closed.Load() {
 				return
 			}
 
-			// If the server is not closed, then the error is unexpected, so
-			// we log it and continue.
-			log.Printf("Error accepting connection: %v", err)
+			// If the server is not closed, the error is most likely
+			// temporary, such as running out of file descriptors. Retrying
+			// right away would only fail again, so we back off.
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			log.Printf("Error accepting connection: %v; retrying in %v", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		delay = 0
+
+		c := &conn{Conn: nc}
+		if !s.admit(c) {
 			continue
 		}
 
 		// Once a connection is accepted, we start a new goroutine to handle
 		// the connection. This allows the server to handle multiple
 		// connections concurrently.
-		go s.handle(conn)
+		s.track(c)
+		go s.handle(c)
 	}
 }
 
+const (
+	// minAcceptDelay and maxAcceptDelay bound how long the accept loop
+	// waits after a failed Accept.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
 // handle is the main entry point for handling incoming connections on the
-// server. It will read and parse an HTTP request from the connection, and then
-// invoke the server's handler with the parsed request and a response writer for
-// the connection. If there's an error parsing the request, it will write a 400
-// Bad Request response to the connection.
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+// server. It will read and parse HTTP requests from the connection, and then
+// invoke the server's handler with each parsed request and a response writer
+// for the connection. If there's an error parsing a request, it will write a
+// 400 Bad Request (or 413 Content Too Large, 501 Not Implemented or 505 HTTP
+// Version Not Supported) response to the connection and close it.
+//
+// The connection is kept open for further requests as long as both the
+// request and the response allow it, and the server is not shutting down.
+// Requests the client pipelined are answered in order.
+func (s *Server) handle(c *conn) {
+	var refused bool
+	defer func() {
+		switch {
+		case c.hijacked.Load():
+		case s.closed.Load():
+			// A server that is shutting down does not wait for clients.
+			c.Close()
+		case refused:
+			// Nothing a refused client sent is worth reading, and reject
+			// has already lingered for the answer it got.
+			c.Close()
+		default:
+			c.lingeringClose()
+		}
+		s.untrack(c)
+	}()
+	c.ctx, c.cancel = context.WithCancel(s.ctx)
+	defer c.cancel()
 
-	// Create a new response writer for the connection
-	w := response.NewWriter(conn)
+	c.idle.Store(true)
+	if c.proxied {
+		if err := s.readProxyHeader(c); err != nil {
+			if !errors.Is(err, io.EOF) && !s.closed.Load() {
+				log.Printf("Error reading PROXY protocol header from %s: %v", c.Conn.RemoteAddr(), err)
+			}
+			refused = true
+			return
+		}
+		// Only now is the address of the client known.
+		if allowed, full := s.allowClient(c); !allowed {
+			if full {
+				reject(c)
+			}
+			refused = true
+			return
+		}
+	}
+	isHTTP2, err := c.sniffPreface()
+	if err != nil {
+		return
+	}
+	if isHTTP2 {
+		c.idle.Store(false)
+		s.serveHTTP2(c, c, nil, nil)
+		return
+	}
 
+	rr := request.NewReader(c)
+	rr.MaxBodySize = s.maxBodySize
+	if s.pipelining > 1 {
+		s.servePipelined(c, rr)
+		return
+	}
+	for {
+		c.idle.Store(true)
+		if s.closed.Load() {
+			return
+		}
+		if !s.serveRequest(c, rr) {
+			return
+		}
+	}
+}
+
+// serveRequest reads a single request from the connection and responds to
+// it. It reports whether the connection can be reused for another request.
+func (s *Server) serveRequest(c *conn, rr *request.Reader) bool {
 	// Attempt to read and parse an HTTP request from the connection
-	req, err := request.RequestFromReader(conn)
+	req, parse, err := c.readRequest(rr)
+	c.idle.Store(false)
 	if err != nil {
-		w.WriteStatusLine(response.StatusCodeBadRequest)
+		// The client closed an idle connection, or the server closed it
+		// while shutting down; there is nobody to answer.
+		if errors.Is(err, io.EOF) || s.closed.Load() {
+			return false
+		}
+		writeRequestError(response.NewWriter(c), err)
+		return false
+	}
+	return s.respond(c, c, req, true, parse)
+}
 
-		body := []byte(fmt.Sprintf("Error parsing request: %v", err))
+// respond runs the handler for a request that was parsed during parse,
+// writing the response to out, and reports whether the connection can be
+// reused for another request. The connection can only be hijacked or
+// upgraded if owned is set, meaning that no other request is being read
+// from it.
+func (s *Server) respond(c *conn, out io.Writer, req *request.Request, owned bool, parse interval) bool {
+	req.RemoteAddr = c.RemoteAddr().String()
+	req.ClientIP = remoteIP(c)
+	req.LocalAddr = c.LocalAddr().String()
+	req.ProxyHeader = c.proxyHeader
+	// The context of the request ends with the handler at the latest.
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	req.SetContext(ctx)
 
-		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	trace := s.startTrace(req, parse.start)
+	trace.phase(PhaseParse, parse.start, parse.end)
+	w := response.NewWriter(trace.timeWrites(out))
+	defer trace.end(w)
+	// Answer in the same HTTP version that the client used.
+	w.SetHTTPVersion(req.RequestLine.HttpVersion)
 
-		w.WriteBody(body)
+	if err := req.ValidateHost(); err != nil {
+		writeError(w, response.StatusCodeBadRequest, fmt.Sprintf("Error parsing request: %v", err))
+		return false
+	}
 
-		return
+	// The only expectation defined by HTTP is "100-continue"; anything else
+	// must be rejected before the handler runs.
+	if req.Headers.Get("expect") != "" && !req.ExpectsContinue() {
+		writeError(w, response.StatusCodeExpectationFailed, "Unsupported expectation")
+		return false
+	}
+
+	// If the client is waiting for permission to send the body, send
+	// "100 Continue" lazily, only once the handler actually reads the body.
+	// A handler that rejects the request without reading never triggers it.
+	req.OnContinue(func() error {
+		return w.WriteInformational(response.StatusCodeContinue, nil)
+	})
+
+	if owned {
+		// Let the handler take over the connection. From then on the server
+		// neither closes the connection nor waits for it on shutdown.
+		w.OnHijack(func() (net.Conn, []byte, error) {
+			c.stopBackgroundRead()
+			c.hijacked.Store(true)
+			s.untrack(c)
+			return c.Conn, append(req.Buffered(), c.takePeeked()...), nil
+		})
+
+		if upgraded := s.upgradeH2C(c, w, req); upgraded {
+			return false
+		}
+	}
+
+	// While the handler runs, nothing else reads from a connection it owns,
+	// so the server can watch for the client going away.
+	if owned {
+		c.startBackgroundRead(cancel)
+		defer c.stopBackgroundRead()
 	}
 
 	// If the request is successfully parsed, invoke the server's handler
 	// with the response writer and the parsed request
+	handlerStart := time.Now()
 	s.handler(w, req)
+	trace.phase(PhaseHandler, handlerStart, time.Now())
+	if c.hijacked.Load() {
+		return false
+	}
+
+	// A body the handler never read is still on the wire (or never will be),
+	// so the connection cannot be used for another request.
+	return req.KeepAlive() && !w.ConnectionClose() && !req.BodyPending()
+}
+
+// writeRequestError answers a request that could not be parsed.
+func writeRequestError(w *response.Writer, err error) {
+	if errors.Is(err, request.ErrHTTPVersionNotSupported) {
+		writeError(w, response.StatusCodeHTTPVersionNotSupported, fmt.Sprintf("Error parsing request: %v", err))
+		return
+	}
+	if errors.Is(err, request.ErrBodyTooLarge) {
+		writeError(w, response.StatusCodeContentTooLarge, fmt.Sprintf("Error parsing request: %v", err))
+		return
+	}
+	if errors.Is(err, request.ErrTransferEncodingNotSupported) {
+		writeError(w, response.StatusCodeNotImplemented, fmt.Sprintf("Error parsing request: %v", err))
+		return
+	}
+	writeError(w, response.StatusCodeBadRequest, fmt.Sprintf("Error parsing request: %v", err))
+}
+
+// writeError writes a complete plain text response with the given status
+// code and message to the response writer.
+func writeError(w *response.Writer, statusCode response.StatusCode, message string) {
+	w.WriteStatusLine(statusCode)
+
+	body := []byte(message)
+
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+
+	w.WriteBody(body)
 }
@@ -0,0 +1,1114 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/cookie"
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/http2"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// okHandler writes a small keep-alive friendly response.
+func okHandler(w *response.Writer, _ *request.Request) {
+	body := []byte("ok")
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "2")
+	w.WriteStatusLine(response.StatusCodeSuccess)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func TestKeepAlive(t *testing.T) {
+	s, err := Serve(0, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	// Test: Two requests on the same connection
+	for i := 0; i < 2; i++ {
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		statusLine, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+		for {
+			line, err := br.ReadString('\n')
+			require.NoError(t, err)
+			if line == "\r\n" {
+				break
+			}
+		}
+		body := make([]byte, 2)
+		_, err = io.ReadFull(br, body)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", string(body))
+	}
+
+	// Test: Close shuts down the idle connection
+	require.NoError(t, s.Close())
+	_, err = br.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestHijack(t *testing.T) {
+	hijacked := make(chan net.Conn, 1)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		// Read the bytes sent after the request, some of which may have
+		// been buffered already.
+		extra := make([]byte, 5)
+		io.ReadFull(io.MultiReader(strings.NewReader(string(buffered)), conn), extra)
+		io.WriteString(conn, "raw:"+string(extra))
+
+		// A second hijack fails, and so does writing HTTP.
+		_, _, err = w.Hijack()
+		assert.ErrorIs(t, err, response.ErrHijacked)
+		assert.Error(t, w.WriteStatusLine(response.StatusCodeSuccess))
+		hijacked <- conn
+	})
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: Handler sees the bytes following the request
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\nextra")
+	require.NoError(t, err)
+	got := make([]byte, 9)
+	_, err = io.ReadFull(conn, got)
+	require.NoError(t, err)
+	assert.Equal(t, "raw:extra", string(got))
+
+	// Test: Close does not wait for, nor close, the hijacked connection
+	serverConn := <-hijacked
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close waited for a hijacked connection")
+	}
+	_, err = io.WriteString(serverConn, "still open")
+	require.NoError(t, err)
+	got = make([]byte, 10)
+	_, err = io.ReadFull(conn, got)
+	require.NoError(t, err)
+	assert.Equal(t, "still open", string(got))
+	serverConn.Close()
+}
+
+func TestCloseWaitsForRequests(t *testing.T) {
+	started := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		okHandler(w, req)
+	})
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	// Test: The in-flight request completes before Close returns
+	<-started
+	require.NoError(t, s.Close())
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(string(resp), "\r\n\r\nok"))
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	readErr := make(chan error, 1)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		close(started)
+		// The body never arrives, and the read ignores the context.
+		_, err := req.ReadBody()
+		readErr <- err
+	}, WithShutdownTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	require.NoError(t, err)
+
+	// Test: Close closes connections still busy after the timeout
+	<-started
+	closed := make(chan error, 1)
+	go func() { closed <- s.Close() }()
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	assert.Error(t, <-readErr)
+}
+
+// pathHandler answers with the path of the request, after waiting for
+// the request's channel in gates, if any.
+func pathHandler(gates map[string]chan struct{}) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		if gate, ok := gates[req.RequestLine.Target.Path]; ok {
+			<-gate
+		}
+		body := []byte(req.RequestLine.Target.Path + " " + string(req.Body))
+		h := response.GetDefaultHeaders(len(body))
+		h.Delete("Connection")
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+	}
+}
+
+// readBodies reads n responses from br and returns their bodies in order.
+func readBodies(t *testing.T, br *bufio.Reader, n int) []string {
+	t.Helper()
+	var bodies []string
+	for i := 0; i < n; i++ {
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+	}
+	return bodies
+}
+
+const pipelinedRequests = "GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+	"POST /second HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+	"GET /third HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+func TestPipelining(t *testing.T) {
+	s, err := Serve(0, pathHandler(nil))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: Requests sent in one write, one with a body, are all answered
+	_, err = io.WriteString(conn, pipelinedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/first ", "/second hello", "/third "}, readBodies(t, bufio.NewReader(conn), 3))
+}
+
+func TestTransferEncoding(t *testing.T) {
+	var handled atomic.Int32
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		handled.Add(1)
+		okHandler(w, req)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name, headers string
+		status        int
+	}{
+		{"chunked", "Transfer-Encoding: chunked\r\n", 501},
+		{"with content-length", "Transfer-Encoding: chunked\r\nContent-Length: 33\r\n", 400},
+	} {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// Test: A request framed by Transfer-Encoding is refused and the
+		// connection closed, so its body is never served as a request
+		_, err = io.WriteString(conn, "POST /a HTTP/1.1\r\nHost: localhost\r\n"+tc.headers+"\r\n"+
+			"1c\r\nGET /smuggled HTTP/1.1\r\n\r\n\r\n0\r\n\r\n")
+		require.NoError(t, err)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.status, resp.StatusCode, tc.name)
+		io.Copy(io.Discard, resp.Body)
+		_, err = br.ReadByte()
+		assert.ErrorIs(t, err, io.EOF, tc.name)
+		conn.Close()
+	}
+	assert.Zero(t, handled.Load())
+}
+
+func TestMaxBodySize(t *testing.T) {
+	s, err := Serve(0, okHandler, WithMaxBodySize(4))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: A request announcing a larger body is answered with 413 before
+	// the body is sent
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10000000000\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 413, resp.StatusCode)
+}
+
+func TestConcurrentPipelining(t *testing.T) {
+	gates := map[string]chan struct{}{"/first": make(chan struct{})}
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		// The first request only completes once the last one was handled.
+		if req.RequestLine.Target.Path == "/third" {
+			close(gates["/first"])
+		}
+		pathHandler(gates)(w, req)
+	}, WithPipelining(4))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	// Test: Handlers run at the same time, responses keep request order
+	_, err = io.WriteString(conn, pipelinedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/first ", "/second hello", "/third "}, readBodies(t, br, 3))
+
+	// Test: A response that closes the connection drops the ones after it
+	_, err = io.WriteString(conn, "GET /a HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"+
+		"GET /b HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a "}, readBodies(t, br, 1))
+	_, err = br.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestPipeliningBufferLimit(t *testing.T) {
+	release := make(chan struct{})
+	written := make(chan struct{})
+	body := strings.Repeat("x", 4*pipelineBufferSize)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Target.Path == "/first" {
+			<-release
+			okHandler(w, req)
+			return
+		}
+		h := response.GetDefaultHeaders(len(body))
+		h.Delete("Connection")
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+		close(written)
+	}, WithPipelining(2))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: A response waiting behind another is not buffered beyond the
+	// limit; its handler blocks until the response reaches the head
+	_, err = io.WriteString(conn, "GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /big HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	select {
+	case <-written:
+		t.Fatal("the body was buffered beyond the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Test: Both responses arrive complete and in order once the first is
+	// done
+	close(release)
+	assert.Equal(t, []string{"ok", body}, readBodies(t, bufio.NewReader(conn), 2))
+	<-written
+}
+
+// readHTTP2Response reads frames until stream 1 ends and returns the header
+// block and body of its response.
+func readHTTP2Response(t *testing.T, br *bufio.Reader) ([]byte, string) {
+	t.Helper()
+	var block []byte
+	var body string
+	for {
+		f, err := http2.ReadFrame(br, 1<<14)
+		require.NoError(t, err)
+		if f.StreamID != 1 {
+			continue
+		}
+		switch f.Type {
+		case http2.FrameHeaders:
+			block = f.Payload
+		case http2.FrameData:
+			body += string(f.Payload)
+		}
+		if f.Has(http2.FlagEndStream) {
+			return block, body
+		}
+	}
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+	s, err := Serve(0, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	// Test: A connection starting with the preface is served as HTTP/2
+	_, err = io.WriteString(conn, http2.ClientPreface)
+	require.NoError(t, err)
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameSettings}))
+	// GET http://localhost/ using static table entries and a literal
+	// :authority.
+	block := append([]byte{0x82, 0x86, 0x84, 0x01, 0x09}, "localhost"...)
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{
+		Type:     http2.FrameHeaders,
+		Flags:    http2.FlagEndHeaders | http2.FlagEndStream,
+		StreamID: 1,
+		Payload:  block,
+	}))
+
+	respBlock, body := readHTTP2Response(t, br)
+	// ":status: 200" is index 8 of the static table.
+	assert.Equal(t, byte(0x88), respBlock[0])
+	assert.Equal(t, "ok", body)
+
+	// Test: Close sends GOAWAY and closes the connection
+	require.NoError(t, s.Close())
+	for {
+		f, err := http2.ReadFrame(br, 1<<14)
+		if err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			break
+		}
+		if f.Type == http2.FrameGoAway {
+			assert.Equal(t, []byte{0, 0, 0, 1, 0, 0, 0, 0}, f.Payload)
+		}
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	s, err := Serve(0, okHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	// Test: The server switches protocols
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n"+
+		"HTTP2-Settings: AAMAAABkAAQAoAAAAAIAAAAA\r\n\r\n")
+	require.NoError(t, err)
+	statusLine, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", statusLine)
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	// Test: The upgrade request is answered on stream 1
+	_, err = io.WriteString(conn, http2.ClientPreface)
+	require.NoError(t, err)
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameSettings}))
+	respBlock, body := readHTTP2Response(t, br)
+	assert.Equal(t, byte(0x88), respBlock[0])
+	assert.Equal(t, "ok", body)
+}
+
+func TestRemoteAddr(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		body := []byte(req.RemoteAddr)
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: The handler sees the address of the client
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, conn.LocalAddr().String(), string(body))
+}
+
+// roundTrip sends a GET request on conn and returns the response status.
+func roundTrip(t *testing.T, conn net.Conn, br *bufio.Reader) int {
+	t.Helper()
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode
+}
+
+func TestMaxConnections(t *testing.T) {
+	s, err := Serve(0, okHandler, WithMaxConnections(1))
+	require.NoError(t, err)
+	defer s.Close()
+
+	first, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, 200, roundTrip(t, first, bufio.NewReader(first)))
+
+	// Test: A connection over the limit waits for a free slot
+	second, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer second.Close()
+	_, err = io.WriteString(second, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	br := bufio.NewReader(second)
+	_, err = br.ReadByte()
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// Test: It is served once the first one is gone
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: Close does not wait for connections that were never admitted
+	third, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer third.Close()
+	require.NoError(t, s.Close())
+}
+
+func TestRejectOverLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		// Test: Over the connection limit with rejection
+		{"max connections", []Option{WithMaxConnections(1), WithRejectOverLimit()}},
+		// Test: Over the per-IP limit, which always rejects
+		{"per ip", []Option{WithMaxConnectionsPerIP(1)}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := Serve(0, okHandler, tc.opts...)
+			require.NoError(t, err)
+			defer s.Close()
+
+			first, err := net.Dial("tcp", s.Addr().String())
+			require.NoError(t, err)
+			assert.Equal(t, 200, roundTrip(t, first, bufio.NewReader(first)))
+
+			second, err := net.Dial("tcp", s.Addr().String())
+			require.NoError(t, err)
+			defer second.Close()
+			resp, err := http.ReadResponse(bufio.NewReader(second), nil)
+			require.NoError(t, err)
+			assert.Equal(t, 503, resp.StatusCode)
+			assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+			assert.True(t, resp.Close)
+
+			// Test: The slot is free again once the first connection is gone
+			first.Close()
+			assert.Eventually(t, func() bool {
+				conn, err := net.Dial("tcp", s.Addr().String())
+				if err != nil {
+					return false
+				}
+				defer conn.Close()
+				io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+				resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+				return err == nil && resp.StatusCode == 200
+			}, 5*time.Second, 20*time.Millisecond)
+		})
+	}
+}
+
+func TestConnFilter(t *testing.T) {
+	var seen atomic.Value
+	var refuse atomic.Bool
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		body := []byte(req.ClientIP.String())
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}, WithConnFilter(func(addr netip.Addr) bool {
+		seen.Store(addr)
+		return !refuse.Load()
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Allowed connections are served and see their client IP
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	local := netip.MustParseAddrPort(conn.LocalAddr().String()).Addr().Unmap()
+	assert.Equal(t, local.String(), string(body))
+	assert.Equal(t, local, seen.Load())
+
+	// Test: Refused connections are closed without a response
+	refuse.Store(true)
+	refused, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer refused.Close()
+	refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := refused.Read(make([]byte, 1))
+	assert.Zero(t, n)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		body := []byte(req.RemoteAddr + " " + req.LocalAddr + " " + req.ClientIP.String())
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+	get := func(t *testing.T, s *Server, prefix string) (string, error) {
+		t.Helper()
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, prefix+"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body), nil
+	}
+	const header = "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+
+	t.Run("required", func(t *testing.T) {
+		s, err := Serve(0, handler, WithProxyProtocol(true))
+		require.NoError(t, err)
+		defer s.Close()
+
+		// Test: The request carries the addresses of the original connection
+		body, err := get(t, s, header)
+		require.NoError(t, err)
+		assert.Equal(t, "192.0.2.1:56324 198.51.100.1:443 192.0.2.1", body)
+
+		// Test: Connections without a header are closed
+		_, err = get(t, s, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("optional", func(t *testing.T) {
+		s, err := Serve(0, handler, WithProxyProtocol(false))
+		require.NoError(t, err)
+		defer s.Close()
+
+		body, err := get(t, s, header)
+		require.NoError(t, err)
+		assert.Equal(t, "192.0.2.1:56324 198.51.100.1:443 192.0.2.1", body)
+
+		// Test: Connections without a header are served as they are
+		body, err = get(t, s, "")
+		require.NoError(t, err)
+		assert.NotContains(t, body, "192.0.2.1")
+
+		// Test: Local connections keep their own addresses
+		body, err = get(t, s, "PROXY UNKNOWN\r\n")
+		require.NoError(t, err)
+		assert.NotContains(t, body, "192.0.2.1")
+	})
+
+	t.Run("http2", func(t *testing.T) {
+		s, err := Serve(0, handler, WithProxyProtocol(true))
+		require.NoError(t, err)
+		defer s.Close()
+
+		// Test: The HTTP/2 preface may follow the header
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(conn, header+http2.ClientPreface)
+		require.NoError(t, err)
+		require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameSettings}))
+		block := append([]byte{0x82, 0x86, 0x84, 0x01, 0x09}, "localhost"...)
+		require.NoError(t, http2.WriteFrame(conn, http2.Frame{
+			Type:     http2.FrameHeaders,
+			Flags:    http2.FlagEndHeaders | http2.FlagEndStream,
+			StreamID: 1,
+			Payload:  block,
+		}))
+		_, body := readHTTP2Response(t, bufio.NewReader(conn))
+		assert.Equal(t, "192.0.2.1:56324 198.51.100.1:443 192.0.2.1", body)
+	})
+
+	t.Run("filter and limits", func(t *testing.T) {
+		s, err := Serve(0, handler, WithProxyProtocol(true),
+			WithConnFilter(func(addr netip.Addr) bool { return addr != netip.MustParseAddr("192.0.2.66") }),
+			WithMaxConnectionsPerIP(1))
+		require.NoError(t, err)
+		defer s.Close()
+
+		// Test: The per-IP limit counts the clients behind the load
+		// balancer, not the load balancer itself
+		first, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer first.Close()
+		_, err = io.WriteString(first, header)
+		require.NoError(t, err)
+		assert.Equal(t, 200, roundTrip(t, first, bufio.NewReader(first)))
+
+		body, err := get(t, s, "PROXY TCP4 192.0.2.2 198.51.100.1 56325 443\r\n")
+		require.NoError(t, err)
+		assert.Contains(t, body, "192.0.2.2")
+
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, header)
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		assert.Equal(t, 503, resp.StatusCode)
+
+		// Test: The filter sees the address from the header
+		_, err = get(t, s, "PROXY TCP4 192.0.2.66 198.51.100.1 56326 443\r\n")
+		assert.Error(t, err)
+	})
+
+	t.Run("trusted sources", func(t *testing.T) {
+		trusted := netip.MustParsePrefix("203.0.113.0/24")
+		s, err := Serve(0, handler, WithProxyProtocol(false, trusted))
+		require.NoError(t, err)
+		defer s.Close()
+
+		// Test: A header from outside the trusted ranges is not read, but
+		// taken for the start of the request
+		body, err := get(t, s, header)
+		require.NoError(t, err)
+		assert.Contains(t, body, "Error parsing request")
+
+		// Test: Connections from outside the trusted ranges are closed if a
+		// header is required
+		required, err := Serve(0, handler, WithProxyProtocol(true, trusted))
+		require.NoError(t, err)
+		defer required.Close()
+		_, err = get(t, required, header)
+		assert.Error(t, err)
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		s, err := Serve(0, handler, WithProxyProtocol(true),
+			WithConnFilter(func(addr netip.Addr) bool { return addr != netip.MustParseAddr("192.0.2.66") }))
+		require.NoError(t, err)
+		defer s.Close()
+		tracked := func() int {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return len(s.conns)
+		}
+
+		// Test: Refused connections are closed at once, not after reading
+		// what the client is still sending
+		for _, prefix := range []string{"PROXY TCP4 192.0.2.66 198.51.100.1 56326 443\r\n", "GET / HTTP/1.1\r\n"} {
+			conn, err := net.Dial("tcp", s.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = io.WriteString(conn, prefix)
+			require.NoError(t, err)
+			conn.SetReadDeadline(time.Now().Add(lingerTimeout / 2))
+			_, err = io.ReadAll(conn)
+			require.NoError(t, err)
+			assert.Eventually(t, func() bool { return tracked() == 0 }, lingerTimeout/2, 10*time.Millisecond)
+		}
+	})
+}
+
+func TestRequestContext(t *testing.T) {
+	cancelled := make(chan error, 1)
+	handler := func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.Target.Path {
+		case "/wait":
+			<-req.Context().Done()
+			cancelled <- req.Context().Err()
+			return
+		case "/body":
+			// Give the background read time to take the first byte.
+			time.Sleep(50 * time.Millisecond)
+			body, err := req.ReadBody()
+			require.NoError(t, err)
+			h := headers.NewHeaders()
+			h.Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteStatusLine(response.StatusCodeSuccess)
+			w.WriteHeaders(h)
+			w.WriteBody(body)
+			return
+		}
+		if err := req.Context().Err(); err != nil {
+			t.Errorf("context of %s is done: %v", req.RequestLine.Target.Path, err)
+		}
+		okHandler(w, req)
+	}
+	wait := func(t *testing.T, why string) {
+		t.Helper()
+		select {
+		case err := <-cancelled:
+			assert.ErrorIs(t, err, context.Canceled)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("context was not cancelled when %s", why)
+		}
+	}
+
+	for _, pipelining := range []int{1, 4} {
+		s, err := Serve(0, handler, WithPipelining(pipelining))
+		require.NoError(t, err)
+		defer s.Close()
+
+		// Test: The client disconnecting cancels the context
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		_, err = io.WriteString(conn, "GET /wait HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+		wait(t, "the client disconnected")
+
+		// Test: Pipelined requests and bodies are not lost to the watch
+		conn, err = net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(conn, "POST /body HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+		require.NoError(t, err)
+		br := bufio.NewReader(conn)
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+		_, err = br.ReadString('\n')
+		require.NoError(t, err)
+		_, err = io.WriteString(conn, "helloGET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(body))
+		resp, err = http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		io.ReadAll(resp.Body)
+
+		// Test: Shutting down the server cancels the context
+		_, err = io.WriteString(conn, "GET /wait HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		time.Sleep(20 * time.Millisecond)
+		require.NoError(t, s.Close())
+		wait(t, "the server shut down")
+	}
+}
+
+// failingListener fails every Accept until it is closed.
+type failingListener struct {
+	net.Listener
+	accepts atomic.Int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts.Add(1)
+	return nil, errors.New("too many open files")
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	fl := &failingListener{Listener: ln}
+	s := &Server{listener: fl, done: make(chan struct{}), conns: map[*conn]struct{}{}}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.listen()
+		close(done)
+	}()
+
+	// Test: Failures are retried after growing delays rather than in a
+	// tight loop: 5, 10, 20, 40 and 80ms add up to 155ms
+	time.Sleep(100 * time.Millisecond)
+	assert.LessOrEqual(t, fl.accepts.Load(), int32(6))
+	assert.GreaterOrEqual(t, fl.accepts.Load(), int32(3))
+
+	// Test: Close stops the loop while it waits
+	require.NoError(t, s.Close())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("accept loop did not stop")
+	}
+}
+
+// recordingTracer is a Tracer that sends every recorded request on traces
+// once it ends. It does not record requests for /untraced.
+type recordingTracer struct {
+	traces chan *recordedTrace
+}
+
+type tracerKey struct{}
+
+type recordedTrace struct {
+	tracer     *recordingTracer
+	path       string
+	start      time.Time
+	phases     map[string]interval
+	statusCode response.StatusCode
+}
+
+func (rt *recordingTracer) StartRequest(req *request.Request, start time.Time) RequestTrace {
+	if req.RequestLine.Target.Path == "/untraced" {
+		return nil
+	}
+	req.SetValue(tracerKey{}, "traced")
+	return &recordedTrace{tracer: rt, path: req.RequestLine.Target.Path, start: start, phases: map[string]interval{}}
+}
+
+func (r *recordedTrace) Phase(name string, start, end time.Time) {
+	r.phases[name] = interval{start: start, end: end}
+}
+
+func (r *recordedTrace) End(statusCode response.StatusCode) {
+	r.statusCode = statusCode
+	r.tracer.traces <- r
+}
+
+func TestTracer(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		time.Sleep(20 * time.Millisecond)
+		body := []byte(fmt.Sprint(req.Value(tracerKey{})))
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+	tracer := &recordingTracer{traces: make(chan *recordedTrace, 10)}
+	s, err := Serve(0, handler, WithTracer(tracer))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: The parse phase starts with the first byte, not when the
+	// connection was opened, and lasts until the headers are complete
+	time.Sleep(20 * time.Millisecond)
+	sent := time.Now()
+	_, err = io.WriteString(conn, "GET /slow HTTP/1.1\r\n")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = io.WriteString(conn, "Host: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	body, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	// Test: The handler sees what the tracer attached to the request
+	assert.True(t, strings.HasSuffix(string(body), "\r\n\r\ntraced"))
+
+	r := <-tracer.traces
+	assert.Equal(t, "/slow", r.path)
+	assert.Equal(t, response.StatusCodeSuccess, r.statusCode)
+	parse, handle, write := r.phases[PhaseParse], r.phases[PhaseHandler], r.phases[PhaseWrite]
+	assert.Equal(t, r.start, parse.start)
+	assert.False(t, parse.start.Before(sent))
+	assert.GreaterOrEqual(t, parse.end.Sub(parse.start), 20*time.Millisecond)
+
+	// Test: The handler phase follows it, and the response is written
+	// during the handler phase
+	assert.False(t, handle.start.Before(parse.end))
+	assert.GreaterOrEqual(t, handle.end.Sub(handle.start), 20*time.Millisecond)
+	assert.False(t, write.start.Before(handle.start))
+	assert.False(t, write.end.After(handle.end))
+
+	t.Run("untraced", func(t *testing.T) {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// Test: Requests the tracer does not record see no trace
+		_, err = io.WriteString(conn, "GET /untraced HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		require.NoError(t, err)
+		body, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.True(t, strings.HasSuffix(string(body), "\r\n\r\n<nil>"))
+		select {
+		case r := <-tracer.traces:
+			t.Fatalf("unexpected trace of %s", r.path)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("pipelined", func(t *testing.T) {
+		s, err := Serve(0, pathHandler(nil), WithTracer(tracer), WithPipelining(4))
+		require.NoError(t, err)
+		defer s.Close()
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// Test: Every pipelined request is recorded with all its phases
+		_, err = io.WriteString(conn, pipelinedRequests)
+		require.NoError(t, err)
+		readBodies(t, bufio.NewReader(conn), 3)
+		paths := map[string]bool{}
+		for range 3 {
+			r := <-tracer.traces
+			paths[r.path] = true
+			assert.Equal(t, response.StatusCodeSuccess, r.statusCode)
+			assert.Len(t, r.phases, 3)
+		}
+		assert.Equal(t, map[string]bool{"/first": true, "/second": true, "/third": true}, paths)
+	})
+
+	t.Run("http2", func(t *testing.T) {
+		s, err := Serve(0, okHandler, WithTracer(tracer))
+		require.NoError(t, err)
+		defer s.Close()
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		_, err = io.WriteString(conn, http2.ClientPreface)
+		require.NoError(t, err)
+		require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameSettings}))
+		block := append([]byte{0x82, 0x86, 0x84, 0x01, 0x09}, "localhost"...)
+		require.NoError(t, http2.WriteFrame(conn, http2.Frame{
+			Type:     http2.FrameHeaders,
+			Flags:    http2.FlagEndHeaders | http2.FlagEndStream,
+			StreamID: 1,
+			Payload:  block,
+		}))
+		readHTTP2Response(t, bufio.NewReader(conn))
+
+		// Test: Only the handler phase of HTTP/2 requests is recorded
+		r := <-tracer.traces
+		assert.Equal(t, response.StatusCodeSuccess, r.statusCode)
+		assert.Len(t, r.phases, 1)
+		assert.Contains(t, r.phases, PhaseHandler)
+	})
+}
+
+func TestHeaderInjection(t *testing.T) {
+	errs := make(chan error, 2)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		// Like session middleware, a hook sets a cookie on every response.
+		w.OnWriteHeaders(func(headers.Headers) {
+			w.SetCookie(&cookie.Cookie{Name: "session", Value: "1"})
+		})
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "2")
+		h.Set("X-Echo", "a\r\nSet-Cookie: admin=1")
+		err := w.WriteHeaders(h)
+		errs <- err
+		if req.RequestLine.Target.Path == "/retry" {
+			h.Delete("x-echo")
+			assert.NoError(t, w.WriteHeaders(h))
+			w.WriteBody([]byte("ok"))
+		}
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	// Test: Headers with a CRLF in a value are refused, and the handler may
+	// write valid ones instead, with the cookies of the hooks set once
+	_, err = io.WriteString(conn, "GET /retry HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.ErrorIs(t, <-errs, headers.ErrInvalidField)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, []string{"session=1"}, resp.Header.Values("Set-Cookie"))
+
+	// Test: If the handler gives up, nothing follows the status line and
+	// the connection is closed
+	_, err = io.WriteString(conn, "GET /give-up HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.ErrorIs(t, <-errs, headers.ErrInvalidField)
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", string(rest))
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"io"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+)
+
+// Phases of a request that a RequestTrace records.
+const (
+	// PhaseParse is reading the request line and headers, from the arrival
+	// of their first byte. The body is read later, by the handler.
+	PhaseParse = "parse"
+	// PhaseHandler is running the handler.
+	PhaseHandler = "handler"
+	// PhaseWrite is writing the response, from its first byte to its last.
+	PhaseWrite = "write"
+)
+
+// Tracer records how the server spends its time on requests.
+type Tracer interface {
+	// StartRequest is called for every request once it is parsed, before
+	// the handler runs, with the time its first byte arrived. It may set
+	// the context of req, so that the handler sees the trace. It returns
+	// nil if the request is not to be recorded.
+	StartRequest(req *request.Request, start time.Time) RequestTrace
+}
+
+// RequestTrace records the phases of one request. Its methods are called
+// one at a time.
+type RequestTrace interface {
+	// Phase records that the request spent the time from start to end in
+	// the named phase. Phases may overlap, since the response is written
+	// while the handler runs.
+	Phase(name string, start, end time.Time)
+	// End is called once the server is done with the request, with the
+	// status code of the response, or 0 if none was written.
+	End(statusCode response.StatusCode)
+}
+
+// WithTracer has t record the parse, handler and write phases of every
+// HTTP/1.x request. Requests over HTTP/2 are parsed by the HTTP/2
+// connection and their responses framed by it, so only their handler
+// phase is recorded.
+func WithTracer(t Tracer) Option {
+	return func(s *Server) {
+		s.tracer = t
+	}
+}
+
+// interval is the time a request spent in a phase.
+type interval struct {
+	start, end time.Time
+}
+
+// writeTimer notes when the first and last writes of a response happened.
+type writeTimer struct {
+	w io.Writer
+	interval
+}
+
+func (t *writeTimer) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.w.Write(p)
+	if t.start.IsZero() {
+		t.start = start
+	}
+	t.end = time.Now()
+	return n, err
+}
+
+// tracedRequest records a request for the tracer of the server. A nil
+// tracedRequest records nothing.
+type tracedRequest struct {
+	trace RequestTrace
+	write *writeTimer
+}
+
+// startTrace starts recording a request whose first byte arrived at start.
+func (s *Server) startTrace(req *request.Request, start time.Time) *tracedRequest {
+	if s.tracer == nil {
+		return nil
+	}
+	trace := s.tracer.StartRequest(req, start)
+	if trace == nil {
+		return nil
+	}
+	return &tracedRequest{trace: trace}
+}
+
+// phase records a phase of the request.
+func (t *tracedRequest) phase(name string, start, end time.Time) {
+	if t != nil {
+		t.trace.Phase(name, start, end)
+	}
+}
+
+// timeWrites returns a writer that writes to out and notes the write phase
+// of the request.
+func (t *tracedRequest) timeWrites(out io.Writer) io.Writer {
+	if t == nil {
+		return out
+	}
+	t.write = &writeTimer{w: out}
+	return t.write
+}
+
+// end finishes recording once the server is done with the request that w
+// answered.
+func (t *tracedRequest) end(w *response.Writer) {
+	if t == nil {
+		return
+	}
+	if t.write != nil && !t.write.start.IsZero() {
+		t.trace.Phase(PhaseWrite, t.write.start, t.write.end)
+	}
+	t.trace.End(w.StatusCode())
+}
+
+// readRequest reads the next request from rr, noting when it was parsed.
+func (c *conn) readRequest(rr *request.Reader) (*request.Request, interval, error) {
+	called := time.Now()
+	c.readAt = time.Time{}
+	req, err := rr.ReadRequest()
+	parse := interval{start: c.readAt, end: time.Now()}
+	// Nothing was read if the request had been read along with the one
+	// before it.
+	if parse.start.IsZero() {
+		parse.start = called
+	}
+	return req, parse, err
+}
+
+// noteRead notes the time of the first read that returned data.
+func (c *conn) noteRead(n int) {
+	if n > 0 && c.readAt.IsZero() {
+		c.readAt = time.Now()
+	}
+}
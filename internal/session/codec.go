@@ -0,0 +1,137 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// MinSigningKeySize is the smallest key NewSignedCodec accepts: the size of
+// the HMAC-SHA256 output.
+const MinSigningKeySize = sha256.Size
+
+// ErrInvalidCookie is returned when a cookie value was not produced by the
+// codec with any of its keys, or was tampered with.
+var ErrInvalidCookie = errors.New("session: invalid cookie")
+
+// Codec protects the value of the session cookie. Every codec takes a list
+// of keys: the first one protects new cookies, and all of them are tried on
+// cookies sent back, so that keys can be rotated without logging everyone
+// out. Add the new key in front, and drop the old one once the cookies it
+// protected have expired.
+type Codec interface {
+	// Encode protects data for the cookie with the given name.
+	Encode(name string, data []byte) (string, error)
+	// Decode checks and returns the data protected by Encode.
+	Decode(name, value string) ([]byte, error)
+}
+
+// signedCodec signs cookies with HMAC-SHA256. The data can be read by the
+// client but not changed.
+type signedCodec struct {
+	keys [][]byte
+}
+
+// NewSignedCodec returns a codec that signs cookie values with HMAC-SHA256.
+// Keys must be at least MinSigningKeySize random bytes.
+func NewSignedCodec(keys ...[]byte) (Codec, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("session: no signing key")
+	}
+	for _, key := range keys {
+		if len(key) < MinSigningKeySize {
+			return nil, fmt.Errorf("session: signing key must be at least %d bytes, got %d", MinSigningKeySize, len(key))
+		}
+	}
+	return &signedCodec{keys: keys}, nil
+}
+
+func (c *signedCodec) Encode(name string, data []byte) (string, error) {
+	mac := sign(c.keys[0], name, data)
+	raw := append(append([]byte(nil), data...), mac...)
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func (c *signedCodec) Decode(name, value string) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(raw) < sha256.Size {
+		return nil, ErrInvalidCookie
+	}
+	data, mac := raw[:len(raw)-sha256.Size], raw[len(raw)-sha256.Size:]
+	for _, key := range c.keys {
+		if hmac.Equal(mac, sign(key, name, data)) {
+			return data, nil
+		}
+	}
+	return nil, ErrInvalidCookie
+}
+
+// sign computes the MAC of a cookie. The name is included so that a value
+// cannot be moved to another cookie signed with the same key.
+func sign(key []byte, name string, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// encryptedCodec encrypts cookies with AES-GCM, so the client can neither
+// read nor change the data.
+type encryptedCodec struct {
+	aeads []cipher.AEAD
+}
+
+// NewEncryptedCodec returns a codec that encrypts cookie values with
+// AES-GCM. Keys must be 16, 24 or 32 random bytes.
+func NewEncryptedCodec(keys ...[]byte) (Codec, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("session: no encryption key")
+	}
+	c := &encryptedCodec{}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("session: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("session: %w", err)
+		}
+		c.aeads = append(c.aeads, aead)
+	}
+	return c, nil
+}
+
+func (c *encryptedCodec) Encode(name string, data []byte) (string, error) {
+	aead := c.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	// The name is authenticated as additional data, like in signedCodec.
+	sealed := aead.Seal(nonce, nonce, data, []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (c *encryptedCodec) Decode(name, value string) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCookie
+	}
+	for _, aead := range c.aeads {
+		if len(raw) < aead.NonceSize() {
+			continue
+		}
+		nonce, sealed := raw[:aead.NonceSize()], raw[aead.NonceSize():]
+		if data, err := aead.Open(nil, nonce, sealed, []byte(name)); err == nil {
+			return data, nil
+		}
+	}
+	return nil, ErrInvalidCookie
+}
@@ -0,0 +1,93 @@
+package session
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecs(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	constructors := map[string]func(keys ...[]byte) (Codec, error){
+		"signed":    NewSignedCodec,
+		"encrypted": NewEncryptedCodec,
+	}
+	for name, newCodec := range constructors {
+		t.Run(name, func(t *testing.T) {
+			old, err := newCodec(oldKey)
+			require.NoError(t, err)
+			rotated, err := newCodec(newKey, oldKey)
+			require.NoError(t, err)
+			fresh, err := newCodec(newKey)
+			require.NoError(t, err)
+
+			// Test: Values round trip
+			value, err := old.Encode("session", []byte("data"))
+			require.NoError(t, err)
+			data, err := old.Decode("session", value)
+			require.NoError(t, err)
+			assert.Equal(t, "data", string(data))
+
+			// Test: Old keys still decode after rotation
+			data, err = rotated.Decode("session", value)
+			require.NoError(t, err)
+			assert.Equal(t, "data", string(data))
+
+			// Test: New values use the first key
+			value, err = rotated.Encode("session", []byte("data"))
+			require.NoError(t, err)
+			_, err = fresh.Decode("session", value)
+			require.NoError(t, err)
+			_, err = old.Decode("session", value)
+			require.ErrorIs(t, err, ErrInvalidCookie)
+
+			// Test: Values are bound to the cookie name
+			_, err = rotated.Decode("other", value)
+			require.ErrorIs(t, err, ErrInvalidCookie)
+
+			// Test: Tampered values are rejected
+			raw, err := base64.RawURLEncoding.DecodeString(value)
+			require.NoError(t, err)
+			raw[0] ^= 1
+			_, err = rotated.Decode("session", base64.RawURLEncoding.EncodeToString(raw))
+			require.ErrorIs(t, err, ErrInvalidCookie)
+
+			// Test: Garbage is rejected
+			for _, v := range []string{"", "not base64!", "c2hvcnQ"} {
+				_, err = rotated.Decode("session", v)
+				require.ErrorIs(t, err, ErrInvalidCookie)
+			}
+
+			// Test: A codec needs a key
+			_, err = newCodec()
+			require.Error(t, err)
+			for _, keys := range [][][]byte{{nil}, {[]byte{}}, {newKey, nil}, {[]byte("short")}, {newKey[:31]}} {
+				_, err = newCodec(keys...)
+				require.Error(t, err)
+			}
+		})
+	}
+
+	// Test: Signed values are readable, encrypted ones are not
+	signed, err := NewSignedCodec(oldKey)
+	require.NoError(t, err)
+	value, err := signed.Encode("session", []byte("visible"))
+	require.NoError(t, err)
+	raw, _ := base64.RawURLEncoding.DecodeString(value)
+	assert.Contains(t, string(raw), "visible")
+
+	encrypted, err := NewEncryptedCodec(oldKey)
+	require.NoError(t, err)
+	value, err = encrypted.Encode("session", []byte("visible"))
+	require.NoError(t, err)
+	raw, _ = base64.RawURLEncoding.DecodeString(value)
+	assert.NotContains(t, string(raw), "visible")
+
+	// Test: AES keys must have a valid size
+	_, err = NewEncryptedCodec([]byte("short"))
+	require.Error(t, err)
+}
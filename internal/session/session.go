@@ -0,0 +1,389 @@
+// Package session keeps per-client state across requests in a cookie.
+//
+// The session either lives entirely in the cookie, signed or encrypted by a
+// Codec, or in a Store on the server with only its ID in the cookie.
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/cookie"
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+)
+
+const (
+	// DefaultCookieName is the name of the session cookie when
+	// Config.Cookie.Name is empty.
+	DefaultCookieName = "session"
+	// maxCookieSize is the largest cookie browsers are required to keep,
+	// counting its name and value.
+	maxCookieSize = 4096
+)
+
+// Config configures the session middleware.
+type Config struct {
+	// Cookie holds the name and attributes of the session cookie. The name
+	// defaults to DefaultCookieName, Path to "/" and SameSite to Lax.
+	// HttpOnly is always set, and Value and MaxAge are filled in for each
+	// response.
+	Cookie cookie.Cookie
+	// Codec signs or encrypts the cookie. It is required.
+	Codec Codec
+	// Store keeps sessions on the server. If nil, the whole session is kept
+	// in the cookie, which limits its size to about 4 KB.
+	Store Store
+	// IdleTimeout ends a session once no request has used it for this long.
+	// Zero means no limit.
+	IdleTimeout time.Duration
+	// AbsoluteTimeout ends a session this long after it was created, or
+	// after its ID was last regenerated, however active it is. Zero means
+	// no limit.
+	AbsoluteTimeout time.Duration
+
+	// now returns the current time. Tests replace it.
+	now func() time.Time
+}
+
+// sessionKey is the request value key the session is stored under.
+type sessionKey struct{}
+
+// Session holds the values of one client's session. A Session is only
+// used by the request it belongs to and is not safe for concurrent use.
+type Session struct {
+	id        string
+	values    map[string]string
+	createdAt time.Time
+	lastSeen  time.Time
+
+	now func() time.Time
+	// isNew is set for sessions the client has no cookie for yet. They are
+	// only saved once something changes them.
+	isNew   bool
+	changed bool
+	// destroyed is set by Destroy, until a later Set starts over.
+	destroyed bool
+	// clearCookie is set when the client sent a cookie that is no longer
+	// valid, so that it is deleted if no new session replaces it.
+	clearCookie bool
+	// stale lists IDs to delete from the store when the session is saved.
+	stale []string
+}
+
+// record is how a Session is encoded as JSON.
+type record struct {
+	ID        string            `json:"id"`
+	Values    map[string]string `json:"values,omitempty"`
+	CreatedAt time.Time         `json:"created"`
+	LastSeen  time.Time         `json:"seen"`
+}
+
+func (s *Session) MarshalJSON() ([]byte, error) {
+	return json.Marshal(record{ID: s.id, Values: s.values, CreatedAt: s.createdAt, LastSeen: s.lastSeen})
+}
+
+func (s *Session) UnmarshalJSON(data []byte) error {
+	var r record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	if !validID(r.ID) {
+		return errors.New("session: invalid ID")
+	}
+	s.id, s.values, s.createdAt, s.lastSeen = r.ID, r.Values, r.CreatedAt, r.LastSeen
+	return nil
+}
+
+// ID returns the session ID. It changes when the session is regenerated.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// IsNew reports whether the client did not have this session before the
+// current request.
+func (s *Session) IsNew() bool {
+	return s.isNew
+}
+
+// CreatedAt returns when the session was created, or its ID last
+// regenerated.
+func (s *Session) CreatedAt() time.Time {
+	return s.createdAt
+}
+
+// Get returns the value stored under key, or "".
+func (s *Session) Get(key string) string {
+	return s.values[key]
+}
+
+// Set stores value under key. Setting a value after Destroy starts a new
+// session.
+func (s *Session) Set(key, value string) {
+	if s.destroyed {
+		s.reset()
+		s.destroyed = false
+	}
+	if s.values == nil {
+		s.values = map[string]string{}
+	}
+	s.values[key] = value
+	s.changed = true
+}
+
+// Delete removes the value stored under key.
+func (s *Session) Delete(key string) {
+	if _, ok := s.values[key]; ok {
+		delete(s.values, key)
+		s.changed = true
+	}
+}
+
+// Regenerate gives the session a new ID, keeping its values, and drops the
+// old one. Call it whenever the privileges of the client change, such as
+// on login, so that an ID an attacker planted or saw before is useless.
+func (s *Session) Regenerate() {
+	values := s.values
+	s.reset()
+	s.values = values
+	s.changed = true
+}
+
+// Destroy ends the session, dropping its values and deleting its cookie.
+func (s *Session) Destroy() {
+	s.reset()
+	s.destroyed = true
+}
+
+// reset replaces the session with an empty new one, marking the old ID for
+// deletion.
+func (s *Session) reset() {
+	if !s.isNew {
+		s.stale = append(s.stale, s.id)
+		s.clearCookie = true
+	}
+	now := s.now()
+	s.id = newID()
+	s.values = nil
+	s.createdAt = now
+	s.lastSeen = now
+	s.isNew = true
+	s.changed = false
+}
+
+// expired reports whether the session has timed out at now.
+func (s *Session) expired(cfg *Config, now time.Time) bool {
+	if cfg.IdleTimeout > 0 && now.Sub(s.lastSeen) >= cfg.IdleTimeout {
+		return true
+	}
+	return cfg.AbsoluteTimeout > 0 && now.Sub(s.createdAt) >= cfg.AbsoluteTimeout
+}
+
+// expires returns when the session will time out if it is not used again,
+// or the zero time if it never does.
+func (s *Session) expires(cfg *Config) time.Time {
+	var t time.Time
+	if cfg.IdleTimeout > 0 {
+		t = s.lastSeen.Add(cfg.IdleTimeout)
+	}
+	if cfg.AbsoluteTimeout > 0 {
+		if end := s.createdAt.Add(cfg.AbsoluteTimeout); t.IsZero() || end.Before(t) {
+			t = end
+		}
+	}
+	return t
+}
+
+// Get returns the session of a request handled by the session middleware,
+// or nil if the middleware is not in use.
+func Get(req *request.Request) *Session {
+	s, _ := req.Value(sessionKey{}).(*Session)
+	return s
+}
+
+type manager struct {
+	cfg Config
+}
+
+// Handler returns a handler that attaches a session to every request before
+// passing it on to next, where Get returns it. Sessions are created lazily:
+// a client only gets a cookie once a handler stores something in its
+// session. Changes are saved, and the cookie refreshed, right before the
+// response headers are written.
+func Handler(cfg Config, next server.Handler) server.Handler {
+	if cfg.Codec == nil {
+		panic("session: Config.Codec is required")
+	}
+	if cfg.Cookie.Name == "" {
+		cfg.Cookie.Name = DefaultCookieName
+	}
+	if cfg.Cookie.Path == "" {
+		cfg.Cookie.Path = "/"
+	}
+	if cfg.Cookie.SameSite == cookie.SameSiteDefault {
+		cfg.Cookie.SameSite = cookie.SameSiteLax
+	}
+	cfg.Cookie.HttpOnly = true
+	if cfg.now == nil {
+		cfg.now = time.Now
+	}
+	m := &manager{cfg: cfg}
+
+	return func(w *response.Writer, req *request.Request) {
+		s := m.load(req)
+		req.SetValue(sessionKey{}, s)
+		w.OnWriteHeaders(func(headers.Headers) { m.save(w, s) })
+		next(w, req)
+	}
+}
+
+// load returns the session the request's cookie refers to, or a new one if
+// there is no valid cookie.
+func (m *manager) load(req *request.Request) *Session {
+	s, err := m.decode(req)
+	switch {
+	case errors.Is(err, request.ErrNoCookie):
+		return m.newSession(false)
+	case err != nil:
+		if !errors.Is(err, ErrInvalidCookie) && !errors.Is(err, ErrNotFound) {
+			log.Printf("Error loading session: %v", err)
+		}
+		return m.newSession(true)
+	}
+
+	now := m.cfg.now()
+	if s.expired(&m.cfg, now) {
+		if m.cfg.Store != nil {
+			if err := m.cfg.Store.Delete(s.id); err != nil {
+				log.Printf("Error deleting session: %v", err)
+			}
+		}
+		return m.newSession(true)
+	}
+	s.now = m.cfg.now
+	s.lastSeen = now
+	return s
+}
+
+// decode reads the session from the request's cookie, and from the store
+// if there is one.
+func (m *manager) decode(req *request.Request) (*Session, error) {
+	c, err := req.Cookie(m.cfg.Cookie.Name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := m.cfg.Codec.Decode(c.Name, c.Value)
+	if err != nil {
+		return nil, err
+	}
+	if m.cfg.Store != nil {
+		return m.cfg.Store.Load(string(data))
+	}
+	s := &Session{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, ErrInvalidCookie
+	}
+	return s, nil
+}
+
+func (m *manager) newSession(clearCookie bool) *Session {
+	now := m.cfg.now()
+	return &Session{
+		id:          newID(),
+		createdAt:   now,
+		lastSeen:    now,
+		now:         m.cfg.now,
+		isNew:       true,
+		clearCookie: clearCookie,
+	}
+}
+
+// save stores the session and sets its cookie on the response. Failures
+// are logged, since the response is already on its way.
+func (m *manager) save(w *response.Writer, s *Session) {
+	if m.cfg.Store != nil {
+		for _, id := range s.stale {
+			if err := m.cfg.Store.Delete(id); err != nil {
+				log.Printf("Error deleting session: %v", err)
+			}
+		}
+	}
+	if s.destroyed || (s.isNew && !s.changed) {
+		if s.clearCookie {
+			m.setCookie(w, "", -1)
+		}
+		return
+	}
+
+	expires := s.expires(&m.cfg)
+	var data []byte
+	if m.cfg.Store != nil {
+		if err := m.cfg.Store.Save(s, expires); err != nil {
+			log.Printf("Error saving session: %v", err)
+			return
+		}
+		data = []byte(s.id)
+	} else {
+		var err error
+		if data, err = json.Marshal(s); err != nil {
+			log.Printf("Error saving session: %v", err)
+			return
+		}
+	}
+	value, err := m.cfg.Codec.Encode(m.cfg.Cookie.Name, data)
+	if err != nil {
+		log.Printf("Error saving session: %v", err)
+		return
+	}
+	// Sessions kept in the cookie are lost rather than truncated when they
+	// outgrow it; those need a Store.
+	if n := len(m.cfg.Cookie.Name) + 1 + len(value); n > maxCookieSize {
+		log.Printf("Error saving session: cookie of %d bytes is too large", n)
+		return
+	}
+
+	// Without a timeout the cookie lasts until the browser is closed.
+	maxAge := 0
+	if !expires.IsZero() {
+		maxAge = max(int(expires.Sub(m.cfg.now()).Round(time.Second)/time.Second), 1)
+	}
+	m.setCookie(w, value, maxAge)
+}
+
+func (m *manager) setCookie(w *response.Writer, value string, maxAge int) {
+	c := m.cfg.Cookie
+	c.Value = value
+	c.MaxAge = maxAge
+	if err := w.SetCookie(&c); err != nil {
+		log.Printf("Error setting session cookie: %v", err)
+	}
+}
+
+// newID returns a random session ID with 256 bits of entropy.
+func newID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("session: cannot generate ID: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// validID reports whether id looks like an ID made by newID.
+func validID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,249 @@
+package session
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/cookie"
+	"github.com/Fepozopo/httpfromtcp/internal/handlertest"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// app is a handler with a login, a page showing who is logged in and a
+// logout.
+func app(w *response.Writer, req *request.Request) {
+	s := Get(req)
+	switch req.RequestLine.Target.Path {
+	case "/login":
+		s.Regenerate()
+		s.Set("user", "alice")
+	case "/big":
+		s.Set("big", strings.Repeat("x", maxCookieSize))
+	case "/logout":
+		s.Destroy()
+	}
+
+	body := []byte(s.Get("user"))
+	w.WriteStatusLine(response.StatusCodeSuccess)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+// client sends requests to a handler, keeping the cookies it sets like a
+// browser would.
+type client struct {
+	t       *testing.T
+	handler server.Handler
+	cookies map[string]*cookie.Cookie
+}
+
+func newClient(t *testing.T, handler server.Handler) *client {
+	return &client{t: t, handler: handler, cookies: map[string]*cookie.Cookie{}}
+}
+
+// get requests path and returns the body and the session cookie set by the
+// response, if any.
+func (c *client) get(path string) (string, *cookie.Cookie) {
+	c.t.Helper()
+	var hdrs []string
+	for _, ck := range c.cookies {
+		hdrs = append(hdrs, "Cookie: "+ck.Name+"="+ck.Value)
+	}
+	resp := handlertest.Do(c.t, c.handler, handlertest.NewRequest(c.t, "GET", path, hdrs...))
+	body := handlertest.Body(c.t, resp)
+
+	var set *cookie.Cookie
+	for _, line := range resp.Header.Values("Set-Cookie") {
+		ck, err := cookie.ParseSetCookie(line)
+		require.NoError(c.t, err)
+		if ck.MaxAge < 0 {
+			delete(c.cookies, ck.Name)
+		} else {
+			c.cookies[ck.Name] = ck
+		}
+		set = ck
+	}
+	return string(body), set
+}
+
+// clock is a fake time source.
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time { return c.now }
+
+func testConfigs(t *testing.T) map[string]Config {
+	key := bytes.Repeat([]byte{7}, 32)
+	signed, err := NewSignedCodec(key)
+	require.NoError(t, err)
+	encrypted, err := NewEncryptedCodec(key)
+	require.NoError(t, err)
+	fileStore, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	return map[string]Config{
+		"signed cookie":    {Codec: signed},
+		"encrypted cookie": {Codec: encrypted},
+		"memory store":     {Codec: signed, Store: NewMemoryStore()},
+		"file store":       {Codec: encrypted, Store: fileStore},
+	}
+}
+
+func TestHandler(t *testing.T) {
+	for name, cfg := range testConfigs(t) {
+		t.Run(name, func(t *testing.T) {
+			c := newClient(t, Handler(cfg, app))
+
+			// Test: No cookie until the session is used
+			body, set := c.get("/")
+			assert.Empty(t, body)
+			assert.Nil(t, set)
+
+			// Test: Login sets the session cookie
+			_, set = c.get("/login")
+			require.NotNil(t, set)
+			assert.Equal(t, DefaultCookieName, set.Name)
+			assert.Equal(t, "/", set.Path)
+			assert.True(t, set.HttpOnly)
+			assert.Equal(t, cookie.SameSiteLax, set.SameSite)
+			assert.Zero(t, set.MaxAge)
+
+			// Test: The session is kept across requests
+			body, _ = c.get("/")
+			assert.Equal(t, "alice", body)
+
+			// Test: A tampered cookie starts over and is deleted
+			saved := *c.cookies[DefaultCookieName]
+			c.cookies[DefaultCookieName].Value = "x" + saved.Value
+			body, set = c.get("/")
+			assert.Empty(t, body)
+			require.NotNil(t, set)
+			assert.Equal(t, -1, set.MaxAge)
+
+			// Test: Logout ends the session
+			c.cookies[DefaultCookieName] = &saved
+			_, set = c.get("/logout")
+			require.NotNil(t, set)
+			assert.Equal(t, -1, set.MaxAge)
+			body, _ = c.get("/")
+			assert.Empty(t, body)
+		})
+	}
+}
+
+func TestRegenerate(t *testing.T) {
+	store := NewMemoryStore()
+	cfg := Config{Codec: testConfigs(t)["memory store"].Codec, Store: store}
+	var ids []string
+	h := Handler(cfg, func(w *response.Writer, req *request.Request) {
+		app(w, req)
+		ids = append(ids, Get(req).ID())
+	})
+	c := newClient(t, h)
+
+	// Test: Logging in again gives a new ID and deletes the old one
+	c.get("/login")
+	c.get("/login")
+	require.Len(t, ids, 2)
+	assert.NotEqual(t, ids[0], ids[1])
+	_, err := store.Load(ids[0])
+	require.ErrorIs(t, err, ErrNotFound)
+	body, _ := c.get("/")
+	assert.Equal(t, "alice", body)
+
+	// Test: The old ID no longer works
+	old := newClient(t, h)
+	value, err := cfg.Codec.Encode(DefaultCookieName, []byte(ids[0]))
+	require.NoError(t, err)
+	old.cookies[DefaultCookieName] = &cookie.Cookie{Name: DefaultCookieName, Value: value}
+	body, _ = old.get("/")
+	assert.Empty(t, body)
+
+	// Test: Logout deletes the session from the store
+	c.get("/logout")
+	_, err = store.Load(ids[1])
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestExpiry(t *testing.T) {
+	for name, cfg := range testConfigs(t) {
+		t.Run(name, func(t *testing.T) {
+			clk := &clock{now: time.Now()}
+			cfg.now = clk.Now
+			cfg.IdleTimeout = 10 * time.Minute
+			cfg.AbsoluteTimeout = time.Hour
+			c := newClient(t, Handler(cfg, app))
+
+			// Test: The cookie lasts as long as the idle timeout
+			_, set := c.get("/login")
+			require.NotNil(t, set)
+			assert.Equal(t, 600, set.MaxAge)
+
+			// Test: Activity keeps the session alive
+			for range 5 {
+				clk.now = clk.now.Add(9 * time.Minute)
+				body, _ := c.get("/")
+				assert.Equal(t, "alice", body)
+			}
+
+			// Test: The cookie never outlives the absolute timeout
+			clk.now = clk.now.Add(9 * time.Minute)
+			body, set := c.get("/")
+			assert.Equal(t, "alice", body)
+			require.NotNil(t, set)
+			assert.Equal(t, 360, set.MaxAge)
+
+			// Test: The absolute timeout ends an active session
+			clk.now = clk.now.Add(6 * time.Minute)
+			body, _ = c.get("/")
+			assert.Empty(t, body)
+
+			// Test: The idle timeout ends an unused session
+			c.get("/login")
+			clk.now = clk.now.Add(10 * time.Minute)
+			body, _ = c.get("/")
+			assert.Empty(t, body)
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	old, err := NewEncryptedCodec(oldKey)
+	require.NoError(t, err)
+	rotated, err := NewEncryptedCodec(newKey, oldKey)
+	require.NoError(t, err)
+
+	c := newClient(t, Handler(Config{Codec: old}, app))
+	c.get("/login")
+
+	// Test: Cookies protected with the old key still work, and are
+	// reissued with the new one
+	c.handler = Handler(Config{Codec: rotated}, app)
+	body, set := c.get("/")
+	assert.Equal(t, "alice", body)
+	require.NotNil(t, set)
+	_, err = old.Decode(DefaultCookieName, set.Value)
+	require.ErrorIs(t, err, ErrInvalidCookie)
+}
+
+func TestCookieTooLarge(t *testing.T) {
+	cfgs := testConfigs(t)
+
+	// Test: A session too large for the cookie is not sent
+	c := newClient(t, Handler(cfgs["signed cookie"], app))
+	_, set := c.get("/big")
+	assert.Nil(t, set)
+
+	// Test: A store has no such limit
+	c = newClient(t, Handler(cfgs["memory store"], app))
+	_, set = c.get("/big")
+	assert.NotNil(t, set)
+}
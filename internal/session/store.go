@@ -0,0 +1,190 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Store.Load for sessions that do not exist or
+// have expired.
+var ErrNotFound = errors.New("session: not found")
+
+// Store keeps sessions on the server, so that the cookie only carries the
+// session ID. Sessions can be encoded with json.Marshal for storage.
+type Store interface {
+	// Load returns the session with the given ID.
+	Load(id string) (*Session, error)
+	// Save stores a session until expires. A zero time keeps it until it is
+	// deleted.
+	Save(s *Session, expires time.Time) error
+	// Delete removes a session. Deleting an unknown session is not an
+	// error.
+	Delete(id string) error
+}
+
+// sweepInterval is how often MemoryStore drops expired sessions.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps sessions in memory. They are lost when the process
+// exits.
+type MemoryStore struct {
+	mu        sync.Mutex
+	sessions  map[string]storedSession
+	lastSweep time.Time
+}
+
+// storedSession is an encoded session and the time it expires.
+type storedSession struct {
+	Expires time.Time       `json:"expires"`
+	Session json.RawMessage `json:"session"`
+}
+
+func (e storedSession) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: map[string]storedSession{}}
+}
+
+func (m *MemoryStore) Load(id string) (*Session, error) {
+	m.mu.Lock()
+	e, ok := m.sessions[id]
+	m.mu.Unlock()
+	if !ok || e.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	s := &Session{}
+	if err := json.Unmarshal(e.Session, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (m *MemoryStore) Save(s *Session, expires time.Time) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.ID()] = storedSession{Expires: expires, Session: data}
+
+	// Expired sessions are dropped every now and then, so that abandoned
+	// sessions do not pile up.
+	now := time.Now()
+	if now.Sub(m.lastSweep) >= sweepInterval {
+		for id, e := range m.sessions {
+			if e.expired(now) {
+				delete(m.sessions, id)
+			}
+		}
+		m.lastSweep = now
+	}
+	return nil
+}
+
+func (m *MemoryStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// FileStore keeps each session in a JSON file of its own in a directory,
+// so that sessions survive restarts.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a FileStore that keeps its files in dir, creating
+// the directory if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("session: %w", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// path returns the file of a session. IDs come from cookies, so anything
+// that is not a generated ID is rejected rather than used in a path.
+func (f *FileStore) path(id string) (string, error) {
+	if !validID(id) {
+		return "", ErrNotFound
+	}
+	return filepath.Join(f.dir, id+".json"), nil
+}
+
+func (f *FileStore) Load(id string) (*Session, error) {
+	path, err := f.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e storedSession
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	if e.expired(time.Now()) {
+		os.Remove(path)
+		return nil, ErrNotFound
+	}
+	s := &Session{}
+	if err := json.Unmarshal(e.Session, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (f *FileStore) Save(s *Session, expires time.Time) error {
+	path, err := f.path(s.ID())
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(storedSession{Expires: expires, Session: encoded})
+	if err != nil {
+		return err
+	}
+	// Writing to a temporary file first means a reader never sees a
+	// partly written session.
+	tmp, err := os.CreateTemp(f.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *FileStore) Delete(id string) error {
+	path, err := f.path(id)
+	if err != nil {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
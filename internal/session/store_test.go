@@ -0,0 +1,80 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStores(t *testing.T) {
+	fileStore, err := NewFileStore(filepath.Join(t.TempDir(), "sessions"))
+	require.NoError(t, err)
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"file":   fileStore,
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now().Truncate(time.Second)
+			s := &Session{id: newID(), values: map[string]string{"user": "alice"}, createdAt: now, lastSeen: now}
+
+			// Test: Saved sessions load back
+			require.NoError(t, store.Save(s, time.Now().Add(time.Hour)))
+			loaded, err := store.Load(s.ID())
+			require.NoError(t, err)
+			assert.Equal(t, s.ID(), loaded.ID())
+			assert.Equal(t, "alice", loaded.Get("user"))
+			assert.True(t, s.CreatedAt().Equal(loaded.CreatedAt()))
+
+			// Test: Loaded sessions are copies
+			loaded.Set("user", "mallory")
+			loaded, err = store.Load(s.ID())
+			require.NoError(t, err)
+			assert.Equal(t, "alice", loaded.Get("user"))
+
+			// Test: Deleted sessions are gone
+			require.NoError(t, store.Delete(s.ID()))
+			_, err = store.Load(s.ID())
+			require.ErrorIs(t, err, ErrNotFound)
+			require.NoError(t, store.Delete(s.ID()))
+
+			// Test: Expired sessions are not loaded
+			require.NoError(t, store.Save(s, time.Now().Add(-time.Second)))
+			_, err = store.Load(s.ID())
+			require.ErrorIs(t, err, ErrNotFound)
+
+			// Test: Sessions without an expiry are kept
+			require.NoError(t, store.Save(s, time.Time{}))
+			_, err = store.Load(s.ID())
+			require.NoError(t, err)
+
+			// Test: Unknown IDs are not found
+			_, err = store.Load(newID())
+			require.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+
+	// Test: IDs that could escape the directory are rejected
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secret.json"), []byte(`{"session":{"id":"x"}}`), 0o600))
+	fileStore, err = NewFileStore(filepath.Join(dir, "sessions"))
+	require.NoError(t, err)
+	for _, id := range []string{"../secret", "", "a/b", "a.b"} {
+		_, err = fileStore.Load(id)
+		require.ErrorIs(t, err, ErrNotFound, id)
+	}
+	_, err = os.Stat(filepath.Join(dir, "secret.json"))
+	require.NoError(t, err)
+
+	// Test: The file store leaves no temporary files behind
+	s := &Session{id: newID()}
+	require.NoError(t, fileStore.Save(s, time.Time{}))
+	entries, err := os.ReadDir(filepath.Join(dir, "sessions"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, s.ID()+".json", entries[0].Name())
+}
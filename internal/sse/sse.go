@@ -0,0 +1,241 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+)
+
+// ErrDisconnected is returned when writing to a stream whose client has
+// gone away or that has been closed.
+var ErrDisconnected = errors.New("sse: client disconnected")
+
+// Event is a single server-sent event. Only Data is required; the other
+// fields are omitted when empty.
+type Event struct {
+	// ID sets the client's last event ID, which it sends back in the
+	// Last-Event-ID header when reconnecting.
+	ID string
+	// Event is the event type; browsers dispatch it to listeners for that
+	// type instead of "message".
+	Event string
+	// Data is the payload. It may span several lines.
+	Data string
+	// Retry tells the client how long to wait before reconnecting.
+	Retry time.Duration
+}
+
+// Stream is an open event stream to a single client. Its methods may be
+// called from several goroutines.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu        sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+	// closed is set by Close, and gone once the client is known to have
+	// disconnected, in which case nothing more can be sent to it.
+	closed bool
+	gone   atomic.Bool
+}
+
+// NewStream writes the response headers for an event stream and returns the
+// stream. The connection is closed once the handler returns, so the handler
+// should keep sending events until it is done or Done is closed.
+//
+// A goroutine watches the connection for the client hanging up and closes
+// Done when it does. Done is also closed when the context of the request
+// ends, such as when the server shuts down.
+func NewStream(w *response.Writer, req *request.Request) (*Stream, error) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+	// The connection is watched for disconnects below, so it cannot be used
+	// for another request afterwards.
+	h.Set("Connection", "close")
+
+	if err := w.WriteStatusLine(response.StatusCodeSuccess); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	s := &Stream{
+		w:           w,
+		lastEventID: req.Headers.Get("last-event-id"),
+		done:        make(chan struct{}),
+	}
+
+	// A client never sends anything after an event stream request, so any
+	// end of the read side means it has disconnected.
+	if conn, err := req.Upgrade(); err == nil {
+		go func() {
+			io.Copy(io.Discard, conn)
+			s.hangUp()
+		}()
+	}
+
+	context.AfterFunc(req.Context(), s.disconnect)
+
+	if err := w.Flush(); err != nil {
+		s.hangUp()
+		return nil, err
+	}
+	return s, nil
+}
+
+// LastEventID returns the Last-Event-ID sent by a reconnecting client, so
+// the handler can resume after the last event the client saw.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done returns a channel that is closed when the client disconnects, the
+// context of the request ends or the stream is closed.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Send writes an event to the client and flushes it.
+func (s *Stream) Send(ev Event) error {
+	if strings.ContainsAny(ev.ID, "\r\n\x00") {
+		return fmt.Errorf("sse: invalid event id %q", ev.ID)
+	}
+	if strings.ContainsAny(ev.Event, "\r\n") {
+		return fmt.Errorf("sse: invalid event type %q", ev.Event)
+	}
+	return s.write(formatEvent(ev))
+}
+
+// Comment writes a comment line, which clients ignore.
+func (s *Stream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range splitLines(text) {
+		b.WriteString(": ")
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Heartbeat sends a comment every interval until the stream is done. It
+// keeps proxies from timing out an idle stream and detects clients that
+// went away without closing the connection.
+func (s *Stream) Heartbeat(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				if err := s.Comment("heartbeat"); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Close ends the event stream. The client will reconnect after its retry
+// delay unless the handler told it otherwise.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.disconnect()
+	// A stream ended by its context still ends the body properly.
+	if s.gone.Load() {
+		return nil
+	}
+
+	if _, err := s.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	if err := s.w.WriteTrailers(headers.NewHeaders()); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// write sends a formatted block as a single chunk. A failed write means the
+// client is gone.
+func (s *Stream) write(block string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return ErrDisconnected
+	default:
+	}
+
+	if _, err := s.w.WriteChunkedBody([]byte(block)); err != nil {
+		s.hangUp()
+		return fmt.Errorf("%w: %v", ErrDisconnected, err)
+	}
+	if err := s.w.Flush(); err != nil {
+		s.hangUp()
+		return fmt.Errorf("%w: %v", ErrDisconnected, err)
+	}
+	return nil
+}
+
+// disconnect closes Done exactly once.
+func (s *Stream) disconnect() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// hangUp records that the client has gone away and closes Done.
+func (s *Stream) hangUp() {
+	s.gone.Store(true)
+	s.disconnect()
+}
+
+// formatEvent encodes an event in the text/event-stream format. Every line
+// of the data becomes its own "data:" field, which the client joins back
+// together with newlines.
+func formatEvent(ev Event) string {
+	var b strings.Builder
+	if ev.ID != "" {
+		b.WriteString("id: " + ev.ID + "\n")
+	}
+	if ev.Event != "" {
+		b.WriteString("event: " + ev.Event + "\n")
+	}
+	if ev.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(ev.Retry.Milliseconds(), 10) + "\n")
+	}
+	for _, line := range splitLines(ev.Data) {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// splitLines splits text on any of the line endings allowed by the format:
+// CRLF, LF or CR.
+func splitLines(text string) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	return strings.Split(text, "\n")
+}
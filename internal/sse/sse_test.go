@@ -0,0 +1,145 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatEvent(t *testing.T) {
+	// Test: Data only
+	assert.Equal(t, "data: hello\n\n", formatEvent(Event{Data: "hello"}))
+
+	// Test: All fields
+	assert.Equal(t,
+		"id: 42\nevent: update\nretry: 1500\ndata: hi\n\n",
+		formatEvent(Event{ID: "42", Event: "update", Retry: 1500 * time.Millisecond, Data: "hi"}))
+
+	// Test: Multi-line data with mixed line endings
+	assert.Equal(t,
+		"data: one\ndata: two\ndata: three\ndata: \n\n",
+		formatEvent(Event{Data: "one\r\ntwo\rthree\n"}))
+
+	// Test: Empty data still dispatches an event
+	assert.Equal(t, "data: \n\n", formatEvent(Event{}))
+}
+
+// openStream starts an event stream on one end of a pipe and returns the
+// stream together with a reader for what the client receives, positioned
+// after the response headers.
+func openStream(t *testing.T, ctx context.Context, extraHeaders string) (*Stream, net.Conn, *bufio.Reader) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	go io.WriteString(clientConn, "GET /events HTTP/1.1\r\nHost: localhost\r\n"+extraHeaders+"\r\n")
+	req, err := request.RequestFromReader(serverConn)
+	require.NoError(t, err)
+	req.SetContext(ctx)
+
+	streams := make(chan *Stream, 1)
+	go func() {
+		s, err := NewStream(response.NewWriter(serverConn), req)
+		assert.NoError(t, err)
+		streams <- s
+	}()
+
+	br := bufio.NewReader(clientConn)
+	var head strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	assert.True(t, strings.HasPrefix(head.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, head.String(), "content-type: text/event-stream\r\n")
+	assert.Contains(t, head.String(), "transfer-encoding: chunked\r\n")
+
+	return <-streams, clientConn, br
+}
+
+// readChunk reads a single chunk of a chunked body.
+func readChunk(t *testing.T, br *bufio.Reader) string {
+	t.Helper()
+	sizeLine, err := br.ReadString('\n')
+	require.NoError(t, err)
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeLine), 16, 64)
+	require.NoError(t, err)
+	data := make([]byte, size+2)
+	_, err = io.ReadFull(br, data)
+	require.NoError(t, err)
+	return string(data[:size])
+}
+
+func TestStream(t *testing.T) {
+	s, conn, br := openStream(t, context.Background(), "Last-Event-ID: 41\r\n")
+
+	// Test: Last-Event-ID is exposed
+	assert.Equal(t, "41", s.LastEventID())
+
+	// Test: Events are sent as chunks
+	go s.Send(Event{ID: "42", Data: "line one\nline two"})
+	assert.Equal(t, "id: 42\ndata: line one\ndata: line two\n\n", readChunk(t, br))
+
+	// Test: Heartbeat comments
+	s.Heartbeat(10 * time.Millisecond)
+	assert.Equal(t, ": heartbeat\n\n", readChunk(t, br))
+
+	// Test: Invalid ids are rejected
+	require.Error(t, s.Send(Event{ID: "4\n2", Data: "x"}))
+
+	// Test: Client disconnect closes Done and fails further sends
+	conn.Close()
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("disconnect was not detected")
+	}
+	require.ErrorIs(t, s.Send(Event{Data: "late"}), ErrDisconnected)
+}
+
+func TestStreamClose(t *testing.T) {
+	s, _, br := openStream(t, context.Background(), "")
+
+	// Test: Close ends the chunked body
+	go s.Close()
+	assert.Equal(t, "", readChunk(t, br))
+	<-s.Done()
+	require.ErrorIs(t, s.Send(Event{Data: "late"}), ErrDisconnected)
+}
+
+func TestStreamContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, _, br := openStream(t, ctx, "")
+
+	// Test: The end of the request's context, such as on shutdown, closes
+	// Done even though the client is still connected
+	cancel()
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Done was not closed")
+	}
+	require.ErrorIs(t, s.Send(Event{Data: "late"}), ErrDisconnected)
+
+	// Test: Close still ends the chunked body
+	go s.Close()
+	assert.Equal(t, "", readChunk(t, br))
+}
@@ -0,0 +1,260 @@
+// Package timeout limits how long handlers may take to respond.
+package timeout
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/cookie"
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+)
+
+// DefaultBody is the body of the 503 response when Config.Body is empty.
+var DefaultBody = []byte("Service Unavailable: the request timed out")
+
+// ErrHandlerTimeout is returned by writes of a handler that is still
+// running after it timed out.
+var ErrHandlerTimeout = errors.New("timeout: handler timed out")
+
+// Config configures the timeout middleware.
+type Config struct {
+	// Timeout is how long the handler may take. It is required.
+	Timeout time.Duration
+	// Body is the body of the 503 response sent when the handler times
+	// out, and ContentType its type, "text/plain" if empty.
+	Body        []byte
+	ContentType string
+}
+
+// Handler returns a handler that runs next with a deadline on the context
+// of the request. The response of next is buffered and sent once next
+// returns. If the deadline passes first, the buffered response is
+// discarded, the client gets 503 Service Unavailable instead, and whatever
+// next writes afterwards fails with ErrHandlerTimeout.
+//
+// Since the response is buffered, next cannot stream it, hijack the
+// connection or upgrade it to another protocol.
+func Handler(cfg Config, next server.Handler) server.Handler {
+	if cfg.Timeout <= 0 {
+		panic("timeout: Config.Timeout is required")
+	}
+	if len(cfg.Body) == 0 {
+		cfg.Body = DefaultBody
+	}
+	if cfg.ContentType == "" {
+		cfg.ContentType = "text/plain"
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), cfg.Timeout)
+		defer cancel()
+		req.SetContext(ctx)
+
+		rec := &recorder{ctx: ctx}
+		inner := response.NewBackendWriter(rec)
+		// The backend drops Connection, so it is noted before that.
+		inner.OnWriteHeaders(func(h headers.Headers) {
+			rec.closeConn = h.HasToken("connection", "close")
+		})
+		// "100 Continue" goes straight to the client, unless the 503 has
+		// been sent already.
+		req.OnContinue(func() error {
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			if rec.expired() {
+				return ErrHandlerTimeout
+			}
+			return w.WriteInformational(response.StatusCodeContinue, nil)
+		})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			next(inner, req)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		switch {
+		case rec.finish(done):
+			rec.replay(w)
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			serviceUnavailable(w, cfg)
+		}
+		// Otherwise the client is gone or the server is shutting down, and
+		// nobody is waiting for a response.
+	}
+}
+
+// serviceUnavailable answers a request whose handler timed out. The
+// connection is closed afterwards, since the handler may still be reading
+// the body of the request.
+func serviceUnavailable(w *response.Writer, cfg Config) {
+	w.WriteStatusLine(response.StatusCodeServiceUnavailable)
+	h := response.GetDefaultHeaders(len(cfg.Body))
+	h.Override("Content-Type", cfg.ContentType)
+	w.WriteHeaders(h)
+	w.WriteBody(cfg.Body)
+}
+
+// recorder is a response.Backend that keeps the response of a handler so
+// that it can be sent once the handler has returned in time.
+type recorder struct {
+	// ctx is the context of the request. mu protects timedOut, which is
+	// set once the context is done and makes any further writes fail.
+	ctx      context.Context
+	mu       sync.Mutex
+	timedOut bool
+
+	wroteHeaders bool
+	statusCode   response.StatusCode
+	header       headers.Headers
+	cookies      []string
+	closeConn    bool
+	body         bytes.Buffer
+	trailers     headers.Headers
+}
+
+// expired reports whether the handler is out of time. r.mu must be held.
+func (r *recorder) expired() bool {
+	if !r.timedOut && r.ctx.Err() != nil {
+		r.timedOut = true
+	}
+	return r.timedOut
+}
+
+// finish reports whether the handler, whose goroutine closes done, has
+// returned in time. Otherwise, it makes sure nothing else is recorded.
+func (r *recorder) finish(done <-chan struct{}) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-done:
+		if !r.expired() {
+			return true
+		}
+	default:
+	}
+	r.timedOut = true
+	return false
+}
+
+func (r *recorder) WriteHeaders(statusCode response.StatusCode, h headers.Headers, cookies []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.expired() {
+		return ErrHandlerTimeout
+	}
+	// Informational responses other than "100 Continue" cannot be sent
+	// ahead of a response that may never come, so they are dropped.
+	if statusCode.IsInformational() {
+		return nil
+	}
+	r.wroteHeaders = true
+	r.statusCode = statusCode
+	r.header = h
+	r.cookies = cookies
+	return nil
+}
+
+func (r *recorder) WriteBody(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.expired() {
+		return 0, ErrHandlerTimeout
+	}
+	return r.body.Write(p)
+}
+
+func (r *recorder) WriteTrailers(h headers.Headers) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.expired() {
+		return ErrHandlerTimeout
+	}
+	r.trailers = h
+	return nil
+}
+
+func (r *recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.expired() {
+		return ErrHandlerTimeout
+	}
+	return nil
+}
+
+// replay sends the recorded response. The whole body is known by now, so
+// it gets a Content-Length, unless there are trailers to send after it.
+func (r *recorder) replay(w *response.Writer) {
+	if !r.wroteHeaders {
+		return
+	}
+	for _, line := range r.cookies {
+		c, err := cookie.ParseSetCookie(line)
+		if err == nil {
+			err = w.SetCookie(c)
+		}
+		if err != nil {
+			log.Printf("Error replaying cookie: %v", err)
+		}
+	}
+
+	h := r.header
+	if r.closeConn {
+		h.Set("Connection", "close")
+	}
+	if len(r.trailers) > 0 {
+		h.Delete("content-length")
+		h.Override("Transfer-Encoding", "chunked")
+	} else if r.body.Len() > 0 || (h.Get("content-length") == "" && bodyAllowed(r.statusCode)) {
+		h.Override("Content-Length", strconv.Itoa(r.body.Len()))
+	}
+
+	if err := w.WriteStatusLine(r.statusCode); err != nil {
+		log.Printf("Error writing status line: %v", err)
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		log.Printf("Error writing headers: %v", err)
+		return
+	}
+	if len(r.trailers) == 0 {
+		if r.body.Len() > 0 {
+			if _, err := w.WriteBody(r.body.Bytes()); err != nil {
+				log.Printf("Error writing body: %v", err)
+			}
+		}
+		return
+	}
+	if r.body.Len() > 0 {
+		if _, err := w.WriteChunkedBody(r.body.Bytes()); err != nil {
+			log.Printf("Error writing body: %v", err)
+			return
+		}
+	}
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		log.Printf("Error writing body: %v", err)
+		return
+	}
+	if err := w.WriteTrailers(r.trailers); err != nil {
+		log.Printf("Error writing trailers: %v", err)
+	}
+}
+
+// bodyAllowed reports whether a response with the given status may have a
+// body; 204 No Content and 304 Not Modified may not.
+func bodyAllowed(statusCode response.StatusCode) bool {
+	return statusCode != response.StatusCodeNoContent && statusCode != 304
+}
@@ -0,0 +1,118 @@
+package timeout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/cookie"
+	"github.com/Fepozopo/httpfromtcp/internal/handlertest"
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerInTime(t *testing.T) {
+	h := Handler(Config{Timeout: time.Second}, func(w *response.Writer, req *request.Request) {
+		_, ok := req.Context().Deadline()
+		assert.True(t, ok)
+		w.SetCookie(&cookie.Cookie{Name: "id", Value: "42", Path: "/"})
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		hdrs := headers.NewHeaders()
+		hdrs.Set("Content-Type", "text/plain")
+		hdrs.Set("Transfer-Encoding", "chunked")
+		w.WriteHeaders(hdrs)
+		w.WriteChunkedBody([]byte("hello, "))
+		w.WriteChunkedBody([]byte("world"))
+		w.WriteChunkedBodyDone()
+		w.WriteTrailers(headers.NewHeaders())
+	})
+
+	// Test: The response of a handler that returns in time is sent, with a
+	// Content-Length since it was buffered
+	resp := handlertest.Do(t, h, handlertest.NewRequest(t, "GET", "/"))
+	body := handlertest.Body(t, resp)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "hello, world", body)
+	assert.Equal(t, int64(12), resp.ContentLength)
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, []string{"id=42; Path=/"}, resp.Header["Set-Cookie"])
+}
+
+func TestHandlerTrailers(t *testing.T) {
+	h := Handler(Config{Timeout: time.Second}, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		hdrs := headers.NewHeaders()
+		hdrs.Set("Transfer-Encoding", "chunked")
+		hdrs.Set("Trailer", "X-Checksum")
+		hdrs.Set("Connection", "close")
+		w.WriteHeaders(hdrs)
+		w.WriteChunkedBody([]byte("data"))
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "abc")
+		w.WriteTrailers(trailers)
+	})
+
+	// Test: Trailers are still sent after the body, and Connection is kept
+	resp := handlertest.Do(t, h, handlertest.NewRequest(t, "GET", "/"))
+	body := handlertest.Body(t, resp)
+	assert.Equal(t, "data", body)
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+	assert.True(t, resp.Close)
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	late := make(chan error, 1)
+	h := Handler(Config{Timeout: 20 * time.Millisecond, Body: []byte(`{"error":"timeout"}`), ContentType: "application/json"},
+		func(w *response.Writer, req *request.Request) {
+			<-req.Context().Done()
+			assert.ErrorIs(t, req.Context().Err(), context.DeadlineExceeded)
+			w.WriteStatusLine(response.StatusCodeSuccess)
+			late <- w.WriteHeaders(response.GetDefaultHeaders(0))
+		})
+
+	// Test: A handler that takes too long is answered with 503
+	raw := handlertest.Record(h, handlertest.NewRequest(t, "GET", "/"))
+	resp := handlertest.ReadResponse(t, raw)
+	body := handlertest.Body(t, resp)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, `{"error":"timeout"}`, body)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.True(t, resp.Close)
+
+	// Test: Its late writes go nowhere
+	assert.ErrorIs(t, <-late, ErrHandlerTimeout)
+	assert.NotContains(t, raw, "200")
+}
+
+func TestHandlerCancelled(t *testing.T) {
+	h := Handler(Config{Timeout: time.Minute}, func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+	})
+
+	// Test: Nothing is written when the client is gone
+	req := handlertest.NewRequest(t, "GET", "/")
+	ctx, cancel := context.WithCancel(context.Background())
+	req.SetContext(ctx)
+	cancel()
+	assert.Empty(t, handlertest.Record(h, req))
+}
+
+func TestHandlerConfig(t *testing.T) {
+	// Test: The timeout is required
+	assert.Panics(t, func() {
+		Handler(Config{}, func(w *response.Writer, req *request.Request) {})
+	})
+
+	// Test: The default body
+	h := Handler(Config{Timeout: time.Millisecond}, func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+	})
+	resp := handlertest.Do(t, h, handlertest.NewRequest(t, "GET", "/"))
+	body := handlertest.Body(t, resp)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, string(DefaultBody), body)
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+}
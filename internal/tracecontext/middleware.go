@@ -0,0 +1,152 @@
+package tracecontext
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+)
+
+// RequestIDHeader is the header that carries the request ID, both in
+// requests and in responses.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID accepted from a client.
+const maxRequestIDLength = 200
+
+// Config configures the trace context middleware.
+type Config struct {
+	// NewRequestID generates the ID of requests that come without a valid
+	// one. If nil, NewRequestID is used.
+	NewRequestID func() string
+}
+
+// Trace is what identifies a request: its request ID and the span this
+// server handles it in.
+type Trace struct {
+	RequestID string
+	// Parent is the span of the caller, taken from the traceparent header.
+	// It is invalid if the request started a new trace.
+	Parent SpanContext
+	// Span is the span of this server. It belongs to the trace of Parent,
+	// if there is one, and carries on its flags and state.
+	Span SpanContext
+}
+
+// Child returns a new span of the same trace, to be passed on to a
+// request made on behalf of this one.
+func (t *Trace) Child() SpanContext {
+	child := t.Span
+	child.SpanID = NewSpanID()
+	return child
+}
+
+// Inject sets the request ID and trace context headers of an outgoing
+// request to those of a new child span, which it returns.
+func (t *Trace) Inject(h http.Header) SpanContext {
+	child := t.Child()
+	h.Set(RequestIDHeader, t.RequestID)
+	h.Set("Traceparent", child.Traceparent())
+	if child.State != "" {
+		h.Set("Tracestate", child.State)
+	} else {
+		h.Del("Tracestate")
+	}
+	return child
+}
+
+// traceKey is the request value key the trace is stored under.
+type traceKey struct{}
+
+// Get returns the trace of a request that passed the middleware, or nil.
+func Get(req *request.Request) *Trace {
+	return FromContext(req.Context())
+}
+
+// FromContext returns the trace stored in the context of a request that
+// passed the middleware, or nil.
+func FromContext(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	return t
+}
+
+// NewContext returns a copy of ctx that carries t.
+func NewContext(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// New returns the trace of a request as its headers describe it. The
+// request ID is taken from the X-Request-ID header, or generated with
+// newRequestID if there is none. The span of the request continues the
+// trace of the traceparent header; without a valid one, a new, sampled
+// trace is started.
+func New(req *request.Request, newRequestID func() string) *Trace {
+	t := &Trace{RequestID: req.Headers.Get("x-request-id")}
+	if !validRequestID(t.RequestID) {
+		t.RequestID = newRequestID()
+	}
+
+	if parent, err := ParseTraceparent(req.Headers.Get("traceparent")); err == nil {
+		parent.State = ParseTracestate(req.Headers.Get("tracestate"))
+		t.Parent = parent
+		t.Span = parent
+		t.Span.SpanID = NewSpanID()
+	} else {
+		t.Span = SpanContext{TraceID: NewTraceID(), SpanID: NewSpanID(), Flags: FlagSampled}
+	}
+	return t
+}
+
+// Handler returns a handler that gives every request a Trace, as New
+// describes, before passing it on to next, where Get returns it. The
+// request ID is sent back in the X-Request-ID header of the response.
+//
+// A request that already has a trace, such as one the server's tracer
+// records, keeps it, so the tracer should be configured with the same
+// NewRequestID.
+func Handler(cfg Config, next server.Handler) server.Handler {
+	if cfg.NewRequestID == nil {
+		cfg.NewRequestID = NewRequestID
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		t := Get(req)
+		if t == nil {
+			t = New(req, cfg.NewRequestID)
+			req.SetValue(traceKey{}, t)
+		}
+		w.OnWriteHeaders(func(h headers.Headers) {
+			h.Override(RequestIDHeader, t.RequestID)
+		})
+		next(w, req)
+	}
+}
+
+// validRequestID reports whether id is short and made of visible ASCII, so
+// that it can be repeated in logs and headers safely.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRequestID returns a random version 4 UUID, such as
+// "9f1c2b7e-3d4a-4f6b-8c2d-1e5a7b9c0d3f".
+func NewRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,127 @@
+package tracecontext
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Fepozopo/httpfromtcp/internal/handlertest"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// capture returns a handler that stores the trace of its request in *got
+// and answers 204.
+func capture(got **Trace) server.Handler {
+	return Handler(Config{}, func(w *response.Writer, req *request.Request) {
+		*got = Get(req)
+		w.WriteStatusLine(response.StatusCodeNoContent)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+}
+
+func TestHandlerNewTrace(t *testing.T) {
+	var got *Trace
+	resp := handlertest.Do(t, capture(&got), handlertest.NewRequest(t, "GET", "/"))
+	require.NotNil(t, got)
+
+	// Test: A request without IDs gets a generated request ID, sent back in
+	// the response
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), got.RequestID)
+	assert.Equal(t, got.RequestID, resp.Header.Get("X-Request-ID"))
+
+	// Test: It starts a new, sampled trace without a parent
+	assert.False(t, got.Parent.IsValid())
+	assert.True(t, got.Span.IsValid())
+	assert.True(t, got.Span.Sampled())
+}
+
+func TestHandlerContinueTrace(t *testing.T) {
+	var got *Trace
+	resp := handlertest.Do(t, capture(&got), handlertest.NewRequest(t, "GET", "/",
+		"X-Request-ID: abc-123",
+		"Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+		"Tracestate: congo=t61rcWkgMzE"))
+	require.NotNil(t, got)
+
+	// Test: The request ID of the client is kept
+	assert.Equal(t, "abc-123", got.RequestID)
+	assert.Equal(t, "abc-123", resp.Header.Get("X-Request-ID"))
+
+	// Test: The span continues the trace of the caller, with its flags and
+	// state
+	assert.Equal(t, "00f067aa0ba902b7", got.Parent.SpanID.String())
+	assert.Equal(t, got.Parent.TraceID, got.Span.TraceID)
+	assert.NotEqual(t, got.Parent.SpanID, got.Span.SpanID)
+	assert.False(t, got.Span.Sampled())
+	assert.Equal(t, "congo=t61rcWkgMzE", got.Span.State)
+
+	// Test: Child spans belong to the same trace
+	child := got.Child()
+	assert.Equal(t, got.Span.TraceID, child.TraceID)
+	assert.NotEqual(t, got.Span.SpanID, child.SpanID)
+
+	// Test: Inject sets the headers of an outgoing request to a child span
+	h := http.Header{}
+	h.Set("Tracestate", "stale=1")
+	injected := got.Inject(h)
+	assert.Equal(t, "abc-123", h.Get("X-Request-ID"))
+	assert.Equal(t, injected.Traceparent(), h.Get("Traceparent"))
+	assert.Equal(t, "congo=t61rcWkgMzE", h.Get("Tracestate"))
+}
+
+func TestHandlerInvalidIDs(t *testing.T) {
+	var got *Trace
+	handlertest.Do(t, capture(&got), handlertest.NewRequest(t, "GET", "/",
+		"X-Request-ID: has spaces",
+		"Traceparent: 00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"Tracestate: congo=t61rcWkgMzE"))
+	require.NotNil(t, got)
+
+	// Test: An invalid request ID is replaced
+	assert.NotEqual(t, "has spaces", got.RequestID)
+
+	// Test: An invalid traceparent starts a new trace, and its tracestate is
+	// ignored
+	assert.False(t, got.Parent.IsValid())
+	assert.True(t, got.Span.IsValid())
+	assert.Equal(t, "", got.Span.State)
+
+	// Test: Config.NewRequestID generates request IDs
+	h := Handler(Config{NewRequestID: func() string { return "fixed" }}, func(w *response.Writer, req *request.Request) {
+		got = Get(req)
+		w.WriteStatusLine(response.StatusCodeNoContent)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	handlertest.Do(t, h, handlertest.NewRequest(t, "GET", "/", "X-Request-ID: "+strings.Repeat("x", maxRequestIDLength+1)))
+	assert.Equal(t, "fixed", got.RequestID)
+}
+
+func TestGet(t *testing.T) {
+	req := handlertest.NewRequest(t, "GET", "/")
+
+	// Test: Requests that did not pass the middleware have no trace
+	assert.Nil(t, Get(req))
+	assert.Nil(t, FromContext(req.Context()))
+}
+
+func TestHandlerExistingTrace(t *testing.T) {
+	existing := &Trace{RequestID: "from-tracer", Span: SpanContext{TraceID: NewTraceID(), SpanID: NewSpanID()}}
+	var got *Trace
+	h := Handler(Config{}, func(w *response.Writer, req *request.Request) {
+		got = Get(req)
+		w.WriteStatusLine(response.StatusCodeNoContent)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	req := handlertest.NewRequest(t, "GET", "/", "X-Request-ID: abc-123")
+	req.SetContext(NewContext(req.Context(), existing))
+
+	// Test: A request that already has a trace keeps it
+	resp := handlertest.Do(t, h, req)
+	assert.Same(t, existing, got)
+	assert.Equal(t, "from-tracer", resp.Header.Get("X-Request-ID"))
+}
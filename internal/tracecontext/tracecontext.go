@@ -0,0 +1,193 @@
+// Package tracecontext identifies requests across services: it accepts or
+// generates an X-Request-ID, and propagates W3C Trace Context
+// (https://www.w3.org/TR/trace-context/) through the traceparent and
+// tracestate headers.
+package tracecontext
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TraceID identifies a trace, which is all the work done for one request
+// across every service it passes through.
+type TraceID [16]byte
+
+// SpanID identifies a span, which is the part of a trace done by one
+// service or operation.
+type SpanID [8]byte
+
+// IsValid reports whether the ID is not all zeros.
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID is not all zeros.
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// NewTraceID returns a random trace ID.
+func NewTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// NewSpanID returns a random span ID.
+func NewSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// FlagSampled is the trace flag telling that the caller may have recorded
+// the trace.
+const FlagSampled byte = 0x01
+
+// SpanContext is what a span passes on to the spans it causes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	// State is the tracestate header: vendor-specific entries, such as
+	// "congo=t61rcWkgMzE", which are passed on unchanged.
+	State string
+}
+
+// IsValid reports whether both IDs are valid.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Sampled reports whether the sampled flag is set.
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+// Traceparent returns the value of the traceparent header for the span,
+// such as "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ErrInvalidTraceparent is returned for a malformed traceparent header.
+var ErrInvalidTraceparent = errors.New("tracecontext: invalid traceparent")
+
+// ParseTraceparent parses a traceparent header. Versions after 00 are
+// parsed as far as version 00 defines them, as the specification asks.
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+	// version "-" trace-id "-" parent-id "-" trace-flags
+	if len(value) < 55 || value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+	version, ok := decodeHex(value[0:2])
+	if !ok || version[0] == 0xff {
+		return sc, ErrInvalidTraceparent
+	}
+	if version[0] == 0 && len(value) != 55 {
+		return sc, ErrInvalidTraceparent
+	}
+	if len(value) > 55 && value[55] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+
+	traceID, ok1 := decodeHex(value[3:35])
+	spanID, ok2 := decodeHex(value[36:52])
+	flags, ok3 := decodeHex(value[53:55])
+	if !ok1 || !ok2 || !ok3 {
+		return sc, ErrInvalidTraceparent
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	return sc, nil
+}
+
+// decodeHex decodes lowercase hexadecimal digits; uppercase ones are not
+// allowed in trace context headers.
+func decodeHex(s string) ([]byte, bool) {
+	if strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+// maxStateMembers is the number of list members a tracestate header may
+// have.
+const maxStateMembers = 32
+
+// ParseTracestate validates a tracestate header and returns it with
+// optional whitespace and empty members removed. A header that is not
+// valid is of no use to anyone and is dropped, so "" is returned.
+func ParseTracestate(value string) string {
+	var members []string
+	seen := map[string]bool{}
+	for _, member := range strings.Split(value, ",") {
+		member = strings.Trim(member, " \t")
+		if member == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(member, "=")
+		if !ok || !validStateKey(key) || !validStateValue(val) || seen[key] {
+			return ""
+		}
+		seen[key] = true
+		members = append(members, member)
+	}
+	if len(members) > maxStateMembers {
+		return ""
+	}
+	return strings.Join(members, ",")
+}
+
+// validStateKey reports whether key is a simple key, such as "congo", or a
+// multi-tenant one, such as "fw529a3039@dt".
+func validStateKey(key string) bool {
+	tenant, system, multi := strings.Cut(key, "@")
+	if !multi {
+		return len(key) <= 256 && isLowerAlpha(key, 0) && stateKeyChars(key)
+	}
+	return len(tenant) >= 1 && len(tenant) <= 241 && stateKeyChars(tenant) &&
+		len(system) >= 1 && len(system) <= 14 && isLowerAlpha(system, 0) && stateKeyChars(system)
+}
+
+func isLowerAlpha(s string, i int) bool {
+	return i < len(s) && s[i] >= 'a' && s[i] <= 'z'
+}
+
+func stateKeyChars(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '*' || c == '/') {
+			return false
+		}
+	}
+	return true
+}
+
+// validStateValue reports whether value is made of printable ASCII other
+// than "," and "=", and does not end in a space.
+func validStateValue(value string) bool {
+	if len(value) == 0 || len(value) > 256 || value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c < 0x20 || c > 0x7e || c == ',' || c == '=' {
+			return false
+		}
+	}
+	return true
+}
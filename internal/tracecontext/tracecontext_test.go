@@ -0,0 +1,87 @@
+package tracecontext
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	// Test: A version 00 header is parsed
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled())
+
+	// Test: Traceparent formats it back
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	// Test: A later version is parsed as far as version 00 goes
+	sc, err = ParseTraceparent("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-what-the-future-holds")
+	require.NoError(t, err)
+	assert.False(t, sc.Sampled())
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", sc.Traceparent())
+
+	// Test: Malformed headers are rejected
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0g",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+		"cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.",
+		// Two headers joined into one
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01, 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceparent(value)
+		assert.ErrorIs(t, err, ErrInvalidTraceparent, value)
+	}
+}
+
+func TestParseTracestate(t *testing.T) {
+	// Test: Valid members are kept in order, without optional whitespace and
+	// empty members
+	assert.Equal(t, "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE",
+		ParseTracestate("rojo=00f067aa0ba902b7 ,\t, congo=t61rcWkgMzE"))
+
+	// Test: Multi-tenant keys are allowed
+	assert.Equal(t, "fw529a3039@dt=abc", ParseTracestate("fw529a3039@dt=abc"))
+
+	// Test: A header with any invalid member is dropped
+	for _, value := range []string{
+		"Rojo=1",
+		"rojo",
+		"rojo=",
+		"rojo=a,rojo=b",
+		"rojo=a=b",
+		"rojo=a\tb",
+		"1rojo=a",
+		"tenant@System=a",
+		"rojo=\x7f",
+	} {
+		assert.Equal(t, "", ParseTracestate(value), value)
+	}
+
+	// Test: No more than 32 members are allowed
+	var members []string
+	for i := 0; i < 33; i++ {
+		members = append(members, "k"+strings.Repeat("a", i)+"=v")
+	}
+	assert.Equal(t, "", ParseTracestate(strings.Join(members, ",")))
+	assert.NotEqual(t, "", ParseTracestate(strings.Join(members[:32], ",")))
+}
+
+func TestNewIDs(t *testing.T) {
+	// Test: Generated IDs are valid and differ
+	assert.True(t, NewTraceID().IsValid())
+	assert.NotEqual(t, NewTraceID(), NewTraceID())
+	assert.True(t, NewSpanID().IsValid())
+	assert.NotEqual(t, NewSpanID(), NewSpanID())
+}
@@ -0,0 +1,66 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// JSONExporter writes spans as JSON, one object per line, such as:
+//
+//	{"name":"GET","kind":"server","trace_id":"4bf92f35…","span_id":"00f067aa…","start":"2024-05-01T12:00:00.000001Z","end":"2024-05-01T12:00:00.000151Z","duration_us":150,"attributes":{"http.request.method":"GET"}}
+type JSONExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONExporter returns an exporter that writes to w, such as os.Stdout.
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{enc: json.NewEncoder(w)}
+}
+
+// jsonSpan is how JSONExporter writes a span.
+type jsonSpan struct {
+	Name         string         `json:"name"`
+	Kind         string         `json:"kind"`
+	TraceID      string         `json:"trace_id"`
+	SpanID       string         `json:"span_id"`
+	ParentSpanID string         `json:"parent_span_id,omitempty"`
+	Start        time.Time      `json:"start"`
+	End          time.Time      `json:"end"`
+	DurationUS   int64          `json:"duration_us"`
+	Attributes   map[string]any `json:"attributes,omitempty"`
+	Error        bool           `json:"error,omitempty"`
+}
+
+func (e *JSONExporter) Export(ctx context.Context, spans []Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, span := range spans {
+		js := jsonSpan{
+			Name:       span.Name,
+			Kind:       span.Kind.String(),
+			TraceID:    span.TraceID.String(),
+			SpanID:     span.SpanID.String(),
+			Start:      span.Start.UTC(),
+			End:        span.End.UTC(),
+			DurationUS: span.End.Sub(span.Start).Microseconds(),
+			Error:      span.Error,
+		}
+		if span.ParentSpanID.IsValid() {
+			js.ParentSpanID = span.ParentSpanID.String()
+		}
+		if len(span.Attributes) > 0 {
+			js.Attributes = make(map[string]any, len(span.Attributes))
+			for _, attr := range span.Attributes {
+				js.Attributes[attr.Key] = attr.Value
+			}
+		}
+		if err := e.enc.Encode(js); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/tracecontext"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSpans returns a server span and one of its phases.
+func testSpans() []Span {
+	sc, _ := tracecontext.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	root := Span{
+		Name:    "GET",
+		Kind:    SpanKindServer,
+		TraceID: sc.TraceID,
+		SpanID:  sc.SpanID,
+		Start:   start,
+		End:     start.Add(150 * time.Microsecond),
+		Attributes: []Attribute{
+			{Key: "url.path", Value: "/"},
+			{Key: "http.response.status_code", Value: int64(503)},
+		},
+		Error: true,
+	}
+	phase := Span{
+		Name:         "handler",
+		Kind:         SpanKindInternal,
+		TraceID:      sc.TraceID,
+		SpanID:       tracecontext.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		ParentSpanID: sc.SpanID,
+		Start:        start.Add(10 * time.Microsecond),
+		End:          start.Add(100 * time.Microsecond),
+	}
+	return []Span{phase, root}
+}
+
+func TestJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, NewJSONExporter(&buf).Export(context.Background(), testSpans()))
+
+	// Test: Every span is written on a line of its own
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, `{"name":"handler","kind":"internal","trace_id":"4bf92f3577b34da6a3ce929d0e0e4736",`+
+		`"span_id":"0102030405060708","parent_span_id":"00f067aa0ba902b7",`+
+		`"start":"2024-05-01T12:00:00.00001Z","end":"2024-05-01T12:00:00.0001Z","duration_us":90}`, lines[0])
+
+	// Test: Attributes and errors are included, and a span without a parent
+	// has no parent_span_id
+	var root map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &root))
+	assert.Equal(t, "server", root["kind"])
+	assert.NotContains(t, root, "parent_span_id")
+	assert.Equal(t, map[string]any{"url.path": "/", "http.response.status_code": float64(503)}, root["attributes"])
+	assert.Equal(t, true, root["error"])
+}
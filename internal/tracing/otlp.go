@@ -0,0 +1,176 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultOTLPEndpoint is where an OpenTelemetry collector running
+	// locally accepts traces over HTTP.
+	DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+	// DefaultServiceName names the server in exported traces when
+	// OTLPConfig.ServiceName is empty.
+	DefaultServiceName = "httpfromtcp"
+)
+
+// OTLPConfig configures an OTLPExporter.
+type OTLPConfig struct {
+	// Endpoint is the URL spans are posted to. If empty,
+	// DefaultOTLPEndpoint is used.
+	Endpoint string
+	// ServiceName names the server in the exported traces.
+	ServiceName string
+	// Client sends the requests. If nil, http.DefaultClient is used; the
+	// context of Export limits how long they take.
+	Client *http.Client
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector with the JSON
+// encoding of OTLP/HTTP, as specified in
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp.
+type OTLPExporter struct {
+	cfg OTLPConfig
+}
+
+// NewOTLPExporter returns an exporter that posts to cfg.Endpoint.
+func NewOTLPExporter(cfg OTLPConfig) *OTLPExporter {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = DefaultOTLPEndpoint
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = DefaultServiceName
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	return &OTLPExporter{cfg: cfg}
+}
+
+// The messages of an ExportTraceServiceRequest, as far as they are used.
+// In the JSON encoding, IDs are hexadecimal and 64-bit integers strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              SpanKind       `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	}
+	otlpStatus struct {
+		// Code is 0 for unset and 2 for an error.
+		Code int `json:"code,omitempty"`
+	}
+)
+
+// scopeName names what recorded the spans.
+const scopeName = "github.com/Fepozopo/httpfromtcp/internal/tracing"
+
+func (e *OTLPExporter) Export(ctx context.Context, spans []Span) error {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: scopeName}}
+	for _, span := range spans {
+		o := otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: unixNano(span.Start),
+			EndTimeUnixNano:   unixNano(span.End),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if span.ParentSpanID.IsValid() {
+			o.ParentSpanID = span.ParentSpanID.String()
+		}
+		if span.Error {
+			o.Status.Code = 2
+		}
+		scope.Spans = append(scope.Spans, o)
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes([]Attribute{
+			{Key: "service.name", Value: e.cfg.ServiceName},
+		})},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("tracing: collector answered %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpAttributes(attrs []Attribute) []otlpKeyValue {
+	var kvs []otlpKeyValue
+	for _, attr := range attrs {
+		var v otlpValue
+		switch value := attr.Value.(type) {
+		case string:
+			v.StringValue = &value
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, otlpKeyValue{Key: attr.Key, Value: v})
+	}
+	return kvs
+}
@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.Write([]byte("{}"))
+	}))
+	defer collector.Close()
+
+	e := NewOTLPExporter(OTLPConfig{Endpoint: collector.URL + "/v1/traces", ServiceName: "test"})
+	require.NoError(t, e.Export(context.Background(), testSpans()))
+
+	// Test: The spans are posted as OTLP/HTTP JSON
+	assert.Equal(t, "POST", got.Method)
+	assert.Equal(t, "/v1/traces", got.URL.Path)
+	assert.Equal(t, "application/json", got.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"resourceSpans":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"test"}}]},
+		"scopeSpans":[{
+			"scope":{"name":"github.com/Fepozopo/httpfromtcp/internal/tracing"},
+			"spans":[{
+				"traceId":"4bf92f3577b34da6a3ce929d0e0e4736",
+				"spanId":"0102030405060708",
+				"parentSpanId":"00f067aa0ba902b7",
+				"name":"handler",
+				"kind":1,
+				"startTimeUnixNano":"1714564800000010000",
+				"endTimeUnixNano":"1714564800000100000",
+				"status":{}
+			},{
+				"traceId":"4bf92f3577b34da6a3ce929d0e0e4736",
+				"spanId":"00f067aa0ba902b7",
+				"name":"GET",
+				"kind":2,
+				"startTimeUnixNano":"1714564800000000000",
+				"endTimeUnixNano":"1714564800000150000",
+				"attributes":[
+					{"key":"url.path","value":{"stringValue":"/"}},
+					{"key":"http.response.status_code","value":{"intValue":"503"}}
+				],
+				"status":{"code":2}
+			}]
+		}]
+	}]}`, string(body))
+}
+
+func TestOTLPExporterError(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "over quota", http.StatusTooManyRequests)
+	}))
+	defer collector.Close()
+
+	// Test: A collector that refuses the spans makes Export fail
+	err := NewOTLPExporter(OTLPConfig{Endpoint: collector.URL}).Export(context.Background(), testSpans())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "429")
+	assert.Contains(t, err.Error(), "over quota")
+
+	// Test: So does an unreachable one
+	collector.Close()
+	err = NewOTLPExporter(OTLPConfig{Endpoint: collector.URL}).Export(context.Background(), testSpans())
+	assert.Error(t, err)
+}
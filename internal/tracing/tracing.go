@@ -0,0 +1,341 @@
+// Package tracing records spans for the requests a server handles and
+// exports them, such as to an OpenTelemetry collector.
+//
+// A Tracer is given to the server with server.WithTracer. For every sampled
+// request, it records a server span, which continues the trace of the
+// traceparent header, with a child span for each of its phases: parse,
+// handler and write. The trace is also attached to the request, where
+// tracecontext.Get finds it, so that handlers can pass it on.
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+	"github.com/Fepozopo/httpfromtcp/internal/tracecontext"
+)
+
+const (
+	// DefaultQueueSize is how many spans may wait to be exported when
+	// Config.QueueSize is zero. Spans beyond that are dropped.
+	DefaultQueueSize = 2048
+	// DefaultBatchSize is the most spans exported at once when
+	// Config.BatchSize is zero.
+	DefaultBatchSize = 512
+	// DefaultBatchTimeout is how long a span may wait for a batch to fill
+	// up when Config.BatchTimeout is zero.
+	DefaultBatchTimeout = time.Second
+	// DefaultExportTimeout limits how long an export may take when
+	// Config.ExportTimeout is zero.
+	DefaultExportTimeout = 10 * time.Second
+)
+
+// SpanKind tells what a span represents. The values are those of
+// OpenTelemetry.
+type SpanKind int
+
+const (
+	// SpanKindInternal is an operation within the server, such as a phase
+	// of a request.
+	SpanKindInternal SpanKind = 1
+	// SpanKindServer is the handling of a request from a client.
+	SpanKindServer SpanKind = 2
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindInternal:
+		return "internal"
+	case SpanKindServer:
+		return "server"
+	default:
+		return "unspecified"
+	}
+}
+
+// Span is a recorded operation.
+type Span struct {
+	Name    string
+	Kind    SpanKind
+	TraceID tracecontext.TraceID
+	SpanID  tracecontext.SpanID
+	// ParentSpanID is the span this one is part of. It is invalid for the
+	// first span of a trace.
+	ParentSpanID tracecontext.SpanID
+	Start        time.Time
+	End          time.Time
+	Attributes   []Attribute
+	// Error is set if the operation failed, such as a request answered
+	// with a 5xx status.
+	Error bool
+}
+
+// Attribute describes a span. Value is a string, an int64 or a bool.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Exporter sends spans somewhere, such as to a collector.
+type Exporter interface {
+	Export(ctx context.Context, spans []Span) error
+}
+
+// Sampler decides whether a request is recorded, given the span of the
+// caller, which is invalid if the request starts a new trace, and the
+// trace ID of the request.
+type Sampler func(parent tracecontext.SpanContext, traceID tracecontext.TraceID) bool
+
+// AlwaysSample records every request.
+func AlwaysSample() Sampler {
+	return func(tracecontext.SpanContext, tracecontext.TraceID) bool { return true }
+}
+
+// NeverSample records no request.
+func NeverSample() Sampler {
+	return func(tracecontext.SpanContext, tracecontext.TraceID) bool { return false }
+}
+
+// TraceIDRatio records the given fraction of traces. The decision is made
+// from the random part of the trace ID, so that every service sampling the
+// same ratio records the same traces.
+func TraceIDRatio(ratio float64) Sampler {
+	if ratio >= 1 {
+		return AlwaysSample()
+	}
+	bound := uint64(max(ratio, 0) * (1 << 63))
+	return func(_ tracecontext.SpanContext, traceID tracecontext.TraceID) bool {
+		return binary.BigEndian.Uint64(traceID[8:])>>1 < bound
+	}
+}
+
+// ParentBased follows the decision of the caller, as told by the sampled
+// flag of its traceparent header, and asks root about traces that start
+// here.
+func ParentBased(root Sampler) Sampler {
+	return func(parent tracecontext.SpanContext, traceID tracecontext.TraceID) bool {
+		if parent.IsValid() {
+			return parent.Sampled()
+		}
+		return root(parent, traceID)
+	}
+}
+
+// Config configures a Tracer.
+type Config struct {
+	// Exporter receives the recorded spans. It is required.
+	Exporter Exporter
+	// Sampler decides which requests are recorded. If nil,
+	// ParentBased(AlwaysSample()) is used.
+	Sampler Sampler
+	// NewRequestID generates the ID of requests that come without a valid
+	// one. The tracer gives requests their trace before any middleware
+	// runs, so it should be the same as tracecontext.Config.NewRequestID.
+	// If nil, tracecontext.NewRequestID is used.
+	NewRequestID func() string
+	// QueueSize is how many spans may wait to be exported, BatchSize how
+	// many are exported at once, and BatchTimeout how long a span may wait
+	// for its batch to fill up.
+	QueueSize    int
+	BatchSize    int
+	BatchTimeout time.Duration
+	// ExportTimeout limits how long an export may take.
+	ExportTimeout time.Duration
+}
+
+// Tracer records the requests of a server; see the package documentation.
+// Spans are exported in batches in the background, so that slow exports
+// do not hold up requests.
+type Tracer struct {
+	cfg   Config
+	queue chan Span
+	done  chan struct{}
+
+	// mu guards closed, so that no span is queued once the queue is
+	// closed.
+	mu     sync.RWMutex
+	closed bool
+}
+
+var _ server.Tracer = (*Tracer)(nil)
+
+// New returns a Tracer that exports with cfg.Exporter. It must be closed
+// with Close to export the last spans.
+func New(cfg Config) *Tracer {
+	if cfg.Exporter == nil {
+		panic("tracing: Config.Exporter is required")
+	}
+	if cfg.Sampler == nil {
+		cfg.Sampler = ParentBased(AlwaysSample())
+	}
+	if cfg.NewRequestID == nil {
+		cfg.NewRequestID = tracecontext.NewRequestID
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.BatchTimeout <= 0 {
+		cfg.BatchTimeout = DefaultBatchTimeout
+	}
+	if cfg.ExportTimeout <= 0 {
+		cfg.ExportTimeout = DefaultExportTimeout
+	}
+
+	t := &Tracer{
+		cfg:   cfg,
+		queue: make(chan Span, cfg.QueueSize),
+		done:  make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Close exports the spans still queued and stops the tracer. Requests that
+// end afterwards are not recorded.
+func (t *Tracer) Close() error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+	<-t.done
+	return nil
+}
+
+// StartRequest gives the request a trace, unless the tracecontext
+// middleware already did, and starts recording it if it is sampled. The
+// sampling decision is kept in the sampled flag that the trace passes on.
+func (t *Tracer) StartRequest(req *request.Request, start time.Time) server.RequestTrace {
+	tc := tracecontext.Get(req)
+	if tc == nil {
+		tc = tracecontext.New(req, t.cfg.NewRequestID)
+		req.SetContext(tracecontext.NewContext(req.Context(), tc))
+	}
+	if !t.cfg.Sampler(tc.Parent, tc.Span.TraceID) {
+		tc.Span.Flags &^= tracecontext.FlagSampled
+		return nil
+	}
+	tc.Span.Flags |= tracecontext.FlagSampled
+
+	target := req.RequestLine.Target.Path
+	if target == "" {
+		target = req.RequestLine.RequestTarget
+	}
+	return &requestTrace{
+		tracer: t,
+		req:    req,
+		span: Span{
+			Name:         req.RequestLine.Method,
+			Kind:         SpanKindServer,
+			TraceID:      tc.Span.TraceID,
+			SpanID:       tc.Span.SpanID,
+			ParentSpanID: tc.Parent.SpanID,
+			Start:        start,
+			Attributes: []Attribute{
+				{Key: "http.request.method", Value: req.RequestLine.Method},
+				{Key: "url.path", Value: target},
+				{Key: "network.protocol.version", Value: req.RequestLine.HttpVersion},
+				{Key: "http.request.id", Value: tc.RequestID},
+			},
+		},
+	}
+}
+
+// requestTrace records the spans of one request.
+type requestTrace struct {
+	tracer *Tracer
+	req    *request.Request
+	span   Span
+	phases []Span
+}
+
+func (r *requestTrace) Phase(name string, start, end time.Time) {
+	r.phases = append(r.phases, Span{
+		Name:         name,
+		Kind:         SpanKindInternal,
+		TraceID:      r.span.TraceID,
+		SpanID:       tracecontext.NewSpanID(),
+		ParentSpanID: r.span.SpanID,
+		Start:        start,
+		End:          end,
+	})
+}
+
+func (r *requestTrace) End(statusCode response.StatusCode) {
+	r.span.End = time.Now()
+	// The client address is only known once middleware such as
+	// ipfilter.TrustedProxies has looked past the proxies in front of the
+	// server.
+	r.span.Attributes = append(r.span.Attributes, Attribute{Key: "client.address", Value: r.req.ClientIP.String()})
+	if statusCode != 0 {
+		r.span.Attributes = append(r.span.Attributes, Attribute{Key: "http.response.status_code", Value: int64(statusCode)})
+	}
+	r.span.Error = statusCode >= 500
+	r.tracer.enqueue(append(r.phases, r.span))
+}
+
+// enqueue queues spans for export, dropping them if the queue is full.
+func (t *Tracer) enqueue(spans []Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	for i, span := range spans {
+		select {
+		case t.queue <- span:
+		default:
+			log.Printf("Error recording spans: export queue is full; dropping %d", len(spans)-i)
+			return
+		}
+	}
+}
+
+// run exports the queued spans in batches until the queue is closed.
+func (t *Tracer) run() {
+	defer close(t.done)
+	timer := time.NewTimer(t.cfg.BatchTimeout)
+	defer timer.Stop()
+
+	var batch []Span
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(t.cfg.BatchTimeout)
+			}
+			batch = append(batch, span)
+			if len(batch) < t.cfg.BatchSize {
+				continue
+			}
+		case <-timer.C:
+		}
+		t.export(batch)
+		batch = nil
+	}
+}
+
+func (t *Tracer) export(spans []Span) {
+	if len(spans) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.ExportTimeout)
+	defer cancel()
+	if err := t.cfg.Exporter.Export(ctx, spans); err != nil {
+		log.Printf("Error exporting %d spans: %v", len(spans), err)
+	}
+}
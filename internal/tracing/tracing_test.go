@@ -0,0 +1,263 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Fepozopo/httpfromtcp/internal/handlertest"
+	"github.com/Fepozopo/httpfromtcp/internal/ipfilter"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/Fepozopo/httpfromtcp/internal/server"
+	"github.com/Fepozopo/httpfromtcp/internal/tracecontext"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryExporter keeps the spans it is given.
+type memoryExporter struct {
+	mu      sync.Mutex
+	spans   []Span
+	batches int
+}
+
+func (e *memoryExporter) Export(ctx context.Context, spans []Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	e.batches++
+	return nil
+}
+
+// byName returns the exported spans by name.
+func (e *memoryExporter) byName() map[string]Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	spans := map[string]Span{}
+	for _, span := range e.spans {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func attribute(span Span, key string) any {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return nil
+}
+
+// get sends a request with the given header lines to s and returns the
+// body of the response.
+func get(t *testing.T, s *server.Server, headerLines string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /path?q=1 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n"+headerLines+"\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+// traceparentHandler answers with the traceparent of a child span of the
+// request, and 500 for /fail.
+func traceparentHandler(w *response.Writer, req *request.Request) {
+	body := []byte("-")
+	if tc := tracecontext.Get(req); tc != nil {
+		body = []byte(tc.Child().Traceparent())
+	}
+	status := response.StatusCodeSuccess
+	if req.RequestLine.Target.Path == "/fail" {
+		status = response.StatusCodeInternalServerError
+	}
+	w.WriteStatusLine(status)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func TestTracer(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := New(Config{Exporter: exporter})
+	s, err := server.Serve(0, traceparentHandler, server.WithTracer(tracer))
+	require.NoError(t, err)
+
+	body := get(t, s, "Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n")
+	require.NoError(t, s.Close())
+	require.NoError(t, tracer.Close())
+
+	// Test: Close exports the spans of the request: one for the server and
+	// one for each phase
+	spans := exporter.byName()
+	require.Len(t, spans, 4)
+	root := spans["GET"]
+	assert.Equal(t, SpanKindServer, root.Kind)
+
+	// Test: The server span continues the trace of the caller
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", root.ParentSpanID.String())
+	assert.Equal(t, "/path", attribute(root, "url.path"))
+	assert.Equal(t, int64(200), attribute(root, "http.response.status_code"))
+	assert.False(t, root.Error)
+
+	// Test: The phases are children of the server span, within it
+	for _, name := range []string{server.PhaseParse, server.PhaseHandler, server.PhaseWrite} {
+		span, ok := spans[name]
+		require.True(t, ok, name)
+		assert.Equal(t, SpanKindInternal, span.Kind)
+		assert.Equal(t, root.TraceID, span.TraceID)
+		assert.Equal(t, root.SpanID, span.ParentSpanID)
+		assert.False(t, span.Start.Before(root.Start), name)
+		assert.False(t, span.End.After(root.End), name)
+	}
+
+	// Test: The handler sees the span of the server, and passes it on
+	child, err := tracecontext.ParseTraceparent(body)
+	require.NoError(t, err)
+	assert.Equal(t, root.TraceID, child.TraceID)
+	assert.True(t, child.Sampled())
+}
+
+func TestTracerMiddleware(t *testing.T) {
+	exporter := &memoryExporter{}
+	newID := func() string { return "generated-id" }
+	tracer := New(Config{Exporter: exporter, NewRequestID: newID})
+	h := ipfilter.TrustedProxies(
+		[]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")},
+		tracecontext.Handler(tracecontext.Config{NewRequestID: newID}, traceparentHandler),
+	)
+	s, err := server.Serve(0, h, server.WithTracer(tracer))
+	require.NoError(t, err)
+
+	get(t, s, "X-Forwarded-For: 203.0.113.7\r\n")
+	require.NoError(t, s.Close())
+	require.NoError(t, tracer.Close())
+
+	// Test: A request without an ID gets one from the configured generator
+	root := exporter.byName()["GET"]
+	assert.Equal(t, "generated-id", attribute(root, "http.request.id"))
+
+	// Test: The client address is the one middleware found behind the
+	// proxies, not the address of the nearest proxy
+	assert.Equal(t, "203.0.113.7", attribute(root, "client.address"))
+}
+
+func TestTracerSampling(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := New(Config{Exporter: exporter, Sampler: ParentBased(NeverSample())})
+	var mu sync.Mutex
+	var seen []tracecontext.SpanContext
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		mu.Lock()
+		seen = append(seen, tracecontext.Get(req).Span)
+		mu.Unlock()
+		traceparentHandler(w, req)
+	}, server.WithTracer(tracer))
+	require.NoError(t, err)
+
+	get(t, s, "")
+	get(t, s, "Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n")
+	get(t, s, "Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00\r\n")
+	require.NoError(t, s.Close())
+	require.NoError(t, tracer.Close())
+
+	// Test: New traces are not recorded, and the decision is passed on
+	require.Len(t, seen, 3)
+	assert.False(t, seen[0].Sampled())
+
+	// Test: The decision of the caller is followed
+	assert.True(t, seen[1].Sampled())
+	assert.False(t, seen[2].Sampled())
+	spans := exporter.byName()
+	assert.Len(t, spans, 4)
+	assert.Equal(t, "00f067aa0ba902b7", spans["GET"].ParentSpanID.String())
+}
+
+func TestTracerError(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := New(Config{Exporter: exporter, BatchTimeout: 10 * time.Millisecond})
+	defer tracer.Close()
+	s, err := server.Serve(0, traceparentHandler, server.WithTracer(tracer))
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /fail HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	io.ReadAll(conn)
+
+	// Test: Spans are exported once the batch times out, and a 5xx response
+	// marks the server span as failed
+	require.Eventually(t, func() bool { return len(exporter.byName()) == 4 }, time.Second, 5*time.Millisecond)
+	assert.True(t, exporter.byName()["GET"].Error)
+}
+
+func TestTracerBatches(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := New(Config{Exporter: exporter, BatchSize: 2, BatchTimeout: time.Hour})
+	req := handlertest.NewRequest(t, "GET", "/")
+
+	// Test: Full batches are exported right away
+	trace := tracer.StartRequest(req, time.Now())
+	trace.Phase(server.PhaseHandler, time.Now(), time.Now())
+	trace.End(response.StatusCodeSuccess)
+	require.Eventually(t, func() bool {
+		exporter.mu.Lock()
+		defer exporter.mu.Unlock()
+		return exporter.batches == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// Test: Requests that end after Close are not recorded
+	require.NoError(t, tracer.Close())
+	trace = tracer.StartRequest(req, time.Now())
+	trace.End(response.StatusCodeSuccess)
+	assert.Len(t, exporter.spans, 2)
+}
+
+func TestSamplers(t *testing.T) {
+	sampled, _ := tracecontext.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	unsampled, _ := tracecontext.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	none := tracecontext.SpanContext{}
+
+	// Test: ParentBased follows the caller and asks its root otherwise
+	assert.True(t, ParentBased(NeverSample())(sampled, sampled.TraceID))
+	assert.False(t, ParentBased(AlwaysSample())(unsampled, unsampled.TraceID))
+	assert.True(t, ParentBased(AlwaysSample())(none, sampled.TraceID))
+	assert.False(t, ParentBased(NeverSample())(none, sampled.TraceID))
+
+	// Test: TraceIDRatio records about the given fraction of traces
+	for _, ratio := range []float64{0, 0.25, 1} {
+		sampler := TraceIDRatio(ratio)
+		n := 0
+		for range 4000 {
+			if sampler(none, tracecontext.NewTraceID()) {
+				n++
+			}
+		}
+		assert.InDelta(t, ratio*4000, n, 200, "ratio %v", ratio)
+	}
+
+	// Test: The decision only depends on the trace ID
+	sampler := TraceIDRatio(0.5)
+	id := tracecontext.NewTraceID()
+	assert.Equal(t, sampler(none, id), sampler(sampled, id))
+}
+
+func TestConfig(t *testing.T) {
+	// Test: An exporter is required
+	assert.Panics(t, func() { New(Config{}) })
+}
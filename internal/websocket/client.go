@@ -0,0 +1,88 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+)
+
+// NewClient performs the client side of the opening handshake over rw,
+// usually a net.Conn, and returns the WebSocket connection. host and path
+// make up the request-target and Host header; protocols are offered as
+// subprotocols in order of preference.
+func NewClient(rw io.ReadWriter, host, path string, protocols ...string) (*Conn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "GET %s HTTP/1.1\r\n", path)
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	b.WriteString("Upgrade: websocket\r\n")
+	b.WriteString("Connection: Upgrade\r\n")
+	fmt.Fprintf(&b, "Sec-WebSocket-Key: %s\r\n", key)
+	b.WriteString("Sec-WebSocket-Version: 13\r\n")
+	if len(protocols) > 0 {
+		fmt.Fprintf(&b, "Sec-WebSocket-Protocol: %s\r\n", strings.Join(protocols, ", "))
+	}
+	b.WriteString("\r\n")
+	if _, err := io.WriteString(rw, b.String()); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(rw)
+	statusLine, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(statusLine, "HTTP/1.1 101 ") {
+		return nil, fmt.Errorf("%w: unexpected status line %q", ErrBadHandshake, strings.TrimSpace(statusLine))
+	}
+
+	h := headers.NewHeaders()
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		_, done, err := h.Parse([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadHandshake, err)
+		}
+		if done {
+			break
+		}
+	}
+
+	if !h.HasToken("upgrade", "websocket") || !h.HasToken("connection", "upgrade") {
+		return nil, fmt.Errorf("%w: server did not upgrade", ErrBadHandshake)
+	}
+	if h.Get("sec-websocket-accept") != acceptKey(key) {
+		return nil, fmt.Errorf("%w: invalid Sec-WebSocket-Accept", ErrBadHandshake)
+	}
+	protocol := h.Get("sec-websocket-protocol")
+	if protocol != "" && !contains(protocols, protocol) {
+		return nil, fmt.Errorf("%w: unexpected subprotocol %q", ErrBadHandshake, protocol)
+	}
+
+	c := newConn(br, rw, false)
+	c.subprotocol = protocol
+	return c, nil
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
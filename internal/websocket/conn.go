@@ -0,0 +1,401 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unicode/utf8"
+)
+
+// MessageType is the opcode of a data message.
+type MessageType int
+
+// Opcodes as defined in RFC 6455 section 5.2.
+const (
+	opContinuation = 0x0
+	TextMessage    = MessageType(0x1)
+	BinaryMessage  = MessageType(0x2)
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close codes as defined in RFC 6455 section 7.4.1.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+const (
+	// DefaultMaxMessageSize is the default limit on the size of a received
+	// message.
+	DefaultMaxMessageSize = 1 << 20
+	// maxControlPayload is the largest payload allowed in a control frame.
+	maxControlPayload = 125
+)
+
+// ErrClosed is returned when writing to a connection after a close frame has
+// been sent.
+var ErrClosed = errors.New("websocket: connection closed")
+
+// CloseError is returned by ReadMessage once the peer has sent a close frame,
+// or when the connection is closed because the peer violated the protocol.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. Reads must happen from a single goroutine;
+// writes may happen from any goroutine.
+type Conn struct {
+	r        *bufio.Reader
+	w        io.Writer
+	isServer bool
+
+	subprotocol    string
+	maxMessageSize int64
+	pongHandler    func(data []byte)
+
+	// readErr is returned by every read once the connection is done.
+	readErr error
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+// newConn creates a connection. Frames sent by the client are masked, so
+// isServer decides whether outgoing frames are masked and whether incoming
+// frames must be.
+func newConn(r *bufio.Reader, w io.Writer, isServer bool) *Conn {
+	return &Conn{
+		r:              r,
+		w:              w,
+		isServer:       isServer,
+		maxMessageSize: DefaultMaxMessageSize,
+	}
+}
+
+// Subprotocol returns the subprotocol negotiated during the handshake, or ""
+// if none was.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// SetMaxMessageSize sets the limit on the size of a received message. A peer
+// sending a larger message gets closed with code 1009.
+func (c *Conn) SetMaxMessageSize(n int64) {
+	c.maxMessageSize = n
+}
+
+// SetPongHandler sets a function called with the payload of every pong
+// received while reading messages.
+func (c *Conn) SetPongHandler(f func(data []byte)) {
+	c.pongHandler = f
+}
+
+// frame is a single decoded frame.
+type frame struct {
+	fin     bool
+	opcode  int
+	payload []byte
+}
+
+// ReadMessage reads the next data message, reassembling fragments. Pings are
+// answered with pongs and pongs are passed to the pong handler while waiting.
+// When the peer starts the close handshake, the close frame is echoed and a
+// *CloseError is returned.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+
+	var (
+		messageType MessageType
+		message     []byte
+		inMessage   bool
+	)
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.writeFrame(true, opPong, f.payload); err != nil && !errors.Is(err, ErrClosed) {
+				return 0, nil, c.fail(err)
+			}
+			continue
+		case opPong:
+			if c.pongHandler != nil {
+				c.pongHandler(f.payload)
+			}
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+		case opContinuation:
+			if !inMessage {
+				return 0, nil, c.fail(&CloseError{Code: CloseProtocolError, Reason: "unexpected continuation frame"})
+			}
+		case int(TextMessage), int(BinaryMessage):
+			if inMessage {
+				return 0, nil, c.fail(&CloseError{Code: CloseProtocolError, Reason: "expected continuation frame"})
+			}
+			inMessage = true
+			messageType = MessageType(f.opcode)
+		default:
+			return 0, nil, c.fail(&CloseError{Code: CloseProtocolError, Reason: "unknown opcode"})
+		}
+
+		if int64(len(message)+len(f.payload)) > c.maxMessageSize {
+			return 0, nil, c.fail(&CloseError{Code: CloseMessageTooBig, Reason: "message too big"})
+		}
+		message = append(message, f.payload...)
+		if !f.fin {
+			continue
+		}
+
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(&CloseError{Code: CloseInvalidPayload, Reason: "invalid UTF-8"})
+		}
+		return messageType, message, nil
+	}
+}
+
+// readFrame reads and unmasks a single frame, checking the rules that apply
+// to every frame.
+func (c *Conn) readFrame() (frame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return frame{}, err
+	}
+
+	f := frame{
+		fin:    header[0]&0x80 != 0,
+		opcode: int(header[0] & 0x0F),
+	}
+	if header[0]&0x70 != 0 {
+		return frame{}, &CloseError{Code: CloseProtocolError, Reason: "reserved bits set"}
+	}
+	masked := header[1]&0x80 != 0
+	if masked != c.isServer {
+		return frame{}, &CloseError{Code: CloseProtocolError, Reason: "bad masking"}
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return frame{}, &CloseError{Code: CloseProtocolError, Reason: "invalid length"}
+		}
+	}
+
+	if f.opcode >= opClose {
+		if !f.fin || length > maxControlPayload {
+			return frame{}, &CloseError{Code: CloseProtocolError, Reason: "invalid control frame"}
+		}
+	} else if length > uint64(c.maxMessageSize) {
+		// Reject before allocating the payload.
+		return frame{}, &CloseError{Code: CloseMessageTooBig, Reason: "message too big"}
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.r, key[:]); err != nil {
+			return frame{}, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.r, f.payload); err != nil {
+		return frame{}, err
+	}
+	if masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+// handleClose answers a close frame from the peer and returns the resulting
+// *CloseError.
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		closeErr = &CloseError{Code: CloseProtocolError, Reason: "invalid close payload"}
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) || !utf8.Valid(payload[2:]) {
+			closeErr = &CloseError{Code: CloseProtocolError, Reason: "invalid close payload"}
+		}
+	}
+
+	// Echo the status code to complete the handshake, unless we started it.
+	echo := closeErr.Code
+	if echo == CloseNoStatus {
+		echo = CloseNormal
+	}
+	c.writeClose(echo, "")
+	c.readErr = closeErr
+	return closeErr
+}
+
+// fail closes the connection because of a read error. Protocol violations are
+// reported to the peer with the matching close code.
+func (c *Conn) fail(err error) error {
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		c.writeClose(closeErr.Code, closeErr.Reason)
+	}
+	c.readErr = err
+	return err
+}
+
+// validCloseCode reports whether a close code may be sent on the wire.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// WriteMessage sends a data message in a single frame.
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	return c.writeFrame(true, int(messageType), data)
+}
+
+// WriteFragmented sends a data message split into the given fragments, each
+// in its own frame.
+func (c *Conn) WriteFragmented(messageType MessageType, fragments ...[]byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	if len(fragments) == 0 {
+		return c.writeFrame(true, int(messageType), nil)
+	}
+	opcode := int(messageType)
+	for i, fragment := range fragments {
+		if err := c.writeFrame(i == len(fragments)-1, opcode, fragment); err != nil {
+			return err
+		}
+		opcode = opContinuation
+	}
+	return nil
+}
+
+// Ping sends a ping with the given payload, which must not exceed 125 bytes.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return fmt.Errorf("websocket: ping payload too long")
+	}
+	return c.writeFrame(true, opPing, data)
+}
+
+// Close starts the close handshake by sending a close frame with the given
+// code and reason. The caller should keep calling ReadMessage until it
+// returns the peer's *CloseError, then return from the handler.
+func (c *Conn) Close(code int, reason string) error {
+	if len(reason) > maxControlPayload-2 {
+		return fmt.Errorf("websocket: close reason too long")
+	}
+	return c.writeClose(code, reason)
+}
+
+// writeClose sends a close frame unless one was already sent.
+func (c *Conn) writeClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	return c.writeFrame(true, opClose, payload)
+}
+
+// writeFrame encodes and writes a single frame. Frames from a client are
+// masked with a fresh random key.
+func (c *Conn) writeFrame(fin bool, opcode int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	buf := make([]byte, 0, 14+len(payload))
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+
+	var maskBit byte
+	if !c.isServer {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		buf = append(buf, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(payload)))
+	}
+
+	if c.isServer {
+		buf = append(buf, payload...)
+	} else {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(key, buf[start:])
+	}
+
+	_, err := c.w.Write(buf)
+	return err
+}
+
+// maskBytes applies (or removes) the masking of RFC 6455 section 5.3.
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
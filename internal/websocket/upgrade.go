@@ -0,0 +1,162 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Fepozopo/httpfromtcp/internal/headers"
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+)
+
+// acceptGUID is the fixed GUID from RFC 6455 section 1.3 that is appended to
+// the client's key when computing Sec-WebSocket-Accept.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrBadHandshake is returned (possibly wrapped) when the opening handshake
+// is not a valid WebSocket upgrade.
+var ErrBadHandshake = errors.New("bad websocket handshake")
+
+// Upgrader holds the options for upgrading HTTP requests to WebSocket
+// connections. The zero value is usable.
+type Upgrader struct {
+	// Subprotocols lists the supported subprotocols in order of preference.
+	// The first one also offered by the client is selected.
+	Subprotocols []string
+	// CheckOrigin decides whether a request from a browser with the given
+	// Origin header is allowed. If nil, only requests without an Origin or
+	// with an Origin matching the Host are accepted.
+	CheckOrigin func(req *request.Request) bool
+	// MaxMessageSize limits the size of a received message, after
+	// reassembling fragments. Zero means DefaultMaxMessageSize.
+	MaxMessageSize int64
+}
+
+// Upgrade validates the opening handshake in req, writes the
+// "101 Switching Protocols" response through w and returns the WebSocket
+// connection. The connection lives as long as the handler, so the handler
+// should keep using it until it is done and then return.
+//
+// When the context of the request ends, such as when the server shuts down,
+// the connection starts the close handshake with 1001 (going away), so that
+// ReadMessage returns once the client answers.
+//
+// If the handshake is invalid, Upgrade writes an error response (400, or 426
+// for an unsupported version) and returns an error wrapping ErrBadHandshake.
+func (u *Upgrader) Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	if err := u.checkHandshake(req); err != nil {
+		status := response.StatusCodeBadRequest
+		h := response.GetDefaultHeaders(len(err.Error()))
+		if req.Headers.Get("sec-websocket-version") != "13" {
+			status = response.StatusCodeUpgradeRequired
+			h.Override("Sec-WebSocket-Version", "13")
+		}
+		w.WriteStatusLine(status)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(err.Error()))
+		return nil, err
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(req.Headers.Get("sec-websocket-key")))
+	protocol := u.selectSubprotocol(req)
+	if protocol != "" {
+		h.Set("Sec-WebSocket-Protocol", protocol)
+	}
+
+	if err := w.WriteStatusLine(response.StatusCodeSwitchingProtocols); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	out, err := w.Upgrade()
+	if err != nil {
+		return nil, err
+	}
+	in, err := req.Upgrade()
+	if err != nil {
+		return nil, err
+	}
+
+	c := newConn(bufio.NewReader(in), out, true)
+	c.subprotocol = protocol
+	if u.MaxMessageSize > 0 {
+		c.maxMessageSize = u.MaxMessageSize
+	}
+	context.AfterFunc(req.Context(), func() {
+		c.writeClose(CloseGoingAway, "")
+	})
+	return c, nil
+}
+
+// checkHandshake validates the client's opening handshake as described in
+// RFC 6455 section 4.2.1.
+func (u *Upgrader) checkHandshake(req *request.Request) error {
+	if req.RequestLine.Method != "GET" {
+		return fmt.Errorf("%w: method must be GET", ErrBadHandshake)
+	}
+	if req.RequestLine.HttpVersion != "1.1" {
+		return fmt.Errorf("%w: HTTP/1.1 required", ErrBadHandshake)
+	}
+	if !req.Headers.HasToken("connection", "upgrade") {
+		return fmt.Errorf("%w: missing Connection: Upgrade", ErrBadHandshake)
+	}
+	if !req.Headers.HasToken("upgrade", "websocket") {
+		return fmt.Errorf("%w: missing Upgrade: websocket", ErrBadHandshake)
+	}
+	if req.Headers.Get("sec-websocket-version") != "13" {
+		return fmt.Errorf("%w: unsupported Sec-WebSocket-Version", ErrBadHandshake)
+	}
+	key, err := base64.StdEncoding.DecodeString(req.Headers.Get("sec-websocket-key"))
+	if err != nil || len(key) != 16 {
+		return fmt.Errorf("%w: invalid Sec-WebSocket-Key", ErrBadHandshake)
+	}
+	if req.BodyPending() || len(req.Body) > 0 {
+		return fmt.Errorf("%w: unexpected request body", ErrBadHandshake)
+	}
+
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return fmt.Errorf("%w: origin not allowed", ErrBadHandshake)
+	}
+	return nil
+}
+
+// selectSubprotocol returns the first of the server's subprotocols that the
+// client offered, or "" if there is none.
+func (u *Upgrader) selectSubprotocol(req *request.Request) string {
+	for _, protocol := range u.Subprotocols {
+		if req.Headers.HasToken("sec-websocket-protocol", protocol) {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// sameOrigin accepts requests without an Origin header (non-browser clients)
+// and requests whose Origin host matches the Host header.
+func sameOrigin(req *request.Request) bool {
+	origin := req.Headers.Get("origin")
+	if origin == "" {
+		return true
+	}
+	_, host, ok := strings.Cut(origin, "://")
+	return ok && strings.EqualFold(host, req.Host())
+}
+
+// acceptKey computes the Sec-WebSocket-Accept value for a client key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,204 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Fepozopo/httpfromtcp/internal/request"
+	"github.com/Fepozopo/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startEchoServer upgrades the request arriving on one end of a pipe, with
+// the given context, and echoes every message back. The error that ended
+// the loop is sent on the returned channel.
+func startEchoServer(t *testing.T, ctx context.Context, u *Upgrader) (net.Conn, <-chan error) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		req, err := request.RequestFromReader(serverConn)
+		if err != nil {
+			done <- err
+			return
+		}
+		req.SetContext(ctx)
+		c, err := u.Upgrade(response.NewWriter(serverConn), req)
+		if err != nil {
+			done <- err
+			return
+		}
+		for {
+			mt, data, err := c.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			if err := c.WriteMessage(mt, data); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { clientConn.Close() })
+	return clientConn, done
+}
+
+func TestAcceptKey(t *testing.T) {
+	// Test: Example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestEcho(t *testing.T) {
+	conn, done := startEchoServer(t, context.Background(), &Upgrader{Subprotocols: []string{"chat", "superchat"}})
+	c, err := NewClient(conn, "localhost:42069", "/ws", "superchat", "chat")
+	require.NoError(t, err)
+	assert.Equal(t, "chat", c.Subprotocol())
+
+	// Test: Text message
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("hello")))
+	mt, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, mt)
+	assert.Equal(t, "hello", string(data))
+
+	// Test: Large binary message uses extended length
+	large := bytes.Repeat([]byte{0xAB}, 70000)
+	require.NoError(t, c.WriteMessage(BinaryMessage, large))
+	mt, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BinaryMessage, mt)
+	assert.Equal(t, large, data)
+
+	// Test: Fragmented message is reassembled
+	require.NoError(t, c.WriteFragmented(TextMessage, []byte("frag"), []byte("men"), []byte("ted")))
+	_, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "fragmented", string(data))
+
+	// Test: Ping is answered with a pong
+	var pong []byte
+	c.SetPongHandler(func(data []byte) { pong = data })
+	require.NoError(t, c.Ping([]byte("are you there")))
+	// net.Pipe is unbuffered, so the pong must be read while writing.
+	go c.WriteMessage(TextMessage, []byte("after ping"))
+	_, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "are you there", string(pong))
+	assert.Equal(t, "after ping", string(data))
+
+	// Test: Close handshake
+	require.NoError(t, c.Close(CloseNormal, "bye"))
+	_, _, err = c.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseNormal, closeErr.Code)
+
+	serverErr := <-done
+	require.ErrorAs(t, serverErr, &closeErr)
+	assert.Equal(t, CloseNormal, closeErr.Code)
+	assert.Equal(t, "bye", closeErr.Reason)
+
+	// Test: Writing after close fails
+	require.ErrorIs(t, c.WriteMessage(TextMessage, []byte("late")), ErrClosed)
+}
+
+func TestCloseOnContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, done := startEchoServer(t, ctx, &Upgrader{})
+	c, err := NewClient(conn, "localhost:42069", "/ws")
+	require.NoError(t, err)
+
+	// Test: The end of the request's context, such as on shutdown, starts
+	// the close handshake with 1001
+	cancel()
+	_, _, err = c.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+
+	// Test: Once the client answers, the handler's ReadMessage returns
+	serverErr := <-done
+	require.ErrorAs(t, serverErr, &closeErr)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+}
+
+func TestMessageTooBig(t *testing.T) {
+	conn, done := startEchoServer(t, context.Background(), &Upgrader{MaxMessageSize: 8})
+	c, err := NewClient(conn, "localhost:42069", "/ws")
+	require.NoError(t, err)
+
+	// Test: Fragments add up past the limit
+	go c.WriteFragmented(BinaryMessage, []byte("12345"), []byte("67890"))
+	_, _, err = c.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseMessageTooBig, closeErr.Code)
+
+	serverErr := <-done
+	require.ErrorAs(t, serverErr, &closeErr)
+	assert.Equal(t, CloseMessageTooBig, closeErr.Code)
+}
+
+func TestUnmaskedClientFrame(t *testing.T) {
+	conn, done := startEchoServer(t, context.Background(), &Upgrader{})
+	c, err := NewClient(conn, "localhost:42069", "/ws")
+	require.NoError(t, err)
+
+	// Test: Pretend to be a server so the frame is sent unmasked
+	c.isServer = true
+	go c.WriteMessage(TextMessage, []byte("unmasked"))
+	go io.Copy(io.Discard, conn)
+	var closeErr *CloseError
+	serverErr := <-done
+	require.ErrorAs(t, serverErr, &closeErr)
+	assert.Equal(t, CloseProtocolError, closeErr.Code)
+}
+
+func TestBadHandshake(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    string
+		status string
+	}{
+		{
+			name:   "missing upgrade",
+			req:    "GET /ws HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n",
+			status: "HTTP/1.1 400 Bad Request",
+		},
+		{
+			name:   "wrong version",
+			req:    "GET /ws HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 8\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n",
+			status: "HTTP/1.1 426 Upgrade Required",
+		},
+		{
+			name:   "short key",
+			req:    "GET /ws HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: c2hvcnQ=\r\n\r\n",
+			status: "HTTP/1.1 400 Bad Request",
+		},
+		{
+			name:   "cross origin",
+			req:    "GET /ws HTTP/1.1\r\nHost: localhost\r\nOrigin: http://evil.example\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n",
+			status: "HTTP/1.1 400 Bad Request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, done := startEchoServer(t, context.Background(), &Upgrader{})
+			go conn.Write([]byte(tt.req))
+			resp, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			statusLine, _, _ := strings.Cut(string(resp), "\r\n")
+			assert.Equal(t, tt.status, statusLine)
+			require.ErrorIs(t, <-done, ErrBadHandshake)
+		})
+	}
+}